@@ -179,6 +179,10 @@ type BrokerConf struct {
 	TLSCert []byte
 	//TLS key
 	TLSKey []byte
+
+	// Recorder, if set, captures all requests sent and responses received
+	// by the broker connections, so that they can be replayed in tests.
+	Recorder *proto.Recorder
 }
 
 func (conf *BrokerConf) useTLS() bool {
@@ -624,9 +628,9 @@ func (b *Broker) getConnection(addr string) (*connection, error) {
 	var c *connection
 	var err error
 	if b.conf.useTLS() {
-		c, err = newTLSConnection(addr, b.conf.TLSCa, b.conf.TLSCert, b.conf.TLSKey, b.conf.DialTimeout, b.conf.ReadTimeout)
+		c, err = newTLSConnection(addr, b.conf.TLSCa, b.conf.TLSCert, b.conf.TLSKey, b.conf.DialTimeout, b.conf.ReadTimeout, b.conf.Recorder)
 	} else {
-		c, err = newTCPConnection(addr, b.conf.DialTimeout, b.conf.ReadTimeout)
+		c, err = newTCPConnection(addr, b.conf.DialTimeout, b.conf.ReadTimeout, b.conf.Recorder)
 	}
 
 	if err != nil {
@@ -859,11 +863,14 @@ type ProducerConf struct {
 	// Compression method to use, defaulting to proto.CompressionNone.
 	Compression proto.Compression
 
+	// CompressionLevel of the gzip codec, defaulting to
+	// proto.CompressionLevelDefault.
+	CompressionLevel proto.CompressionLevel
+
 	// Message ACK configuration. Use proto.RequiredAcksAll to require all
 	// servers to write, proto.RequiredAcksLocal to wait only for leader node
 	// answer or proto.RequiredAcksNone to not wait for any response.
-	// Setting this to any other, greater than zero value will make producer to
-	// wait for given number of servers to confirm write before returning.
+	// Any other value is rejected with proto.ErrInvalidRequiredAcks.
 	RequiredAcks int16
 
 	// Timeout of single produce request. By default, 5 seconds.
@@ -976,10 +983,11 @@ func (p *producer) produce(topic string, partition int32, messages ...*proto.Mes
 	}
 
 	req := proto.ProduceReq{
-		RequestHeader: proto.RequestHeader{ClientID: p.broker.conf.ClientID},
-		Compression:   p.conf.Compression,
-		RequiredAcks:  p.conf.RequiredAcks,
-		Timeout:       p.conf.RequestTimeout,
+		RequestHeader:    proto.RequestHeader{ClientID: p.broker.conf.ClientID},
+		Compression:      p.conf.Compression,
+		CompressionLevel: p.conf.CompressionLevel,
+		RequiredAcks:     p.conf.RequiredAcks,
+		Timeout:          p.conf.RequestTimeout,
 		Topics: []proto.ProduceReqTopic{
 			{
 				Name: topic,
@@ -1008,7 +1016,7 @@ func (p *producer) produce(topic string, partition int32, messages ...*proto.Mes
 		return 0, err
 	}
 
-	if req.RequiredAcks == proto.RequiredAcksNone {
+	if !req.ExpectsResponse() {
 		return 0, err
 	}
 
@@ -1353,7 +1361,7 @@ func extractMessages(resp *proto.FetchResp, conf ConsumerConf) ([]*proto.Message
 				return nil, true, part.Err
 			}
 
-			if part.MessageVersion < 2 {
+			if len(part.RecordBatches) == 0 {
 				return part.Messages, false, part.Err
 			}
 
@@ -1361,21 +1369,25 @@ func extractMessages(resp *proto.FetchResp, conf ConsumerConf) ([]*proto.Message
 			// with a new structure called RecordBatch
 			// and Message was replaced with Record
 			// In order to keep API for Consumer
-			// here we repack Records to Messages
-			recordCount := 0
+			// here we repack Records to Messages. Both
+			// can be present during message format upgrade.
+			recordCount := len(part.Messages)
 			for _, rb := range part.RecordBatches {
 				recordCount += len(rb.Records)
 			}
 			messages := make([]*proto.Message, 0, recordCount)
+			messages = append(messages, part.Messages...)
 			for _, rb := range part.RecordBatches {
 				for _, r := range rb.Records {
 					m := &proto.Message{
-						Key:       r.Key,
-						Value:     r.Value,
-						Offset:    rb.FirstOffset + r.OffsetDelta,
-						Topic:     topic.Name,
-						Partition: part.ID,
-						TipOffset: part.TipOffset,
+						Key:            r.Key,
+						Value:          r.Value,
+						Offset:         rb.FirstOffset + r.OffsetDelta,
+						Topic:          topic.Name,
+						Partition:      part.ID,
+						TipOffset:      part.TipOffset,
+						TimestampMs:    rb.FirstTimestamp + r.TimestampDelta,
+						MessageVersion: proto.MessageV2,
 					}
 					messages = append(messages, m)
 				}
@@ -1649,7 +1649,7 @@ func TestConsumerFailover(t *testing.T) {
 			t.Fatalf("failed to consume: %s", err)
 		}
 		if string(msg.Value) != "first" {
-			t.Fatalf("expected first message got %#q", msg)
+			t.Fatalf("expected first message got %#v", msg)
 		}
 
 		msg, err = consumer.Consume()
@@ -1657,11 +1657,11 @@ func TestConsumerFailover(t *testing.T) {
 			t.Fatalf("failed to consume: %s", err)
 		}
 		if string(msg.Value) != "second" {
-			t.Fatalf("expected second message got %#q", msg)
+			t.Fatalf("expected second message got %#v", msg)
 		}
 
 		if msg, err := consumer.Consume(); err != ErrNoData {
-			t.Fatalf("expected no data, got %#v (%#q)", err, msg)
+			t.Fatalf("expected no data, got %#v (%#v)", err, msg)
 		}
 
 		return
@@ -2259,26 +2259,29 @@ func TestExtractMessages(t *testing.T) {
 			partition: 0,
 
 			expMsgs: []*proto.Message{{
-				Key:       []byte("key3"),
-				Value:     []byte("value3"),
-				Offset:    3,
-				Topic:     "topic1",
-				Partition: 0,
-				TipOffset: 532,
+				Key:            []byte("key3"),
+				Value:          []byte("value3"),
+				Offset:         3,
+				Topic:          "topic1",
+				Partition:      0,
+				TipOffset:      532,
+				MessageVersion: proto.MessageV2,
 			}, {
-				Key:       []byte("key4"),
-				Value:     []byte("value4"),
-				Offset:    4,
-				Topic:     "topic1",
-				Partition: 0,
-				TipOffset: 532,
+				Key:            []byte("key4"),
+				Value:          []byte("value4"),
+				Offset:         4,
+				Topic:          "topic1",
+				Partition:      0,
+				TipOffset:      532,
+				MessageVersion: proto.MessageV2,
 			}, {
-				Key:       []byte("key5"),
-				Value:     []byte("value5"),
-				Offset:    5,
-				Topic:     "topic1",
-				Partition: 0,
-				TipOffset: 532,
+				Key:            []byte("key5"),
+				Value:          []byte("value5"),
+				Offset:         5,
+				Topic:          "topic1",
+				Partition:      0,
+				TipOffset:      532,
+				MessageVersion: proto.MessageV2,
 			}},
 			expRetry: false,
 			expError: false,
@@ -7,6 +7,7 @@ import (
 	"crypto/x509"
 	"errors"
 	"fmt"
+	"io"
 	"math"
 	"net"
 	"sync"
@@ -30,9 +31,10 @@ type connection struct {
 	stopErr     error
 	readTimeout time.Duration
 	apiVersions map[int16]proto.SupportedVersion
+	recorder    *proto.Recorder
 }
 
-func newTLSConnection(address string, ca, cert, key []byte, timeout, readTimeout time.Duration) (*connection, error) {
+func newTLSConnection(address string, ca, cert, key []byte, timeout, readTimeout time.Duration, recorder *proto.Recorder) (*connection, error) {
 	var fetchVersions = true
 	for {
 		roots := x509.NewCertPool()
@@ -67,6 +69,7 @@ func newTLSConnection(address string, ca, cert, key []byte, timeout, readTimeout
 			logger:      &nullLogger{},
 			readTimeout: readTimeout,
 			apiVersions: make(map[int16]proto.SupportedVersion),
+			recorder:    recorder,
 		}
 		go c.nextIDLoop()
 		go c.readRespLoop()
@@ -84,7 +87,7 @@ func newTLSConnection(address string, ca, cert, key []byte, timeout, readTimeout
 }
 
 // newConnection returns new, initialized connection or error
-func newTCPConnection(address string, timeout, readTimeout time.Duration) (*connection, error) {
+func newTCPConnection(address string, timeout, readTimeout time.Duration, recorder *proto.Recorder) (*connection, error) {
 	var fetchVersions = true
 	for {
 		dialer := net.Dialer{
@@ -103,6 +106,7 @@ func newTCPConnection(address string, timeout, readTimeout time.Duration) (*conn
 			logger:      &nullLogger{},
 			readTimeout: readTimeout,
 			apiVersions: make(map[int16]proto.SupportedVersion),
+			recorder:    recorder,
 		}
 		go c.nextIDLoop()
 		go c.readRespLoop()
@@ -127,6 +131,11 @@ func (c *connection) cacheApiVersions() error {
 			"error", err)
 		return err
 	}
+	if apiVersions.Err != nil {
+		c.logger.Debug("cannot fetch apiversions",
+			"error", apiVersions.Err)
+		return apiVersions.Err
+	}
 	for _, api := range apiVersions.APIVersions {
 		c.apiVersions[api.APIKey] = api
 	}
@@ -198,7 +207,7 @@ func (c *connection) readRespLoop() {
 					"error", err)
 			}
 		}
-		correlationID, b, err := proto.ReadResp(rd)
+		correlationID, b, err := c.readResp(rd)
 		if err != nil {
 			c.mu.Lock()
 			if c.stopErr == nil {
@@ -294,7 +303,7 @@ func (c *connection) sendRequest(req proto.Request) ([]byte, error) {
 		return nil, fmt.Errorf("wait for response: %s", err)
 	}
 
-	if _, err := req.WriteTo(c.rw); err != nil {
+	if _, err := c.writeRequest(req); err != nil {
 		c.logger.Error("msg", "cannot write", "error", err)
 		c.releaseWaiter(req.GetCorrelationID())
 		return nil, err
@@ -316,10 +325,28 @@ func (c *connection) sendRequestWithoutAcks(req proto.Request) error {
 
 	proto.SetVersion(req.GetHeader(), c.getBestVersion(req.Kind()))
 
-	_, err := req.WriteTo(c.rw)
+	_, err := c.writeRequest(req)
 	return err
 }
 
+// writeRequest writes the request to the socket, recording it if the
+// connection was created with a recorder.
+func (c *connection) writeRequest(req proto.Request) (int64, error) {
+	if c.recorder != nil {
+		return c.recorder.WriteRequest(c.rw, req)
+	}
+	return req.WriteTo(c.rw)
+}
+
+// readResp reads single response from the socket, recording it if the
+// connection was created with a recorder.
+func (c *connection) readResp(r io.Reader) (correlationID int32, b []byte, err error) {
+	if c.recorder != nil {
+		return c.recorder.ReadResp(r)
+	}
+	return proto.ReadResp(r)
+}
+
 // APIVersions sends a request to fetch the supported versions for each API.
 // Versioning is only supported in Kafka versions above 0.10.0.0
 func (c *connection) APIVersions(req *proto.APIVersionsReq) (*proto.APIVersionsResp, error) {
@@ -358,7 +385,7 @@ func (c *connection) CreateTopic(req *proto.CreateTopicsReq) (*proto.CreateTopic
 // Calling this method on closed connection will always return ErrClosed.
 func (c *connection) Produce(req *proto.ProduceReq) (*proto.ProduceResp, error) {
 
-	if req.RequiredAcks == proto.RequiredAcksNone {
+	if !req.ExpectsResponse() {
 		return nil, c.sendRequestWithoutAcks(req)
 	}
 
@@ -383,51 +410,13 @@ func (c *connection) Fetch(req *proto.FetchReq) (*proto.FetchResp, error) {
 		return nil, err
 	}
 
-	trimLeadingMessages(req, resp)
+	// compressed messages are returned in whole sets, possibly starting
+	// before the requested offset
+	resp.DropBefore(req)
 
 	return resp, nil
 }
 
-// trimLeadingMessages removes any messages from the response that are before
-// the requested offset.
-//
-// This may be sent by the server because compressed messages are returned in
-// full batches for efficiency (the broker doesn't need to decompress).  This
-// means that it's possible to get some leading messages with a smaller offset
-// than requested.
-func trimLeadingMessages(req *proto.FetchReq, resp *proto.FetchResp) {
-	for ti := range resp.Topics {
-		topic := &resp.Topics[ti]
-		reqTopic := &req.Topics[ti]
-		for pi := range topic.Partitions {
-			partition := &topic.Partitions[pi]
-			requestedOffset := reqTopic.Partitions[pi].FetchOffset
-			if partition.MessageVersion < 2 {
-				i := 0
-				for _, msg := range partition.Messages {
-					if msg.Offset >= requestedOffset {
-						break
-					}
-					i++
-				}
-				partition.Messages = partition.Messages[i:]
-			} else {
-				for _, rb := range partition.RecordBatches {
-					i := 0
-					firstOffset := rb.FirstOffset
-					for _, rec := range rb.Records {
-						if firstOffset+rec.OffsetDelta >= requestedOffset {
-							break
-						}
-						i++
-					}
-					rb.Records = rb.Records[i:]
-				}
-			}
-		}
-	}
-}
-
 // Offset sends given offset request to kafka node and returns related response.
 // Calling this method on closed connection will always return ErrClosed.
 func (c *connection) Offset(req *proto.OffsetReq) (*proto.OffsetResp, error) {
@@ -450,6 +439,17 @@ func (c *connection) ConsumerMetadata(req *proto.ConsumerMetadataReq) (*proto.Co
 	return proto.ReadVersionedConsumerMetadataResp(bytes.NewReader(b), req.GetVersion())
 }
 
+// FindCoordinator sends given find coordinator request to kafka node and
+// returns related response.
+// Calling this method on closed connection will always return ErrClosed.
+func (c *connection) FindCoordinator(req *proto.FindCoordinatorReq) (*proto.FindCoordinatorResp, error) {
+	b, err := c.sendRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	return proto.ReadVersionedFindCoordinatorResp(bytes.NewReader(b), req.GetVersion())
+}
+
 func (c *connection) OffsetCommit(req *proto.OffsetCommitReq) (*proto.OffsetCommitResp, error) {
 	b, err := c.sendRequest(req)
 	if err != nil {
@@ -280,7 +280,7 @@ func TestConnectionMetadata(t *testing.T) {
 	}
 
 	ch <- versionResp
-	conn, err := newTCPConnection(ln.Addr().String(), time.Second, time.Second)
+	conn, err := newTCPConnection(ln.Addr().String(), time.Second, time.Second, nil)
 	if err != nil {
 		t.Fatalf("could not connect to test server: %s", err)
 	}
@@ -347,7 +347,7 @@ func TestConnectionProduce(t *testing.T) {
 		msgs <- versionResp
 
 	}()
-	conn, err := newTCPConnection(ln.Addr().String(), time.Second, time.Second)
+	conn, err := newTCPConnection(ln.Addr().String(), time.Second, time.Second, nil)
 	if err != nil {
 		t.Fatalf("could not connect to test server: %s", err)
 	}
@@ -470,7 +470,7 @@ func TestConnectionFetch(t *testing.T) {
 		time.Sleep(50 * time.Millisecond)
 		ch <- versionResp
 	}()
-	conn, err := newTCPConnection(ln.Addr().String(), time.Second, time.Second)
+	conn, err := newTCPConnection(ln.Addr().String(), time.Second, time.Second, nil)
 	if err != nil {
 		t.Fatalf("could not connect to test server: %s", err)
 	}
@@ -510,6 +510,7 @@ func TestConnectionFetch(t *testing.T) {
 	for _, m := range messages {
 		m.Topic = "foo"
 		m.Partition = 1
+		m.TimestampMs = proto.NoTimestamp
 	}
 	// offset 5 was requested; first message should be trimmed
 	resp1.Topics[0].Partitions[0].Messages = messages[1:]
@@ -586,7 +587,7 @@ func TestTrimRecordBatches(t *testing.T) {
 		},
 	}
 
-	trimLeadingMessages(req, resp)
+	resp.DropBefore(req)
 
 	rbs := resp.Topics[0].Partitions[0].RecordBatches
 	if got, exp := len(rbs[0].Records), 1; got != exp {
@@ -634,7 +635,7 @@ func TestConnectionOffset(t *testing.T) {
 		ch <- versionResp
 	}()
 
-	conn, err := newTCPConnection(ln.Addr().String(), time.Second, time.Second)
+	conn, err := newTCPConnection(ln.Addr().String(), time.Second, time.Second, nil)
 	if err != nil {
 		t.Fatalf("could not connect to test server: %s", err)
 	}
@@ -753,7 +754,7 @@ func TestConnectionProduceNoAck(t *testing.T) {
 		time.Sleep(50 * time.Millisecond)
 		ch <- versionResp
 	}()
-	conn, err := newTCPConnection(ln.Addr().String(), time.Second, time.Second)
+	conn, err := newTCPConnection(ln.Addr().String(), time.Second, time.Second, nil)
 	if err != nil {
 		t.Fatalf("could not connect to test server: %s", err)
 	}
@@ -798,7 +799,7 @@ func TestClosedConnectionWriter(t *testing.T) {
 	if err != nil {
 		t.Fatalf("test server error: %s", err)
 	}
-	conn, err := newTCPConnection(ln.Addr().String(), time.Second, time.Second)
+	conn, err := newTCPConnection(ln.Addr().String(), time.Second, time.Second, nil)
 	if err != nil {
 		t.Fatalf("could not connect to test server: %s", err)
 	}
@@ -845,7 +846,7 @@ func TestClosedConnectionReader(t *testing.T) {
 	if err != nil {
 		t.Fatalf("test server error: %s", err)
 	}
-	conn, err := newTCPConnection(ln.Addr().String(), time.Second, time.Second)
+	conn, err := newTCPConnection(ln.Addr().String(), time.Second, time.Second, nil)
 	if err != nil {
 		t.Fatalf("could not connect to test server: %s", err)
 	}
@@ -892,7 +893,7 @@ func TestConnectionReaderAfterEOF(t *testing.T) {
 		_ = ln.Close()
 	}()
 
-	conn, err := newTCPConnection(ln.Addr().String(), time.Second, time.Second)
+	conn, err := newTCPConnection(ln.Addr().String(), time.Second, time.Second, nil)
 	if err != nil {
 		t.Fatalf("could not connect to test server: %s", err)
 	}
@@ -932,7 +933,7 @@ func TestNoServerResponse(t *testing.T) {
 	if err != nil {
 		t.Fatalf("test server error: %s", err)
 	}
-	conn, err := newTCPConnection(ln.Addr().String(), time.Second, time.Second)
+	conn, err := newTCPConnection(ln.Addr().String(), time.Second, time.Second, nil)
 	if err != nil {
 		t.Fatalf("could not connect to test server: %s", err)
 	}
@@ -988,7 +989,7 @@ func TestTLSConnection(t *testing.T) {
 		t.Fatalf("cannot get tls parametes: %s", err)
 	}
 	_ = tlsConf
-	conn, err := newTLSConnection(ln.Addr().String(), tlsConf.ca, tlsConf.cert, tlsConf.key, time.Second, time.Second)
+	conn, err := newTLSConnection(ln.Addr().String(), tlsConf.ca, tlsConf.cert, tlsConf.key, time.Second, time.Second, nil)
 
 	if err != nil {
 		t.Fatalf("could not connect to test server: %s", err)
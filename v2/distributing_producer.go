@@ -1,6 +1,7 @@
 package kafka
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"hash/fnv"
@@ -106,7 +107,8 @@ type hashProducer struct {
 
 // NewHashProducer wraps given producer and return DistributingProducer that
 // publish messages to kafka, computing partition number from message key hash,
-// using fnv hash and [0, numPartitions) range.
+// using fnv hash and [0, numPartitions) range. The partitions differ from the
+// ones chosen by the Java client, use Partition for compatibility.
 func NewHashProducer(p Producer, numPartitions int32) DistributingProducer {
 	return &hashProducer{
 		producer:   p,
@@ -158,3 +160,54 @@ func messageHashPartition(key []byte, partitions int32) (int32, error) {
 	}
 	return sum % partitions, nil
 }
+
+// Partition returns the partition message with given key is written to by
+// the default partitioner of the Java client, so that messages with the same
+// key written by different clients end up in the same partition. The murmur2
+// hash of the key is used. Nil key is hashed as an empty one, while the Java
+// client chooses the partition of messages without key arbitrarily. If there
+// are no partitions, 0 is returned.
+func Partition(key []byte, numPartitions int32) int32 {
+	if numPartitions <= 0 {
+		return 0
+	}
+	return (murmur2(key) & 0x7fffffff) % numPartitions
+}
+
+// murmur2 implements the 32 bit murmur2 hash the same way as the Java client.
+func murmur2(data []byte) int32 {
+	const (
+		seed uint32 = 0x9747b28c
+		m    uint32 = 0x5bd1e995
+		r           = 24
+	)
+
+	length := len(data)
+	h := seed ^ uint32(length)
+	for i := 0; i+4 <= length; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+
+	tail := data[length&^3:]
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
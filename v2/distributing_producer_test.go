@@ -152,3 +152,40 @@ type nullproducer struct{}
 func (nullproducer) Produce(topic string, part int32, msgs ...*proto.Message) (int64, error) {
 	return 0, nil
 }
+
+func TestMurmur2(t *testing.T) {
+	// expected values are computed by the Java client
+	cases := map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	}
+	for key, expected := range cases {
+		if got := murmur2([]byte(key)); got != expected {
+			t.Errorf("%q: expected %d, got %d", key, expected, got)
+		}
+	}
+}
+
+func TestPartition(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		part := Partition(key, 7)
+		if part < 0 || part >= 7 {
+			t.Fatalf("%q: partition %d out of range", key, part)
+		}
+		if expected := (murmur2(key) & 0x7fffffff) % 7; part != expected {
+			t.Fatalf("%q: expected partition %d, got %d", key, expected, part)
+		}
+	}
+	// "foobar" hash is negative
+	if part := Partition([]byte("foobar"), 10); part != 6 {
+		t.Fatalf("expected partition 6, got %d", part)
+	}
+	if part := Partition([]byte("foo"), 0); part != 0 {
+		t.Fatalf("expected partition 0, got %d", part)
+	}
+}
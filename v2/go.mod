@@ -5,4 +5,6 @@ go 1.13
 require (
 	github.com/fsouza/go-dockerclient v1.4.4
 	github.com/golang/snappy v0.0.1
+	github.com/klauspost/compress v1.11.13
+	github.com/pierrec/lz4/v4 v4.1.2
 )
@@ -0,0 +1,139 @@
+package proto
+
+import (
+	"time"
+)
+
+// ProduceAccumulator collects messages for multiple topics and partitions and
+// batches them into produce requests.
+type ProduceAccumulator struct {
+	ClientID     string
+	RequiredAcks int16
+	Timeout      time.Duration
+	Compression  Compression
+
+	// MaxRequestSize limits the size of a single produce request in bytes.
+	// If adding a message would exceed the limit, another request is
+	// created. Message larger than the limit is sent in a request on its
+	// own. The size is computed from the uncompressed messages. Zero
+	// disables the limit.
+	MaxRequestSize int
+
+	partitions []*accumulatedPartition
+	index      map[string]map[int32]*accumulatedPartition
+}
+
+type accumulatedPartition struct {
+	topic     string
+	partition int32
+	messages  []*Message
+}
+
+// Add appends the message to the batch of given topic and partition. The
+// order of messages within a single partition is preserved.
+func (a *ProduceAccumulator) Add(topic string, partition int32, m *Message) {
+	if a.index == nil {
+		a.index = make(map[string]map[int32]*accumulatedPartition)
+	}
+	parts, ok := a.index[topic]
+	if !ok {
+		parts = make(map[int32]*accumulatedPartition)
+		a.index[topic] = parts
+	}
+	p, ok := parts[partition]
+	if !ok {
+		p = &accumulatedPartition{topic: topic, partition: partition}
+		parts[partition] = p
+		a.partitions = append(a.partitions, p)
+	}
+	p.messages = append(p.messages, m)
+}
+
+// Len returns the number of accumulated messages.
+func (a *ProduceAccumulator) Len() int {
+	n := 0
+	for _, p := range a.partitions {
+		n += len(p.messages)
+	}
+	return n
+}
+
+// Flush returns produce requests containing all accumulated messages and
+// resets the accumulator. Nil is returned if there are no messages.
+func (a *ProduceAccumulator) Flush() []*ProduceReq {
+	var (
+		reqs   []*ProduceReq
+		req    *ProduceReq
+		size   int
+		topics map[string]int // index of the topic within req
+	)
+	for _, p := range a.partitions {
+		var ti, pi = 0, -1 // position of the partition within req
+		for _, m := range p.messages {
+			// timestamp is included, because it is sent with KafkaV2
+			extra := m.encodedSize(MessageV1)
+			if pi < 0 {
+				extra += a.partitionSize()
+				if _, ok := topics[p.topic]; !ok {
+					extra += a.topicSize(p.topic)
+				}
+			}
+
+			// do not split if there are no messages in the request yet
+			if req == nil || (a.MaxRequestSize > 0 && size+extra > a.MaxRequestSize && size > a.requestSize()) {
+				req = &ProduceReq{
+					RequestHeader: RequestHeader{ClientID: a.ClientID},
+					Compression:   a.Compression,
+					RequiredAcks:  a.RequiredAcks,
+					Timeout:       a.Timeout,
+				}
+				reqs = append(reqs, req)
+				size = a.requestSize()
+				topics = make(map[string]int)
+				pi = -1
+				extra = m.encodedSize(MessageV1) + a.partitionSize() + a.topicSize(p.topic)
+			}
+
+			if pi < 0 {
+				var ok bool
+				if ti, ok = topics[p.topic]; !ok {
+					ti = len(req.Topics)
+					topics[p.topic] = ti
+					req.Topics = append(req.Topics, ProduceReqTopic{Name: p.topic})
+				}
+				pi = len(req.Topics[ti].Partitions)
+				req.Topics[ti].Partitions = append(req.Topics[ti].Partitions, ProduceReqPartition{ID: p.partition})
+			}
+			part := &req.Topics[ti].Partitions[pi]
+			part.Messages = append(part.Messages, m)
+			size += extra
+		}
+	}
+
+	a.partitions = nil
+	a.index = nil
+	return reqs
+}
+
+// requestSize returns the size of the produce request with no topics.
+func (a *ProduceAccumulator) requestSize() int {
+	// size, api key, version, correlation id, client id
+	size := 4 + 2 + 2 + 4 + 2 + len(a.ClientID)
+	// transactional id, required acks, timeout, topics array length
+	return size + 2 + 2 + 4 + 4
+}
+
+func (a *ProduceAccumulator) topicSize(name string) int {
+	// name, partitions array length
+	return 2 + len(name) + 4
+}
+
+func (a *ProduceAccumulator) partitionSize() int {
+	// id, message set size
+	size := 4 + 4
+	if a.Compression != CompressionNone {
+		// wrapper message with no key, including timestamp
+		size += 26 + 8
+	}
+	return size
+}
@@ -0,0 +1,113 @@
+package proto
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestProduceAccumulator(t *testing.T) {
+	acc := &ProduceAccumulator{
+		ClientID:     "test",
+		RequiredAcks: RequiredAcksAll,
+		Timeout:      time.Second,
+	}
+	m1 := &Message{Value: []byte("1")}
+	m2 := &Message{Value: []byte("2")}
+	m3 := &Message{Value: []byte("3")}
+	m4 := &Message{Value: []byte("4")}
+	acc.Add("foo", 0, m1)
+	acc.Add("bar", 1, m2)
+	acc.Add("foo", 0, m3)
+	acc.Add("foo", 1, m4)
+	if n := acc.Len(); n != 4 {
+		t.Fatalf("expected 4 messages, got %d", n)
+	}
+
+	reqs := acc.Flush()
+	expected := []*ProduceReq{
+		{
+			RequestHeader: RequestHeader{ClientID: "test"},
+			RequiredAcks:  RequiredAcksAll,
+			Timeout:       time.Second,
+			Topics: []ProduceReqTopic{
+				{
+					Name: "foo",
+					Partitions: []ProduceReqPartition{
+						{ID: 0, Messages: []*Message{m1, m3}},
+						{ID: 1, Messages: []*Message{m4}},
+					},
+				},
+				{
+					Name: "bar",
+					Partitions: []ProduceReqPartition{
+						{ID: 1, Messages: []*Message{m2}},
+					},
+				},
+			},
+		},
+	}
+	if !reflect.DeepEqual(reqs, expected) {
+		t.Fatalf("expected %#v, got %#v", expected, reqs)
+	}
+
+	if n := acc.Len(); n != 0 {
+		t.Fatalf("expected no messages after flush, got %d", n)
+	}
+	if reqs := acc.Flush(); reqs != nil {
+		t.Fatalf("expected no requests, got %#v", reqs)
+	}
+}
+
+func TestProduceAccumulatorMaxRequestSize(t *testing.T) {
+	for _, compression := range []Compression{CompressionNone, CompressionGzip} {
+		acc := &ProduceAccumulator{
+			ClientID:       "test",
+			RequiredAcks:   RequiredAcksAll,
+			Timeout:        time.Second,
+			Compression:    compression,
+			MaxRequestSize: 400,
+		}
+		var messages []*Message
+		for i := 0; i < 10; i++ {
+			m := &Message{Value: bytes.Repeat([]byte(fmt.Sprint(i)), 100)}
+			messages = append(messages, m)
+			acc.Add("foo", int32(i%2), m)
+		}
+		huge := &Message{Value: make([]byte, 1000)}
+		acc.Add("bar", 0, huge)
+
+		reqs := acc.Flush()
+		if len(reqs) < 2 {
+			t.Fatalf("expected messages to be split, got %d requests", len(reqs))
+		}
+
+		got := make(map[string][]*Message)
+		for _, req := range reqs {
+			SetVersion(req.GetHeader(), KafkaV2)
+			b, err := req.Bytes()
+			if err != nil {
+				t.Fatalf("cannot serialize request: %s", err)
+			}
+			if len(b) > acc.MaxRequestSize && (len(req.Topics) != 1 || req.Topics[0].Name != "bar") {
+				t.Fatalf("request of %d bytes exceeds the limit: %#v", len(b), req)
+			}
+			for _, topic := range req.Topics {
+				for _, part := range topic.Partitions {
+					key := fmt.Sprintf("%s/%d", topic.Name, part.ID)
+					got[key] = append(got[key], part.Messages...)
+				}
+			}
+		}
+		expected := map[string][]*Message{
+			"foo/0": {messages[0], messages[2], messages[4], messages[6], messages[8]},
+			"foo/1": {messages[1], messages[3], messages[5], messages[7], messages[9]},
+			"bar/0": {huge},
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Fatalf("expected %#v, got %#v", expected, got)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package proto
+
+// Arena is a preallocated buffer that keys and values of decoded messages are
+// taken from, instead of allocating them one by one, when set as
+// FetchResp.Arena of the response passed to ReadFetchRespInto. Calling Reset
+// makes the whole buffer available again, so the same arena can be reused
+// for every fetch response.
+//
+// Keys, values and header values of messages and records decoded using the
+// arena point into its buffer. They must not be used, nor retained, after
+// the arena is reset, because decoding of the next response overwrites them.
+// Copy whatever has to outlive the response before calling Reset. Arena is
+// not safe for concurrent use, so every consumer decoding concurrently needs
+// its own arena.
+type Arena struct {
+	buf []byte
+	off int
+}
+
+// NewArena returns arena with buffer of given size in bytes.
+func NewArena(size int) *Arena {
+	return &Arena{buf: make([]byte, size)}
+}
+
+// Alloc returns a slice of n bytes taken from the arena. If there is not
+// enough room left, the slice is allocated separately, so that decoding
+// never fails because the arena is too small.
+func (a *Arena) Alloc(n int) []byte {
+	if n > len(a.buf)-a.off {
+		return make([]byte, n)
+	}
+	b := a.buf[a.off : a.off+n : a.off+n]
+	a.off += n
+	return b
+}
+
+// Len returns the number of bytes taken from the arena since the last reset.
+func (a *Arena) Len() int {
+	return a.off
+}
+
+// Reset makes the whole buffer of the arena available for allocation again.
+// All slices returned by the arena before are invalidated.
+func (a *Arena) Reset() {
+	a.off = 0
+}
@@ -0,0 +1,108 @@
+package proto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestArenaAlloc(t *testing.T) {
+	a := NewArena(8)
+
+	b1 := a.Alloc(3)
+	b2 := a.Alloc(5)
+	if len(b1) != 3 || cap(b1) != 3 || len(b2) != 5 || cap(b2) != 5 {
+		t.Fatalf("unexpected slices: %d/%d, %d/%d", len(b1), cap(b1), len(b2), cap(b2))
+	}
+	if a.Len() != 8 {
+		t.Fatalf("expected 8 bytes taken, got %d", a.Len())
+	}
+	if &b1[0] != &a.buf[0] || &b2[0] != &a.buf[3] {
+		t.Fatal("expected slices to point to the arena buffer")
+	}
+
+	// full arena allocates separately
+	b3 := a.Alloc(2)
+	if len(b3) != 2 || a.Len() != 8 {
+		t.Fatalf("unexpected allocation: %d bytes, %d taken", len(b3), a.Len())
+	}
+
+	a.Reset()
+	if a.Len() != 0 {
+		t.Fatalf("expected empty arena, got %d", a.Len())
+	}
+	if b := a.Alloc(4); &b[0] != &a.buf[0] {
+		t.Fatal("expected reset arena to be reused")
+	}
+}
+
+func TestFetchResponseArena(t *testing.T) {
+	resp := &FetchResp{
+		Topics: []FetchRespTopic{
+			{
+				Name: "foo",
+				Partitions: []FetchRespPartition{
+					{ID: 0, Messages: []*Message{
+						{Offset: 1, Key: []byte("k1"), Value: []byte("v1")},
+						{Offset: 2, Value: []byte("v2")},
+					}},
+					{ID: 1, RecordBatches: []*RecordBatch{{
+						LastOffsetDelta: 1,
+						Records: []*Record{
+							{Key: []byte("k3"), Value: []byte("v3")},
+							{OffsetDelta: 1, Value: []byte("v4"), Headers: []RecordHeader{{Key: "h", Value: []byte("hv")}}},
+						},
+					}}},
+				},
+			},
+		},
+	}
+	b, err := resp.Bytes()
+	if err != nil {
+		t.Fatalf("cannot serialize response: %s", err)
+	}
+
+	arena := NewArena(1024)
+	got := &FetchResp{Arena: arena}
+
+	// data pointing to the arena is overwritten when clearing it
+	cleared := func(b []byte) bool {
+		return len(b) > 0 && bytes.Count(b, []byte{0}) == len(b)
+	}
+
+	for i := 0; i < 2; i++ {
+		arena.Reset()
+		if err := ReadFetchRespInto(bytes.NewReader(b), got); err != nil {
+			t.Fatalf("cannot read response: %s", err)
+		}
+		if got.Arena != arena || arena.Len() == 0 {
+			t.Fatal("expected arena to be used")
+		}
+
+		msgs := got.Topics[0].Partitions[0].Messages
+		if len(msgs) != 2 || string(msgs[0].Key) != "k1" || string(msgs[0].Value) != "v1" || string(msgs[1].Value) != "v2" {
+			t.Fatalf("unexpected messages: %#v", msgs)
+		}
+		recs := got.Topics[0].Partitions[1].RecordBatches[0].Records
+		if len(recs) != 2 || string(recs[0].Key) != "k3" || string(recs[0].Value) != "v3" ||
+			string(recs[1].Value) != "v4" || string(recs[1].Headers[0].Value) != "hv" {
+			t.Fatalf("unexpected records: %#v", recs)
+		}
+
+		copy(arena.buf, make([]byte, len(arena.buf)))
+		if !cleared(msgs[0].Key) || !cleared(msgs[0].Value) || !cleared(msgs[1].Value) {
+			t.Fatal("expected message key and values to be allocated from the arena")
+		}
+		if !cleared(recs[0].Key) || !cleared(recs[0].Value) || !cleared(recs[1].Headers[0].Value) {
+			t.Fatal("expected record keys and values to be allocated from the arena")
+		}
+	}
+
+	// responses decoded without the arena do not touch it
+	arena.Reset()
+	if _, err := ReadFetchResp(bytes.NewReader(b)); err != nil {
+		t.Fatalf("cannot read response: %s", err)
+	}
+	if arena.Len() != 0 {
+		t.Fatalf("expected arena not to be used, got %d bytes taken", arena.Len())
+	}
+}
@@ -0,0 +1,59 @@
+package proto
+
+import (
+	"bytes"
+	"net"
+	"sync"
+)
+
+// Broker is a thin wrapper around a single connection to a kafka node, that
+// does one synchronous request/response round trip at a time. Unlike the
+// kafka package client it does not pipeline requests, reconnect or track
+// cluster metadata.
+type Broker struct {
+	mu     sync.Mutex
+	conn   net.Conn
+	nextID int32
+}
+
+// NewBroker returns broker using given connection.
+func NewBroker(conn net.Conn) *Broker {
+	return &Broker{conn: conn}
+}
+
+// roundTrip sets the correlation ID of the request, sends it and returns the
+// byte representation of the response, as returned by ReadResp. If the
+// response does not answer the request, *CorrelationMismatchError is
+// returned.
+func (b *Broker) roundTrip(req Request) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.nextID++
+	SetCorrelationID(req.GetHeader(), b.nextID)
+	if _, err := req.WriteTo(b.conn); err != nil {
+		return nil, err
+	}
+	correlationID, resp, err := ReadResp(b.conn)
+	if err != nil {
+		return nil, err
+	}
+	if correlationID != b.nextID {
+		return nil, &CorrelationMismatchError{Expected: b.nextID, Got: correlationID}
+	}
+	return resp, nil
+}
+
+// Fetch sends fetch request and returns the decoded response.
+func (b *Broker) Fetch(req *FetchReq) (*FetchResp, error) {
+	resp, err := b.roundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	return ReadVersionedFetchResp(bytes.NewReader(resp), req.GetVersion())
+}
+
+// Close closes the underlying connection.
+func (b *Broker) Close() error {
+	return b.conn.Close()
+}
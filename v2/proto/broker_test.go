@@ -0,0 +1,73 @@
+package proto
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// serveFetch reads a single fetch request from the connection and writes the
+// response, using the correlation ID of the request shifted by offset.
+func serveFetch(t *testing.T, conn net.Conn, resp *FetchResp, offset int32) {
+	req, err := ReadFetchReq(conn)
+	if err != nil {
+		t.Errorf("cannot read request: %s", err)
+		return
+	}
+	resp.CorrelationID = req.GetCorrelationID() + offset
+	b, err := resp.Bytes()
+	if err != nil {
+		t.Errorf("cannot serialize response: %s", err)
+		return
+	}
+	if _, err := conn.Write(b); err != nil {
+		t.Errorf("cannot write response: %s", err)
+	}
+}
+
+func TestBrokerFetch(t *testing.T) {
+	client, server := net.Pipe()
+	broker := NewBroker(client)
+	defer broker.Close()
+
+	resp := &FetchResp{
+		Topics: []FetchRespTopic{
+			{
+				Name: "foo",
+				Partitions: []FetchRespPartition{
+					{
+						ID:        0,
+						TipOffset: 4,
+						Messages: []*Message{
+							{Offset: 2, Crc: 0xb8ba5f57, Key: []byte("foo"), Value: []byte("bar"), Topic: "foo", TipOffset: 4, TimestampMs: NoTimestamp},
+						},
+					},
+				},
+			},
+		},
+	}
+	req := &FetchReq{
+		RequestHeader: RequestHeader{ClientID: "test"},
+		MaxWaitTime:   time.Second,
+		MinBytes:      1,
+		Topics: []FetchReqTopic{
+			{Name: "foo", Partitions: []FetchReqPartition{{ID: 0, FetchOffset: 2, MaxBytes: 1024}}},
+		},
+	}
+
+	go serveFetch(t, server, resp, 0)
+	got, err := broker.Fetch(req)
+	if err != nil {
+		t.Fatalf("cannot fetch: %s", err)
+	}
+	if !reflect.DeepEqual(got, resp) {
+		t.Fatalf("expected %#v, got %#v", resp, got)
+	}
+
+	go serveFetch(t, server, resp, 1)
+	_, err = broker.Fetch(req)
+	if err, ok := err.(*CorrelationMismatchError); !ok || err.Got != err.Expected+1 {
+		t.Fatalf("expected correlation mismatch error, got %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+package proto
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ErrDispatcherClosed is returned when waiting for a response using closed
+// dispatcher.
+var ErrDispatcherClosed = errors.New("dispatcher closed")
+
+// Dispatcher reads responses from a stream in a separate goroutine and
+// routes them to the waiters by correlation ID. It must be closed to stop
+// the goroutine.
+type Dispatcher struct {
+	rc   io.ReadCloser
+	done chan struct{}
+
+	mu      sync.Mutex
+	waiters map[int32]chan []byte
+	err     error
+}
+
+// PendingResp represents a response that was not yet received.
+type PendingResp struct {
+	d *Dispatcher
+	c chan []byte
+}
+
+// NewDispatcher returns dispatcher reading responses from rc.
+func NewDispatcher(rc io.ReadCloser) *Dispatcher {
+	d := &Dispatcher{
+		rc:      rc,
+		done:    make(chan struct{}),
+		waiters: make(map[int32]chan []byte),
+	}
+	go d.readLoop()
+	return d
+}
+
+func (d *Dispatcher) readLoop() {
+	defer close(d.done)
+	for {
+		correlationID, b, err := ReadResp(d.rc)
+		if err != nil {
+			d.shutdown(err)
+			return
+		}
+
+		d.mu.Lock()
+		c, ok := d.waiters[correlationID]
+		delete(d.waiters, correlationID)
+		d.mu.Unlock()
+		// response to unknown request is dropped
+		if ok {
+			c <- b
+			close(c)
+		}
+	}
+}
+
+// shutdown fails all waiters. Error is kept if the dispatcher was closed.
+func (d *Dispatcher) shutdown(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.err == nil {
+		d.err = err
+	}
+	for _, c := range d.waiters {
+		close(c)
+	}
+	d.waiters = nil
+}
+
+// Expect registers a waiter for the response with given correlation ID. It
+// must be called before sending the request, so that the response cannot be
+// received before the waiter is registered.
+func (d *Dispatcher) Expect(correlationID int32) (*PendingResp, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.err != nil {
+		return nil, d.err
+	}
+	if _, ok := d.waiters[correlationID]; ok {
+		return nil, fmt.Errorf("correlation conflict: %d", correlationID)
+	}
+	c := make(chan []byte, 1)
+	d.waiters[correlationID] = c
+	return &PendingResp{d: d, c: c}, nil
+}
+
+// Wait blocks until the response is received and returns its byte
+// representation, as returned by ReadResp. If the dispatcher is closed or
+// reading fails before the response is received, the error that stopped the
+// dispatcher is returned.
+func (p *PendingResp) Wait() ([]byte, error) {
+	b, ok := <-p.c
+	if !ok {
+		return nil, p.d.Err()
+	}
+	return b, nil
+}
+
+// Err returns the error that stopped the dispatcher, or nil if it is still
+// running.
+func (d *Dispatcher) Err() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.err
+}
+
+// Close closes the underlying reader and waits for the reading goroutine to
+// stop. All waiters that did not receive their response get
+// ErrDispatcherClosed.
+func (d *Dispatcher) Close() error {
+	d.mu.Lock()
+	if d.err == nil {
+		d.err = ErrDispatcherClosed
+	}
+	d.mu.Unlock()
+
+	err := d.rc.Close()
+	<-d.done
+	return err
+}
@@ -0,0 +1,67 @@
+package proto
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestDispatcher(t *testing.T) {
+	pr, pw := io.Pipe()
+	d := NewDispatcher(pr)
+
+	p1, err := d.Expect(1)
+	if err != nil {
+		t.Fatalf("cannot expect response: %s", err)
+	}
+	p2, err := d.Expect(2)
+	if err != nil {
+		t.Fatalf("cannot expect response: %s", err)
+	}
+	if _, err := d.Expect(2); err == nil {
+		t.Fatal("expected correlation conflict error")
+	}
+
+	resp1 := []byte{0x0, 0x0, 0x0, 0x5, 0x0, 0x0, 0x0, 0x1, 0x1}
+	resp2 := []byte{0x0, 0x0, 0x0, 0x5, 0x0, 0x0, 0x0, 0x2, 0x2}
+	go func() {
+		_, _ = pw.Write(resp2)
+		_, _ = pw.Write(resp1)
+	}()
+
+	if b, err := p1.Wait(); err != nil || !bytes.Equal(b, resp1) {
+		t.Fatalf("unexpected response: %#v, %v", b, err)
+	}
+	if b, err := p2.Wait(); err != nil || !bytes.Equal(b, resp2) {
+		t.Fatalf("unexpected response: %#v, %v", b, err)
+	}
+
+	p3, err := d.Expect(3)
+	if err != nil {
+		t.Fatalf("cannot expect response: %s", err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("cannot close dispatcher: %s", err)
+	}
+	if _, err := p3.Wait(); err != ErrDispatcherClosed {
+		t.Fatalf("expected %v, got %v", ErrDispatcherClosed, err)
+	}
+	if _, err := d.Expect(4); err != ErrDispatcherClosed {
+		t.Fatalf("expected %v, got %v", ErrDispatcherClosed, err)
+	}
+}
+
+func TestDispatcherReadError(t *testing.T) {
+	pr, pw := io.Pipe()
+	d := NewDispatcher(pr)
+	defer d.Close()
+
+	p, err := d.Expect(1)
+	if err != nil {
+		t.Fatalf("cannot expect response: %s", err)
+	}
+	_ = pw.Close()
+	if _, err := p.Wait(); err != io.EOF {
+		t.Fatalf("expected %v, got %v", io.EOF, err)
+	}
+}
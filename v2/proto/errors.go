@@ -1,82 +1,83 @@
 package proto
 
 import (
+	"errors"
 	"fmt"
 )
 
 var (
-	ErrUnknown                                 = &KafkaError{-1, "unknown error"}
-	ErrOffsetOutOfRange                        = &KafkaError{1, "offset out of range"}
-	ErrInvalidMessage                          = &KafkaError{2, "invalid message"}
-	ErrUnknownTopicOrPartition                 = &KafkaError{3, "unknown topic or partition"}
-	ErrInvalidMessageSize                      = &KafkaError{4, "invalid message size"}
-	ErrLeaderNotAvailable                      = &KafkaError{5, "leader not available"}
-	ErrNotLeaderForPartition                   = &KafkaError{6, "not leader for partition"}
-	ErrRequestTimeout                          = &KafkaError{7, "request timeed out"}
-	ErrBrokerNotAvailable                      = &KafkaError{8, "broker not available"}
-	ErrReplicaNotAvailable                     = &KafkaError{9, "replica not available"}
-	ErrMessageSizeTooLarge                     = &KafkaError{10, "message size too large"}
-	ErrScaleControllerEpoch                    = &KafkaError{11, "scale controller epoch"}
-	ErrOffsetMetadataTooLarge                  = &KafkaError{12, "offset metadata too large"}
-	ErrNetwork                                 = &KafkaError{13, "server disconnected before response was received"}
-	ErrOffsetLoadInProgress                    = &KafkaError{14, "offsets load in progress"}
-	ErrNoCoordinator                           = &KafkaError{15, "consumer coordinator not available"}
-	ErrNotCoordinator                          = &KafkaError{16, "not coordinator for consumer"}
-	ErrInvalidTopic                            = &KafkaError{17, "operation on an invalid topic"}
-	ErrRecordListTooLarge                      = &KafkaError{18, "message batch larger than the configured segment size"}
-	ErrNotEnoughReplicas                       = &KafkaError{19, "not enough in-sync replicas"}
-	ErrNotEnoughReplicasAfterAppend            = &KafkaError{20, "messages are written to the log, but to fewer in-sync replicas than required"}
-	ErrInvalidRequiredAcks                     = &KafkaError{21, "invalid value for required acks"}
-	ErrIllegalGeneration                       = &KafkaError{22, "consumer generation id is not valid"}
-	ErrInconsistentPartitionAssignmentStrategy = &KafkaError{23, "partition assignment strategy does not match that of the group"}
-	ErrUnknownParititonAssignmentStrategy      = &KafkaError{24, "partition assignment strategy is unknown to the broker"}
-	ErrUnknownConsumerID                       = &KafkaError{25, "coordinator is not aware of this consumer"}
-	ErrInvalidSessionTimeout                   = &KafkaError{26, "invalid session timeout"}
-	ErrRebalanceInProgress                     = &KafkaError{27, "group is rebalancing, so a rejoin is needed"}
-	ErrInvalidCommitOffsetSize                 = &KafkaError{28, "offset data size is not valid"}
-	ErrTopicAuthorizationFailed                = &KafkaError{29, "topic authorization failed"}
-	ErrGroupAuthorizationFailed                = &KafkaError{30, "group authorization failed"}
-	ErrClusterAuthorizationFailed              = &KafkaError{31, "cluster authorization failed"}
-	ErrInvalidTimeStamp                        = &KafkaError{32, "timestamp of the message is out of acceptable range"}
-	ErrUnsupportedSaslMechanism                = &KafkaError{33, "The broker does not support the requested SASL mechanism."}
-	ErrIllegalSaslState                        = &KafkaError{34, "Request is not valid given the current SASL state."}
-	ErrUnsupportedVersion                      = &KafkaError{35, "The version of API is not supported."}
-	ErrTopicAlreadyExists                      = &KafkaError{36, "Topic with this name already exists."}
-	ErrInvalidPartitions                       = &KafkaError{37, "Number of partitions is invalid."}
-	ErrInvalidReplicationFactor                = &KafkaError{38, "Replication-factor is invalid."}
-	ErrInvalidReplicaAssignment                = &KafkaError{39, "Replica assignment is invalid."}
-	ErrInvalidConfig                           = &KafkaError{40, "Configuration is invalid."}
-	ErrNotController                           = &KafkaError{41, "This is not the correct controller for this cluster."}
-	ErrInvalidRequest                          = &KafkaError{42, "This most likely occurs because of a request being malformed by the client library or the message was sent to an incompatible broker. See the broker logs for more details."}
-	ErrUnsupportedForMessageFormat             = &KafkaError{43, "The message format version on the broker does not support the request."}
-	ErrPolicyViolation                         = &KafkaError{44, "Request parameters do not satisfy the configured policy."}
-	ErrOutOfOrderSequenceNumber                = &KafkaError{45, "The broker received an out of order sequence number"}
-	ErrDuplicateSequenceNumber                 = &KafkaError{46, "The broker received a duplicate sequence number"}
-	ErrInvalidProducerEpoch                    = &KafkaError{47, "Producer attempted an operation with an old epoch. Either there is a newer producer with the same transactionalId, or the producer's transaction has been expired by the broker."}
-	ErrInvalidTxnState                         = &KafkaError{48, "The producer attempted a transactional operation in an invalid state"}
-	ErrInvalidProducerIdMapping                = &KafkaError{49, "The producer attempted to use a producer id which is not currently assigned to its transactional id"}
-	ErrInvalidTransactionTimeout               = &KafkaError{50, "The transaction timeout is larger than the maximum value allowed by the broker (as configured by transaction.max.timeout.ms)."}
-	ErrConcurrentTransactions                  = &KafkaError{51, "The producer attempted to update a transaction while another concurrent operation on the same transaction was ongoing"}
-	ErrTransactionCoordinatorFenced            = &KafkaError{52, "Indicates that the transaction coordinator sending a WriteTxnMarker is no longer the current coordinator for a given producer"}
-	ErrTransactionalIdAuthorizationFailed      = &KafkaError{53, "Transactional Id authorization failed"}
-	ErrSecurityDisabled                        = &KafkaError{54, "Security features are disabled."}
-	ErrOperationNotAttempted                   = &KafkaError{55, "The broker did not attempt to execute this operation. This may happen for batched RPCs where some operations in the batch failed, causing the broker to respond without trying the rest."}
-	ErrKafkaStorageError                       = &KafkaError{56, "Disk error when trying to access log file on the disk."}
-	ErrLogDirNotFound                          = &KafkaError{57, "The user-specified log directory is not found in the broker config."}
-	ErrSaslAuthenticationFailed                = &KafkaError{58, "SASL Authentication failed."}
-	ErrUnknownProducerId                       = &KafkaError{59, "This exception is raised by the broker if it could not locate the producer metadata associated with the producerId in question. This could happen if, for instance, the producer's records were deleted because their retention time had elapsed. Once the last records of the producerId are removed, the producer's metadata is removed from the broker, and future appends by the producer will return this exception."}
-	ErrReassignmentInProgress                  = &KafkaError{60, "A partition reassignment is in progress"}
-	ErrDelegationTokenAuthDisabled             = &KafkaError{61, "Delegation Token feature is not enabled."}
-	ErrDelegationTokenNotFound                 = &KafkaError{62, "Delegation Token is not found on server."}
-	ErrDelegationTokenOwnerMismatch            = &KafkaError{63, "Specified Principal is not valid Owner/Renewer."}
-	ErrDelegationTokenRequestNotAllowed        = &KafkaError{64, "Delegation Token requests are not allowed on PLAINTEXT/1-way SSL channels and on delegation token authenticated channels."}
-	ErrDelegationTokenAuthorizationFailed      = &KafkaError{65, "Delegation Token authorization failed."}
-	ErrDelegationTokenExpired                  = &KafkaError{66, "Delegation Token is expired."}
-	ErrInvalidPrincipalType                    = &KafkaError{67, "Supplied principalType is not supported"}
-	ErrNonEmptyGroup                           = &KafkaError{68, "The group The group is not empty is not empty"}
-	ErrGroupIdNotFound                         = &KafkaError{69, "The group id The group id does not exist was not found"}
-	ErrFetchSessionIdNotFound                  = &KafkaError{70, "The fetch session ID was not found"}
-	ErrInvalidFetchSessionEpoch                = &KafkaError{71, "The fetch session epoch is invalid"}
+	ErrUnknown                                 = &KafkaError{Code: -1, Message: "unknown error"}
+	ErrOffsetOutOfRange                        = &KafkaError{Code: 1, Message: "offset out of range"}
+	ErrInvalidMessage                          = &KafkaError{Code: 2, Message: "invalid message", Retriable: true}
+	ErrUnknownTopicOrPartition                 = &KafkaError{Code: 3, Message: "unknown topic or partition", Retriable: true}
+	ErrInvalidMessageSize                      = &KafkaError{Code: 4, Message: "invalid message size"}
+	ErrLeaderNotAvailable                      = &KafkaError{Code: 5, Message: "leader not available", Retriable: true}
+	ErrNotLeaderForPartition                   = &KafkaError{Code: 6, Message: "not leader for partition", Retriable: true}
+	ErrRequestTimeout                          = &KafkaError{Code: 7, Message: "request timeed out", Retriable: true}
+	ErrBrokerNotAvailable                      = &KafkaError{Code: 8, Message: "broker not available"}
+	ErrReplicaNotAvailable                     = &KafkaError{Code: 9, Message: "replica not available"}
+	ErrMessageSizeTooLarge                     = &KafkaError{Code: 10, Message: "message size too large"}
+	ErrScaleControllerEpoch                    = &KafkaError{Code: 11, Message: "scale controller epoch"}
+	ErrOffsetMetadataTooLarge                  = &KafkaError{Code: 12, Message: "offset metadata too large"}
+	ErrNetwork                                 = &KafkaError{Code: 13, Message: "server disconnected before response was received", Retriable: true}
+	ErrOffsetLoadInProgress                    = &KafkaError{Code: 14, Message: "offsets load in progress", Retriable: true}
+	ErrNoCoordinator                           = &KafkaError{Code: 15, Message: "consumer coordinator not available", Retriable: true}
+	ErrNotCoordinator                          = &KafkaError{Code: 16, Message: "not coordinator for consumer", Retriable: true}
+	ErrInvalidTopic                            = &KafkaError{Code: 17, Message: "operation on an invalid topic"}
+	ErrRecordListTooLarge                      = &KafkaError{Code: 18, Message: "message batch larger than the configured segment size"}
+	ErrNotEnoughReplicas                       = &KafkaError{Code: 19, Message: "not enough in-sync replicas", Retriable: true}
+	ErrNotEnoughReplicasAfterAppend            = &KafkaError{Code: 20, Message: "messages are written to the log, but to fewer in-sync replicas than required", Retriable: true}
+	ErrInvalidRequiredAcks                     = &KafkaError{Code: 21, Message: "invalid value for required acks"}
+	ErrIllegalGeneration                       = &KafkaError{Code: 22, Message: "consumer generation id is not valid"}
+	ErrInconsistentPartitionAssignmentStrategy = &KafkaError{Code: 23, Message: "partition assignment strategy does not match that of the group"}
+	ErrUnknownParititonAssignmentStrategy      = &KafkaError{Code: 24, Message: "partition assignment strategy is unknown to the broker"}
+	ErrUnknownConsumerID                       = &KafkaError{Code: 25, Message: "coordinator is not aware of this consumer"}
+	ErrInvalidSessionTimeout                   = &KafkaError{Code: 26, Message: "invalid session timeout"}
+	ErrRebalanceInProgress                     = &KafkaError{Code: 27, Message: "group is rebalancing, so a rejoin is needed"}
+	ErrInvalidCommitOffsetSize                 = &KafkaError{Code: 28, Message: "offset data size is not valid"}
+	ErrTopicAuthorizationFailed                = &KafkaError{Code: 29, Message: "topic authorization failed"}
+	ErrGroupAuthorizationFailed                = &KafkaError{Code: 30, Message: "group authorization failed"}
+	ErrClusterAuthorizationFailed              = &KafkaError{Code: 31, Message: "cluster authorization failed"}
+	ErrInvalidTimeStamp                        = &KafkaError{Code: 32, Message: "timestamp of the message is out of acceptable range"}
+	ErrUnsupportedSaslMechanism                = &KafkaError{Code: 33, Message: "The broker does not support the requested SASL mechanism."}
+	ErrIllegalSaslState                        = &KafkaError{Code: 34, Message: "Request is not valid given the current SASL state."}
+	ErrUnsupportedVersion                      = &KafkaError{Code: 35, Message: "The version of API is not supported."}
+	ErrTopicAlreadyExists                      = &KafkaError{Code: 36, Message: "Topic with this name already exists."}
+	ErrInvalidPartitions                       = &KafkaError{Code: 37, Message: "Number of partitions is invalid."}
+	ErrInvalidReplicationFactor                = &KafkaError{Code: 38, Message: "Replication-factor is invalid."}
+	ErrInvalidReplicaAssignment                = &KafkaError{Code: 39, Message: "Replica assignment is invalid."}
+	ErrInvalidConfig                           = &KafkaError{Code: 40, Message: "Configuration is invalid."}
+	ErrNotController                           = &KafkaError{Code: 41, Message: "This is not the correct controller for this cluster.", Retriable: true}
+	ErrInvalidRequest                          = &KafkaError{Code: 42, Message: "This most likely occurs because of a request being malformed by the client library or the message was sent to an incompatible broker. See the broker logs for more details."}
+	ErrUnsupportedForMessageFormat             = &KafkaError{Code: 43, Message: "The message format version on the broker does not support the request."}
+	ErrPolicyViolation                         = &KafkaError{Code: 44, Message: "Request parameters do not satisfy the configured policy."}
+	ErrOutOfOrderSequenceNumber                = &KafkaError{Code: 45, Message: "The broker received an out of order sequence number"}
+	ErrDuplicateSequenceNumber                 = &KafkaError{Code: 46, Message: "The broker received a duplicate sequence number"}
+	ErrInvalidProducerEpoch                    = &KafkaError{Code: 47, Message: "Producer attempted an operation with an old epoch. Either there is a newer producer with the same transactionalId, or the producer's transaction has been expired by the broker."}
+	ErrInvalidTxnState                         = &KafkaError{Code: 48, Message: "The producer attempted a transactional operation in an invalid state"}
+	ErrInvalidProducerIdMapping                = &KafkaError{Code: 49, Message: "The producer attempted to use a producer id which is not currently assigned to its transactional id"}
+	ErrInvalidTransactionTimeout               = &KafkaError{Code: 50, Message: "The transaction timeout is larger than the maximum value allowed by the broker (as configured by transaction.max.timeout.ms)."}
+	ErrConcurrentTransactions                  = &KafkaError{Code: 51, Message: "The producer attempted to update a transaction while another concurrent operation on the same transaction was ongoing", Retriable: true}
+	ErrTransactionCoordinatorFenced            = &KafkaError{Code: 52, Message: "Indicates that the transaction coordinator sending a WriteTxnMarker is no longer the current coordinator for a given producer"}
+	ErrTransactionalIdAuthorizationFailed      = &KafkaError{Code: 53, Message: "Transactional Id authorization failed"}
+	ErrSecurityDisabled                        = &KafkaError{Code: 54, Message: "Security features are disabled."}
+	ErrOperationNotAttempted                   = &KafkaError{Code: 55, Message: "The broker did not attempt to execute this operation. This may happen for batched RPCs where some operations in the batch failed, causing the broker to respond without trying the rest."}
+	ErrKafkaStorageError                       = &KafkaError{Code: 56, Message: "Disk error when trying to access log file on the disk.", Retriable: true}
+	ErrLogDirNotFound                          = &KafkaError{Code: 57, Message: "The user-specified log directory is not found in the broker config."}
+	ErrSaslAuthenticationFailed                = &KafkaError{Code: 58, Message: "SASL Authentication failed."}
+	ErrUnknownProducerId                       = &KafkaError{Code: 59, Message: "This exception is raised by the broker if it could not locate the producer metadata associated with the producerId in question. This could happen if, for instance, the producer's records were deleted because their retention time had elapsed. Once the last records of the producerId are removed, the producer's metadata is removed from the broker, and future appends by the producer will return this exception."}
+	ErrReassignmentInProgress                  = &KafkaError{Code: 60, Message: "A partition reassignment is in progress"}
+	ErrDelegationTokenAuthDisabled             = &KafkaError{Code: 61, Message: "Delegation Token feature is not enabled."}
+	ErrDelegationTokenNotFound                 = &KafkaError{Code: 62, Message: "Delegation Token is not found on server."}
+	ErrDelegationTokenOwnerMismatch            = &KafkaError{Code: 63, Message: "Specified Principal is not valid Owner/Renewer."}
+	ErrDelegationTokenRequestNotAllowed        = &KafkaError{Code: 64, Message: "Delegation Token requests are not allowed on PLAINTEXT/1-way SSL channels and on delegation token authenticated channels."}
+	ErrDelegationTokenAuthorizationFailed      = &KafkaError{Code: 65, Message: "Delegation Token authorization failed."}
+	ErrDelegationTokenExpired                  = &KafkaError{Code: 66, Message: "Delegation Token is expired."}
+	ErrInvalidPrincipalType                    = &KafkaError{Code: 67, Message: "Supplied principalType is not supported"}
+	ErrNonEmptyGroup                           = &KafkaError{Code: 68, Message: "The group The group is not empty is not empty"}
+	ErrGroupIdNotFound                         = &KafkaError{Code: 69, Message: "The group id The group id does not exist was not found"}
+	ErrFetchSessionIdNotFound                  = &KafkaError{Code: 70, Message: "The fetch session ID was not found", Retriable: true}
+	ErrInvalidFetchSessionEpoch                = &KafkaError{Code: 71, Message: "The fetch session epoch is invalid", Retriable: true}
 
 	errnoToErr = map[int16]error{
 		-1: ErrUnknown,
@@ -152,19 +153,103 @@ var (
 		70: ErrFetchSessionIdNotFound,
 		71: ErrInvalidFetchSessionEpoch,
 	}
+
+	// rejoinErrs are the errors returned to members of a consumer group that
+	// have to join the group again, instead of retrying the request.
+	rejoinErrs = []error{
+		ErrRebalanceInProgress,
+		ErrIllegalGeneration,
+		ErrUnknownConsumerID,
+	}
 )
 
+// KafkaError is an error returned by the broker. Errors known to this package
+// are returned as the exported sentinels, like ErrNotLeaderForPartition,
+// which are shared and must not be modified.
 type KafkaError struct {
-	errno   int16
-	message string
+	Code      int16
+	Message   string
+	Retriable bool // see IsRetriable
 }
 
 func (err *KafkaError) Error() string {
-	return fmt.Sprintf("%s (%d)", err.message, err.errno)
+	return fmt.Sprintf("%s (%d)", err.Message, err.Code)
 }
 
 func (err *KafkaError) Errno() int {
-	return int(err.errno)
+	return int(err.Code)
+}
+
+// Is reports whether target is KafkaError with the same code, so that
+// errors.Is matches the sentinels even for errors that are not the sentinel
+// values themselves.
+func (err *KafkaError) Is(target error) bool {
+	t, ok := target.(*KafkaError)
+	return ok && t.Code == err.Code
+}
+
+// UnknownBrokerError is returned for error codes that are not known to this
+// package, most likely because they were introduced by a newer broker.
+type UnknownBrokerError struct {
+	Code int16
+}
+
+func (err *UnknownBrokerError) Error() string {
+	return fmt.Sprintf("unknown kafka error (%d)", err.Code)
+}
+
+func (err *UnknownBrokerError) Errno() int {
+	return int(err.Code)
+}
+
+// InsufficientDataError is returned when the stream ends before the whole
+// message was read. Clean end of the stream, before any byte of the message
+// was read, is reported as io.EOF instead.
+type InsufficientDataError struct {
+	Expected int // size of the message, including the size prefix
+	Got      int
+}
+
+func (err *InsufficientDataError) Error() string {
+	return fmt.Sprintf("insufficient data: expected %d bytes, got %d", err.Expected, err.Got)
+}
+
+// TruncatedResponseError is returned when the stream ends after the
+// correlation ID of the response was read, but before its whole body of
+// declared size was decoded. This happens when the broker closes the
+// connection instead of sending the response, for example when the request
+// was too large to be processed. Fetch response ending within the message
+// set of its last partition is not reported, as the set is decoded as
+// partial, see FetchRespPartition.TruncatedBytes.
+type TruncatedResponseError struct {
+	CorrelationID int32
+	Size          int32 // declared size of the response, without the size itself
+}
+
+func (err *TruncatedResponseError) Error() string {
+	return fmt.Sprintf("response %d truncated: body shorter than declared size %d", err.CorrelationID, err.Size)
+}
+
+// CorrelationMismatchError is returned when the correlation ID of the
+// response does not match the one of the request it should answer.
+type CorrelationMismatchError struct {
+	Expected int32
+	Got      int32
+}
+
+func (err *CorrelationMismatchError) Error() string {
+	return fmt.Sprintf("correlation mismatch: expected %d, got %d", err.Expected, err.Got)
+}
+
+// DuplicatePartitionError is returned when serializing or validating fetch
+// request listing the same partition more than once.
+type DuplicatePartitionError struct {
+	Topic     string
+	Partition int32
+}
+
+func (err *DuplicatePartitionError) Error() string {
+	return fmt.Sprintf("partition %s:%d is fetched more than once", err.Topic, err.Partition)
 }
 
 func errFromNo(errno int16) error {
@@ -173,7 +258,30 @@ func errFromNo(errno int16) error {
 	}
 	err, ok := errnoToErr[errno]
 	if !ok {
-		return fmt.Errorf("unknown kafka error %d", errno)
+		return &UnknownBrokerError{Code: errno}
 	}
 	return err
 }
+
+// IsRetriable returns true if the given error returned by the broker is
+// transient and the request can be retried. For some of the errors, like
+// ErrNotLeaderForPartition or ErrNotController, the metadata must be
+// refreshed first, so that the request is sent to the right broker.
+func IsRetriable(err error) bool {
+	var kerr *KafkaError
+	return errors.As(err, &kerr) && kerr.Retriable
+}
+
+// IsRejoinNeeded returns true if the given error returned by the broker to a
+// consumer group member means the member has to rejoin the group, like
+// ErrRebalanceInProgress returned by Heartbeat or OffsetCommit during a
+// rebalance. Such errors are not retriable: repeating the request after
+// a backoff keeps failing until the member joins the group again.
+func IsRejoinNeeded(err error) bool {
+	for _, rerr := range rejoinErrs {
+		if errors.Is(err, rerr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+package proto
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestErrFromNo(t *testing.T) {
+	if err := errFromNo(0); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := errFromNo(3); err != ErrUnknownTopicOrPartition {
+		t.Fatalf("expected %v, got %v", ErrUnknownTopicOrPartition, err)
+	}
+
+	err := errFromNo(9999)
+	var uerr *UnknownBrokerError
+	if !errors.As(fmt.Errorf("fetch failed: %w", err), &uerr) {
+		t.Fatalf("expected *UnknownBrokerError, got %T", err)
+	}
+	if uerr.Code != 9999 {
+		t.Fatalf("expected code 9999, got %d", uerr.Code)
+	}
+	if IsRetriable(err) {
+		t.Fatalf("expected %v not to be retriable", err)
+	}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.EncodeError(err)
+	if err := enc.Err(); err != nil {
+		t.Fatalf("cannot encode unknown error: %s", err)
+	}
+	dec := NewDecoder(&buf)
+	if got := errFromNo(dec.DecodeInt16()); got.(*UnknownBrokerError).Code != 9999 {
+		t.Fatalf("error code not preserved: %v", got)
+	}
+}
+
+func TestIsRetriable(t *testing.T) {
+	if err := errFromNo(41); err != ErrNotController {
+		t.Fatalf("expected %v, got %v", ErrNotController, err)
+	}
+
+	tests := []struct {
+		Err       error
+		Retriable bool
+	}{
+		{ErrNotController, true},
+		{ErrNotLeaderForPartition, true},
+		{ErrLeaderNotAvailable, true},
+		{ErrTopicAlreadyExists, false},
+		{ErrInvalidPartitions, false},
+		{&UnknownBrokerError{Code: 9999}, false},
+		{fmt.Errorf("fetch failed: %w", ErrNotLeaderForPartition), true},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := IsRetriable(tt.Err); got != tt.Retriable {
+			t.Fatalf("%v: expected retriable %v, got %v", tt.Err, tt.Retriable, got)
+		}
+	}
+}
+
+func TestIsRejoinNeeded(t *testing.T) {
+	if err := errFromNo(27); err != ErrRebalanceInProgress {
+		t.Fatalf("expected %v, got %v", ErrRebalanceInProgress, err)
+	}
+
+	tests := []struct {
+		Err    error
+		Rejoin bool
+	}{
+		{ErrRebalanceInProgress, true},
+		{ErrIllegalGeneration, true},
+		{ErrUnknownConsumerID, true},
+		{fmt.Errorf("heartbeat failed: %w", ErrRebalanceInProgress), true},
+		{&CorrelationMismatchError{Expected: 1, Got: 2}, false},
+		{ErrNotCoordinator, false},
+		{ErrNetwork, false},
+		{&UnknownBrokerError{Code: 9999}, false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := IsRejoinNeeded(tt.Err); got != tt.Rejoin {
+			t.Fatalf("%v: expected rejoin needed %v, got %v", tt.Err, tt.Rejoin, got)
+		}
+		if tt.Rejoin && IsRetriable(tt.Err) {
+			t.Fatalf("%v: expected not to be retriable", tt.Err)
+		}
+	}
+}
+
+func TestKafkaError(t *testing.T) {
+	err := errFromNo(6)
+	kerr, ok := err.(*KafkaError)
+	if !ok {
+		t.Fatalf("expected *KafkaError, got %T", err)
+	}
+	if kerr.Code != 6 || kerr.Message != "not leader for partition" || !kerr.Retriable {
+		t.Fatalf("unexpected error fields: %#v", kerr)
+	}
+	if kerr := errFromNo(1).(*KafkaError); kerr.Retriable {
+		t.Fatalf("expected %v not to be retriable", kerr)
+	}
+
+	if !errors.Is(fmt.Errorf("fetch failed: %w", err), ErrNotLeaderForPartition) {
+		t.Fatalf("expected wrapped error to match %v", ErrNotLeaderForPartition)
+	}
+	if !errors.Is(&KafkaError{Code: 6}, ErrNotLeaderForPartition) {
+		t.Fatalf("expected error with the same code to match %v", ErrNotLeaderForPartition)
+	}
+	if errors.Is(err, ErrLeaderNotAvailable) {
+		t.Fatalf("expected %v not to match %v", err, ErrLeaderNotAvailable)
+	}
+}
@@ -0,0 +1,251 @@
+package proto
+
+import (
+	"bytes"
+	"sort"
+)
+
+// ConsumerProtocolType is the protocol type used by consumer groups when
+// joining the group.
+const ConsumerProtocolType = "consumer"
+
+// ConsumerSubscription is the member metadata sent with JoinGroup request
+// by members of the group using the "consumer" protocol.
+type ConsumerSubscription struct {
+	Version  int16
+	Topics   []string
+	UserData []byte
+
+	// OwnedPartitions are the partitions assigned to the member before the
+	// rebalance, used by the cooperative rebalancing protocol.
+	OwnedPartitions []ConsumerAssignmentTopic // >= 1
+
+	// GenerationID is the generation the owned partitions were assigned in,
+	// or -1 if unknown. Used by the cooperative sticky assignor to tell
+	// which member owned a partition most recently.
+	GenerationID int32 // >= 2
+}
+
+// ConsumerAssignment is the member assignment computed by the group leader
+// and distributed with SyncGroup request for the "consumer" protocol.
+//
+// All versions of the assignment share the same format. With cooperative
+// rebalancing, the member compares the assignment with the partitions it
+// owned to find out which partitions to start and stop consuming, see
+// DiffAssignment.
+type ConsumerAssignment struct {
+	Version  int16
+	Topics   []ConsumerAssignmentTopic
+	UserData []byte
+}
+
+type ConsumerAssignmentTopic struct {
+	Name       string
+	Partitions []int32
+}
+
+// EncodeConsumerSubscription returns the binary representation of the
+// subscription, as expected by JoinGroup request protocol metadata.
+func EncodeConsumerSubscription(s *ConsumerSubscription) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	enc.EncodeInt16(s.Version)
+	enc.EncodeArrayLen(len(s.Topics))
+	for _, topic := range s.Topics {
+		enc.EncodeString(topic)
+	}
+	enc.EncodeBytes(s.UserData)
+	if s.Version >= 1 {
+		encodeTopicPartitions(enc, s.OwnedPartitions)
+	}
+	if s.Version >= 2 {
+		enc.EncodeInt32(s.GenerationID)
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeConsumerSubscription parses subscription metadata of a group member.
+// Fields added by versions newer than supported are ignored.
+func DecodeConsumerSubscription(b []byte) (*ConsumerSubscription, error) {
+	var s ConsumerSubscription
+	dec := NewDecoder(bytes.NewReader(b))
+
+	s.Version = dec.DecodeInt16()
+
+	len, err := dec.DecodeArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	s.Topics = make([]string, len)
+	for i := range s.Topics {
+		s.Topics[i] = dec.DecodeString()
+	}
+	s.UserData = dec.DecodeBytes()
+	if s.Version >= 1 {
+		if s.OwnedPartitions, err = decodeTopicPartitions(dec); err != nil {
+			return nil, err
+		}
+	}
+	if s.Version >= 2 {
+		s.GenerationID = dec.DecodeInt32()
+	}
+
+	if dec.Err() != nil {
+		return nil, dec.Err()
+	}
+	return &s, nil
+}
+
+// EncodeConsumerAssignment returns the binary representation of the
+// assignment, as expected by SyncGroup request.
+func EncodeConsumerAssignment(a *ConsumerAssignment) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	enc.EncodeInt16(a.Version)
+	encodeTopicPartitions(enc, a.Topics)
+	enc.EncodeBytes(a.UserData)
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeConsumerAssignment parses the member assignment returned by
+// SyncGroup response. Fields added by versions newer than supported are
+// ignored.
+func DecodeConsumerAssignment(b []byte) (*ConsumerAssignment, error) {
+	var a ConsumerAssignment
+	dec := NewDecoder(bytes.NewReader(b))
+
+	a.Version = dec.DecodeInt16()
+
+	var err error
+	if a.Topics, err = decodeTopicPartitions(dec); err != nil {
+		return nil, err
+	}
+	a.UserData = dec.DecodeBytes()
+
+	if dec.Err() != nil {
+		return nil, dec.Err()
+	}
+	return &a, nil
+}
+
+func encodeTopicPartitions(enc *encoder, topics []ConsumerAssignmentTopic) {
+	enc.EncodeArrayLen(len(topics))
+	for _, topic := range topics {
+		enc.EncodeString(topic.Name)
+		enc.EncodeInt32s(topic.Partitions)
+	}
+}
+
+func decodeTopicPartitions(dec *decoder) ([]ConsumerAssignmentTopic, error) {
+	len, err := dec.DecodeArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	topics := make([]ConsumerAssignmentTopic, len)
+	for ti := range topics {
+		var topic = &topics[ti]
+		topic.Name = dec.DecodeString()
+
+		len, err = dec.DecodeArrayLen()
+		if err != nil {
+			return nil, err
+		}
+		topic.Partitions = make([]int32, len)
+		for pi := range topic.Partitions {
+			topic.Partitions[pi] = dec.DecodeInt32()
+		}
+	}
+	return topics, nil
+}
+
+// AssignmentChanges describes how the partitions of a group member change
+// with the new assignment. Topics are ordered by name and partitions by ID.
+type AssignmentChanges struct {
+	// Added partitions were not owned by the member before and have to be
+	// consumed starting with their committed offsets.
+	Added []ConsumerAssignmentTopic
+	// Kept partitions are owned by the member before and after the
+	// rebalance and their consumption continues uninterrupted.
+	Kept []ConsumerAssignmentTopic
+	// Revoked partitions are no longer assigned to the member. Their
+	// offsets should be committed and their consumption stopped, before
+	// they can be assigned to another member.
+	Revoked []ConsumerAssignmentTopic
+}
+
+// DiffAssignment compares the partitions owned by the member with the newly
+// assigned ones, as required by the cooperative rebalancing protocol.
+func DiffAssignment(owned, assigned []ConsumerAssignmentTopic) AssignmentChanges {
+	before := topicPartitionSet(owned)
+	after := topicPartitionSet(assigned)
+
+	var changes AssignmentChanges
+	for _, topic := range sortedTopics(after) {
+		for _, id := range sortedPartitions(after[topic]) {
+			if before[topic][id] {
+				changes.Kept = appendTopicPartition(changes.Kept, topic, id)
+			} else {
+				changes.Added = appendTopicPartition(changes.Added, topic, id)
+			}
+		}
+	}
+	for _, topic := range sortedTopics(before) {
+		for _, id := range sortedPartitions(before[topic]) {
+			if !after[topic][id] {
+				changes.Revoked = appendTopicPartition(changes.Revoked, topic, id)
+			}
+		}
+	}
+	return changes
+}
+
+func topicPartitionSet(topics []ConsumerAssignmentTopic) map[string]map[int32]bool {
+	set := make(map[string]map[int32]bool)
+	for _, topic := range topics {
+		if set[topic.Name] == nil {
+			set[topic.Name] = make(map[int32]bool)
+		}
+		for _, id := range topic.Partitions {
+			set[topic.Name][id] = true
+		}
+	}
+	return set
+}
+
+func sortedTopics(set map[string]map[int32]bool) []string {
+	topics := make([]string, 0, len(set))
+	for topic := range set {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+func sortedPartitions(set map[int32]bool) []int32 {
+	ids := make([]int32, 0, len(set))
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// appendTopicPartition adds the partition to the last topic of the list, if
+// it has the same name, or as a new topic otherwise.
+func appendTopicPartition(topics []ConsumerAssignmentTopic, topic string, id int32) []ConsumerAssignmentTopic {
+	if n := len(topics); n > 0 && topics[n-1].Name == topic {
+		topics[n-1].Partitions = append(topics[n-1].Partitions, id)
+		return topics
+	}
+	return append(topics, ConsumerAssignmentTopic{Name: topic, Partitions: []int32{id}})
+}
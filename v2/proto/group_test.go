@@ -0,0 +1,186 @@
+package proto
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestConsumerSubscription(t *testing.T) {
+	sub := &ConsumerSubscription{
+		Topics:   []string{"foo", "bar"},
+		UserData: []byte{0x1, 0x2},
+	}
+	b, err := EncodeConsumerSubscription(sub)
+	if err != nil {
+		t.Fatalf("cannot encode subscription: %s", err)
+	}
+	expected := []byte{
+		0x0, 0x0, // version
+		0x0, 0x0, 0x0, 0x2, // topics
+		0x0, 0x3, 0x66, 0x6f, 0x6f,
+		0x0, 0x3, 0x62, 0x61, 0x72,
+		0x0, 0x0, 0x0, 0x2, 0x1, 0x2, // user data
+	}
+	if !bytes.Equal(b, expected) {
+		t.Fatalf("expected different bytes representation: %#v", b)
+	}
+
+	decoded, err := DecodeConsumerSubscription(b)
+	if err != nil {
+		t.Fatalf("cannot decode subscription: %s", err)
+	}
+	if !reflect.DeepEqual(decoded, sub) {
+		t.Fatalf("expected %#v, got %#v", sub, decoded)
+	}
+}
+
+func TestConsumerSubscriptionOwnedPartitions(t *testing.T) {
+	sub := &ConsumerSubscription{
+		Version: 1,
+		Topics:  []string{"foo"},
+		OwnedPartitions: []ConsumerAssignmentTopic{
+			{Name: "foo", Partitions: []int32{1}},
+		},
+	}
+	b, err := EncodeConsumerSubscription(sub)
+	if err != nil {
+		t.Fatalf("cannot encode subscription: %s", err)
+	}
+	expected := []byte{
+		0x0, 0x1, // version
+		0x0, 0x0, 0x0, 0x1, // topics
+		0x0, 0x3, 0x66, 0x6f, 0x6f,
+		0xff, 0xff, 0xff, 0xff, // user data
+		0x0, 0x0, 0x0, 0x1, // owned partitions
+		0x0, 0x3, 0x66, 0x6f, 0x6f,
+		0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x1,
+	}
+	if !bytes.Equal(b, expected) {
+		t.Fatalf("expected different bytes representation: %#v", b)
+	}
+
+	decoded, err := DecodeConsumerSubscription(b)
+	if err != nil {
+		t.Fatalf("cannot decode subscription: %s", err)
+	}
+	if !reflect.DeepEqual(decoded, sub) {
+		t.Fatalf("expected %#v, got %#v", sub, decoded)
+	}
+
+	// owned partitions are not part of version 0
+	sub.Version = 0
+	b, err = EncodeConsumerSubscription(sub)
+	if err != nil {
+		t.Fatalf("cannot encode subscription: %s", err)
+	}
+	if decoded, err := DecodeConsumerSubscription(b); err != nil || decoded.OwnedPartitions != nil {
+		t.Fatalf("expected no owned partitions, got %#v, %v", decoded, err)
+	}
+}
+
+func TestConsumerAssignment(t *testing.T) {
+	assignment := &ConsumerAssignment{
+		Topics: []ConsumerAssignmentTopic{
+			{Name: "foo", Partitions: []int32{0, 2}},
+			{Name: "bar", Partitions: []int32{1}},
+		},
+	}
+	b, err := EncodeConsumerAssignment(assignment)
+	if err != nil {
+		t.Fatalf("cannot encode assignment: %s", err)
+	}
+	expected := []byte{
+		0x0, 0x0, // version
+		0x0, 0x0, 0x0, 0x2, // topics
+		0x0, 0x3, 0x66, 0x6f, 0x6f,
+		0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x2,
+		0x0, 0x3, 0x62, 0x61, 0x72,
+		0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x1,
+		0xff, 0xff, 0xff, 0xff, // user data
+	}
+	if !bytes.Equal(b, expected) {
+		t.Fatalf("expected different bytes representation: %#v", b)
+	}
+
+	decoded, err := DecodeConsumerAssignment(b)
+	if err != nil {
+		t.Fatalf("cannot decode assignment: %s", err)
+	}
+	if !reflect.DeepEqual(decoded, assignment) {
+		t.Fatalf("expected %#v, got %#v", assignment, decoded)
+	}
+
+	if _, err := DecodeConsumerAssignment(b[:10]); err == nil {
+		t.Fatal("expected error when decoding truncated assignment")
+	}
+}
+
+func TestConsumerSubscriptionGenerationID(t *testing.T) {
+	sub := &ConsumerSubscription{
+		Version: 2,
+		Topics:  []string{"foo"},
+		OwnedPartitions: []ConsumerAssignmentTopic{
+			{Name: "foo", Partitions: []int32{1}},
+		},
+		GenerationID: 7,
+	}
+	b, err := EncodeConsumerSubscription(sub)
+	if err != nil {
+		t.Fatalf("cannot encode subscription: %s", err)
+	}
+	if !bytes.HasSuffix(b, []byte{0x0, 0x0, 0x0, 0x7}) {
+		t.Fatalf("expected generation id at the end: %#v", b)
+	}
+
+	decoded, err := DecodeConsumerSubscription(b)
+	if err != nil {
+		t.Fatalf("cannot decode subscription: %s", err)
+	}
+	if !reflect.DeepEqual(decoded, sub) {
+		t.Fatalf("expected %#v, got %#v", sub, decoded)
+	}
+}
+
+func TestDiffAssignment(t *testing.T) {
+	// cooperative assignment uses the same format as version 0
+	b := []byte{
+		0x0, 0x1, // version
+		0x0, 0x0, 0x0, 0x2, // topics
+		0x0, 0x3, 0x66, 0x6f, 0x6f,
+		0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0x1,
+		0x0, 0x3, 0x62, 0x61, 0x7a,
+		0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0,
+		0xff, 0xff, 0xff, 0xff, // user data
+	}
+	assignment, err := DecodeConsumerAssignment(b)
+	if err != nil {
+		t.Fatalf("cannot decode assignment: %s", err)
+	}
+
+	owned := []ConsumerAssignmentTopic{
+		{Name: "foo", Partitions: []int32{0, 1}},
+		{Name: "bar", Partitions: []int32{3}},
+	}
+	changes := DiffAssignment(owned, assignment.Topics)
+	expected := AssignmentChanges{
+		Added: []ConsumerAssignmentTopic{
+			{Name: "baz", Partitions: []int32{0}},
+			{Name: "foo", Partitions: []int32{2}},
+		},
+		Kept: []ConsumerAssignmentTopic{
+			{Name: "foo", Partitions: []int32{1}},
+		},
+		Revoked: []ConsumerAssignmentTopic{
+			{Name: "bar", Partitions: []int32{3}},
+			{Name: "foo", Partitions: []int32{0}},
+		},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Fatalf("expected %#v, got %#v", expected, changes)
+	}
+
+	if changes := DiffAssignment(owned, owned); changes.Added != nil || changes.Revoked != nil {
+		t.Fatalf("expected no changes, got %#v", changes)
+	}
+}
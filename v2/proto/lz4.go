@@ -0,0 +1,144 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"math/bits"
+
+	"github.com/pierrec/lz4/v4"
+)
+
+// Kafka before 0.10 computed the LZ4 frame header checksum incorrectly, over
+// the frame magic number and the descriptor instead of the descriptor only.
+// To interoperate, MessageV0 messages must be compressed with the broken
+// checksum, while MessageV1 messages and record batches use the correct one,
+// as defined by the LZ4 frame format (KIP-57).
+
+var errInvalidLZ4Frame = errors.New("invalid lz4 frame")
+
+// lz4Encode compresses b into a LZ4 frame. Frame header checksum is broken
+// the same way as by old Kafka if brokenChecksum is set, which should be
+// done for MessageV0 messages only.
+func lz4Encode(b []byte, brokenChecksum bool) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := lz4.NewWriter(&buf)
+	// block size and no content checksum, as used by the java client
+	if err := zw.Apply(lz4.BlockSizeOption(lz4.Block64Kb), lz4.ChecksumOption(false)); err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(b); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	frame := buf.Bytes()
+	if brokenChecksum {
+		pos, err := lz4HeaderChecksumPos(frame)
+		if err != nil {
+			return nil, err
+		}
+		frame[pos] = lz4HeaderChecksum(frame[:pos])
+	}
+	return frame, nil
+}
+
+// lz4Decode decompresses LZ4 frame. If brokenChecksum is set, which should be
+// done for MessageV0 messages only, frame header checksum computed by old
+// Kafka is accepted as well as the correct one.
+func lz4Decode(b []byte, brokenChecksum bool) ([]byte, error) {
+	if brokenChecksum {
+		pos, err := lz4HeaderChecksumPos(b)
+		if err != nil {
+			return nil, err
+		}
+		if b[pos] == lz4HeaderChecksum(b[:pos]) {
+			// fix the checksum on a copy, so that the input is not
+			// modified
+			b = append([]byte(nil), b...)
+			b[pos] = lz4HeaderChecksum(b[4:pos])
+		}
+	}
+	return ioutil.ReadAll(lz4.NewReader(bytes.NewReader(b)))
+}
+
+// lz4HeaderChecksumPos returns the position of the header checksum byte
+// within LZ4 frame.
+func lz4HeaderChecksumPos(b []byte) (int, error) {
+	// magic number, FLG and BD bytes
+	if len(b) < 7 || binary.LittleEndian.Uint32(b) != 0x184D2204 {
+		return 0, errInvalidLZ4Frame
+	}
+	pos := 6
+	flg := b[4]
+	if flg&0x08 != 0 {
+		pos += 8 // content size
+	}
+	if flg&0x01 != 0 {
+		pos += 4 // dictionary id
+	}
+	if len(b) <= pos {
+		return 0, errInvalidLZ4Frame
+	}
+	return pos, nil
+}
+
+// lz4HeaderChecksum returns LZ4 frame header checksum of given bytes, which
+// is the second byte of their xxHash32.
+func lz4HeaderChecksum(b []byte) byte {
+	return byte(xxh32(b) >> 8)
+}
+
+const (
+	xxh32Prime1 uint32 = 2654435761
+	xxh32Prime2 uint32 = 2246822519
+	xxh32Prime3 uint32 = 3266489917
+	xxh32Prime4 uint32 = 668265263
+	xxh32Prime5 uint32 = 374761393
+)
+
+// xxh32 returns xxHash32 of b with zero seed.
+func xxh32(b []byte) uint32 {
+	n := len(b)
+	var h uint32
+	if n >= 16 {
+		// constant expressions would overflow, so the initial
+		// accumulators are computed at runtime
+		var v1, v2, v3, v4 uint32 = xxh32Prime1, xxh32Prime2, 0, 0
+		v1 += xxh32Prime2
+		v4 -= xxh32Prime1
+		for ; len(b) >= 16; b = b[16:] {
+			v1 = xxh32Round(v1, binary.LittleEndian.Uint32(b[0:]))
+			v2 = xxh32Round(v2, binary.LittleEndian.Uint32(b[4:]))
+			v3 = xxh32Round(v3, binary.LittleEndian.Uint32(b[8:]))
+			v4 = xxh32Round(v4, binary.LittleEndian.Uint32(b[12:]))
+		}
+		h = bits.RotateLeft32(v1, 1) + bits.RotateLeft32(v2, 7) + bits.RotateLeft32(v3, 12) + bits.RotateLeft32(v4, 18)
+	} else {
+		h = xxh32Prime5
+	}
+	h += uint32(n)
+
+	for ; len(b) >= 4; b = b[4:] {
+		h += binary.LittleEndian.Uint32(b) * xxh32Prime3
+		h = bits.RotateLeft32(h, 17) * xxh32Prime4
+	}
+	for _, c := range b {
+		h += uint32(c) * xxh32Prime5
+		h = bits.RotateLeft32(h, 11) * xxh32Prime1
+	}
+
+	h ^= h >> 15
+	h *= xxh32Prime2
+	h ^= h >> 13
+	h *= xxh32Prime3
+	h ^= h >> 16
+	return h
+}
+
+func xxh32Round(acc, input uint32) uint32 {
+	acc += input * xxh32Prime2
+	return bits.RotateLeft32(acc, 13) * xxh32Prime1
+}
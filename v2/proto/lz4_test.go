@@ -0,0 +1,126 @@
+package proto
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestXXH32(t *testing.T) {
+	cases := map[string]uint32{
+		"":    0x02cc5d05,
+		"a":   0x550d7456,
+		"abc": 0x32d153ff,
+		"Nobody inspects the spammish repetition": 0xe2293b2f,
+	}
+	for s, expected := range cases {
+		if h := xxh32([]byte(s)); h != expected {
+			t.Errorf("%q: expected %#x, got %#x", s, expected, h)
+		}
+	}
+}
+
+func TestLZ4HeaderChecksum(t *testing.T) {
+	data := bytes.Repeat([]byte("lz4 compressed value "), 100)
+
+	valid, err := lz4Encode(data, false)
+	if err != nil {
+		t.Fatalf("cannot encode: %s", err)
+	}
+	broken, err := lz4Encode(data, true)
+	if err != nil {
+		t.Fatalf("cannot encode: %s", err)
+	}
+	pos, err := lz4HeaderChecksumPos(valid)
+	if err != nil {
+		t.Fatalf("invalid frame: %s", err)
+	}
+	if valid[pos] == broken[pos] || !bytes.Equal(valid[:pos], broken[:pos]) || !bytes.Equal(valid[pos+1:], broken[pos+1:]) {
+		t.Fatalf("expected frames to differ in header checksum only")
+	}
+
+	// frame with broken checksum is accepted only when expected
+	if _, err := lz4Decode(broken, false); err == nil {
+		t.Fatal("expected broken checksum to be rejected")
+	}
+	for _, frame := range [][]byte{valid, broken} {
+		decoded, err := lz4Decode(frame, true)
+		if err != nil {
+			t.Fatalf("cannot decode: %s", err)
+		}
+		if !bytes.Equal(decoded, data) {
+			t.Fatalf("expected %q, got %q", data, decoded)
+		}
+	}
+	if decoded, err := lz4Decode(valid, false); err != nil || !bytes.Equal(decoded, data) {
+		t.Fatalf("cannot decode: %v", err)
+	}
+}
+
+func TestLZ4MessageSet(t *testing.T) {
+	for _, version := range []MessageVersion{MessageV0, MessageV1} {
+		messages := []*Message{
+			{Offset: 0, Key: []byte("a"), Value: []byte("foo"), TimestampMs: 1500000000000},
+			{Offset: 1, Value: []byte("bar"), TimestampMs: 1500000000001},
+		}
+		var buf bytes.Buffer
+		if _, err := writeMessageSetVersioned(&buf, messages, CompressionLZ4, version); err != nil {
+			t.Fatalf("cannot serialize messages: %s", err)
+		}
+		b := buf.Bytes()
+
+		// offset, size, crc, magic byte, attributes, timestamp, null
+		// key and value size precede the compressed value
+		start := 8 + 4 + 4 + 1 + 1 + 4 + 4
+		if version == MessageV1 {
+			start += 8
+		}
+		// the frame header checksum must be broken for MessageV0 only
+		_, err := lz4Decode(b[start:], false)
+		if version == MessageV0 && err == nil {
+			t.Fatal("expected broken header checksum of MessageV0 frame")
+		}
+		if version == MessageV1 && err != nil {
+			t.Fatalf("expected valid MessageV1 frame: %s", err)
+		}
+
+		got, _, err := readMessageSet(bytes.NewReader(b), int32(len(b)))
+		if err != nil {
+			t.Fatalf("cannot deserialize version %d messages: %s", version, err)
+		}
+		var values []string
+		for _, m := range got {
+			values = append(values, string(m.Value))
+		}
+		if expected := []string{"foo", "bar"}; !reflect.DeepEqual(values, expected) {
+			t.Fatalf("expected %v, got %v", expected, values)
+		}
+	}
+}
+
+func BenchmarkCompressLZ4(b *testing.B) {
+	payload := benchmarkPayload()
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		compressed, err := lz4Encode(payload, false)
+		if err != nil {
+			b.Fatalf("cannot compress: %s", err)
+		}
+		b.ReportMetric(float64(len(payload))/float64(len(compressed)), "ratio")
+	}
+}
+
+func BenchmarkDecompressLZ4(b *testing.B) {
+	compressed, err := lz4Encode(benchmarkPayload(), false)
+	if err != nil {
+		b.Fatalf("cannot compress: %s", err)
+	}
+	b.SetBytes(int64(len(benchmarkPayload())))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := lz4Decode(compressed, false); err != nil {
+			b.Fatalf("cannot decompress: %s", err)
+		}
+	}
+}
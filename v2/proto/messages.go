@@ -10,6 +10,8 @@ import (
 	"hash/crc32"
 	"io"
 	"io/ioutil"
+	"math"
+	"strings"
 	"time"
 
 	"github.com/golang/snappy"
@@ -28,18 +30,32 @@ const (
 	KafkaV3
 	KafkaV4
 	KafkaV5
+	KafkaV6
+	KafkaV7
+	KafkaV8
+	KafkaV9
+	KafkaV10
+	KafkaV11
 )
 
 const (
-	ProduceReqKind          = 0
-	FetchReqKind            = 1
-	OffsetReqKind           = 2
-	MetadataReqKind         = 3
-	OffsetCommitReqKind     = 8
-	OffsetFetchReqKind      = 9
-	ConsumerMetadataReqKind = 10
-	APIVersionsReqKind      = 18
-	CreateTopicsReqKind     = 19
+	ProduceReqKind            = 0
+	FetchReqKind              = 1
+	OffsetReqKind             = 2
+	MetadataReqKind           = 3
+	OffsetCommitReqKind       = 8
+	OffsetFetchReqKind        = 9
+	ConsumerMetadataReqKind   = 10
+	FindCoordinatorReqKind    = 10 // supersedes ConsumerMetadataReqKind
+	APIVersionsReqKind        = 18
+	CreateTopicsReqKind       = 19
+	InitProducerIdReqKind     = 22
+	AddPartitionsToTxnReqKind = 24
+	AddOffsetsToTxnReqKind    = 25
+	EndTxnReqKind             = 26
+	DescribeAclsReqKind       = 29
+	CreateAclsReqKind         = 30
+	DeleteAclsReqKind         = 31
 )
 
 const (
@@ -82,8 +98,13 @@ var _ Request = &MetadataReq{}
 var _ Request = &OffsetCommitReq{}
 var _ Request = &OffsetFetchReq{}
 var _ Request = &ConsumerMetadataReq{}
+var _ Request = &FindCoordinatorReq{}
 var _ Request = &APIVersionsReq{}
 var _ Request = &CreateTopicsReq{}
+var _ Request = &InitProducerIdReq{}
+var _ Request = &AddPartitionsToTxnReq{}
+var _ Request = &AddOffsetsToTxnReq{}
+var _ Request = &EndTxnReq{}
 
 func SetVersion(header *RequestHeader, version int16) {
 	header.version = version
@@ -120,14 +141,21 @@ func (h *RequestHeader) SetClientID(cliendID string) {
 }
 
 var SupportedByDriver = map[int16]SupportedVersion{
-	ProduceReqKind:          SupportedVersion{MinVersion: KafkaV0, MaxVersion: KafkaV2},
-	FetchReqKind:            SupportedVersion{MinVersion: KafkaV0, MaxVersion: KafkaV5},
-	OffsetReqKind:           SupportedVersion{MinVersion: KafkaV0, MaxVersion: KafkaV2},
-	MetadataReqKind:         SupportedVersion{MinVersion: KafkaV0, MaxVersion: KafkaV5},
-	OffsetCommitReqKind:     SupportedVersion{MinVersion: KafkaV0, MaxVersion: KafkaV3},
-	OffsetFetchReqKind:      SupportedVersion{MinVersion: KafkaV0, MaxVersion: KafkaV3},
-	ConsumerMetadataReqKind: SupportedVersion{MinVersion: KafkaV0, MaxVersion: KafkaV1},
-	APIVersionsReqKind:      SupportedVersion{MinVersion: KafkaV0, MaxVersion: KafkaV1},
+	ProduceReqKind:            SupportedVersion{MinVersion: KafkaV0, MaxVersion: KafkaV3},
+	FetchReqKind:              SupportedVersion{MinVersion: KafkaV0, MaxVersion: KafkaV11},
+	OffsetReqKind:             SupportedVersion{MinVersion: KafkaV0, MaxVersion: KafkaV2},
+	MetadataReqKind:           SupportedVersion{MinVersion: KafkaV0, MaxVersion: KafkaV5},
+	OffsetCommitReqKind:       SupportedVersion{MinVersion: KafkaV0, MaxVersion: KafkaV3},
+	OffsetFetchReqKind:        SupportedVersion{MinVersion: KafkaV0, MaxVersion: KafkaV3},
+	ConsumerMetadataReqKind:   SupportedVersion{MinVersion: KafkaV0, MaxVersion: KafkaV1},
+	APIVersionsReqKind:        SupportedVersion{MinVersion: KafkaV0, MaxVersion: KafkaV1},
+	InitProducerIdReqKind:     SupportedVersion{MinVersion: KafkaV0, MaxVersion: KafkaV1},
+	AddPartitionsToTxnReqKind: SupportedVersion{MinVersion: KafkaV0, MaxVersion: KafkaV1},
+	AddOffsetsToTxnReqKind:    SupportedVersion{MinVersion: KafkaV0, MaxVersion: KafkaV1},
+	EndTxnReqKind:             SupportedVersion{MinVersion: KafkaV0, MaxVersion: KafkaV1},
+	DescribeAclsReqKind:       SupportedVersion{MinVersion: KafkaV0, MaxVersion: KafkaV1},
+	CreateAclsReqKind:         SupportedVersion{MinVersion: KafkaV0, MaxVersion: KafkaV1},
+	DeleteAclsReqKind:         SupportedVersion{MinVersion: KafkaV0, MaxVersion: KafkaV1},
 }
 
 type Compression int8
@@ -136,8 +164,54 @@ const (
 	CompressionNone   Compression = 0
 	CompressionGzip   Compression = 1
 	CompressionSnappy Compression = 2
+	CompressionLZ4    Compression = 3
+	CompressionZstd   Compression = 4 // only supported by RecordBatch, produced with KafkaV3 and newer
 )
 
+// CompressionLevel trades compression speed for compression ratio. It is
+// used by gzip and zstd codecs and ignored by the others.
+type CompressionLevel int8
+
+const (
+	CompressionLevelDefault CompressionLevel = 0
+	CompressionLevelFastest CompressionLevel = 1
+	CompressionLevelBest    CompressionLevel = 2
+)
+
+// gzipLevel returns the gzip package level for the compression level.
+func (l CompressionLevel) gzipLevel() int {
+	switch l {
+	case CompressionLevelFastest:
+		return gzip.BestSpeed
+	case CompressionLevelBest:
+		return gzip.BestCompression
+	}
+	return gzip.DefaultCompression
+}
+
+// compressionCodecMask is the part of the attributes holding compression
+// codec.
+const compressionCodecMask = 0x07
+
+// logAppendTimeFlag is the timestamp type bit of MessageV1 attributes. When
+// set on a compressed wrapper message, the wrapper timestamp is the time the
+// broker appended the set to the log and it applies to all inner messages.
+// Otherwise inner messages keep their own create time, while the wrapper
+// carries the maximum of them.
+const logAppendTimeFlag = 0x08
+
+// compressionFromAttributes returns compression codec of MessageSet message
+// with given attributes.
+func compressionFromAttributes(attr int8) Compression {
+	return Compression(attr & compressionCodecMask)
+}
+
+// compressionFromBatchAttributes returns compression codec of RecordBatch with
+// given attributes.
+func compressionFromBatchAttributes(attr int16) Compression {
+	return Compression(attr & compressionCodecMask)
+}
+
 // ParserConfig is optional configuration for the parser. It can be configured via
 // SetParserConfig
 type ParserConfig struct {
@@ -148,6 +222,58 @@ type ParserConfig struct {
 	// the cost of not providing access to the message payload after
 	// parsing.
 	SimplifiedMessageSetParsing bool
+
+	// SkipMessageValues makes the parser skip over values of uncompressed
+	// legacy (MessageV0 and MessageV1) messages without reading them into
+	// memory, leaving Message.Value nil. Because the value is not read, the
+	// message checksum is not verified.
+	SkipMessageValues bool
+
+	// OnPartitionDecoded, if set, is called by fetch response readers after
+	// each partition is decoded, with the number of messages (or records)
+	// it contains and the time spent decoding it.
+	OnPartitionDecoded func(topic string, partition int32, messages int, dur time.Duration)
+
+	// ValidateOffsets makes the parser check that offsets of messages
+	// within a message set are strictly increasing. Otherwise
+	// ErrNonMonotonicOffsets is returned, as it means that the message set
+	// was not decoded correctly.
+	ValidateOffsets bool
+
+	// SkipRecordBatch, if set, is called with the header of every record
+	// batch of the fetch response, before its records are decoded. If it
+	// returns true, records of the batch are neither decompressed nor
+	// decoded and the batch is returned without records, with
+	// RecordBatch.Skipped set. Together with
+	// FirstOffset, LastOffsetDelta of the header tells the offset range of
+	// the batch, so already processed batches can be skipped cheaply.
+	SkipRecordBatch func(topic string, partition int32, header *RecordBatch) bool
+
+	// ValidateUTF8 makes the parser check that all decoded strings, like
+	// topic names or client IDs, are valid UTF-8. Otherwise ErrInvalidUTF8
+	// is returned.
+	ValidateUTF8 bool
+
+	// TolerateCrcMismatch makes the parser decode legacy (MessageV0 and
+	// MessageV1) messages with invalid checksum instead of ignoring the
+	// rest of the message set. Such messages have Message.CrcMismatch set,
+	// see CrcMismatches. Meant for inspecting possibly corrupted data.
+	TolerateCrcMismatch bool
+
+	// SnappyFramedFallback makes the parser accept snappy compressed data
+	// using the standard snappy framing format, as written by some non
+	// Kafka producers, in addition to the snappy-java framing and plain
+	// snappy. It is off by default, so that corrupted data is not mistaken
+	// for a different framing.
+	SnappyFramedFallback bool
+
+	// MaxMessages limits the total number of messages (or records) fetch
+	// response readers decode across all partitions of a single response.
+	// Once the limit is reached, no further partitions are decoded nor read
+	// from the reader and the response is marked as FetchResp.Truncated.
+	// Partitions are always decoded whole, so the limit can be exceeded by
+	// the last decoded partition. Zero means no limit.
+	MaxMessages int
 }
 
 var (
@@ -170,35 +296,62 @@ func boolToInt8(val bool) int8 {
 	return res
 }
 
-// ReadReq returns request kind ID and byte representation of the whole message
-// in wire protocol format.
-func ReadReq(r io.Reader) (requestKind int16, b []byte, err error) {
-	dec := NewDecoder(r)
-	msgSize := dec.DecodeInt32()
-	requestKind = dec.DecodeInt16()
-	if err := dec.Err(); err != nil {
-		return 0, nil, err
+// ReadFrame reads a single size prefixed frame, which every request and
+// response is sent as, from given stream. Frames are always handled whole,
+// including the 4 bytes big endian size, so that the returned bytes can be
+// passed to request and response readers, or to WriteFrame. If the stream
+// ends after the size was read, but before the whole frame was read,
+// *InsufficientDataError is returned.
+func ReadFrame(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	frameSize := int32(binary.BigEndian.Uint32(size[:]))
+	if frameSize < 0 {
+		return nil, messageSizeError(int(frameSize))
 	}
-	// size of the message + size of the message itself
-	b, err = allocParseBuf(int(msgSize + 4))
+	// size of the frame + size of the frame itself
+	b, err := allocParseBuf(int(frameSize) + 4)
 	if err != nil {
-		return 0, nil, err
+		return nil, err
 	}
-
-	binary.BigEndian.PutUint32(b, uint32(msgSize))
-
-	// only write back requestKind if it was included in messageSize
-	if len(b) >= 6 {
-		binary.BigEndian.PutUint16(b[4:], uint16(requestKind))
+	copy(b, size[:])
+	if n, err := io.ReadFull(r, b[4:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = &InsufficientDataError{Expected: len(b), Got: 4 + n}
+		}
+		return nil, err
 	}
+	return b, nil
+}
 
-	// read rest of request into allocated buffer if we allocated for it
-	if len(b) > 6 {
-		if _, err := io.ReadFull(r, b[6:]); err != nil {
-			return 0, nil, err
-		}
+// WriteFrame writes a single frame to the stream. As returned by ReadFrame
+// or by Bytes of requests and responses, b must start with the 4 bytes big
+// endian size of the rest of the frame, otherwise nothing is written and an
+// error is returned. The number of bytes written is returned.
+func WriteFrame(w io.Writer, b []byte) (int, error) {
+	if len(b) < 4 || len(b) > maxParseBufSize {
+		return 0, messageSizeError(len(b))
+	}
+	if size := int32(binary.BigEndian.Uint32(b)); int(size) != len(b)-4 {
+		return 0, messageSizeError(int(size))
 	}
+	n, err := writeFull(w, b)
+	return int(n), err
+}
 
+// ReadReq returns request kind ID and byte representation of the whole message
+// in wire protocol format.
+func ReadReq(r io.Reader) (requestKind int16, b []byte, err error) {
+	b, err = ReadFrame(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(b) < 6 {
+		return 0, nil, messageSizeError(len(b) - 4)
+	}
+	requestKind = int16(binary.BigEndian.Uint16(b[4:]))
 	return requestKind, b, nil
 }
 
@@ -207,23 +360,39 @@ func ReadReq(r io.Reader) (requestKind int16, b []byte, err error) {
 // including 4 bytes of message size itself.
 // Byte representation returned by ReadResp can be parsed by all response
 // reeaders to transform it into specialized response structure.
+// If the stream ends after the message size was read, but before the whole
+// message was read, *InsufficientDataError is returned.
 func ReadResp(r io.Reader) (correlationID int32, b []byte, err error) {
-	dec := NewDecoder(r)
-	msgSize := dec.DecodeInt32()
-	correlationID = dec.DecodeInt32()
-	if err := dec.Err(); err != nil {
-		return 0, nil, err
-	}
-	// size of the message + size of the message itself
-	b, err = allocParseBuf(int(msgSize + 4))
+	b, err = ReadFrame(r)
 	if err != nil {
 		return 0, nil, err
 	}
+	if len(b) < 8 {
+		return 0, nil, messageSizeError(len(b) - 4)
+	}
+	correlationID = int32(binary.BigEndian.Uint32(b[4:]))
+	return correlationID, b, nil
+}
 
-	binary.BigEndian.PutUint32(b, uint32(msgSize))
-	binary.BigEndian.PutUint32(b[4:], uint32(correlationID))
-	_, err = io.ReadFull(r, b[8:])
-	return correlationID, b, err
+// PeekResponseHeader reads only the message size and correlation ID of the
+// response from given stream. The remaining size-4 bytes of the response body
+// are left unread, so that the caller can route the response before reading
+// or skipping it. If the stream ends after the message size was read, but
+// before the correlation ID was read, *InsufficientDataError is returned.
+func PeekResponseHeader(r io.Reader) (size int32, correlationID int32, err error) {
+	var b [8]byte
+	if n, err := io.ReadFull(r, b[:]); err != nil {
+		if err == io.ErrUnexpectedEOF && n >= 4 {
+			err = &InsufficientDataError{Expected: len(b), Got: n}
+		}
+		return 0, 0, err
+	}
+	size = int32(binary.BigEndian.Uint32(b[:4]))
+	if size < 4 {
+		return 0, 0, messageSizeError(int(size))
+	}
+	correlationID = int32(binary.BigEndian.Uint32(b[4:]))
+	return size, correlationID, nil
 }
 
 // Message represents single entity of message set.
@@ -235,6 +404,147 @@ type Message struct {
 	Topic     string // set when fetching, ignored when producing
 	Partition int32  // set when fetching, ignored when producing
 	TipOffset int64  // set when fetching, ignored when processing
+
+	// TimestampMs is the message timestamp in milliseconds since epoch, as
+	// sent over the wire. NoTimestamp (-1) means that the timestamp is not
+	// set, which is always the case for MessageV0 messages.
+	//
+	// When producing with KafkaV2 or newer, zero value is replaced with the
+	// current time. Use NoTimestamp to send the message without timestamp.
+	TimestampMs int64
+
+	// Attributes holds the raw attributes byte of the message, including
+	// the compression codec and timestamp type bits. Set when fetching,
+	// ignored when producing. Record batches carry their attributes in
+	// RecordBatch.Attributes instead.
+	Attributes int8
+
+	// MessageVersion is the format the message was fetched in, needed to
+	// recompute its checksum. Set when fetching, ignored when producing.
+	MessageVersion MessageVersion
+
+	// CrcMismatch is set when fetching with
+	// ParserConfig.TolerateCrcMismatch if the checksum of the message, or of
+	// the compressed message wrapping it, is invalid.
+	CrcMismatch bool
+
+	// createTimestampMs is the timestamp the message was written with, kept
+	// for VerifyCRC when TimestampMs was replaced by the log append time of
+	// the compressed message wrapping it.
+	createTimestampMs int64
+	logAppendTime     bool
+
+	// valueSkipped is set if the value was not read because of
+	// ParserConfig.SkipMessageValues.
+	valueSkipped bool
+}
+
+// CrcMismatches returns offsets of the messages that failed the checksum
+// validation.
+func CrcMismatches(messages []*Message) []int64 {
+	var offsets []int64
+	for _, m := range messages {
+		if m.CrcMismatch {
+			offsets = append(offsets, m.Offset)
+		}
+	}
+	return offsets
+}
+
+// NoTimestamp is the timestamp value of messages without a timestamp.
+const NoTimestamp = -1
+
+// Time returns the message timestamp. Zero time is returned if the message
+// has no timestamp.
+func (m *Message) Time() time.Time {
+	if m.TimestampMs == NoTimestamp {
+		return time.Time{}
+	}
+	return time.Unix(0, m.TimestampMs*int64(time.Millisecond))
+}
+
+// encodedSize returns the number of bytes the message takes when written as
+// part of a message set in given format, including the offset and message
+// size prefix.
+func (m *Message) encodedSize(version MessageVersion) int {
+	size := 26 + len(m.Key) + len(m.Value)
+	if version == MessageV1 {
+		size += 8 // timestamp
+	}
+	return size
+}
+
+// Validate checks the message before it is sent to the broker. It returns
+// ErrMessageSizeTooLarge if the encoded message exceeds maxSize bytes, which
+// should be set to the broker's max.message.bytes. A maxSize that is not
+// greater than zero disables the size check. The size is counted in the
+// MessageV1 format, which is the larger one and the one sent with KafkaV2
+// and newer.
+func (m *Message) Validate(maxSize int) error {
+	if maxSize > 0 && m.encodedSize(MessageV1) > maxSize {
+		return ErrMessageSizeTooLarge
+	}
+	return nil
+}
+
+// VerifyCRC recomputes the checksum of the fetched message from its format,
+// attributes, timestamp, key and value, and returns true if it matches Crc.
+// Fetched nil key or value may have been sent as either null or empty, so
+// both are tried.
+//
+// Only messages of a MessageSet have their own checksum. False is also
+// returned for records of record batches, whose checksum covers the whole
+// batch, and for messages whose value was skipped because of
+// ParserConfig.SkipMessageValues, as their checksum cannot be recomputed.
+func (m *Message) VerifyCRC() bool {
+	if m.MessageVersion > MessageV1 || m.valueSkipped {
+		return false
+	}
+	var head [1 + 1 + 8]byte
+	head[0] = byte(m.MessageVersion)
+	head[1] = byte(m.Attributes)
+	n := 2
+	if m.MessageVersion == MessageV1 {
+		ts := m.TimestampMs
+		if m.logAppendTime {
+			ts = m.createTimestampMs
+		}
+		binary.BigEndian.PutUint64(head[2:], uint64(ts))
+		n += 8
+	}
+	for _, nullKey := range nullEncodings(m.Key) {
+		for _, nullValue := range nullEncodings(m.Value) {
+			crc := crc32.Update(0, crc32.IEEETable, head[:n])
+			crc = crc32.Update(crc, crc32.IEEETable, bytesLen(m.Key, nullKey))
+			crc = crc32.Update(crc, crc32.IEEETable, m.Key)
+			crc = crc32.Update(crc, crc32.IEEETable, bytesLen(m.Value, nullValue))
+			crc = crc32.Update(crc, crc32.IEEETable, m.Value)
+			if crc == m.Crc {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// nullEncodings returns the possible encodings of b as null, true if b is
+// nil, as nil can be decoded from both null and empty bytes.
+func nullEncodings(b []byte) []bool {
+	if b == nil {
+		return []bool{true, false}
+	}
+	return []bool{false}
+}
+
+// bytesLen returns the length prefix of b, encoded as -1 if null.
+func bytesLen(b []byte, null bool) []byte {
+	size := int32(len(b))
+	if null {
+		size = -1
+	}
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], uint32(size))
+	return buf[:]
 }
 
 // ComputeCrc returns crc32 hash for given message content.
@@ -245,12 +555,85 @@ func ComputeCrc(m *Message, compression Compression) uint32 {
 	enc.EncodeInt8(int8(compression))
 	enc.EncodeBytes(m.Key)
 	enc.EncodeBytes(m.Value)
-	return crc32.ChecksumIEEE(buf.Bytes())
+	return messageChecksum(MessageV0, buf.Bytes())
+}
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// crcTable returns the table of the checksum used by given message format.
+// MessageSet messages (MessageV0 and MessageV1) use IEEE polynomial, while
+// RecordBatch (MessageV2) uses Castagnoli. Brokers reject data with the
+// checksum computed using the wrong polynomial.
+func crcTable(version MessageVersion) *crc32.Table {
+	if version >= MessageV2 {
+		return castagnoliTable
+	}
+	return crc32.IEEETable
+}
+
+// messageChecksum returns checksum of data in given message format.
+func messageChecksum(version MessageVersion, b []byte) uint32 {
+	return crc32.Checksum(b, crcTable(version))
 }
 
-// writeMessageSet writes a Message Set into w.
+// writeMessageSet writes a Message Set of MessageV0 messages into w.
 // It returns the number of bytes written and any error.
 func writeMessageSet(w io.Writer, messages []*Message, compression Compression) (int, error) {
+	return writeMessageSetVersioned(w, messages, compression, MessageV0)
+}
+
+// writeMessageSetVersioned writes a Message Set of messages in given format
+// into w. Only MessageV0 and MessageV1 are supported. MessageV1 messages
+// without a timestamp set are written with the current time.
+func writeMessageSetVersioned(w io.Writer, messages []*Message, compression Compression, version MessageVersion) (int, error) {
+	return writeMessages(w, messages, compression, CompressionLevelDefault, version, time.Now())
+}
+
+// messageTimestamp returns the timestamp a MessageV1 message is written
+// with, defaulting unset timestamp to now.
+func messageTimestamp(m *Message, now time.Time) int64 {
+	if m.TimestampMs == 0 {
+		return now.UnixNano() / int64(time.Millisecond)
+	}
+	return m.TimestampMs
+}
+
+// writeRecordBatchMessages writes messages as a single record batch, as sent
+// by produce request of KafkaV3 and newer. The broker assigns offsets when
+// appending the batch to the log, so the batch starts at offset 0 and offsets
+// of the messages are ignored. It returns the number of bytes written.
+func writeRecordBatchMessages(w io.Writer, messages []*Message, compression Compression, level CompressionLevel, now time.Time) (int, error) {
+	if len(messages) == 0 {
+		return 0, nil
+	}
+	rb := &RecordBatch{
+		Attributes:      int16(compression),
+		LastOffsetDelta: int32(len(messages) - 1),
+		FirstTimestamp:  messageTimestamp(messages[0], now),
+		ProducerId:      -1,
+		ProducerEpoch:   -1,
+		FirstSequence:   -1,
+		Records:         make([]*Record, len(messages)),
+	}
+	rb.MaxTimestamp = rb.FirstTimestamp
+	for i, m := range messages {
+		ts := messageTimestamp(m, now)
+		if ts > rb.MaxTimestamp {
+			rb.MaxTimestamp = ts
+		}
+		rb.Records[i] = &Record{
+			TimestampDelta: ts - rb.FirstTimestamp,
+			OffsetDelta:    int64(i),
+			Key:            m.Key,
+			Value:          m.Value,
+		}
+	}
+	cw := &countingWriter{w: w}
+	err := writeRecordBatch(cw, rb, level)
+	return int(cw.n), err
+}
+
+func writeMessages(w io.Writer, messages []*Message, compression Compression, level CompressionLevel, version MessageVersion, now time.Time) (int, error) {
 	if len(messages) == 0 {
 		return 0, nil
 	}
@@ -258,11 +641,24 @@ func writeMessageSet(w io.Writer, messages []*Message, compression Compression)
 	// Java client sets the offset of the synthesized message set for a group of
 	// compressed messages to be the offset of the last message in the set.
 	compressOffset := messages[len(messages)-1].Offset
+	// the wrapper message of MessageV1 carries the maximum timestamp of
+	// the compressed messages
+	var compressTimestamp int64 = NoTimestamp
+	if version == MessageV1 && compression != CompressionNone {
+		for _, m := range messages {
+			if ts := messageTimestamp(m, now); ts > compressTimestamp {
+				compressTimestamp = ts
+			}
+		}
+	}
 	switch compression {
 	case CompressionGzip:
 		var buf bytes.Buffer
-		gz := gzip.NewWriter(&buf)
-		if _, err := writeMessageSet(gz, messages, CompressionNone); err != nil {
+		gz, err := gzip.NewWriterLevel(&buf, level.gzipLevel())
+		if err != nil {
+			return 0, err
+		}
+		if _, err := writeMessages(gz, messages, CompressionNone, level, version, now); err != nil {
 			return 0, err
 		}
 		if err := gz.Close(); err != nil {
@@ -270,21 +666,41 @@ func writeMessageSet(w io.Writer, messages []*Message, compression Compression)
 		}
 		messages = []*Message{
 			{
-				Value:  buf.Bytes(),
-				Offset: compressOffset,
+				Value:       buf.Bytes(),
+				Offset:      compressOffset,
+				TimestampMs: compressTimestamp,
 			},
 		}
 	case CompressionSnappy:
 		var buf bytes.Buffer
-		if _, err := writeMessageSet(&buf, messages, CompressionNone); err != nil {
+		if _, err := writeMessages(&buf, messages, CompressionNone, level, version, now); err != nil {
+			return 0, err
+		}
+		messages = []*Message{
+			{
+				Value:       snappy.Encode(nil, buf.Bytes()),
+				Offset:      compressOffset,
+				TimestampMs: compressTimestamp,
+			},
+		}
+	case CompressionLZ4:
+		var buf bytes.Buffer
+		if _, err := writeMessages(&buf, messages, CompressionNone, level, version, now); err != nil {
+			return 0, err
+		}
+		compressed, err := lz4Encode(buf.Bytes(), version == MessageV0)
+		if err != nil {
 			return 0, err
 		}
 		messages = []*Message{
 			{
-				Value:  snappy.Encode(nil, buf.Bytes()),
-				Offset: compressOffset,
+				Value:       compressed,
+				Offset:      compressOffset,
+				TimestampMs: compressTimestamp,
 			},
 		}
+	case CompressionZstd:
+		return 0, ErrZstdMessageSet
 	}
 
 	totalSize := 0
@@ -294,20 +710,32 @@ func writeMessageSet(w io.Writer, messages []*Message, compression Compression)
 	}
 
 	for _, message := range messages {
-		bsize := 26 + len(message.Key) + len(message.Value)
-		if err := b.Reset(bsize); err != nil {
+		bsize := message.encodedSize(version)
+		if int64(bsize-12) > maxEncodedLen {
+			return totalSize, ErrMessageSizeTooLarge
+		}
+		// the value is not copied into the buffer, but checksummed and
+		// written directly, so that large values are not read more than
+		// necessary
+		if err := b.Reset(bsize - len(message.Value)); err != nil {
 			return 0, err
 		}
 
 		enc := NewEncoder(b)
 		enc.EncodeInt64(message.Offset)
-		msize := int32(14 + len(message.Key) + len(message.Value))
-		enc.EncodeInt32(msize)
+		enc.EncodeInt32(int32(bsize - 12))
 		enc.EncodeUint32(0) // crc32 placeholder
-		enc.EncodeInt8(0)   // magic byte
+		enc.EncodeInt8(int8(version))
 		enc.EncodeInt8(int8(compression))
+		if version == MessageV1 {
+			enc.EncodeInt64(messageTimestamp(message, now))
+		}
 		enc.EncodeBytes(message.Key)
-		enc.EncodeBytes(message.Value)
+		if message.Value == nil {
+			enc.EncodeInt32(-1)
+		} else {
+			enc.EncodeInt32(int32(len(message.Value)))
+		}
 
 		if err := enc.Err(); err != nil {
 			return totalSize, err
@@ -315,14 +743,21 @@ func writeMessageSet(w io.Writer, messages []*Message, compression Compression)
 
 		const hsize = 8 + 4 + 4 // offset + message size + crc32
 		const crcoff = 8 + 4    // offset + message size
-		binary.BigEndian.PutUint32(b.buf[crcoff:crcoff+4], crc32.ChecksumIEEE(b.buf[hsize:bsize]))
+		head := b.Slice()
+		crc := crc32.Update(0, crcTable(version), head[hsize:])
+		crc = crc32.Update(crc, crcTable(version), message.Value)
+		binary.BigEndian.PutUint32(head[crcoff:crcoff+4], crc)
 
-		if n, err := w.Write(b.Slice()); err != nil {
+		n, err := w.Write(head)
+		totalSize += n
+		if err != nil {
+			return totalSize, err
+		}
+		n, err = w.Write(message.Value)
+		totalSize += n
+		if err != nil {
 			return totalSize, err
-		} else {
-			totalSize += n
 		}
-
 	}
 	return totalSize, nil
 }
@@ -372,15 +807,15 @@ func (w *slicewriter) Slice() []byte {
 	return w.buf[:w.pos]
 }
 
-// readRecordBatch reasd and return record batch from the stream
-// RecordBatch replace MessageSet for kafka >= 0.11
-
-// Because kafka is sending message set directly from the drive, it might cut
-// off part of the last message. This also means that the last message can be
-// shorter than the header is saying. In such case just ignore the last
-// malformed message from the set and returned earlier data.
-func readRecordBatch(r io.Reader) (*RecordBatch, error) {
+// readRecordBatch reads the record batch, which replaced MessageSet for kafka
+// >= 0.11, from the stream. If skip is not nil, it is called with the batch
+// header and if it returns true, records of the batch are read over without
+// being decoded and the batch is marked as Skipped. Because kafka is sending
+// the data directly from the drive, it might cut off part of the last batch,
+// in which case an end of stream error is returned.
+func readRecordBatch(r io.Reader, skip func(header *RecordBatch) bool, arena *Arena, stats *FetchStats) (*RecordBatch, error) {
 	dec := NewDecoder(r)
+	dec.arena = arena
 
 	rb := &RecordBatch{}
 	rb.FirstOffset = dec.DecodeInt64()
@@ -394,7 +829,7 @@ func readRecordBatch(r io.Reader) (*RecordBatch, error) {
 
 	rb.CRC = dec.DecodeInt32()
 
-	crc := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	crc := crc32.New(crcTable(MessageV2))
 	r = io.TeeReader(r, crc)
 	dec.SetReader(r)
 
@@ -412,33 +847,69 @@ func readRecordBatch(r io.Reader) (*RecordBatch, error) {
 		return nil, err
 	}
 
-	switch rb.Compression() {
-	case CompressionNone:
-		break
-	case CompressionGzip:
-		r, err = gzip.NewReader(r)
+	// records are limited to the batch, so that compressed data is never read
+	// past its end
+	const recordsOffset = 4 + 1 + 4 + 2 + 4 + 8 + 8 + 8 + 2 + 4 + 4 // from PartitionLeaderEpoch to records count
+	recordsSize := int64(rb.Length) - recordsOffset
+	if recordsSize < 0 {
+		return nil, fmt.Errorf("invalid record batch length %d", rb.Length)
+	}
+	records := io.LimitReader(r, recordsSize)
+
+	if skip != nil && skip(rb) {
+		// records are still read, so that the checksum can be verified
+		n, err := io.Copy(ioutil.Discard, records)
 		if err != nil {
 			return nil, err
 		}
-		allUnzipped, err := ioutil.ReadAll(r)
-		if err != nil {
-			return nil, err
+		if n < recordsSize {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if uint32(rb.CRC) != crc.Sum32() {
+			stats.countCrcFailure()
+			return nil, fmt.Errorf("Wrong CRC32")
 		}
-		r = bytes.NewReader(allUnzipped)
-		dec.SetReader(r)
+		rb.Skipped = true
+		return rb, nil
+	}
 
-	case CompressionSnappy:
-		var err error
-		val, err := ioutil.ReadAll(r)
+	// unlike with MessageSet, compression applies to the records of the
+	// whole batch at once
+	switch compression := rb.Compression(); compression {
+	case CompressionNone:
+		dec.SetReader(records)
+	case CompressionGzip, CompressionSnappy, CompressionLZ4, CompressionZstd:
+		raw, err := ioutil.ReadAll(records)
 		if err != nil {
 			return nil, err
 		}
-		decoded, err := snappyDecode(val)
-		if err != nil {
-			return nil, err
+		if int64(len(raw)) < recordsSize {
+			return nil, io.ErrUnexpectedEOF
+		}
+		var decoded []byte
+		switch compression {
+		case CompressionGzip:
+			gz, err := gzip.NewReader(bytes.NewReader(raw))
+			if err != nil {
+				return nil, err
+			}
+			if decoded, err = ioutil.ReadAll(gz); err != nil {
+				return nil, err
+			}
+		case CompressionSnappy:
+			if decoded, err = snappyDecode(raw); err != nil {
+				return nil, err
+			}
+		case CompressionLZ4:
+			if decoded, err = lz4Decode(raw, false); err != nil {
+				return nil, err
+			}
+		case CompressionZstd:
+			if decoded, err = zstdDecode(raw); err != nil {
+				return nil, err
+			}
 		}
-		r = bytes.NewReader(decoded)
-		dec.SetReader(r)
+		dec.SetReader(bytes.NewReader(decoded))
 	default:
 		return nil, errors.New("Unknown compression")
 	}
@@ -456,12 +927,110 @@ func readRecordBatch(r io.Reader) (*RecordBatch, error) {
 		}
 		rb.Records = append(rb.Records, rec)
 	}
+	// whatever was not read as a record is still covered by the checksum
+	if _, err := io.Copy(ioutil.Discard, records); err != nil {
+		return nil, err
+	}
 	if uint32(rb.CRC) != crc.Sum32() {
+		stats.countCrcFailure()
 		return nil, fmt.Errorf("Wrong CRC32")
 	}
 	return rb, nil
 }
 
+// ErrSkippedRecordBatch is returned when writing a record batch whose records
+// were not decoded, because it was skipped when fetching.
+var ErrSkippedRecordBatch = errors.New("cannot write skipped record batch")
+
+// writeRecordBatch writes the record batch. Batch length, checksum and
+// lengths of the records are computed, so that they do not have to be set,
+// and records are compressed with the codec set in the batch attributes, at
+// given level.
+func writeRecordBatch(w io.Writer, rb *RecordBatch, level CompressionLevel) error {
+	if rb.Skipped {
+		return ErrSkippedRecordBatch
+	}
+	var records, rec bytes.Buffer
+	renc := NewEncoder(&records)
+	for _, r := range rb.Records {
+		rec.Reset()
+		enc := NewEncoder(&rec)
+		enc.EncodeInt8(r.Attributes)
+		enc.EncodeVarInt(r.TimestampDelta)
+		enc.EncodeVarInt(r.OffsetDelta)
+		enc.EncodeVarBytes(r.Key)
+		enc.EncodeVarBytes(r.Value)
+		enc.EncodeVarInt(int64(len(r.Headers)))
+		for _, h := range r.Headers {
+			enc.EncodeVarString(h.Key)
+			enc.EncodeVarBytes(h.Value)
+		}
+		if err := enc.Err(); err != nil {
+			return err
+		}
+		renc.EncodeVarInt(int64(rec.Len()))
+		records.Write(rec.Bytes())
+	}
+	if err := renc.Err(); err != nil {
+		return err
+	}
+
+	data := records.Bytes()
+	switch compression := rb.Compression(); compression {
+	case CompressionNone:
+	case CompressionGzip:
+		var buf bytes.Buffer
+		gz, err := gzip.NewWriterLevel(&buf, level.gzipLevel())
+		if err != nil {
+			return err
+		}
+		if _, err := gz.Write(data); err != nil {
+			return err
+		}
+		if err := gz.Close(); err != nil {
+			return err
+		}
+		data = buf.Bytes()
+	case CompressionSnappy:
+		data = snappy.Encode(nil, data)
+	case CompressionLZ4:
+		var err error
+		if data, err = lz4Encode(data, false); err != nil {
+			return err
+		}
+	case CompressionZstd:
+		data = zstdEncode(data, level)
+	default:
+		return errors.New("Unknown compression")
+	}
+
+	// the checksum covers everything from the attributes to the end
+	var body bytes.Buffer
+	enc := NewEncoder(&body)
+	enc.EncodeInt16(rb.Attributes)
+	enc.EncodeInt32(rb.LastOffsetDelta)
+	enc.EncodeInt64(rb.FirstTimestamp)
+	enc.EncodeInt64(rb.MaxTimestamp)
+	enc.EncodeInt64(rb.ProducerId)
+	enc.EncodeInt16(rb.ProducerEpoch)
+	enc.EncodeInt32(rb.FirstSequence)
+	enc.EncodeArrayLen(len(rb.Records))
+	body.Write(data)
+
+	enc = NewEncoder(w)
+	enc.EncodeInt64(rb.FirstOffset)
+	// partition leader epoch, magic byte and checksum precede the body
+	enc.EncodeInt32(int32(4 + 1 + 4 + body.Len()))
+	enc.EncodeInt32(rb.PartitionLeaderEpoch)
+	enc.EncodeInt8(int8(MessageV2))
+	enc.EncodeUint32(messageChecksum(MessageV2, body.Bytes()))
+	if enc.Err() != nil {
+		return enc.Err()
+	}
+	_, err := w.Write(body.Bytes())
+	return err
+}
+
 func readRecord(dec *decoder) (*Record, error) {
 	rec := &Record{}
 	rec.Length = dec.DecodeVarInt()
@@ -482,143 +1051,407 @@ func readRecord(dec *decoder) (*Record, error) {
 	return rec, dec.Err()
 }
 
+// ErrNonMonotonicOffsets is returned when decoded message set contains
+// offsets that are not strictly increasing and ParserConfig.ValidateOffsets
+// is enabled.
+var ErrNonMonotonicOffsets = errors.New("message set offsets are not strictly increasing")
+
 // readMessageSet reads and return messages from the stream.
 // The size is known before a message set is decoded.
 // Because kafka is sending message set directly from the drive, it might cut
 // off part of the last message. This also means that the last message can be
 // shorter than the header is saying. In such case just ignore the last
 // malformed message from the set and returned earlier data.
-func readMessageSet(r io.Reader, size int32) ([]*Message, error) {
+//
+// Exactly size bytes are always consumed from the stream, even if the last
+// message was ignored, so that the reader is positioned right after the
+// message set. The number of bytes that were skipped because they did not
+// form a complete message is returned together with the messages.
+func readMessageSet(r io.Reader, size int32) ([]*Message, int, error) {
+	return readMessageSetInto(r, size, nil, nil, nil, nil)
+}
+
+// readMessageSetInto works as readMessageSet, but appends the messages to given
+// set, reusing structs left in its capacity. If stop is not nil, it is called
+// before every message and reading ends as soon as it returns true. The rest
+// of the set is left unread in such case.
+func readMessageSetInto(r io.Reader, size int32, set []*Message, stop func() bool, arena *Arena, stats *FetchStats) ([]*Message, int, error) {
 	if size < 0 || size > maxParseBufSize {
-		return nil, messageSizeError(int(size))
+		return nil, 0, messageSizeError(int(size))
 	}
 
 	if conf.SimplifiedMessageSetParsing {
 		msgbuf, err := allocParseBuf(int(size))
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 
 		if _, err := io.ReadFull(r, msgbuf); err != nil {
+			return nil, 0, err
+		}
+		return make([]*Message, 0, 0), 0, nil
+	}
+
+	lr := &io.LimitedReader{R: r, N: int64(size)}
+	set, parsed, err := readMessages(lr, int(size), set, stop, arena, stats)
+	if err != nil {
+		return nil, 0, err
+	}
+	if conf.ValidateOffsets {
+		for i := 1; i < len(set); i++ {
+			if set[i].Offset <= set[i-1].Offset {
+				return nil, 0, ErrNonMonotonicOffsets
+			}
+		}
+	}
+	// skip whatever is left of the cut off or ignored messages, unless
+	// the caller wants to read the rest on its own
+	if stop == nil || !stop() {
+		if _, err := io.Copy(ioutil.Discard, lr); err != nil {
+			return nil, 0, err
+		}
+	}
+	return set, int(int64(size)-lr.N) - parsed, nil
+}
+
+// ReadLogSegment reads messages from the stream of concatenated message sets
+// and record batches, as stored in log segment files, until the stream ends.
+// Both formats can be mixed in a single stream. Records of record batches are
+// returned as messages with absolute offsets and timestamps. Incomplete
+// message or record batch at the end of the stream is ignored, as is the
+// rest of a message set following a malformed message.
+func ReadLogSegment(r io.Reader) ([]*Message, error) {
+	br := bufio.NewReader(r)
+	messages := make([]*Message, 0)
+	for {
+		// offset, size or length, and crc or partition leader epoch
+		// precede the magic byte
+		b, err := br.Peek(17)
+		if err == io.EOF {
+			return messages, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if MessageVersion(int8(b[16])) < MessageV2 {
+			messages, _, err = readMessageSetInto(br, maxParseBufSize, messages, func() bool {
+				b, err := br.Peek(17)
+				return err == nil && MessageVersion(int8(b[16])) >= MessageV2
+			}, nil, nil)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		batch, err := readRecordBatch(br, nil, nil, nil)
+		if err == ErrNotEnoughData || err == io.EOF || err == io.ErrUnexpectedEOF {
+			return messages, nil
+		}
+		if err != nil {
 			return nil, err
 		}
-		return make([]*Message, 0, 0), nil
+		for _, rec := range batch.Records {
+			messages = append(messages, &Message{
+				Key:            rec.Key,
+				Value:          rec.Value,
+				Offset:         batch.FirstOffset + rec.OffsetDelta,
+				TimestampMs:    batch.FirstTimestamp + rec.TimestampDelta,
+				MessageVersion: MessageV2,
+			})
+		}
+	}
+}
+
+// nextMessage returns the struct for the message to be appended to the set.
+// Struct left in the set capacity by previous decoding is reused.
+func nextMessage(set []*Message) *Message {
+	if len(set) < cap(set) {
+		if m := set[:len(set)+1][len(set)]; m != nil {
+			return m
+		}
 	}
+	return &Message{}
+}
 
+// readMessages reads messages from the stream until it's exhausted or
+// a malformed message is found. The setSize is the expected size of the whole
+// set and it's only used to estimate how many messages it contains.
+// Together with the messages, the number of bytes taken by them is returned.
+// Messages are appended to given set, reusing structs left in its capacity.
+// Reading ends early when stop is not nil and returns true.
+func readMessages(r io.Reader, setSize int, set []*Message, stop func() bool, arena *Arena, stats *FetchStats) ([]*Message, int, error) {
 	dec := NewDecoder(r)
-	set := make([]*Message, 0, 256)
+	if set == nil {
+		set = make([]*Message, 0)
+	}
+	parsed := 0
+
+	// single decoder is reused for all messages of the set
+	msgr := bytes.NewReader(nil)
+	msgdec := NewDecoder(msgr)
 
 	for {
+		if stop != nil && stop() {
+			return set, parsed, nil
+		}
 		offset := dec.DecodeInt64()
 		if err := dec.Err(); err != nil {
 			if err == io.EOF || err == io.ErrUnexpectedEOF {
-				return set, nil
+				return set, parsed, nil
 			}
-			return nil, err
+			return nil, 0, err
 		}
 		// single message size
 		size := dec.DecodeInt32()
 		if err := dec.Err(); err != nil {
 			if err == io.EOF || err == io.ErrUnexpectedEOF {
-				return set, nil
+				return set, parsed, nil
 			}
-			return nil, err
+			return nil, 0, err
 		}
 
 		// Skip over empty messages
 		if size <= int32(0) {
-			return set, nil
+			return set, parsed, nil
 		}
 
-		msgbuf, err := allocParseBuf(int(size))
-		if err != nil {
-			return nil, err
+		var (
+			msgbuf       []byte
+			valueSkipped bool
+			err          error
+		)
+		if conf.SkipMessageValues && size > 6 {
+			msgbuf, valueSkipped, err = readMessageSkippingValue(r, int(size))
+		} else {
+			// key and value of uncompressed message point to the
+			// buffer, so it comes from the arena if there is one
+			msgbuf, err = allocValueBuf(arena, int(size))
+			if err == nil {
+				_, err = io.ReadFull(r, msgbuf)
+			}
 		}
-
-		if _, err := io.ReadFull(r, msgbuf); err != nil {
+		if err != nil {
 			if err == io.EOF || err == io.ErrUnexpectedEOF {
-				return set, nil
+				return set, parsed, nil
 			}
-			return nil, err
+			return nil, 0, err
+		}
+		msgr.Reset(msgbuf)
+
+		if cap(set) == 0 {
+			set = make([]*Message, 0, estimateSetLen(setSize, int(size)))
 		}
-		msgdec := NewDecoder(bytes.NewBuffer(msgbuf))
 
-		msg := &Message{
-			Offset: offset,
-			Crc:    msgdec.DecodeUint32(),
+		msg := nextMessage(set)
+		*msg = Message{
+			Offset:       offset,
+			Crc:          msgdec.DecodeUint32(),
+			valueSkipped: valueSkipped,
 		}
 
 		// MessageSet with no payload
 		if size <= int32(4) {
 			set = append(set, msg)
-			return set, nil
+			parsed += 12 + int(size)
+			return set, parsed, nil
 		}
 
-		if msg.Crc != crc32.ChecksumIEEE(msgbuf[4:]) {
-			// ignore this message and because we want to have constant
-			// history, do not process anything more
-			return set, nil
+		if !valueSkipped && msg.Crc != messageChecksum(MessageVersion(msgbuf[4]), msgbuf[4:]) {
+			stats.countCrcFailure()
+			if !conf.TolerateCrcMismatch {
+				// ignore this message and because we want to have
+				// constant history, do not process anything more
+				return set, parsed, nil
+			}
+			msg.CrcMismatch = true
 		}
 
 		// magic byte
 		messageVersion := MessageVersion(msgdec.DecodeInt8())
+		msg.MessageVersion = messageVersion
 
 		attributes := msgdec.DecodeInt8()
+		msg.Attributes = attributes
 
 		if messageVersion == MessageV1 {
-			// timestamp
-			_ = msgdec.DecodeInt64()
+			msg.TimestampMs = msgdec.DecodeInt64()
+		} else {
+			msg.TimestampMs = NoTimestamp
 		}
 
-		switch compression := Compression(attributes & 3); compression {
+		switch compression := compressionFromAttributes(attributes); compression {
 		case CompressionNone:
-			msg.Key = msgdec.DecodeBytes()
-			msg.Value = msgdec.DecodeBytes()
 			if err := msgdec.Err(); err != nil {
-				return nil, err
+				return nil, 0, err
+			}
+			// key and value are not copied, but point to the message
+			// buffer that is allocated for each message separately
+			msg.Key, msg.Value, err = sliceKeyValue(msgbuf[len(msgbuf)-msgr.Len():])
+			if err != nil {
+				return nil, 0, err
 			}
 			set = append(set, msg)
-		case CompressionGzip, CompressionSnappy:
+		case CompressionGzip, CompressionSnappy, CompressionLZ4:
 			_ = msgdec.DecodeBytes() // ignore key
 			val := msgdec.DecodeBytes()
 			if err := msgdec.Err(); err != nil {
-				return nil, err
+				return nil, 0, err
 			}
 			var decoded []byte
 			switch compression {
 			case CompressionGzip:
 				cr, err := gzip.NewReader(bytes.NewReader(val))
 				if err != nil {
-					return nil, err
+					return nil, 0, err
 				}
 				decoded, err = ioutil.ReadAll(cr)
 				if err != nil {
-					return nil, err
+					return nil, 0, err
 				}
 				_ = cr.Close()
 			case CompressionSnappy:
 				var err error
 				decoded, err = snappyDecode(val)
 				if err != nil {
-					return nil, err
+					return nil, 0, err
+				}
+			case CompressionLZ4:
+				var err error
+				decoded, err = lz4Decode(val, messageVersion == MessageV0)
+				if err != nil {
+					return nil, 0, err
 				}
 			}
-			msgs, err := readMessageSet(bytes.NewReader(decoded), int32(len(decoded)))
+			msgs, _, err := readMessageSetInto(bytes.NewReader(decoded), int32(len(decoded)), nil, nil, arena, stats)
 			if err != nil {
-				return nil, err
+				return nil, 0, err
+			}
+			// MessageV1 compressed messages use offsets relative to the
+			// first one, while the wrapper offset is the absolute offset
+			// of the last one
+			if messageVersion == MessageV1 && len(msgs) > 0 {
+				delta := offset - msgs[len(msgs)-1].Offset
+				for _, m := range msgs {
+					m.Offset += delta
+				}
+			}
+			if messageVersion == MessageV1 && attributes&logAppendTimeFlag != 0 {
+				for _, m := range msgs {
+					m.createTimestampMs = m.TimestampMs
+					m.logAppendTime = true
+					m.TimestampMs = msg.TimestampMs
+				}
+			}
+			if msg.CrcMismatch {
+				for _, m := range msgs {
+					m.CrcMismatch = true
+				}
 			}
 			set = append(set, msgs...)
+		case CompressionZstd:
+			return nil, 0, ErrZstdMessageSet
 		default:
-			return nil, err
+			return nil, 0, errors.New("Unknown compression")
 		}
+		parsed += 12 + int(size)
 	}
 }
 
-func encodeHeader(e *encoder, r Request) {
-	// message size - for now just placeholder
-	e.EncodeInt32(0)
-	e.EncodeInt16(r.Kind())
-	e.EncodeInt16(r.GetVersion())
+// readMessageSkippingValue reads the message of given size from r. If the
+// message is not compressed, its value is discarded without being read into
+// memory and the returned buffer ends with null value instead, so that it can
+// be parsed as usual. Compressed messages are read whole.
+func readMessageSkippingValue(r io.Reader, size int) (msgbuf []byte, skipped bool, err error) {
+	// crc, magic byte and attributes
+	msgbuf = make([]byte, 6, 6+8+4)
+	if _, err := io.ReadFull(r, msgbuf); err != nil {
+		return nil, false, err
+	}
+	if compressionFromAttributes(int8(msgbuf[5])) != CompressionNone {
+		msgbuf = append(msgbuf, make([]byte, size-len(msgbuf))...)
+		if _, err := io.ReadFull(r, msgbuf[6:]); err != nil {
+			return nil, false, err
+		}
+		return msgbuf, false, nil
+	}
+
+	head := 4 // key size
+	if MessageVersion(msgbuf[4]) == MessageV1 {
+		head += 8 // timestamp
+	}
+	if len(msgbuf)+head > size {
+		return nil, false, ErrNotEnoughData
+	}
+	msgbuf = msgbuf[:len(msgbuf)+head]
+	if _, err := io.ReadFull(r, msgbuf[6:]); err != nil {
+		return nil, false, err
+	}
+	if keySize := int(int32(binary.BigEndian.Uint32(msgbuf[len(msgbuf)-4:]))); keySize > 0 {
+		if len(msgbuf)+keySize > size {
+			return nil, false, ErrNotEnoughData
+		}
+		msgbuf = append(msgbuf, make([]byte, keySize)...)
+		if _, err := io.ReadFull(r, msgbuf[len(msgbuf)-keySize:]); err != nil {
+			return nil, false, err
+		}
+	}
+
+	// whatever is left is the value, including its size
+	if _, err := io.CopyN(ioutil.Discard, r, int64(size-len(msgbuf))); err != nil {
+		return nil, false, err
+	}
+	msgbuf = append(msgbuf, 0xff, 0xff, 0xff, 0xff)
+	return msgbuf, true, nil
+}
+
+// estimateSetLen returns the expected number of messages in the message set
+// of given size, based on the size of its first message.
+func estimateSetLen(setSize, msgSize int) int {
+	const maxEstimate = 1 << 16
+	n := setSize/(msgSize+12) + 1 // offset and message size are not included
+	if n > maxEstimate {
+		return maxEstimate
+	}
+	return n
+}
+
+// sliceKeyValue returns key and value of the uncompressed message, which
+// content is given starting right after the attributes (or timestamp). No
+// data is copied and returned slices are pointing to b.
+func sliceKeyValue(b []byte) (key, value []byte, err error) {
+	if key, b, err = sliceBytes(b); err != nil {
+		return nil, nil, err
+	}
+	if value, _, err = sliceBytes(b); err != nil {
+		return nil, nil, err
+	}
+	return key, value, nil
+}
+
+// sliceBytes works as decoder's DecodeBytes, but returns a slice of b instead
+// of a copy, together with the rest of the buffer.
+func sliceBytes(b []byte) (val, rest []byte, err error) {
+	if len(b) < 4 {
+		return nil, nil, ErrNotEnoughData
+	}
+	size := int32(binary.BigEndian.Uint32(b))
+	b = b[4:]
+	if size < 1 {
+		return nil, b, nil
+	}
+	if int(size) > len(b) {
+		return nil, nil, ErrNotEnoughData
+	}
+	return b[:size:size], b[size:], nil
+}
+
+func encodeHeader(e *encoder, r Request) {
+	// message size - for now just placeholder
+	e.EncodeInt32(0)
+	e.EncodeInt16(r.Kind())
+	e.EncodeInt16(r.GetVersion())
 	e.EncodeInt32(r.GetCorrelationID())
 	e.EncodeString(r.GetClientID())
 }
@@ -635,6 +1468,9 @@ func decodeHeader(dec *decoder, req Request) {
 
 type MetadataReq struct {
 	RequestHeader
+	// Topics to fetch the metadata for. Nil means all topics. Empty, non nil
+	// slice means no topics for KafkaV1 and newer, but all topics for
+	// KafkaV0, which cannot express the difference.
 	Topics                 []string
 	AllowAutoTopicCreation bool // >= KafkaV4 only
 }
@@ -645,11 +1481,13 @@ func ReadMetadataReq(r io.Reader) (*MetadataReq, error) {
 
 	decodeHeader(dec, &req)
 
-	len, err := dec.DecodeArrayLen()
+	len, err := dec.DecodeNullableArrayLen()
 	if err != nil {
 		return nil, err
 	}
-	req.Topics = make([]string, len)
+	if len >= 0 {
+		req.Topics = make([]string, len)
+	}
 
 	for i := range req.Topics {
 		req.Topics[i] = dec.DecodeString()
@@ -675,12 +1513,9 @@ func (r *MetadataReq) Bytes() ([]byte, error) {
 
 	encodeHeader(enc, r)
 
-	if len(r.Topics) == 0 {
-		if r.version >= 1 {
-			enc.EncodeArrayLen(-1)
-		} else {
-			enc.EncodeArrayLen(0)
-		}
+	if r.Topics == nil && r.version >= KafkaV1 {
+		// null array requests all topics
+		enc.EncodeArrayLen(-1)
 	} else {
 		enc.EncodeArrayLen(len(r.Topics))
 	}
@@ -708,8 +1543,7 @@ func (r *MetadataReq) WriteTo(w io.Writer) (int64, error) {
 	if err != nil {
 		return 0, err
 	}
-	n, err := w.Write(b)
-	return int64(n), err
+	return writeFull(w, b)
 }
 
 type MetadataResp struct {
@@ -726,7 +1560,9 @@ type MetadataRespBroker struct {
 	NodeID int32
 	Host   string
 	Port   int32
-	Rack   string // >= KafkaV1
+	// Rack the broker is placed in, as configured by its broker.rack
+	// setting. Empty if not configured, which is sent as null.
+	Rack string // >= KafkaV1
 }
 
 type MetadataRespTopic struct {
@@ -745,6 +1581,28 @@ type MetadataRespPartition struct {
 	OfflineReplicas []int32
 }
 
+// Controller returns the metadata of the controller broker. False is returned
+// if the response does not carry the controller, either because the version
+// is older than KafkaV1 or because the controller is not known.
+func (r *MetadataResp) Controller() (MetadataRespBroker, bool) {
+	if r.Version < KafkaV1 || r.ControllerID < 0 {
+		return MetadataRespBroker{}, false
+	}
+	return r.Broker(r.ControllerID)
+}
+
+// Broker returns the metadata of the broker with given node ID, such as
+// FetchRespPartition.PreferredReadReplica, including its rack. False is
+// returned if the response does not list the broker.
+func (r *MetadataResp) Broker(nodeID int32) (MetadataRespBroker, bool) {
+	for _, b := range r.Brokers {
+		if b.NodeID == nodeID {
+			return b, true
+		}
+	}
+	return MetadataRespBroker{}, false
+}
+
 func (r *MetadataResp) Bytes() ([]byte, error) {
 	var buf bytes.Buffer
 	enc := NewEncoder(&buf)
@@ -764,7 +1622,7 @@ func (r *MetadataResp) Bytes() ([]byte, error) {
 		enc.EncodeInt32(broker.Port)
 
 		if r.Version >= KafkaV1 {
-			enc.EncodeString(broker.Rack)
+			encodeNullableString(enc, broker.Rack)
 		}
 	}
 
@@ -917,15 +1775,238 @@ func ReadVersionedMetadataResp(r io.Reader, version int16) (*MetadataResp, error
 	return &resp, nil
 }
 
+// MergeMetadata combines metadata responses received from several brokers
+// into a single cluster view. Responses are expected in order they were
+// received, so the information from later responses takes precedence.
+// Brokers are deduplicated by node ID. Topic metadata from a later response
+// replaces the earlier one, unless the later one is an error and the earlier
+// one is not.
+func MergeMetadata(resps ...*MetadataResp) *MetadataResp {
+	var merged MetadataResp
+	brokers := make(map[int32]int)
+	topics := make(map[string]int)
+
+	for _, resp := range resps {
+		if resp == nil {
+			continue
+		}
+		merged.Version = resp.Version
+		merged.CorrelationID = resp.CorrelationID
+		merged.ThrottleTime = resp.ThrottleTime
+		if resp.ClusterID != "" {
+			merged.ClusterID = resp.ClusterID
+		}
+		if resp.Version >= KafkaV1 {
+			merged.ControllerID = resp.ControllerID
+		}
+
+		for _, b := range resp.Brokers {
+			if i, ok := brokers[b.NodeID]; ok {
+				merged.Brokers[i] = b
+				continue
+			}
+			brokers[b.NodeID] = len(merged.Brokers)
+			merged.Brokers = append(merged.Brokers, b)
+		}
+
+		for _, t := range resp.Topics {
+			if i, ok := topics[t.Name]; ok {
+				if t.Err == nil || merged.Topics[i].Err != nil {
+					merged.Topics[i] = t
+				}
+				continue
+			}
+			topics[t.Name] = len(merged.Topics)
+			merged.Topics = append(merged.Topics, t)
+		}
+	}
+	return &merged
+}
+
+// MetadataChanges describes the difference between two metadata responses,
+// as returned by DiffMetadata.
+type MetadataChanges struct {
+	LeaderChanges     []LeaderChange
+	AddedPartitions   []MetadataPartitionRef
+	RemovedPartitions []MetadataPartitionRef
+	AddedBrokers      []MetadataRespBroker
+	RemovedBrokers    []MetadataRespBroker
+}
+
+// MetadataPartitionRef identifies a partition of a topic.
+type MetadataPartitionRef struct {
+	Topic     string
+	Partition int32
+}
+
+// LeaderChange describes a partition which leader has changed. Leader is -1
+// if there is no leader available.
+type LeaderChange struct {
+	Topic     string
+	Partition int32
+	OldLeader int32
+	NewLeader int32
+}
+
+// Empty returns true if there are no changes.
+func (c *MetadataChanges) Empty() bool {
+	return len(c.LeaderChanges) == 0 &&
+		len(c.AddedPartitions) == 0 &&
+		len(c.RemovedPartitions) == 0 &&
+		len(c.AddedBrokers) == 0 &&
+		len(c.RemovedBrokers) == 0
+}
+
+// DiffMetadata compares two metadata responses of the same cluster, the
+// earlier one first, and returns partitions that changed their leader and
+// partitions and brokers that appeared or disappeared. Brokers are compared
+// by node ID. Topics with an error in either response are not compared, as
+// their partitions are not known. Nil response is treated as empty.
+func DiffMetadata(from, to *MetadataResp) MetadataChanges {
+	if from == nil {
+		from = &MetadataResp{}
+	}
+	if to == nil {
+		to = &MetadataResp{}
+	}
+	var changes MetadataChanges
+
+	fromBrokers := make(map[int32]bool, len(from.Brokers))
+	for _, b := range from.Brokers {
+		fromBrokers[b.NodeID] = true
+	}
+	toBrokers := make(map[int32]bool, len(to.Brokers))
+	for _, b := range to.Brokers {
+		toBrokers[b.NodeID] = true
+		if !fromBrokers[b.NodeID] {
+			changes.AddedBrokers = append(changes.AddedBrokers, b)
+		}
+	}
+	for _, b := range from.Brokers {
+		if !toBrokers[b.NodeID] {
+			changes.RemovedBrokers = append(changes.RemovedBrokers, b)
+		}
+	}
+
+	fromTopics := make(map[string]*MetadataRespTopic, len(from.Topics))
+	for i := range from.Topics {
+		fromTopics[from.Topics[i].Name] = &from.Topics[i]
+	}
+	toTopics := make(map[string]*MetadataRespTopic, len(to.Topics))
+	for i := range to.Topics {
+		toTopics[to.Topics[i].Name] = &to.Topics[i]
+	}
+
+	for i := range to.Topics {
+		topic := &to.Topics[i]
+		prev, ok := fromTopics[topic.Name]
+		if topic.Err != nil || (ok && prev.Err != nil) {
+			continue
+		}
+		leaders := make(map[int32]int32)
+		if ok {
+			for _, p := range prev.Partitions {
+				leaders[p.ID] = p.Leader
+			}
+		}
+		for _, p := range topic.Partitions {
+			leader, ok := leaders[p.ID]
+			if !ok {
+				changes.AddedPartitions = append(changes.AddedPartitions, MetadataPartitionRef{
+					Topic:     topic.Name,
+					Partition: p.ID,
+				})
+				continue
+			}
+			if leader != p.Leader {
+				changes.LeaderChanges = append(changes.LeaderChanges, LeaderChange{
+					Topic:     topic.Name,
+					Partition: p.ID,
+					OldLeader: leader,
+					NewLeader: p.Leader,
+				})
+			}
+		}
+	}
+
+	for i := range from.Topics {
+		topic := &from.Topics[i]
+		next, ok := toTopics[topic.Name]
+		if topic.Err != nil || (ok && next.Err != nil) {
+			continue
+		}
+		present := make(map[int32]bool)
+		if ok {
+			for _, p := range next.Partitions {
+				present[p.ID] = true
+			}
+		}
+		for _, p := range topic.Partitions {
+			if !present[p.ID] {
+				changes.RemovedPartitions = append(changes.RemovedPartitions, MetadataPartitionRef{
+					Topic:     topic.Name,
+					Partition: p.ID,
+				})
+			}
+		}
+	}
+	return changes
+}
+
+// Isolation levels of the fetch request, see FetchReq.IsolationLevel.
+const (
+	// Consumer reads all messages, including those of open and aborted
+	// transactions, up to the high watermark.
+	IsolationReadUncommitted = 0
+
+	// Consumer reads only messages of committed transactions, up to the last
+	// stable offset.
+	IsolationReadCommitted = 1
+)
+
 type FetchReq struct {
 	RequestHeader
-	ReplicaID      int32
+	// ReplicaID is the broker ID of the follower sending the request. It is
+	// only sent when Follower is set, otherwise the request is sent with
+	// replica ID -1, as a consumer fetch.
+	ReplicaID int32
+	// Follower makes the request a follower fetch of the ReplicaID broker.
+	// Set by ReadFetchReq if the request has replica ID other than -1.
+	Follower bool
+	// MaxWaitTime the broker waits for MinBytes of data to be available
+	// before responding. Zero means to return immediately. It is sent in
+	// milliseconds, and positive wait time shorter than a millisecond is
+	// rounded up, so that it is not truncated to zero.
 	MaxWaitTime    time.Duration
 	MinBytes       int32
-	MaxBytes       int32 // >= KafkaV3
-	IsolationLevel int8  // >= KafkaV4
-
-	Topics []FetchReqTopic
+	IsolationLevel int8 // >= KafkaV4, IsolationReadUncommitted or IsolationReadCommitted
+
+	// MaxBytes limits the total size of the response, unlike the partition
+	// MaxBytes limiting the data returned for a single partition. The first
+	// message of the first non empty partition is returned even if it is
+	// larger than the limit, so that the consumer can make progress.
+	//
+	// Zero means no limit, as with versions older than KafkaV3 that do not
+	// have the field, and is sent as math.MaxInt32, so that upgrading the
+	// request version never starves the fetch. Negative values are invalid.
+	MaxBytes int32 // >= KafkaV3
+
+	// SessionID and SessionEpoch of the incremental fetch session. They are
+	// only sent when Session is set, because zero epoch asks the broker to
+	// create a new session. Otherwise the request is sent with zero session
+	// ID and -1 epoch, as a full fetch without a session. ReadFetchReq sets
+	// Session unless the request has no session.
+	SessionID    int32 // >= KafkaV7
+	SessionEpoch int32 // >= KafkaV7
+	Session      bool  // >= KafkaV7
+
+	Topics          []FetchReqTopic
+	ForgottenTopics []FetchReqForgottenTopic // >= KafkaV7
+
+	// RackID of the consumer, used by the broker to select the preferred
+	// read replica of the partitions. Empty means no rack, in which case
+	// partitions are fetched from the leader.
+	RackID string // >= KafkaV11
 }
 
 type FetchReqTopic struct {
@@ -934,10 +2015,87 @@ type FetchReqTopic struct {
 }
 
 type FetchReqPartition struct {
-	ID             int32
-	FetchOffset    int64
-	LogStartOffset int64 // >= KafkaV5
-	MaxBytes       int32
+	ID int32
+	// CurrentLeaderEpoch known to the consumer is only sent when
+	// CheckLeaderEpoch is set, and the broker then rejects the fetch if the
+	// epoch does not match its own. Otherwise -1 is sent, which disables
+	// the check. ReadFetchReq sets CheckLeaderEpoch unless the epoch is -1.
+	CurrentLeaderEpoch int32 // >= KafkaV9
+	CheckLeaderEpoch   bool  // >= KafkaV9
+	FetchOffset        int64
+	LogStartOffset     int64 // >= KafkaV5
+	MaxBytes           int32
+}
+
+// FetchReqForgottenTopic lists partitions to be removed from the incremental
+// fetch session.
+type FetchReqForgottenTopic struct {
+	Name       string
+	Partitions []int32
+}
+
+// NewSinglePartitionFetch returns request fetching messages of a single
+// partition, starting from given offset. The broker responds as soon as any
+// data is available, or after 100ms. The maxBytes limits both the partition
+// data and the whole response. No fetch session is used and the leader epoch
+// is not checked.
+func NewSinglePartitionFetch(topic string, partition int32, offset int64, maxBytes int32) *FetchReq {
+	return &FetchReq{
+		MaxWaitTime: 100 * time.Millisecond,
+		MinBytes:    1,
+		MaxBytes:    maxBytes,
+		Topics: []FetchReqTopic{
+			{
+				Name: topic,
+				Partitions: []FetchReqPartition{
+					{ID: partition, FetchOffset: offset, MaxBytes: maxBytes},
+				},
+			},
+		},
+	}
+}
+
+// BuildBudgetedFetch returns request fetching given partitions, starting from
+// their offsets, within the total byte budget. The budget is split evenly
+// between the partitions, so that a single partition with a lot of data does
+// not take the whole response and starve the others, and it also limits the
+// whole response. The bytes left over by the split are given to the first
+// partitions. Partitions are grouped by topic in the order the topics first
+// appear, and partitions missing from offsets are fetched from offset 0.
+// The budget must be at least the number of partitions, otherwise the last
+// ones get zero MaxBytes and the request fails Validate. Other fields are
+// set as by NewSinglePartitionFetch.
+func BuildBudgetedFetch(partitions []TopicPartition, offsets map[string]map[int32]int64, totalBudget int32) *FetchReq {
+	req := &FetchReq{
+		MaxWaitTime: 100 * time.Millisecond,
+		MinBytes:    1,
+		MaxBytes:    totalBudget,
+	}
+	if len(partitions) == 0 {
+		return req
+	}
+
+	share := totalBudget / int32(len(partitions))
+	extra := totalBudget % int32(len(partitions))
+	topics := make(map[string]int) // index of the topic within req
+	for i, tp := range partitions {
+		maxBytes := share
+		if int32(i) < extra {
+			maxBytes++
+		}
+		ti, ok := topics[tp.Topic]
+		if !ok {
+			ti = len(req.Topics)
+			topics[tp.Topic] = ti
+			req.Topics = append(req.Topics, FetchReqTopic{Name: tp.Topic})
+		}
+		req.Topics[ti].Partitions = append(req.Topics[ti].Partitions, FetchReqPartition{
+			ID:          tp.Partition,
+			FetchOffset: offsets[tp.Topic][tp.Partition],
+			MaxBytes:    maxBytes,
+		})
+	}
+	return req
 }
 
 func ReadFetchReq(r io.Reader) (*FetchReq, error) {
@@ -947,6 +2105,7 @@ func ReadFetchReq(r io.Reader) (*FetchReq, error) {
 	decodeHeader(dec, &req)
 
 	req.ReplicaID = dec.DecodeInt32()
+	req.Follower = req.ReplicaID != -1
 	req.MaxWaitTime = dec.DecodeDuration32()
 	req.MinBytes = dec.DecodeInt32()
 
@@ -958,6 +2117,12 @@ func ReadFetchReq(r io.Reader) (*FetchReq, error) {
 		req.IsolationLevel = dec.DecodeInt8()
 	}
 
+	if req.version >= KafkaV7 {
+		req.SessionID = dec.DecodeInt32()
+		req.SessionEpoch = dec.DecodeInt32()
+		req.Session = req.SessionID != 0 || req.SessionEpoch != -1
+	}
+
 	len, err := dec.DecodeArrayLen()
 	if err != nil {
 		return nil, err
@@ -977,6 +2142,12 @@ func ReadFetchReq(r io.Reader) (*FetchReq, error) {
 		for pi := range topic.Partitions {
 			var part = &topic.Partitions[pi]
 			part.ID = dec.DecodeInt32()
+
+			if req.version >= KafkaV9 {
+				part.CurrentLeaderEpoch = dec.DecodeInt32()
+				part.CheckLeaderEpoch = part.CurrentLeaderEpoch != -1
+			}
+
 			part.FetchOffset = dec.DecodeInt64()
 
 			if req.version >= KafkaV5 {
@@ -987,42 +2158,200 @@ func ReadFetchReq(r io.Reader) (*FetchReq, error) {
 		}
 	}
 
+	if req.version >= KafkaV7 {
+		len, err = dec.DecodeArrayLen()
+		if err != nil {
+			return nil, err
+		}
+		req.ForgottenTopics = make([]FetchReqForgottenTopic, len)
+		for ti := range req.ForgottenTopics {
+			var topic = &req.ForgottenTopics[ti]
+			topic.Name = dec.DecodeString()
+			len, err = dec.DecodeArrayLen()
+			if err != nil {
+				return nil, err
+			}
+			topic.Partitions = make([]int32, len)
+			for pi := range topic.Partitions {
+				topic.Partitions[pi] = dec.DecodeInt32()
+			}
+		}
+	}
+
+	if req.version >= KafkaV11 {
+		req.RackID = dec.DecodeString()
+	}
+
 	if dec.Err() != nil {
 		return nil, dec.Err()
 	}
 	return &req, nil
 }
 
+// Errors describing invalid fetch request, reported by FetchReq.Validate.
+var (
+	ErrNoFetchPartitions        = errors.New("no partitions to fetch")
+	ErrInvalidPartitionMaxBytes = errors.New("partition max bytes must be positive")
+	ErrInvalidMinBytes          = errors.New("min bytes must not be negative")
+	ErrInvalidMaxBytes          = errors.New("max bytes must not be negative")
+	ErrInvalidMaxWaitTime       = errors.New("max wait time must be between 0 and 2147483647 milliseconds")
+)
+
+// ValidationError lists all problems found by validating a request.
+type ValidationError struct {
+	Errs []error
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Errs))
+	for i, err := range e.Errs {
+		msgs[i] = err.Error()
+	}
+	return "invalid request: " + strings.Join(msgs, "; ")
+}
+
+// Is returns true if any of the listed errors matches target, so that
+// errors.Is can be used to check for a specific problem.
+func (e *ValidationError) Is(target error) bool {
+	for _, err := range e.Errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first of the listed errors matching target, as errors.As
+// does.
+func (e *ValidationError) As(target interface{}) bool {
+	for _, err := range e.Errs {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the request for values that make the broker reject it or
+// make the fetch stall: no partitions, partitions with non positive
+// MaxBytes, negative MinBytes or MaxBytes, MaxWaitTime not fitting the wire
+// format and partitions listed more than once, reported as
+// *DuplicatePartitionError. All problems found are returned together as
+// *ValidationError.
+func (r *FetchReq) Validate() error {
+	var errs []error
+	if r.MinBytes < 0 {
+		errs = append(errs, fmt.Errorf("%w: %d", ErrInvalidMinBytes, r.MinBytes))
+	}
+	if r.MaxBytes < 0 {
+		errs = append(errs, fmt.Errorf("%w: %d", ErrInvalidMaxBytes, r.MaxBytes))
+	}
+	if r.MaxWaitTime < 0 || r.MaxWaitTime > math.MaxInt32*time.Millisecond {
+		errs = append(errs, fmt.Errorf("%w: %s", ErrInvalidMaxWaitTime, r.MaxWaitTime))
+	}
+
+	partitions := 0
+	for _, topic := range r.Topics {
+		for _, part := range topic.Partitions {
+			partitions++
+			if part.MaxBytes <= 0 {
+				errs = append(errs, fmt.Errorf("%w: %s:%d has %d", ErrInvalidPartitionMaxBytes, topic.Name, part.ID, part.MaxBytes))
+			}
+		}
+	}
+	if partitions == 0 {
+		errs = append(errs, ErrNoFetchPartitions)
+	}
+	errs = append(errs, r.duplicatePartitions()...)
+
+	if len(errs) > 0 {
+		return &ValidationError{Errs: errs}
+	}
+	return nil
+}
+
+// duplicatePartitions returns *DuplicatePartitionError for every partition
+// listed more than once, across all topics of the request.
+func (r *FetchReq) duplicatePartitions() []error {
+	var errs []error
+	seen := make(map[string]map[int32]bool)
+	for _, topic := range r.Topics {
+		if seen[topic.Name] == nil {
+			seen[topic.Name] = make(map[int32]bool)
+		}
+		for _, part := range topic.Partitions {
+			if seen[topic.Name][part.ID] {
+				errs = append(errs, &DuplicatePartitionError{Topic: topic.Name, Partition: part.ID})
+			}
+			seen[topic.Name][part.ID] = true
+		}
+	}
+	return errs
+}
+
 func (r FetchReq) Kind() int16 {
 	return FetchReqKind
 }
 
 func (r *FetchReq) Bytes() ([]byte, error) {
+	if errs := r.duplicatePartitions(); len(errs) > 0 {
+		return nil, errs[0]
+	}
+
 	var buf bytes.Buffer
 	enc := NewEncoder(&buf)
 
 	encodeHeader(enc, r)
 
-	//enc.Encode(r.ReplicaID)
-	enc.EncodeInt32(-1)
-
-	enc.EncodeDuration(r.MaxWaitTime)
+	if r.Follower {
+		enc.EncodeInt32(r.ReplicaID)
+	} else {
+		enc.EncodeInt32(-1)
+	}
+	if r.MaxWaitTime > 0 && r.MaxWaitTime < time.Millisecond {
+		enc.EncodeDuration(time.Millisecond)
+	} else {
+		enc.EncodeDuration(r.MaxWaitTime)
+	}
 	enc.EncodeInt32(r.MinBytes)
 
 	if r.version >= KafkaV3 {
-		enc.EncodeInt32(r.MaxBytes)
+		if r.MaxBytes == 0 {
+			enc.EncodeInt32(math.MaxInt32)
+		} else {
+			enc.EncodeInt32(r.MaxBytes)
+		}
 	}
 
 	if r.version >= KafkaV4 {
 		enc.EncodeInt8(r.IsolationLevel)
 	}
 
+	if r.version >= KafkaV7 {
+		if r.Session {
+			enc.EncodeInt32(r.SessionID)
+			enc.EncodeInt32(r.SessionEpoch)
+		} else {
+			enc.EncodeInt32(0)
+			enc.EncodeInt32(-1)
+		}
+	}
+
 	enc.EncodeArrayLen(len(r.Topics))
 	for _, topic := range r.Topics {
 		enc.EncodeString(topic.Name)
 		enc.EncodeArrayLen(len(topic.Partitions))
 		for _, part := range topic.Partitions {
 			enc.EncodeInt32(part.ID)
+
+			if r.version >= KafkaV9 {
+				if part.CheckLeaderEpoch {
+					enc.EncodeInt32(part.CurrentLeaderEpoch)
+				} else {
+					enc.EncodeInt32(-1)
+				}
+			}
+
 			enc.EncodeInt64(part.FetchOffset)
 
 			if r.version >= KafkaV5 {
@@ -1033,6 +2362,18 @@ func (r *FetchReq) Bytes() ([]byte, error) {
 		}
 	}
 
+	if r.version >= KafkaV7 {
+		enc.EncodeArrayLen(len(r.ForgottenTopics))
+		for _, topic := range r.ForgottenTopics {
+			enc.EncodeString(topic.Name)
+			enc.EncodeInt32s(topic.Partitions)
+		}
+	}
+
+	if r.version >= KafkaV11 {
+		enc.EncodeString(r.RackID)
+	}
+
 	if enc.Err() != nil {
 		return nil, enc.Err()
 	}
@@ -1044,20 +2385,79 @@ func (r *FetchReq) Bytes() ([]byte, error) {
 	return b, nil
 }
 
+// EncodedSize returns the number of bytes the request takes on the wire,
+// including the size prefix, without encoding it.
+func (r *FetchReq) EncodedSize() int {
+	// size, api key, version, correlation id, client id
+	size := 4 + 2 + 2 + 4 + 2 + len(r.ClientID)
+	// replica id, max wait time, min bytes
+	size += 4 + 4 + 4
+	if r.version >= KafkaV3 {
+		size += 4 // max bytes
+	}
+	if r.version >= KafkaV4 {
+		size++ // isolation level
+	}
+	if r.version >= KafkaV7 {
+		size += 4 + 4 // session id, session epoch
+	}
+
+	partSize := 4 + 8 + 4 // id, fetch offset, max bytes
+	if r.version >= KafkaV5 {
+		partSize += 8 // log start offset
+	}
+	if r.version >= KafkaV9 {
+		partSize += 4 // current leader epoch
+	}
+
+	size += 4 // topics array length
+	for _, topic := range r.Topics {
+		size += 2 + len(topic.Name) + 4 + len(topic.Partitions)*partSize
+	}
+	if r.version >= KafkaV7 {
+		size += 4 // forgotten topics array length
+		for _, topic := range r.ForgottenTopics {
+			size += 2 + len(topic.Name) + 4 + len(topic.Partitions)*4
+		}
+	}
+	if r.version >= KafkaV11 {
+		size += 2 + len(r.RackID)
+	}
+	return size
+}
+
 func (r *FetchReq) WriteTo(w io.Writer) (int64, error) {
 	b, err := r.Bytes()
 	if err != nil {
 		return 0, err
 	}
-	n, err := w.Write(b)
-	return int64(n), err
+	return writeFull(w, b)
 }
 
 type FetchResp struct {
 	Version       int16
 	CorrelationID int32
 	ThrottleTime  time.Duration
+	Err           error // >= KafkaV7, fetch session error
+	SessionID     int32 // >= KafkaV7
 	Topics        []FetchRespTopic
+
+	// Truncated is set by fetch response readers if decoding stopped before
+	// the end of the response, because ParserConfig.MaxMessages was reached.
+	// It is never encoded.
+	Truncated bool
+
+	// Arena, if set on the response passed to ReadFetchRespInto, is used to
+	// allocate keys and values of decoded messages and records, instead of
+	// allocating each of them separately. It is kept by the decoding.
+	// Decoded data aliases the arena and is only valid until it is reset,
+	// see Arena for details. It is never encoded.
+	Arena *Arena
+
+	// Stats, if set on the response passed to ReadFetchRespInto,
+	// accumulates counters of the decoded data, see FetchStats. It is kept
+	// by the decoding and never encoded.
+	Stats *FetchStats
 }
 
 type FetchRespTopic struct {
@@ -1083,9 +2483,26 @@ type FetchRespPartition struct {
 	LastStableOffset    int64
 	LogStartOffset      int64
 	AbortedTransactions []FetchRespAbortedTransaction
-	Messages            []*Message
-	MessageVersion      MessageVersion
-	RecordBatches       []*RecordBatch
+
+	// PreferredReadReplica is the broker the partition should be fetched
+	// from instead of the leader, selected by the rack of the consumer. -1
+	// means the leader. Only set with KafkaV11 and newer.
+	PreferredReadReplica int32
+
+	Messages      []*Message
+	RecordBatches []*RecordBatch
+
+	// MessageVersion is the format of the first entry of the partition
+	// data. Messages may be followed by record batches when the topic's
+	// message format was upgraded, in which case both are set.
+	MessageVersion MessageVersion
+
+	// TruncatedBytes is the number of bytes at the end of the partition data
+	// that did not form a complete message or record batch and were skipped.
+	// The broker cuts off the data at MaxBytes, so if it is not zero for
+	// every fetch, MaxBytes is most likely too small for the messages.
+	// It is not part of the protocol and is not serialized.
+	TruncatedBytes int
 }
 
 type FetchRespAbortedTransaction struct {
@@ -1096,7 +2513,7 @@ type FetchRespAbortedTransaction struct {
 type RecordBatch struct {
 	FirstOffset          int64
 	Length               int32
-	PartitionLeaderEpoch int32
+	PartitionLeaderEpoch int32 // epoch of the leader that appended the batch, not covered by CRC
 	Magic                int8
 	CRC                  int32
 	Attributes           int16
@@ -1107,6 +2524,11 @@ type RecordBatch struct {
 	ProducerEpoch        int16
 	FirstSequence        int32
 	Records              []*Record
+
+	// Skipped is set when fetching if records of the batch were not decoded,
+	// because ParserConfig.SkipRecordBatch returned true. Skipped batch
+	// cannot be written.
+	Skipped bool
 }
 
 type Record struct {
@@ -1124,217 +2546,2559 @@ type RecordHeader struct {
 	Value []byte
 }
 
-func (rb *RecordBatch) Compression() Compression {
-	return Compression(rb.Attributes & 3)
-}
-
-func (r *FetchResp) Bytes() ([]byte, error) {
-	var buf buffer
-	enc := NewEncoder(&buf)
-
-	enc.EncodeInt32(0) // placeholder
-	enc.EncodeInt32(r.CorrelationID)
-
-	if r.Version >= KafkaV1 {
-		enc.EncodeDuration(r.ThrottleTime)
-	}
-
-	enc.EncodeArrayLen(len(r.Topics))
-	for _, topic := range r.Topics {
-		enc.EncodeString(topic.Name)
-		enc.EncodeArrayLen(len(topic.Partitions))
+// fetchLimitReached returns true if decoded number of messages reached the
+// limit set by ParserConfig.MaxMessages.
+func fetchLimitReached(decoded int) bool {
+	return conf.MaxMessages > 0 && decoded >= conf.MaxMessages
+}
+
+// DropBefore removes messages and records with offsets lower than the fetch
+// offset of their partition in req, the request the response was fetched
+// with. Fetching from the middle of a compressed legacy (MessageV0 and
+// MessageV1) message set, or of a record batch, returns it whole, so that
+// already consumed messages would be returned again. Partitions are matched
+// by topic name and ID, and partitions missing from the request are left
+// whole. Structs of the dropped messages can still be reused by
+// ReadFetchRespInto.
+func (r *FetchResp) DropBefore(req *FetchReq) {
+	offsets := make(map[string]map[int32]int64, len(req.Topics))
+	for _, topic := range req.Topics {
+		if offsets[topic.Name] == nil {
+			offsets[topic.Name] = make(map[int32]int64, len(topic.Partitions))
+		}
 		for _, part := range topic.Partitions {
-			enc.EncodeInt32(part.ID)
-			enc.EncodeError(part.Err)
-			enc.EncodeInt64(part.TipOffset)
-
-			if r.Version >= KafkaV4 {
-				enc.EncodeInt64(part.LastStableOffset)
-
-				if r.Version >= KafkaV5 {
-					enc.EncodeInt64(part.LogStartOffset)
-				}
+			offsets[topic.Name][part.ID] = part.FetchOffset
+		}
+	}
 
-				enc.EncodeArrayLen(len(part.AbortedTransactions))
-				for _, trans := range part.AbortedTransactions {
-					enc.EncodeInt64(trans.ProducerID)
-					enc.EncodeInt64(trans.FirstOffset)
-				}
+	for ti := range r.Topics {
+		topic := &r.Topics[ti]
+		for pi := range topic.Partitions {
+			part := &topic.Partitions[pi]
+			offset, ok := offsets[topic.Name][part.ID]
+			if !ok {
+				continue
 			}
-
-			i := len(buf)
-			enc.EncodeInt32(0) // placeholder
-			// NOTE(caleb): writing compressed fetch response isn't implemented
-			// for now, since that's not needed for clients.
-			n, err := writeMessageSet(&buf, part.Messages, CompressionNone)
-			if err != nil {
-				return nil, err
+			part.Messages = dropMessagesBefore(part.Messages, offset)
+			for _, rb := range part.RecordBatches {
+				i := 0
+				for i < len(rb.Records) && rb.FirstOffset+rb.Records[i].OffsetDelta < offset {
+					i++
+				}
+				rb.Records = rb.Records[i:]
 			}
-			binary.BigEndian.PutUint32(buf[i:i+4], uint32(n))
 		}
 	}
+}
 
-	if enc.Err() != nil {
-		return nil, enc.Err()
+// dropMessagesBefore removes messages with offset lower than given one from
+// the set. Removed structs are moved past the end of the set instead of being
+// overwritten, so that they can still be reused.
+func dropMessagesBefore(set []*Message, offset int64) []*Message {
+	n := 0
+	for i := 0; i < len(set); i++ {
+		if set[i].Offset >= offset {
+			set[n], set[i] = set[i], set[n]
+			n++
+		}
+	}
+	return set[:n]
+}
+
+// lastOffset returns offset of the last message or record batch of the
+// partition, or -1 if it contains none.
+func (p *FetchRespPartition) lastOffset() int64 {
+	var last int64 = -1
+	if n := len(p.Messages); n > 0 {
+		last = p.Messages[n-1].Offset
+	}
+	if n := len(p.RecordBatches); n > 0 {
+		rb := p.RecordBatches[n-1]
+		if o := rb.FirstOffset + int64(rb.LastOffsetDelta); o > last {
+			last = o
+		}
+	}
+	return last
+}
+
+// TrackOffsets records the highest offset of a message (or record batch) of
+// every partition of the response in offsets, and returns the map. Offsets
+// already in the map are only ever increased, so the same map can be used
+// across many responses. A nil map is allocated. Partitions that returned no
+// data are not recorded.
+func (r *FetchResp) TrackOffsets(offsets map[string]map[int32]int64) map[string]map[int32]int64 {
+	if offsets == nil {
+		offsets = make(map[string]map[int32]int64)
+	}
+	for _, topic := range r.Topics {
+		for pi := range topic.Partitions {
+			part := &topic.Partitions[pi]
+			last := part.lastOffset()
+			if last < 0 {
+				continue
+			}
+			parts, ok := offsets[topic.Name]
+			if !ok {
+				parts = make(map[int32]int64)
+				offsets[topic.Name] = parts
+			}
+			if offset, ok := parts[part.ID]; !ok || last > offset {
+				parts[part.ID] = last
+			}
+		}
+	}
+	return offsets
+}
+
+// messageCount returns the number of messages, or records of all record
+// batches, of the partition.
+func (p *FetchRespPartition) messageCount() int {
+	n := len(p.Messages)
+	for _, rb := range p.RecordBatches {
+		n += len(rb.Records)
+	}
+	return n
+}
+
+func (rb *RecordBatch) Compression() Compression {
+	return compressionFromBatchAttributes(rb.Attributes)
+}
+
+const (
+	batchTransactionalFlag int16 = 0x10
+	batchControlFlag       int16 = 0x20
+)
+
+// IsTransactional returns true if the batch was produced as part of a
+// transaction.
+func (rb *RecordBatch) IsTransactional() bool {
+	return rb.Attributes&batchTransactionalFlag != 0
+}
+
+// IsControl returns true if the batch holds a control record, like
+// transaction marker, instead of user data.
+func (rb *RecordBatch) IsControl() bool {
+	return rb.Attributes&batchControlFlag != 0
+}
+
+// Bytes returns the binary representation of the batch, as it is sent within
+// message set of produce request or fetch response. Batch length, checksum and
+// record lengths are computed and do not have to be set.
+func (rb *RecordBatch) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeRecordBatch(&buf, rb, CompressionLevelDefault); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ControlRecordType is the type of the marker written by a control batch.
+type ControlRecordType int16
+
+const (
+	ControlRecordAbort  ControlRecordType = 0
+	ControlRecordCommit ControlRecordType = 1
+)
+
+// NewControlBatch returns transactional control batch holding a single
+// marker record, that ends the transaction of given producer by committing or
+// aborting it. The key of the record holds the marker version and type and the
+// value the marker version and the epoch of the transaction coordinator.
+func NewControlBatch(marker ControlRecordType, producerID int64, producerEpoch int16, coordinatorEpoch int32, timestamp time.Time) *RecordBatch {
+	key := make([]byte, 4)
+	binary.BigEndian.PutUint16(key[0:], 0) // version
+	binary.BigEndian.PutUint16(key[2:], uint16(marker))
+
+	value := make([]byte, 6)
+	binary.BigEndian.PutUint16(value[0:], 0) // version
+	binary.BigEndian.PutUint32(value[2:], uint32(coordinatorEpoch))
+
+	ts := timestamp.UnixNano() / int64(time.Millisecond)
+	return &RecordBatch{
+		Magic:          int8(MessageV2),
+		Attributes:     batchTransactionalFlag | batchControlFlag,
+		FirstTimestamp: ts,
+		MaxTimestamp:   ts,
+		ProducerId:     producerID,
+		ProducerEpoch:  producerEpoch,
+		FirstSequence:  -1,
+		Records:        []*Record{{Key: key, Value: value}},
+	}
+}
+
+// NextOffsets returns the offsets to fetch next for every partition, given
+// the offsets prev the response was fetched from. Offset of a partition is
+// advanced past the last message or record batch returned. Partitions that
+// returned an error or no data keep their previous offset.
+func (r *FetchResp) NextOffsets(prev map[string]map[int32]int64) map[string]map[int32]int64 {
+	next := make(map[string]map[int32]int64, len(prev))
+	for topic, parts := range prev {
+		next[topic] = make(map[int32]int64, len(parts))
+		for id, offset := range parts {
+			next[topic][id] = offset
+		}
+	}
+
+	for _, topic := range r.Topics {
+		for _, part := range topic.Partitions {
+			if part.Err != nil {
+				continue
+			}
+			last := part.lastOffset()
+			if last < 0 {
+				continue
+			}
+			// never move back, even if messages before the fetch offset
+			// were returned as part of compressed set
+			if offset, ok := next[topic.Name][part.ID]; ok && offset > last {
+				continue
+			}
+			if _, ok := next[topic.Name]; !ok {
+				next[topic.Name] = make(map[int32]int64)
+			}
+			next[topic.Name][part.ID] = last + 1
+		}
+	}
+	return next
+}
+
+// TotalLag returns the number of messages behind the high watermark
+// (TipOffset) summed over all partitions of the response, given the offsets
+// to be consumed next, as returned by NextOffsets. Partitions missing from
+// consumed, or that returned an error, are skipped. To count a partition
+// from the beginning of its log instead, add its LogStartOffset to consumed.
+func (r *FetchResp) TotalLag(consumed map[string]map[int32]int64) int64 {
+	var lag int64
+	for _, topic := range r.Topics {
+		for _, part := range topic.Partitions {
+			if part.Err != nil {
+				continue
+			}
+			offset, ok := consumed[topic.Name][part.ID]
+			if !ok {
+				continue
+			}
+			if part.TipOffset > offset {
+				lag += part.TipOffset - offset
+			}
+		}
+	}
+	return lag
+}
+
+// TopicPartition identifies a single partition of a topic.
+type TopicPartition struct {
+	Topic     string
+	Partition int32
+}
+
+// Missing returns the partitions requested by req that are not present in
+// the response, in request order. Broker omits partitions it is not the
+// leader of, so missing partitions usually mean the leadership moved and
+// the metadata of their topics has to be refreshed.
+func (r *FetchResp) Missing(req *FetchReq) []TopicPartition {
+	got := make(map[string]map[int32]bool, len(r.Topics))
+	for _, topic := range r.Topics {
+		if got[topic.Name] == nil {
+			got[topic.Name] = make(map[int32]bool, len(topic.Partitions))
+		}
+		for _, part := range topic.Partitions {
+			got[topic.Name][part.ID] = true
+		}
+	}
+
+	var missing []TopicPartition
+	for _, topic := range req.Topics {
+		for _, part := range topic.Partitions {
+			if !got[topic.Name][part.ID] {
+				missing = append(missing, TopicPartition{Topic: topic.Name, Partition: part.ID})
+			}
+		}
+	}
+	return missing
+}
+
+func (r *FetchResp) Bytes() ([]byte, error) {
+	var buf buffer
+	enc := NewEncoder(&buf)
+
+	enc.EncodeInt32(0) // placeholder
+	enc.EncodeInt32(r.CorrelationID)
+
+	if r.Version >= KafkaV1 {
+		enc.EncodeDuration(r.ThrottleTime)
+	}
+
+	if r.Version >= KafkaV7 {
+		enc.EncodeError(r.Err)
+		enc.EncodeInt32(r.SessionID)
+	}
+
+	enc.EncodeArrayLen(len(r.Topics))
+	for _, topic := range r.Topics {
+		enc.EncodeString(topic.Name)
+		enc.EncodeArrayLen(len(topic.Partitions))
+		for _, part := range topic.Partitions {
+			enc.EncodeInt32(part.ID)
+			enc.EncodeError(part.Err)
+			enc.EncodeInt64(part.TipOffset)
+
+			if r.Version >= KafkaV4 {
+				enc.EncodeInt64(part.LastStableOffset)
+
+				if r.Version >= KafkaV5 {
+					enc.EncodeInt64(part.LogStartOffset)
+				}
+
+				enc.EncodeArrayLen(len(part.AbortedTransactions))
+				for _, trans := range part.AbortedTransactions {
+					enc.EncodeInt64(trans.ProducerID)
+					enc.EncodeInt64(trans.FirstOffset)
+				}
+			}
+
+			if r.Version >= KafkaV11 {
+				enc.EncodeInt32(part.PreferredReadReplica)
+			}
+
+			i := len(buf)
+			enc.EncodeInt32(0) // placeholder
+			if len(part.Messages) > 0 {
+				// messages of compressed message sets are written
+				// uncompressed, unlike record batches that keep their
+				// compression
+				if _, err := writeMessageSetVersioned(&buf, part.Messages, CompressionNone, part.MessageVersion); err != nil {
+					return nil, err
+				}
+			}
+			for _, rb := range part.RecordBatches {
+				if err := writeRecordBatch(&buf, rb, CompressionLevelDefault); err != nil {
+					return nil, err
+				}
+			}
+			binary.BigEndian.PutUint32(buf[i:i+4], uint32(len(buf)-i-4))
+		}
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
 	}
 
 	binary.BigEndian.PutUint32(buf[:4], uint32(len(buf)-4))
 	return []byte(buf), nil
 }
 
+func (r *FetchResp) WriteTo(w io.Writer) (int64, error) {
+	b, err := r.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	return writeFull(w, b)
+}
+
 func ReadFetchResp(r io.Reader) (*FetchResp, error) {
 	return ReadVersionedFetchResp(r, KafkaV0)
 }
 
 func ReadVersionedFetchResp(r io.Reader, version int16) (*FetchResp, error) {
-	var err error
+	resp, err := readFetchResp(r, version)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// ReadFetchRespPartial works as ReadFetchResp, but in case of a decoding error
+// the part of the response that was decoded before the failure is returned
+// together with the error. Only fully decoded partitions are included.
+func ReadFetchRespPartial(r io.Reader) (*FetchResp, error) {
+	return ReadVersionedFetchRespPartial(r, KafkaV0)
+}
+
+func ReadVersionedFetchRespPartial(r io.Reader, version int16) (*FetchResp, error) {
+	return readFetchResp(r, version)
+}
+
+// readFetchResp decodes fetch response. It always returns the response, which
+// is only partially decoded if an error occurred.
+func readFetchResp(r io.Reader, version int16) (_ *FetchResp, err error) {
 	var resp FetchResp
 
 	resp.Version = version
 
-	dec := NewDecoder(r)
-
-	// total message size
-	_ = dec.DecodeInt32()
-	resp.CorrelationID = dec.DecodeInt32()
+	cr := &countingReader{r: r}
+	dec := NewDecoder(cr)
 
-	if resp.Version >= KafkaV1 {
-		resp.ThrottleTime = dec.DecodeDuration32()
-	}
+	size := readFetchRespHeader(dec, &resp)
+	defer func() { err = truncatedRespErr(err, size, resp.CorrelationID) }()
 
 	numTopics, err := dec.DecodeArrayLen()
 	if err != nil {
-		return nil, err
+		return &resp, err
 	}
 	resp.Topics = make([]FetchRespTopic, numTopics)
 
+	decoded := 0
 	for ti := range resp.Topics {
 		var topic = &resp.Topics[ti]
 		topic.Name = dec.DecodeString()
 
 		numPartitions, err := dec.DecodeArrayLen()
 		if err != nil {
-			return nil, err
+			resp.Topics = resp.Topics[:ti]
+			return &resp, err
 		}
 		topic.Partitions = make([]FetchRespPartition, numPartitions)
 
 		for pi := range topic.Partitions {
-			var part = &topic.Partitions[pi]
-			part.ID = dec.DecodeInt32()
-			part.Err = errFromNo(dec.DecodeInt16())
-			part.TipOffset = dec.DecodeInt64()
-
-			if resp.Version >= KafkaV4 {
-				part.LastStableOffset = dec.DecodeInt64()
-				if resp.Version >= KafkaV5 {
-					part.LogStartOffset = dec.DecodeInt64()
-				}
-				numAbortedTransactions, err := dec.DecodeArrayLen()
-				if err != nil {
-					return nil, err
-				}
-				part.AbortedTransactions = make([]FetchRespAbortedTransaction, numAbortedTransactions)
-				for i := range part.AbortedTransactions {
-					part.AbortedTransactions[i].ProducerID = dec.DecodeInt64()
-					part.AbortedTransactions[i].FirstOffset = dec.DecodeInt64()
-				}
-			}
-
-			if dec.Err() != nil {
-				return nil, dec.Err()
-			}
-			msgSetSize := dec.DecodeInt32()
-			if dec.Err() != nil {
-				return nil, dec.Err()
+			if fetchLimitReached(decoded) {
+				truncateFetchResp(&resp, ti, pi)
+				return &resp, discardRespErr(dec, cr, size)
 			}
-
-			br := bufio.NewReader(io.LimitReader(r, int64(msgSetSize)))
-			for {
-				// try to figure out what is next - MessageSet or RecordBatch
-				b, err := br.Peek(17)
-				if err == io.EOF {
-					break
-				}
-				if err != nil {
-					return nil, err
-				}
-				part.MessageVersion = MessageVersion(int8(b[16]))
-
-				if part.MessageVersion < MessageV2 {
-					// Response contains MessageSet
-					if part.Messages, err = readMessageSet(br, msgSetSize); err != nil {
-						return nil, err
-					}
-					for _, msg := range part.Messages {
-						msg.Topic = topic.Name
-						msg.Partition = part.ID
-						msg.TipOffset = part.TipOffset
-					}
-				} else if part.MessageVersion == MessageV2 {
-					// Response contains RecordBatch
-					batch, err := readRecordBatch(br)
-					if (err == ErrNotEnoughData || err == io.EOF || err == io.ErrUnexpectedEOF) && len(part.RecordBatches) > 0 {
-						// it was partial batch so we just ignore it
-						break
-					}
-					if err != nil {
-						return nil, err
-					}
-					part.RecordBatches = append(part.RecordBatches, batch)
-				} else {
-					return nil, errors.New("Incorrect message byte")
-				}
+			var part = &topic.Partitions[pi]
+			if err := readFetchRespPartition(dec, cr, version, topic.Name, part); err != nil {
+				resp.Topics = resp.Topics[:ti+1]
+				topic.Partitions = topic.Partitions[:pi]
+				return &resp, err
 			}
+			decoded += part.messageCount()
 		}
 	}
 
 	if dec.Err() != nil {
-		return nil, dec.Err()
+		return &resp, dec.Err()
+	}
+	return &resp, unreadRespErr(cr, size, version)
+}
+
+// truncateFetchResp marks the response as truncated, dropping partitions of
+// the topic at index ti starting with pi and all following topics. The
+// dropped partitions must still be read over with discardRespErr.
+func truncateFetchResp(resp *FetchResp, ti, pi int) {
+	resp.Truncated = true
+	if pi == 0 {
+		resp.Topics = resp.Topics[:ti]
+		return
+	}
+	resp.Topics = resp.Topics[:ti+1]
+	resp.Topics[ti].Partitions = resp.Topics[ti].Partitions[:pi]
+}
+
+// readFetchRespHeader decodes fields of the fetch response preceding the
+// topics. Their order by version is:
+//
+//	v0:      correlation id
+//	v1-v6:   correlation id, throttle time
+//	v7-v11:  correlation id, throttle time, error code, session id
+//
+// The declared size of the response is returned, or -1 if the stream ended
+// before the correlation ID was read.
+func readFetchRespHeader(dec *decoder, resp *FetchResp) int32 {
+	// total message size
+	size := dec.DecodeInt32()
+	resp.CorrelationID = dec.DecodeInt32()
+	if dec.Err() != nil {
+		return -1
 	}
-	return &resp, nil
+
+	if resp.Version >= KafkaV1 {
+		resp.ThrottleTime = dec.DecodeDuration32()
+	}
+
+	if resp.Version >= KafkaV7 {
+		resp.Err = errFromNo(dec.DecodeInt16())
+		resp.SessionID = dec.DecodeInt32()
+	}
+	return size
 }
 
-const (
-	CorrelationTypeGroup       int8 = 0
-	CorrelationTypeTransaction      = 1
-)
+// ErrVersionMismatch is returned when bytes of the response are left over
+// after it was decoded. This most likely means the response was decoded with
+// a different version than the one of the request it answers.
+var ErrVersionMismatch = errors.New("response not fully decoded, assumed api version may be wrong")
 
-type ConsumerMetadataReq struct {
-	RequestHeader
-	ConsumerGroup   string
-	CoordinatorType int8 // >= KafkaV1
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
 }
 
-func ReadConsumerMetadataReq(r io.Reader) (*ConsumerMetadataReq, error) {
-	var req ConsumerMetadataReq
-	dec := NewDecoder(r)
+func (cr *countingReader) Read(b []byte) (int, error) {
+	n, err := cr.r.Read(b)
+	cr.n += int64(n)
+	return n, err
+}
 
-	decodeHeader(dec, &req)
+// unreadRespErr reads over the bytes of the response of given declared size
+// left unread after it was decoded with given version, returning
+// ErrVersionMismatch if there were any. If the stream ends before the declared
+// size, the data of the last partition was cut short and nil is returned.
+func unreadRespErr(cr *countingReader, size int32, version int16) error {
+	n, err := discardResp(cr, size)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %d bytes left after decoding as version %d", ErrVersionMismatch, n, version)
+}
 
-	req.ConsumerGroup = dec.DecodeString()
+// discardRespErr reads over the rest of the response of given declared size,
+// which was not decoded because it was truncated, so that the stream is left
+// at the start of the next response. It returns the decoding error, if any.
+func discardRespErr(dec *decoder, cr *countingReader, size int32) error {
+	if err := dec.Err(); err != nil {
+		return err
+	}
+	_, err := discardResp(cr, size)
+	return err
+}
 
-	if req.version >= KafkaV1 {
-		req.CoordinatorType = dec.DecodeInt8()
+// discardResp reads over the bytes of the response of given declared size
+// left unread and returns their number. Reaching the end of the stream before
+// the declared size is not an error.
+func discardResp(cr *countingReader, size int32) (int64, error) {
+	left := int64(size) + 4 - cr.n
+	if left <= 0 {
+		return 0, nil
+	}
+	return io.Copy(ioutil.Discard, io.LimitReader(cr, left))
+}
+
+// truncatedRespErr replaces the end of stream error returned while decoding
+// the body of the response of given declared size with
+// *TruncatedResponseError. Size -1 means the correlation ID was not read and
+// err is returned unchanged.
+func truncatedRespErr(err error, size, correlationID int32) error {
+	if size < 0 || (err != io.EOF && err != io.ErrUnexpectedEOF) {
+		return err
+	}
+	return &TruncatedResponseError{CorrelationID: correlationID, Size: size}
+}
+
+// ReadFetchRespInto decodes fetch response into resp, reusing its topics,
+// partitions and message structs allocated by previous decoding. This reduces
+// garbage when fetching in a loop, but messages of the previous response must
+// not be used after calling it, as their structs are overwritten. Message keys
+// and values are never reused.
+func ReadFetchRespInto(r io.Reader, resp *FetchResp) error {
+	return ReadVersionedFetchRespInto(r, KafkaV0, resp)
+}
+
+func ReadVersionedFetchRespInto(r io.Reader, version int16, resp *FetchResp) (err error) {
+	topics := resp.Topics
+	*resp = FetchResp{Version: version, Arena: resp.Arena, Stats: resp.Stats}
+
+	cr := &countingReader{r: r}
+	dec := NewDecoder(cr)
+	dec.arena = resp.Arena
+	dec.stats = resp.Stats
+
+	size := readFetchRespHeader(dec, resp)
+	defer func() { err = truncatedRespErr(err, size, resp.CorrelationID) }()
+
+	numTopics, err := dec.DecodeArrayLen()
+	if err != nil {
+		return err
+	}
+	if numTopics > cap(topics) {
+		topics = append(topics[:cap(topics)], make([]FetchRespTopic, numTopics-cap(topics))...)
+	}
+	resp.Topics = topics[:numTopics]
+
+	decoded := 0
+	for ti := range resp.Topics {
+		var topic = &resp.Topics[ti]
+		topic.Name = dec.DecodeString()
+
+		numPartitions, err := dec.DecodeArrayLen()
+		if err != nil {
+			return err
+		}
+		parts := topic.Partitions
+		if numPartitions > cap(parts) {
+			parts = append(parts[:cap(parts)], make([]FetchRespPartition, numPartitions-cap(parts))...)
+		}
+		topic.Partitions = parts[:numPartitions]
+
+		for pi := range topic.Partitions {
+			if fetchLimitReached(decoded) {
+				truncateFetchResp(resp, ti, pi)
+				return discardRespErr(dec, cr, size)
+			}
+			if err := readFetchRespPartition(dec, cr, version, topic.Name, &topic.Partitions[pi]); err != nil {
+				return err
+			}
+			decoded += topic.Partitions[pi].messageCount()
+		}
 	}
 
 	if dec.Err() != nil {
-		return nil, dec.Err()
+		return dec.Err()
 	}
-	return &req, nil
+	return unreadRespErr(cr, size, version)
 }
 
-func (r ConsumerMetadataReq) Kind() int16 {
-	return ConsumerMetadataReqKind
+// ReadFetchRespFunc decodes fetch response, calling fn for every partition as
+// soon as it is decoded, instead of collecting all of them. The returned
+// response has no topics. Decoding stops at the first error returned by fn.
+func ReadFetchRespFunc(r io.Reader, fn func(topic string, part FetchRespPartition) error) (*FetchResp, error) {
+	return ReadVersionedFetchRespFunc(r, KafkaV0, fn)
+}
+
+func ReadVersionedFetchRespFunc(r io.Reader, version int16, fn func(topic string, part FetchRespPartition) error) (_ *FetchResp, err error) {
+	var resp FetchResp
+
+	resp.Version = version
+
+	cr := &countingReader{r: r}
+	dec := NewDecoder(cr)
+
+	size := readFetchRespHeader(dec, &resp)
+	defer func() { err = truncatedRespErr(err, size, resp.CorrelationID) }()
+
+	numTopics, err := dec.DecodeArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	decoded := 0
+	for ti := 0; ti < numTopics; ti++ {
+		topic := dec.DecodeString()
+
+		numPartitions, err := dec.DecodeArrayLen()
+		if err != nil {
+			return nil, err
+		}
+		for pi := 0; pi < numPartitions; pi++ {
+			if fetchLimitReached(decoded) {
+				resp.Truncated = true
+				return &resp, discardRespErr(dec, cr, size)
+			}
+			var part FetchRespPartition
+			if err := readFetchRespPartition(dec, cr, version, topic, &part); err != nil {
+				return nil, err
+			}
+			if err := fn(topic, part); err != nil {
+				return nil, err
+			}
+			decoded += part.messageCount()
+		}
+	}
+
+	if dec.Err() != nil {
+		return nil, dec.Err()
+	}
+	if err := unreadRespErr(cr, size, version); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// readFetchRespPartition decodes a single partition of the fetch response.
+// Partition header is read using the decoder, while the message set is read
+// directly from r. Message structs already referenced by the partition are
+// reused, and keys and values are allocated from the arena of the decoder, if
+// it has one. Fields of the partition header by version are:
+//
+//	v0-v3:   id, error code, high watermark
+//	v4:      id, error code, high watermark, last stable offset,
+//	         aborted transactions
+//	v5-v10:  id, error code, high watermark, last stable offset,
+//	         log start offset, aborted transactions
+//	v11:     id, error code, high watermark, last stable offset,
+//	         log start offset, aborted transactions, preferred read replica
+func readFetchRespPartition(dec *decoder, r io.Reader, version int16, topic string, part *FetchRespPartition) error {
+	start := time.Now()
+
+	// message structs left by previous decoding are reused
+	reuse := part.Messages[:0]
+	*part = FetchRespPartition{}
+
+	part.ID = dec.DecodeInt32()
+	part.Err = errFromNo(dec.DecodeInt16())
+	part.TipOffset = dec.DecodeInt64()
+
+	if version >= KafkaV4 {
+		part.LastStableOffset = dec.DecodeInt64()
+		if version >= KafkaV5 {
+			part.LogStartOffset = dec.DecodeInt64()
+		}
+		numAbortedTransactions, err := dec.DecodeArrayLen()
+		if err != nil {
+			return err
+		}
+		part.AbortedTransactions = make([]FetchRespAbortedTransaction, numAbortedTransactions)
+		for i := range part.AbortedTransactions {
+			part.AbortedTransactions[i].ProducerID = dec.DecodeInt64()
+			part.AbortedTransactions[i].FirstOffset = dec.DecodeInt64()
+		}
+	}
+
+	if version >= KafkaV11 {
+		part.PreferredReadReplica = dec.DecodeInt32()
+	}
+
+	if dec.Err() != nil {
+		return dec.Err()
+	}
+	msgSetSize := dec.DecodeInt32()
+	if dec.Err() != nil {
+		return dec.Err()
+	}
+
+	var skipBatch func(*RecordBatch) bool
+	if conf.SkipRecordBatch != nil {
+		skipBatch = func(header *RecordBatch) bool {
+			return conf.SkipRecordBatch(topic, part.ID, header)
+		}
+	}
+
+	lr := &io.LimitedReader{R: r, N: int64(msgSetSize)}
+	br := bufio.NewReader(lr)
+	parsed := 0 // bytes taken by complete messages and record batches
+	for {
+		// try to figure out what is next - MessageSet or RecordBatch
+		b, err := br.Peek(17)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		msgVersion := MessageVersion(int8(b[16]))
+		if len(part.Messages) == 0 && len(part.RecordBatches) == 0 {
+			part.MessageVersion = msgVersion
+		}
+
+		if msgVersion < MessageV2 {
+			// Response contains MessageSet. During message format upgrade
+			// it can be followed by record batches, so the set is read
+			// only up to the first of them.
+			remaining := lr.N + int64(br.Buffered())
+			if dec.stats != nil {
+				dec.stats.countMessageSet(br)
+			}
+			msgs := part.Messages
+			if msgs == nil {
+				msgs = reuse
+			}
+			msgs, skipped, err := readMessageSetInto(br, int32(remaining), msgs, func() bool {
+				b, err := br.Peek(17)
+				return err == nil && MessageVersion(int8(b[16])) >= MessageV2
+			}, dec.arena, dec.stats)
+			if err != nil {
+				return err
+			}
+			consumed := remaining - (lr.N + int64(br.Buffered()))
+			parsed += int(consumed) - skipped
+			for _, msg := range msgs[len(part.Messages):] {
+				msg.Topic = topic
+				msg.Partition = part.ID
+				msg.TipOffset = part.TipOffset
+			}
+			part.Messages = msgs
+		} else if msgVersion == MessageV2 {
+			// Response contains RecordBatch. The broker cuts off the data
+			// at MaxBytes, so the last batch might be incomplete. As its
+			// checksum covers the whole batch, it is dropped without
+			// being parsed.
+			remaining := lr.N + int64(br.Buffered())
+			if batchLen := int32(binary.BigEndian.Uint32(b[8:12])); 12+int64(batchLen) > remaining {
+				break
+			}
+			batch, err := readRecordBatch(br, skipBatch, dec.arena, dec.stats)
+			partial := err == ErrNotEnoughData || err == io.EOF || err == io.ErrUnexpectedEOF
+			if partial && (len(part.RecordBatches) > 0 || len(part.Messages) > 0) {
+				// it was partial batch so we just ignore it
+				break
+			}
+			if err != nil {
+				return err
+			}
+			part.RecordBatches = append(part.RecordBatches, batch)
+			parsed += 12 + int(batch.Length)
+			if dec.stats != nil {
+				dec.stats.countSet(batch.Compression())
+			}
+		} else {
+			return errors.New("Incorrect message byte")
+		}
+	}
+	// partial record batch at the end of the set might be left unread
+	if _, err := io.Copy(ioutil.Discard, br); err != nil {
+		return err
+	}
+	part.TruncatedBytes = int(int64(msgSetSize)-lr.N) - parsed
+	if dec.stats != nil {
+		dec.stats.countPartition(parsed, part.messageCount())
+	}
+	if conf.OnPartitionDecoded != nil {
+		conf.OnPartitionDecoded(topic, part.ID, part.messageCount(), time.Since(start))
+	}
+	return nil
+}
+
+const (
+	CorrelationTypeGroup       int8 = 0
+	CorrelationTypeTransaction      = 1
+)
+
+// ConsumerMetadataReq is the group coordinator lookup request. Use
+// FindCoordinatorReq to look up transaction coordinators as well.
+type ConsumerMetadataReq struct {
+	RequestHeader
+	ConsumerGroup   string
+	CoordinatorType int8 // >= KafkaV1
+}
+
+func ReadConsumerMetadataReq(r io.Reader) (*ConsumerMetadataReq, error) {
+	var req ConsumerMetadataReq
+	dec := NewDecoder(r)
+
+	decodeHeader(dec, &req)
+
+	req.ConsumerGroup = dec.DecodeString()
+
+	if req.version >= KafkaV1 {
+		req.CoordinatorType = dec.DecodeInt8()
+	}
+
+	if dec.Err() != nil {
+		return nil, dec.Err()
+	}
+	return &req, nil
+}
+
+func (r ConsumerMetadataReq) Kind() int16 {
+	return ConsumerMetadataReqKind
+}
+
+func (r *ConsumerMetadataReq) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	encodeHeader(enc, r)
+
+	enc.EncodeString(r.ConsumerGroup)
+
+	if r.version >= KafkaV1 {
+		enc.EncodeInt8(r.CoordinatorType)
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+func (r *ConsumerMetadataReq) WriteTo(w io.Writer) (int64, error) {
+	b, err := r.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	return writeFull(w, b)
+}
+
+type ConsumerMetadataResp struct {
+	Version         int16
+	CorrelationID   int32
+	ThrottleTime    time.Duration // >= KafkaV1
+	Err             error
+	ErrMsg          string // >= KafkaV1
+	CoordinatorID   int32
+	CoordinatorHost string
+	CoordinatorPort int32
+}
+
+func ReadConsumerMetadataResp(r io.Reader) (*ConsumerMetadataResp, error) {
+	return ReadVersionedConsumerMetadataResp(r, KafkaV0)
+}
+
+func ReadVersionedConsumerMetadataResp(r io.Reader, version int16) (*ConsumerMetadataResp, error) {
+	var resp ConsumerMetadataResp
+	resp.Version = version
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	resp.CorrelationID = dec.DecodeInt32()
+
+	if version >= KafkaV1 {
+		resp.ThrottleTime = dec.DecodeDuration32()
+	}
+
+	resp.Err = errFromNo(dec.DecodeInt16())
+	if version >= KafkaV1 {
+		resp.ErrMsg = dec.DecodeString()
+	}
+	resp.CoordinatorID = dec.DecodeInt32()
+	resp.CoordinatorHost = dec.DecodeString()
+	resp.CoordinatorPort = dec.DecodeInt32()
+
+	if err := dec.Err(); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (r *ConsumerMetadataResp) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.EncodeInt32(0)
+	enc.EncodeInt32(r.CorrelationID)
+
+	if r.Version >= KafkaV1 {
+		enc.EncodeDuration(r.ThrottleTime)
+	}
+
+	enc.EncodeError(r.Err)
+
+	if r.Version >= KafkaV1 {
+		enc.EncodeString(r.ErrMsg)
+	}
+
+	enc.EncodeInt32(r.CoordinatorID)
+	enc.EncodeString(r.CoordinatorHost)
+	enc.EncodeInt32(r.CoordinatorPort)
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+// FindCoordinatorReq looks up the coordinator of a consumer group or, with
+// KafkaV1 and newer, of a transactional producer.
+type FindCoordinatorReq struct {
+	RequestHeader
+	Key     string // group id or transactional id
+	KeyType int8   // >= KafkaV1, CorrelationTypeGroup or CorrelationTypeTransaction
+}
+
+func ReadFindCoordinatorReq(r io.Reader) (*FindCoordinatorReq, error) {
+	var req FindCoordinatorReq
+	dec := NewDecoder(r)
+
+	decodeHeader(dec, &req)
+
+	req.Key = dec.DecodeString()
+
+	if req.version >= KafkaV1 {
+		req.KeyType = dec.DecodeInt8()
+	}
+
+	if dec.Err() != nil {
+		return nil, dec.Err()
+	}
+	return &req, nil
+}
+
+func (r FindCoordinatorReq) Kind() int16 {
+	return FindCoordinatorReqKind
+}
+
+func (r *FindCoordinatorReq) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	encodeHeader(enc, r)
+
+	enc.EncodeString(r.Key)
+
+	if r.version >= KafkaV1 {
+		enc.EncodeInt8(r.KeyType)
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+func (r *FindCoordinatorReq) WriteTo(w io.Writer) (int64, error) {
+	b, err := r.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	return writeFull(w, b)
+}
+
+type FindCoordinatorResp struct {
+	Version       int16
+	CorrelationID int32
+	ThrottleTime  time.Duration // >= KafkaV1
+	Err           error
+	ErrMsg        string // >= KafkaV1
+	NodeID        int32
+	Host          string
+	Port          int32
+}
+
+func ReadFindCoordinatorResp(r io.Reader) (*FindCoordinatorResp, error) {
+	return ReadVersionedFindCoordinatorResp(r, KafkaV0)
+}
+
+func ReadVersionedFindCoordinatorResp(r io.Reader, version int16) (*FindCoordinatorResp, error) {
+	var resp FindCoordinatorResp
+	resp.Version = version
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	resp.CorrelationID = dec.DecodeInt32()
+
+	if version >= KafkaV1 {
+		resp.ThrottleTime = dec.DecodeDuration32()
+	}
+
+	resp.Err = errFromNo(dec.DecodeInt16())
+	if version >= KafkaV1 {
+		resp.ErrMsg = dec.DecodeString()
+	}
+	resp.NodeID = dec.DecodeInt32()
+	resp.Host = dec.DecodeString()
+	resp.Port = dec.DecodeInt32()
+
+	if err := dec.Err(); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (r *FindCoordinatorResp) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.EncodeInt32(0)
+	enc.EncodeInt32(r.CorrelationID)
+
+	if r.Version >= KafkaV1 {
+		enc.EncodeDuration(r.ThrottleTime)
+	}
+
+	enc.EncodeError(r.Err)
+
+	if r.Version >= KafkaV1 {
+		enc.EncodeString(r.ErrMsg)
+	}
+
+	enc.EncodeInt32(r.NodeID)
+	enc.EncodeString(r.Host)
+	enc.EncodeInt32(r.Port)
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+type OffsetCommitReq struct {
+	RequestHeader
+	ConsumerGroup     string
+	GroupGenerationID int32  // >= KafkaV1 only
+	MemberID          string // >= KafkaV1 only
+	RetentionTime     int64  // >= KafkaV2 only
+	Topics            []OffsetCommitReqTopic
+}
+
+type OffsetCommitReqTopic struct {
+	Name       string
+	Partitions []OffsetCommitReqPartition
+}
+
+type OffsetCommitReqPartition struct {
+	ID        int32
+	Offset    int64
+	TimeStamp time.Time // == KafkaV1 only
+	Metadata  string
+}
+
+func ReadOffsetCommitReq(r io.Reader) (*OffsetCommitReq, error) {
+	var req OffsetCommitReq
+	dec := NewDecoder(r)
+
+	decodeHeader(dec, &req)
+
+	req.ConsumerGroup = dec.DecodeString()
+
+	if req.version >= KafkaV1 {
+		req.GroupGenerationID = dec.DecodeInt32()
+		req.MemberID = dec.DecodeString()
+	}
+
+	if req.version >= KafkaV2 {
+		req.RetentionTime = dec.DecodeInt64()
+	}
+
+	len, err := dec.DecodeArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	req.Topics = make([]OffsetCommitReqTopic, len)
+
+	for ti := range req.Topics {
+		var topic = &req.Topics[ti]
+		topic.Name = dec.DecodeString()
+
+		len, err := dec.DecodeArrayLen()
+		if err != nil {
+			return nil, err
+		}
+		topic.Partitions = make([]OffsetCommitReqPartition, len)
+
+		for pi := range topic.Partitions {
+			var part = &topic.Partitions[pi]
+			part.ID = dec.DecodeInt32()
+			part.Offset = dec.DecodeInt64()
+
+			if req.version == KafkaV1 {
+				part.TimeStamp = time.Unix(0, dec.DecodeInt64()*int64(time.Millisecond))
+			}
+
+			part.Metadata = dec.DecodeString()
+		}
+	}
+
+	if dec.Err() != nil {
+		return nil, dec.Err()
+	}
+	return &req, nil
+}
+
+func (r OffsetCommitReq) Kind() int16 {
+	return OffsetCommitReqKind
+}
+
+func (r *OffsetCommitReq) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	encodeHeader(enc, r)
+
+	enc.EncodeString(r.ConsumerGroup)
+
+	if r.version >= KafkaV1 {
+		enc.EncodeInt32(r.GroupGenerationID)
+		enc.EncodeString(r.MemberID)
+	}
+
+	if r.version >= KafkaV2 {
+		enc.EncodeInt64(r.RetentionTime)
+	}
+
+	enc.EncodeArrayLen(len(r.Topics))
+	for _, topic := range r.Topics {
+		enc.EncodeString(topic.Name)
+		enc.EncodeArrayLen(len(topic.Partitions))
+		for _, part := range topic.Partitions {
+			enc.EncodeInt32(part.ID)
+			enc.EncodeInt64(part.Offset)
+
+			if r.version == KafkaV1 {
+				// TODO(husio) is this really in milliseconds?
+				enc.EncodeInt64(part.TimeStamp.UnixNano() / int64(time.Millisecond))
+			}
+
+			enc.EncodeString(part.Metadata)
+		}
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+func (r *OffsetCommitReq) WriteTo(w io.Writer) (int64, error) {
+	b, err := r.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	return writeFull(w, b)
+}
+
+type OffsetCommitResp struct {
+	Version       int16
+	CorrelationID int32
+	ThrottleTime  time.Duration // >= KafkaV3 only
+	Topics        []OffsetCommitRespTopic
+}
+
+type OffsetCommitRespTopic struct {
+	Name       string
+	Partitions []OffsetCommitRespPartition
+}
+
+type OffsetCommitRespPartition struct {
+	ID  int32
+	Err error
+}
+
+func ReadOffsetCommitResp(r io.Reader) (*OffsetCommitResp, error) {
+	return ReadVersionedOffsetCommitResp(r, KafkaV0)
+}
+
+func ReadVersionedOffsetCommitResp(r io.Reader, version int16) (*OffsetCommitResp, error) {
+	var resp OffsetCommitResp
+	resp.Version = version
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	resp.CorrelationID = dec.DecodeInt32()
+
+	if version >= KafkaV3 {
+		resp.ThrottleTime = dec.DecodeDuration32()
+	}
+
+	len, err := dec.DecodeArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	resp.Topics = make([]OffsetCommitRespTopic, len)
+
+	for ti := range resp.Topics {
+		var t = &resp.Topics[ti]
+		t.Name = dec.DecodeString()
+
+		len, err := dec.DecodeArrayLen()
+		if err != nil {
+			return nil, err
+		}
+		t.Partitions = make([]OffsetCommitRespPartition, len)
+
+		for pi := range t.Partitions {
+			var p = &t.Partitions[pi]
+			p.ID = dec.DecodeInt32()
+			p.Err = errFromNo(dec.DecodeInt16())
+		}
+	}
+
+	if err := dec.Err(); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (r *OffsetCommitResp) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.EncodeInt32(0)
+	enc.EncodeInt32(r.CorrelationID)
+
+	if r.Version >= KafkaV3 {
+		enc.EncodeDuration(r.ThrottleTime)
+	}
+
+	enc.EncodeArrayLen(len(r.Topics))
+	for _, t := range r.Topics {
+		enc.EncodeString(t.Name)
+		enc.EncodeArrayLen(len(t.Partitions))
+		for _, p := range t.Partitions {
+			enc.EncodeInt32(p.ID)
+			enc.EncodeError(p.Err)
+		}
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+
+}
+
+type OffsetFetchReq struct {
+	RequestHeader
+	ConsumerGroup string
+	// Topics to fetch the committed offsets for. Nil means all partitions
+	// the group has committed offsets for, which is supported by KafkaV2 and
+	// newer. Older versions treat it as no topics.
+	Topics []OffsetFetchReqTopic
+}
+
+type OffsetFetchReqTopic struct {
+	Name       string
+	Partitions []int32
+}
+
+func ReadOffsetFetchReq(r io.Reader) (*OffsetFetchReq, error) {
+	var req OffsetFetchReq
+	dec := NewDecoder(r)
+
+	decodeHeader(dec, &req)
+
+	req.ConsumerGroup = dec.DecodeString()
+
+	len, err := dec.DecodeNullableArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	if len >= 0 {
+		req.Topics = make([]OffsetFetchReqTopic, len)
+	}
+
+	for ti := range req.Topics {
+		var topic = &req.Topics[ti]
+		topic.Name = dec.DecodeString()
+		len, err = dec.DecodeArrayLen()
+		if err != nil {
+			return nil, err
+		}
+		topic.Partitions = make([]int32, len)
+
+		for pi := range topic.Partitions {
+			topic.Partitions[pi] = dec.DecodeInt32()
+		}
+	}
+
+	if dec.Err() != nil {
+		return nil, dec.Err()
+	}
+	return &req, nil
+}
+
+func (r OffsetFetchReq) Kind() int16 {
+	return OffsetFetchReqKind
+}
+
+func (r *OffsetFetchReq) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	encodeHeader(enc, r)
+
+	enc.EncodeString(r.ConsumerGroup)
+	if r.Topics == nil && r.version >= KafkaV2 {
+		// null array requests all partitions
+		enc.EncodeArrayLen(-1)
+	} else {
+		enc.EncodeArrayLen(len(r.Topics))
+	}
+	for _, t := range r.Topics {
+		enc.EncodeString(t.Name)
+		enc.EncodeInt32s(t.Partitions)
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+func (r *OffsetFetchReq) WriteTo(w io.Writer) (int64, error) {
+	b, err := r.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	return writeFull(w, b)
+}
+
+// OffsetFetchResp is the response to OffsetFetchReq. Version 0 returns offsets
+// committed to ZooKeeper by legacy consumers, while version 1 and newer return
+// offsets stored by the broker. Partition fields are the same in all
+// versions, as commit timestamps sent with OffsetCommitReq version 1 are never
+// returned. Fields by version are:
+//
+//	v0-v1:   correlation id, topics
+//	v2:      correlation id, topics, error code
+//	v3:      correlation id, throttle time, topics, error code
+type OffsetFetchResp struct {
+	Version       int16
+	CorrelationID int32
+	ThrottleTime  time.Duration // >= KafkaV3
+	Topics        []OffsetFetchRespTopic
+	Err           error // >= KafkaV2
+}
+
+type OffsetFetchRespTopic struct {
+	Name       string
+	Partitions []OffsetFetchRespPartition
+}
+
+type OffsetFetchRespPartition struct {
+	ID       int32
+	Offset   int64 // -1 if the group has no offset committed
+	Metadata string
+	Err      error
+}
+
+// CommittedOffsets returns the offsets committed for every partition of the
+// response. Partitions without a committed offset, or that returned an error,
+// are left out. It can be used to move offsets of a legacy consumer, fetched
+// from ZooKeeper with version 0, to a group storing offsets in the broker.
+func (r *OffsetFetchResp) CommittedOffsets() map[string]map[int32]int64 {
+	offsets := make(map[string]map[int32]int64)
+	for _, topic := range r.Topics {
+		for _, part := range topic.Partitions {
+			if part.Err != nil || part.Offset < 0 {
+				continue
+			}
+			if offsets[topic.Name] == nil {
+				offsets[topic.Name] = make(map[int32]int64)
+			}
+			offsets[topic.Name][part.ID] = part.Offset
+		}
+	}
+	return offsets
+}
+
+func ReadOffsetFetchResp(r io.Reader) (*OffsetFetchResp, error) {
+	return ReadVersionedOffsetFetchResp(r, KafkaV0)
+}
+
+func ReadVersionedOffsetFetchResp(r io.Reader, version int16) (*OffsetFetchResp, error) {
+	var resp OffsetFetchResp
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	resp.CorrelationID = dec.DecodeInt32()
+
+	resp.Version = version
+
+	if version >= KafkaV3 {
+		resp.ThrottleTime = dec.DecodeDuration32()
+	}
+
+	len, err := dec.DecodeArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	resp.Topics = make([]OffsetFetchRespTopic, len)
+
+	for ti := range resp.Topics {
+		var t = &resp.Topics[ti]
+		t.Name = dec.DecodeString()
+
+		len, err = dec.DecodeArrayLen()
+		if err != nil {
+			return nil, err
+		}
+		t.Partitions = make([]OffsetFetchRespPartition, len)
+
+		for pi := range t.Partitions {
+			var p = &t.Partitions[pi]
+			p.ID = dec.DecodeInt32()
+			p.Offset = dec.DecodeInt64()
+			p.Metadata = dec.DecodeString()
+			p.Err = errFromNo(dec.DecodeInt16())
+		}
+	}
+
+	if version >= KafkaV2 {
+		resp.Err = errFromNo(dec.DecodeInt16())
+	}
+
+	if err := dec.Err(); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (r *OffsetFetchResp) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.EncodeInt32(0)
+	enc.EncodeInt32(r.CorrelationID)
+
+	if r.Version >= KafkaV3 {
+		enc.EncodeDuration(r.ThrottleTime)
+	}
+
+	enc.EncodeArrayLen(len(r.Topics))
+	for _, topic := range r.Topics {
+		enc.EncodeString(topic.Name)
+		enc.EncodeArrayLen(len(topic.Partitions))
+		for _, part := range topic.Partitions {
+			enc.EncodeInt32(part.ID)
+			enc.EncodeInt64(part.Offset)
+			enc.EncodeString(part.Metadata)
+			enc.EncodeError(part.Err)
+		}
+	}
+
+	if r.Version >= KafkaV2 {
+		enc.EncodeError(r.Err)
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+type ProduceReq struct {
+	RequestHeader
+	Compression Compression // only used when sending ProduceReqs
+	// CompressionLevel of the Compression codec, only used when sending
+	// ProduceReqs
+	CompressionLevel CompressionLevel
+	TransactionalID  string
+	RequiredAcks     int16
+	Timeout          time.Duration
+	Topics           []ProduceReqTopic
+
+	// SequentialOffsets makes the request write messages of each partition
+	// with offsets 0, 1, 2 and so on, instead of their Offset. The broker
+	// overwrites offsets when appending messages to the log, so the written
+	// ones are only placeholders, but they are expected to be increasing,
+	// as sent by the Java client. Messages are not modified. Only used when
+	// sending ProduceReqs.
+	SequentialOffsets bool
+
+	// Clock provides the time messages without a timestamp are written
+	// with, when producing with KafkaV2 or newer. Nil means the system
+	// clock. Only used when sending ProduceReqs.
+	Clock Clock
+}
+
+// Clock tells the current time. It can be replaced to make the timestamps of
+// produced messages deterministic.
+type Clock interface {
+	Now() time.Time
+}
+
+// now returns the current time of the request clock.
+func (r *ProduceReq) now() time.Time {
+	if r.Clock != nil {
+		return r.Clock.Now()
+	}
+	return time.Now()
+}
+
+// withSequentialOffsets returns copies of the messages with offsets assigned
+// sequentially, starting at 0.
+func withSequentialOffsets(messages []*Message) []*Message {
+	copies := make([]Message, len(messages))
+	res := make([]*Message, len(messages))
+	for i, m := range messages {
+		copies[i] = *m
+		copies[i].Offset = int64(i)
+		res[i] = &copies[i]
+	}
+	return res
+}
+
+type ProduceReqTopic struct {
+	Name       string
+	Partitions []ProduceReqPartition
+}
+
+type ProduceReqPartition struct {
+	ID       int32
+	Messages []*Message
+}
+
+func ReadProduceReq(r io.Reader) (*ProduceReq, error) {
+	var req ProduceReq
+	dec := NewDecoder(r)
+
+	decodeHeader(dec, &req)
+
+	if req.version >= KafkaV3 {
+		req.TransactionalID = dec.DecodeString()
+	}
+
+	req.RequiredAcks = dec.DecodeInt16()
+	req.Timeout = time.Duration(dec.DecodeInt32()) * time.Millisecond
+
+	len, err := dec.DecodeArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	req.Topics = make([]ProduceReqTopic, len)
+
+	for ti := range req.Topics {
+		var topic = &req.Topics[ti]
+		topic.Name = dec.DecodeString()
+
+		len, err = dec.DecodeArrayLen()
+		if err != nil {
+			return nil, err
+		}
+		topic.Partitions = make([]ProduceReqPartition, len)
+
+		for pi := range topic.Partitions {
+			var part = &topic.Partitions[pi]
+			part.ID = dec.DecodeInt32()
+			if dec.Err() != nil {
+				return nil, dec.Err()
+			}
+			msgSetSize := dec.DecodeInt32()
+			if dec.Err() != nil {
+				return nil, dec.Err()
+			}
+			var err error
+			if req.version >= KafkaV3 {
+				// messages are sent as record batches
+				part.Messages, err = ReadLogSegment(io.LimitReader(r, int64(msgSetSize)))
+			} else {
+				part.Messages, _, err = readMessageSet(r, msgSetSize)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if dec.Err() != nil {
+		return nil, dec.Err()
+	}
+	return &req, nil
+}
+
+func (r ProduceReq) Kind() int16 {
+	return ProduceReqKind
+}
+
+// ExpectsResponse returns false if the broker sends no response to the
+// request, which is the case when RequiredAcks is RequiredAcksNone. Such
+// request is fire and forget, and ReadProduceResp must not be called after
+// writing it, as it would block waiting for data that never comes.
+func (r *ProduceReq) ExpectsResponse() bool {
+	return r.RequiredAcks != RequiredAcksNone
+}
+
+// ErrTransactionalRequiredAcks is returned when serializing transactional
+// produce request that does not require acknowledgement of all in sync
+// replicas.
+var ErrTransactionalRequiredAcks = errors.New("transactional produce requires all acks")
+
+// validate checks the request for values the broker would reject. Required
+// acks must be RequiredAcksNone, RequiredAcksLocal or RequiredAcksAll, and
+// transactional requests must use RequiredAcksAll. TransactionalID is only
+// sent since KafkaV3, so older requests are never transactional.
+func (r *ProduceReq) validate() error {
+	switch r.RequiredAcks {
+	case RequiredAcksNone, RequiredAcksLocal, RequiredAcksAll:
+	default:
+		return ErrInvalidRequiredAcks
+	}
+	if r.version >= KafkaV3 && r.TransactionalID != "" && r.RequiredAcks != RequiredAcksAll {
+		return ErrTransactionalRequiredAcks
+	}
+	return nil
+}
+
+func (r *ProduceReq) Bytes() ([]byte, error) {
+	if err := r.validate(); err != nil {
+		return nil, err
+	}
+
+	var buf buffer
+	enc := NewEncoder(&buf)
+
+	r.encodeHead(enc)
+	magic := r.messageVersion()
+	now := r.now()
+
+	enc.EncodeArrayLen(len(r.Topics))
+	for _, t := range r.Topics {
+		enc.EncodeString(t.Name)
+		enc.EncodeArrayLen(len(t.Partitions))
+		for _, p := range t.Partitions {
+			enc.EncodeInt32(p.ID)
+			i := len(buf)
+			enc.EncodeInt32(0) // placeholder
+			n, err := r.writeSet(&buf, r.partitionMessages(p), magic, now)
+			if err != nil {
+				return nil, err
+			}
+			binary.BigEndian.PutUint32(buf[i:i+4], uint32(n))
+		}
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(buf)-4))
+	return []byte(buf), nil
+}
+
+// encodeHead encodes the request fields preceding the topics.
+func (r *ProduceReq) encodeHead(enc *encoder) {
+	encodeHeader(enc, r)
+
+	if r.version >= KafkaV3 {
+		enc.EncodeString(r.TransactionalID)
+	}
+
+	enc.EncodeInt16(r.RequiredAcks)
+	enc.EncodeInt32(int32(r.Timeout / time.Millisecond))
+}
+
+// messageVersion returns the format messages of the request are written in.
+// Timestamps are supported by the broker starting with KafkaV2 and record
+// batches starting with KafkaV3.
+func (r *ProduceReq) messageVersion() MessageVersion {
+	if r.version >= KafkaV3 {
+		return MessageV2
+	}
+	if r.version >= KafkaV2 {
+		return MessageV1
+	}
+	return MessageV0
+}
+
+// writeSet writes messages of a partition in given format, as a message set
+// or a record batch.
+func (r *ProduceReq) writeSet(w io.Writer, messages []*Message, magic MessageVersion, now time.Time) (int, error) {
+	if magic == MessageV2 {
+		return writeRecordBatchMessages(w, messages, r.Compression, r.CompressionLevel, now)
+	}
+	return writeMessages(w, messages, r.Compression, r.CompressionLevel, magic, now)
+}
+
+func (r *ProduceReq) partitionMessages(p ProduceReqPartition) []*Message {
+	if r.SequentialOffsets {
+		return withSequentialOffsets(p.Messages)
+	}
+	return p.Messages
+}
+
+// WriteTo writes the request to w. Uncompressed requests are streamed: only
+// the request header and the headers of the messages are buffered, while the
+// message keys and values are written directly from the messages, so that
+// producing large message sets does not require memory for their copy. This
+// is possible because sizes of uncompressed messages are known up front.
+// Compressed requests, as well as requests of KafkaV3 and newer, which are
+// sent as record batches, are serialized using Bytes first, as their size is
+// only known after the encoding.
+//
+// Streaming does not change the rest of the protocol: the caller still has to
+// keep the correlation ID of the request to match it with the produce
+// response, unless the request does not expect any, see ExpectsResponse. If
+// writing fails in the middle of the request, the connection is left in an
+// unknown state and must be closed.
+func (r *ProduceReq) WriteTo(w io.Writer) (int64, error) {
+	if r.Compression != CompressionNone || r.messageVersion() == MessageV2 {
+		b, err := r.Bytes()
+		if err != nil {
+			return 0, err
+		}
+		return writeFull(w, b)
+	}
+	return r.writeStream(w)
+}
+
+// writeStream writes uncompressed request to w without serializing it first.
+// The request is encoded with empty message sets of precomputed sizes, which
+// are then written between the encoded parts.
+func (r *ProduceReq) writeStream(w io.Writer) (int64, error) {
+	if err := r.validate(); err != nil {
+		return 0, err
+	}
+
+	var buf buffer
+	enc := NewEncoder(&buf)
+
+	r.encodeHead(enc)
+	magic := r.messageVersion()
+
+	type messageSet struct {
+		at       int // position in the buffer the set is written at
+		size     int
+		messages []*Message
+	}
+	var sets []messageSet
+	total := 0
+
+	enc.EncodeArrayLen(len(r.Topics))
+	for _, t := range r.Topics {
+		enc.EncodeString(t.Name)
+		enc.EncodeArrayLen(len(t.Partitions))
+		for _, p := range t.Partitions {
+			set := messageSet{messages: r.partitionMessages(p)}
+			for _, m := range set.messages {
+				size := m.encodedSize(magic)
+				if int64(size-12) > maxEncodedLen {
+					return 0, ErrMessageSizeTooLarge
+				}
+				set.size += size
+			}
+			if int64(set.size) > math.MaxInt32 {
+				return 0, messageSizeError(set.size)
+			}
+			enc.EncodeInt32(p.ID)
+			enc.EncodeInt32(int32(set.size))
+			set.at = len(buf)
+			sets = append(sets, set)
+			total += set.size
+		}
+	}
+
+	if enc.Err() != nil {
+		return 0, enc.Err()
+	}
+	if int64(len(buf)+total-4) > math.MaxInt32 {
+		return 0, messageSizeError(len(buf) + total - 4)
+	}
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(buf)+total-4))
+
+	// headers of the messages are small and written separately from
+	// their values, so they are buffered to avoid a write call for each
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	prev := 0
+	now := r.now()
+	for _, set := range sets {
+		if _, err := writeFull(bw, buf[prev:set.at]); err != nil {
+			return cw.n, err
+		}
+		if _, err := writeMessages(bw, set.messages, CompressionNone, r.CompressionLevel, magic, now); err != nil {
+			return cw.n, err
+		}
+		prev = set.at
+	}
+	if _, err := writeFull(bw, buf[prev:]); err != nil {
+		return cw.n, err
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.n += int64(n)
+	return n, err
+}
+
+// ProduceResp is the response to ProduceReq. Unlike in most other responses,
+// throttle time follows the topics. Fields by version are:
+//
+//	v0:      correlation id, topics
+//	v1-v8:   correlation id, topics, throttle time
+//
+// Fields of the partitions by version are:
+//
+//	v0-v1:   id, error code, offset
+//	v2-v4:   id, error code, offset, log append time
+//	v5-v7:   id, error code, offset, log append time, log start offset
+//	v8:      id, error code, offset, log append time, log start offset,
+//	         record errors, error message
+type ProduceResp struct {
+	Version       int16
+	CorrelationID int32
+	Topics        []ProduceRespTopic
+
+	// ThrottleTime the request was delayed by because of a quota
+	// violation. Producer should back off accordingly.
+	ThrottleTime time.Duration // >= KafkaV1
+}
+
+type ProduceRespTopic struct {
+	Name       string
+	Partitions []ProduceRespPartition
+}
+
+type ProduceRespPartition struct {
+	ID             int32
+	Err            error
+	Offset         int64
+	LogAppendTime  time.Time     // >= KafkaV2, zero unless topic uses LogAppendTime
+	LogStartOffset int64         // >= KafkaV5
+	RecordErrors   []RecordError // >= KafkaV8
+	ErrMsg         string        // >= KafkaV8
+}
+
+// RecordError describes a single record that caused the whole batch to be
+// rejected.
+type RecordError struct {
+	BatchIndex int32
+	Message    string
+}
+
+func (r *ProduceResp) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.EncodeInt32(0)
+	enc.EncodeInt32(r.CorrelationID)
+	enc.EncodeArrayLen(len(r.Topics))
+	for _, topic := range r.Topics {
+		enc.EncodeString(topic.Name)
+		enc.EncodeArrayLen(len(topic.Partitions))
+		for _, part := range topic.Partitions {
+			enc.EncodeInt32(part.ID)
+			enc.EncodeError(part.Err)
+			enc.EncodeInt64(part.Offset)
+
+			if r.Version >= KafkaV2 {
+				// -1 is sent when the time is unknown
+				logAppendTime := int64(-1)
+				if !part.LogAppendTime.IsZero() {
+					logAppendTime = part.LogAppendTime.UnixNano() / int64(time.Millisecond)
+				}
+				enc.EncodeInt64(logAppendTime)
+			}
+
+			if r.Version >= KafkaV5 {
+				enc.EncodeInt64(part.LogStartOffset)
+			}
+
+			if r.Version >= KafkaV8 {
+				enc.EncodeArrayLen(len(part.RecordErrors))
+				for _, recErr := range part.RecordErrors {
+					enc.EncodeInt32(recErr.BatchIndex)
+					enc.EncodeString(recErr.Message)
+				}
+				enc.EncodeString(part.ErrMsg)
+			}
+		}
+	}
+
+	if r.Version >= KafkaV1 {
+		enc.EncodeDuration(r.ThrottleTime)
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+// ReadProduceResp decodes produce response. Only requests for which
+// ProduceReq.ExpectsResponse returns true are responded to.
+func ReadProduceResp(r io.Reader) (*ProduceResp, error) {
+	return ReadVersionedProduceResp(r, KafkaV0)
+}
+
+func ReadVersionedProduceResp(r io.Reader, version int16) (*ProduceResp, error) {
+	var resp ProduceResp
+	dec := NewDecoder(r)
+	resp.Version = version
+
+	// total message size
+	_ = dec.DecodeInt32()
+	resp.CorrelationID = dec.DecodeInt32()
+	len, err := dec.DecodeArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	resp.Topics = make([]ProduceRespTopic, len)
+
+	for ti := range resp.Topics {
+		var t = &resp.Topics[ti]
+		t.Name = dec.DecodeString()
+
+		len, err = dec.DecodeArrayLen()
+		if err != nil {
+			return nil, err
+		}
+		t.Partitions = make([]ProduceRespPartition, len)
+
+		for pi := range t.Partitions {
+			var p = &t.Partitions[pi]
+			p.ID = dec.DecodeInt32()
+			p.Err = errFromNo(dec.DecodeInt16())
+			p.Offset = dec.DecodeInt64()
+			if resp.Version >= KafkaV2 {
+				if ts := dec.DecodeInt64(); ts != -1 {
+					p.LogAppendTime = time.Unix(0, ts*int64(time.Millisecond))
+				}
+			}
+			if resp.Version >= KafkaV5 {
+				p.LogStartOffset = dec.DecodeInt64()
+			}
+			if resp.Version >= KafkaV8 {
+				len, err = dec.DecodeArrayLen()
+				if err != nil {
+					return nil, err
+				}
+				p.RecordErrors = make([]RecordError, len)
+				for ei := range p.RecordErrors {
+					p.RecordErrors[ei].BatchIndex = dec.DecodeInt32()
+					p.RecordErrors[ei].Message = dec.DecodeString()
+				}
+				p.ErrMsg = dec.DecodeString()
+			}
+		}
+	}
+
+	if resp.Version >= KafkaV1 {
+		resp.ThrottleTime = dec.DecodeDuration32()
+	}
+
+	if err := dec.Err(); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+type OffsetReq struct {
+	RequestHeader
+	ReplicaID int32
+
+	// IsolationLevel set to IsolationReadCommitted makes the latest offset
+	// the last stable offset instead of the high watermark, so that the
+	// consumer is not positioned past uncommitted messages.
+	IsolationLevel int8 // >= KafkaV2
+
+	Topics []OffsetReqTopic
+}
+
+type OffsetReqTopic struct {
+	Name       string
+	Partitions []OffsetReqPartition
+}
+
+type OffsetReqPartition struct {
+	ID         int32
+	TimeMs     int64 // cannot be time.Time because of negative values
+	MaxOffsets int32 // == KafkaV0 only
+}
+
+func ReadOffsetReq(r io.Reader) (*OffsetReq, error) {
+	var req OffsetReq
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	// api key
+	_ = dec.DecodeInt16()
+	req.version = dec.DecodeInt16()
+	req.correlationID = dec.DecodeInt32()
+	req.ClientID = dec.DecodeString()
+	req.ReplicaID = dec.DecodeInt32()
+
+	if req.version >= KafkaV2 {
+		req.IsolationLevel = dec.DecodeInt8()
+	}
+
+	len, err := dec.DecodeArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	req.Topics = make([]OffsetReqTopic, len)
+
+	for ti := range req.Topics {
+		var topic = &req.Topics[ti]
+		topic.Name = dec.DecodeString()
+
+		len, err = dec.DecodeArrayLen()
+		if err != nil {
+			return nil, err
+		}
+		topic.Partitions = make([]OffsetReqPartition, len)
+
+		for pi := range topic.Partitions {
+			var part = &topic.Partitions[pi]
+			part.ID = dec.DecodeInt32()
+			part.TimeMs = dec.DecodeInt64()
+
+			if req.version == KafkaV0 {
+				part.MaxOffsets = dec.DecodeInt32()
+			}
+		}
+	}
+
+	if dec.Err() != nil {
+		return nil, dec.Err()
+	}
+	return &req, nil
+}
+
+func (r OffsetReq) Kind() int16 {
+	return OffsetReqKind
+}
+
+func (r *OffsetReq) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	encodeHeader(enc, r)
+
+	//enc.Encode(r.ReplicaID)
+	enc.EncodeInt32(-1)
+
+	if r.version >= KafkaV2 {
+		enc.EncodeInt8(r.IsolationLevel)
+	}
+
+	enc.EncodeArrayLen(len(r.Topics))
+	for _, topic := range r.Topics {
+		enc.EncodeString(topic.Name)
+		enc.EncodeArrayLen(len(topic.Partitions))
+		for _, part := range topic.Partitions {
+			enc.EncodeInt32(part.ID)
+			enc.EncodeInt64(part.TimeMs)
+
+			if r.version == KafkaV0 {
+				enc.EncodeInt32(part.MaxOffsets)
+			}
+		}
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+func (r *OffsetReq) WriteTo(w io.Writer) (int64, error) {
+	b, err := r.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	return writeFull(w, b)
+}
+
+type OffsetResp struct {
+	Version       int16
+	CorrelationID int32
+	ThrottleTime  time.Duration
+	Topics        []OffsetRespTopic
+}
+
+type OffsetRespTopic struct {
+	Name       string
+	Partitions []OffsetRespPartition
+}
+
+type OffsetRespPartition struct {
+	ID        int32
+	Err       error
+	TimeStamp time.Time // >= KafkaV1 only
+	Offsets   []int64   // used in KafkaV0
+}
+
+func ReadOffsetResp(r io.Reader) (*OffsetResp, error) {
+	return ReadVersionedOffsetResp(r, KafkaV0)
+}
+
+func ReadVersionedOffsetResp(r io.Reader, version int16) (*OffsetResp, error) {
+	var resp OffsetResp
+	dec := NewDecoder(r)
+	resp.Version = version
+
+	// total message size
+	_ = dec.DecodeInt32()
+	resp.CorrelationID = dec.DecodeInt32()
+
+	if version >= KafkaV2 {
+		resp.ThrottleTime = dec.DecodeDuration32()
+	}
+
+	len, err := dec.DecodeArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	resp.Topics = make([]OffsetRespTopic, len)
+
+	for ti := range resp.Topics {
+		var t = &resp.Topics[ti]
+		t.Name = dec.DecodeString()
+
+		len, err = dec.DecodeArrayLen()
+		if err != nil {
+			return nil, err
+		}
+		t.Partitions = make([]OffsetRespPartition, len)
+
+		for pi := range t.Partitions {
+			var p = &t.Partitions[pi]
+			p.ID = dec.DecodeInt32()
+			p.Err = errFromNo(dec.DecodeInt16())
+
+			if version >= KafkaV1 {
+				p.TimeStamp = time.Unix(0, dec.DecodeInt64()*int64(time.Millisecond))
+
+				// in kafka >= KafkaV1 offset can be only one number.
+				// But for compatibility we still use slice
+				offset := dec.DecodeInt64()
+				p.Offsets = []int64{offset}
+			} else {
+				len, err = dec.DecodeArrayLen()
+				if err != nil {
+					return nil, err
+				}
+				p.Offsets = make([]int64, len)
+
+				for oi := range p.Offsets {
+					p.Offsets[oi] = dec.DecodeInt64()
+				}
+			}
+		}
+	}
+
+	if err := dec.Err(); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (r *OffsetResp) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.EncodeInt32(0)
+	enc.EncodeInt32(r.CorrelationID)
+
+	if r.Version >= KafkaV2 {
+		enc.EncodeDuration(r.ThrottleTime)
+	}
+
+	enc.EncodeArrayLen(len(r.Topics))
+	for _, topic := range r.Topics {
+		enc.EncodeString(topic.Name)
+		enc.EncodeArrayLen(len(topic.Partitions))
+		for _, part := range topic.Partitions {
+			enc.EncodeInt32(part.ID)
+			enc.EncodeError(part.Err)
+
+			if r.Version >= KafkaV1 {
+				enc.EncodeInt64(part.TimeStamp.UnixNano() / int64(time.Millisecond))
+
+				// in kafka >= KafkaV1 offset can be only one value.
+				// In this case we use first element of slice
+				var offset int64
+				if len(part.Offsets) > 0 {
+					offset = part.Offsets[0]
+				}
+				enc.EncodeInt64(offset)
+			} else {
+				enc.EncodeInt64s(part.Offsets)
+			}
+		}
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+type ReplicaAssignment struct {
+	Partition int32
+	Replicas  []int32
+}
+type ConfigEntry struct {
+	ConfigName  string
+	ConfigValue string
+}
+
+type TopicInfo struct {
+	Topic              string
+	NumPartitions      int32
+	ReplicationFactor  int16
+	ReplicaAssignments []ReplicaAssignment
+	ConfigEntries      []ConfigEntry
+}
+
+type CreateTopicsReq struct {
+	RequestHeader
+	CreateTopicsRequests []TopicInfo
+	Timeout              time.Duration
+	ValidateOnly         bool
+}
+
+func ReadCreateTopicsReq(r io.Reader) (*CreateTopicsReq, error) {
+	var req CreateTopicsReq
+	dec := NewDecoder(r)
+
+	decodeHeader(dec, &req)
+
+	len, err := dec.DecodeArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	req.CreateTopicsRequests = make([]TopicInfo, len)
+
+	for i := range req.CreateTopicsRequests {
+		ti := TopicInfo{}
+		ti.Topic = dec.DecodeString()
+		ti.NumPartitions = dec.DecodeInt32()
+		ti.ReplicationFactor = dec.DecodeInt16()
+		len, err := dec.DecodeArrayLen()
+		if err != nil {
+			return nil, err
+		}
+
+		ti.ReplicaAssignments = make([]ReplicaAssignment, len)
+		for j := range ti.ReplicaAssignments {
+			ra := ReplicaAssignment{}
+			ra.Partition = dec.DecodeInt32()
+			len, err = dec.DecodeArrayLen()
+			ra.Replicas = make([]int32, len)
+			for k := range ra.Replicas {
+				ra.Replicas[k] = dec.DecodeInt32()
+			}
+
+			ti.ReplicaAssignments[j] = ra
+		}
+		len, err = dec.DecodeArrayLen()
+		ti.ConfigEntries = make([]ConfigEntry, len)
+		for l := range ti.ConfigEntries {
+			ce := ConfigEntry{}
+			ce.ConfigName = dec.DecodeString()
+			ce.ConfigValue = dec.DecodeString()
+			ti.ConfigEntries[l] = ce
+		}
+
+		req.CreateTopicsRequests[i] = ti
+	}
+
+	req.Timeout = dec.DecodeDuration32()
+
+	if req.version >= KafkaV1 {
+		req.ValidateOnly = dec.DecodeInt8() != 0
+	}
+
+	if dec.Err() != nil {
+		return nil, dec.Err()
+	}
+	return &req, nil
+}
+
+func (r CreateTopicsReq) Kind() int16 {
+	return CreateTopicsReqKind
+}
+
+func (r *CreateTopicsReq) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	encodeHeader(enc, r)
+
+	enc.EncodeArrayLen(len(r.CreateTopicsRequests))
+	for _, topicInfo := range r.CreateTopicsRequests {
+		enc.EncodeString(topicInfo.Topic)
+		enc.EncodeInt32(topicInfo.NumPartitions)
+		enc.EncodeInt16(topicInfo.ReplicationFactor)
+		enc.EncodeArrayLen(len(topicInfo.ReplicaAssignments))
+		for _, replicaAssignment := range topicInfo.ReplicaAssignments {
+			enc.EncodeInt32(replicaAssignment.Partition)
+			enc.EncodeInt32s(replicaAssignment.Replicas)
+		}
+
+		enc.EncodeArrayLen(len(topicInfo.ConfigEntries))
+		for _, ce := range topicInfo.ConfigEntries {
+			enc.EncodeString(ce.ConfigName)
+			enc.EncodeString(ce.ConfigValue)
+		}
+	}
+
+	enc.EncodeDuration(r.Timeout)
+
+	if r.version >= KafkaV1 {
+		enc.EncodeInt8(boolToInt8(r.ValidateOnly))
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+func (r *CreateTopicsReq) WriteTo(w io.Writer) (int64, error) {
+	b, err := r.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	return writeFull(w, b)
+}
+
+type TopicError struct {
+	Topic        string
+	ErrorCode    int16
+	ErrorMessage string // >= KafkaV1
+	Err          error
+}
+
+type CreateTopicsResp struct {
+	Version       int16
+	CorrelationID int32
+	TopicErrors   []TopicError
+	ThrottleTime  time.Duration // >= KafkaV2
+}
+
+func (r *CreateTopicsResp) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.EncodeInt32(0)
+	enc.EncodeInt32(r.CorrelationID)
+
+	if r.Version >= KafkaV2 {
+		enc.EncodeDuration(r.ThrottleTime)
+	}
+
+	enc.EncodeArrayLen(len(r.TopicErrors))
+	for _, te := range r.TopicErrors {
+		enc.EncodeString(te.Topic)
+		enc.EncodeInt16(te.ErrorCode)
+		if r.Version >= KafkaV1 {
+			enc.EncodeString(te.ErrorMessage)
+		}
+
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+func ReadCreateTopicsResp(r io.Reader) (*CreateTopicsResp, error) {
+	return ReadVersionedCreateTopicsResp(r, KafkaV0)
+}
+
+func ReadVersionedCreateTopicsResp(r io.Reader, version int16) (*CreateTopicsResp, error) {
+	var resp CreateTopicsResp
+	resp.Version = version
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	resp.CorrelationID = dec.DecodeInt32()
+
+	if resp.Version >= KafkaV2 {
+		resp.ThrottleTime = dec.DecodeDuration32()
+	}
+
+	len, err := dec.DecodeArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	resp.TopicErrors = make([]TopicError, len)
+
+	for i := range resp.TopicErrors {
+		var te = &resp.TopicErrors[i]
+		te.Topic = dec.DecodeString()
+		te.ErrorCode = dec.DecodeInt16()
+		if resp.Version >= KafkaV1 {
+			te.ErrorMessage = dec.DecodeString()
+		}
+		te.Err = errFromNo(te.ErrorCode)
+	}
+
+	if dec.Err() != nil {
+		return nil, dec.Err()
+	}
+	return &resp, nil
+}
+
+type buffer []byte
+
+func (b *buffer) Write(p []byte) (int, error) {
+	*b = append(*b, p...)
+	return len(p), nil
+}
+
+type APIVersionsReq struct {
+	RequestHeader
+}
+
+func ReadAPIVersionsReq(r io.Reader) (*APIVersionsReq, error) {
+	var req APIVersionsReq
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	// api key + api version
+	_ = dec.DecodeInt32()
+	req.correlationID = dec.DecodeInt32()
+	req.ClientID = dec.DecodeString()
+
+	if dec.Err() != nil {
+		return nil, dec.Err()
+	}
+	return &req, nil
+}
+
+func (r APIVersionsReq) Kind() int16 {
+	return APIVersionsReqKind
 }
 
-func (r *ConsumerMetadataReq) Bytes() ([]byte, error) {
+func (r *APIVersionsReq) Bytes() ([]byte, error) {
 	var buf bytes.Buffer
 	enc := NewEncoder(&buf)
 
 	encodeHeader(enc, r)
 
-	enc.EncodeString(r.ConsumerGroup)
-
 	if enc.Err() != nil {
 		return nil, enc.Err()
 	}
@@ -1346,78 +5110,86 @@ func (r *ConsumerMetadataReq) Bytes() ([]byte, error) {
 	return b, nil
 }
 
-func (r *ConsumerMetadataReq) WriteTo(w io.Writer) (int64, error) {
+func (r *APIVersionsReq) WriteTo(w io.Writer) (int64, error) {
 	b, err := r.Bytes()
 	if err != nil {
 		return 0, err
 	}
-	n, err := w.Write(b)
-	return int64(n), err
-}
-
-type ConsumerMetadataResp struct {
-	Version         int16
-	CorrelationID   int32
-	ThrottleTime    time.Duration // >= KafkaV1
-	Err             error
-	ErrMsg          string // >= KafkaV1
-	CoordinatorID   int32
-	CoordinatorHost string
-	CoordinatorPort int32
+	return writeFull(w, b)
 }
 
-func ReadConsumerMetadataResp(r io.Reader) (*ConsumerMetadataResp, error) {
-	return ReadVersionedConsumerMetadataResp(r, KafkaV0)
+// APIVersionsResp is the response to APIVersionsReq.
+//
+// If the request version is not supported by the broker, Err is set to
+// ErrUnsupportedVersion and the response is sent in the KafkaV0 format,
+// regardless of the version it was requested with. It still lists the
+// versions the broker supports, including those of APIVersionsReqKind, so
+// that the request can be retried with a compatible version, see
+// RetryVersion.
+type APIVersionsResp struct {
+	Version       int16
+	CorrelationID int32
+	Err           error
+	APIVersions   []SupportedVersion
+	ThrottleTime  time.Duration
 }
 
-func ReadVersionedConsumerMetadataResp(r io.Reader, version int16) (*ConsumerMetadataResp, error) {
-	var resp ConsumerMetadataResp
-	resp.Version = version
-	dec := NewDecoder(r)
-
-	// total message size
-	_ = dec.DecodeInt32()
-	resp.CorrelationID = dec.DecodeInt32()
-
-	if version >= KafkaV1 {
-		resp.ThrottleTime = dec.DecodeDuration32()
+// RetryVersion returns the version APIVersionsReq should be retried with,
+// when the broker rejected the request version with ErrUnsupportedVersion.
+// It is the highest version supported by both the broker and the driver.
+// False is returned if the response is not such rejection, or there is no
+// common version.
+func (r *APIVersionsResp) RetryVersion() (int16, bool) {
+	if r.Err != ErrUnsupportedVersion {
+		return 0, false
 	}
-
-	resp.Err = errFromNo(dec.DecodeInt16())
-	if version >= KafkaV1 {
-		resp.ErrMsg = dec.DecodeString()
+	supported := SupportedByDriver[APIVersionsReqKind]
+	for _, api := range r.APIVersions {
+		if api.APIKey != APIVersionsReqKind {
+			continue
+		}
+		version := api.MaxVersion
+		if version > supported.MaxVersion {
+			version = supported.MaxVersion
+		}
+		if version < api.MinVersion || version < supported.MinVersion {
+			return 0, false
+		}
+		return version, true
 	}
-	resp.CoordinatorID = dec.DecodeInt32()
-	resp.CoordinatorHost = dec.DecodeString()
-	resp.CoordinatorPort = dec.DecodeInt32()
+	return 0, false
+}
 
-	if err := dec.Err(); err != nil {
-		return nil, err
-	}
-	return &resp, nil
+// unsupportedVersion returns true if the response is sent in the KafkaV0
+// format, because the request version was rejected.
+func (r *APIVersionsResp) unsupportedVersion() bool {
+	return r.Err == ErrUnsupportedVersion
 }
 
-func (r *ConsumerMetadataResp) Bytes() ([]byte, error) {
+type SupportedVersion struct {
+	APIKey     int16
+	MinVersion int16
+	MaxVersion int16
+}
+
+func (r *APIVersionsResp) Bytes() ([]byte, error) {
 	var buf bytes.Buffer
 	enc := NewEncoder(&buf)
 
 	// message size - for now just placeholder
 	enc.EncodeInt32(0)
 	enc.EncodeInt32(r.CorrelationID)
-
-	if r.Version >= KafkaV1 {
-		enc.EncodeDuration(r.ThrottleTime)
-	}
-
 	enc.EncodeError(r.Err)
-
-	if r.Version >= KafkaV1 {
-		enc.EncodeString(r.ErrMsg)
+	enc.EncodeArrayLen(len(r.APIVersions))
+	for _, api := range r.APIVersions {
+		enc.EncodeInt16(api.APIKey)
+		enc.EncodeInt16(api.MinVersion)
+		enc.EncodeInt16(api.MaxVersion)
 	}
 
-	enc.EncodeInt32(r.CoordinatorID)
-	enc.EncodeString(r.CoordinatorHost)
-	enc.EncodeInt32(r.CoordinatorPort)
+	if r.Version >= KafkaV1 && !r.unsupportedVersion() {
+		enc.EncodeDuration(r.ThrottleTime)
+	}
 
 	if enc.Err() != nil {
 		return nil, enc.Err()
@@ -1430,72 +5202,58 @@ func (r *ConsumerMetadataResp) Bytes() ([]byte, error) {
 	return b, nil
 }
 
-type OffsetCommitReq struct {
-	RequestHeader
-	ConsumerGroup     string
-	GroupGenerationID int32  // >= KafkaV1 only
-	MemberID          string // >= KafkaV1 only
-	RetentionTime     int64  // >= KafkaV2 only
-	Topics            []OffsetCommitReqTopic
-}
-
-type OffsetCommitReqTopic struct {
-	Name       string
-	Partitions []OffsetCommitReqPartition
-}
-
-type OffsetCommitReqPartition struct {
-	ID        int32
-	Offset    int64
-	TimeStamp time.Time // == KafkaV1 only
-	Metadata  string
+func ReadAPIVersionsResp(r io.Reader) (*APIVersionsResp, error) {
+	return ReadVersionedAPIVersionsResp(r, KafkaV0)
 }
 
-func ReadOffsetCommitReq(r io.Reader) (*OffsetCommitReq, error) {
-	var req OffsetCommitReq
+func ReadVersionedAPIVersionsResp(r io.Reader, version int16) (*APIVersionsResp, error) {
+	var resp APIVersionsResp
+	resp.Version = version
 	dec := NewDecoder(r)
 
-	decodeHeader(dec, &req)
-
-	req.ConsumerGroup = dec.DecodeString()
-
-	if req.version >= KafkaV1 {
-		req.GroupGenerationID = dec.DecodeInt32()
-		req.MemberID = dec.DecodeString()
+	// total message size
+	_ = dec.DecodeInt32()
+	resp.CorrelationID = dec.DecodeInt32()
+	resp.Err = errFromNo(dec.DecodeInt16())
+	len, err := dec.DecodeArrayLen()
+	if err != nil {
+		return nil, err
 	}
 
-	if req.version >= KafkaV2 {
-		req.RetentionTime = dec.DecodeInt64()
+	resp.APIVersions = make([]SupportedVersion, len)
+	for i := range resp.APIVersions {
+		api := &resp.APIVersions[i]
+		api.APIKey = dec.DecodeInt16()
+		api.MinVersion = dec.DecodeInt16()
+		api.MaxVersion = dec.DecodeInt16()
 	}
 
-	len, err := dec.DecodeArrayLen()
-	if err != nil {
-		return nil, err
+	if version >= KafkaV1 && !resp.unsupportedVersion() {
+		resp.ThrottleTime = dec.DecodeDuration32()
 	}
-	req.Topics = make([]OffsetCommitReqTopic, len)
 
-	for ti := range req.Topics {
-		var topic = &req.Topics[ti]
-		topic.Name = dec.DecodeString()
+	if dec.Err() != nil {
+		return nil, dec.Err()
+	}
+	return &resp, nil
+}
 
-		len, err := dec.DecodeArrayLen()
-		if err != nil {
-			return nil, err
-		}
-		topic.Partitions = make([]OffsetCommitReqPartition, len)
+// InitProducerIdReq requests producer ID and epoch, required by idempotent
+// and transactional producers.
+type InitProducerIdReq struct {
+	RequestHeader
+	TransactionalID    string // empty for idempotent producer without transactions
+	TransactionTimeout time.Duration
+}
 
-		for pi := range topic.Partitions {
-			var part = &topic.Partitions[pi]
-			part.ID = dec.DecodeInt32()
-			part.Offset = dec.DecodeInt64()
+func ReadInitProducerIdReq(r io.Reader) (*InitProducerIdReq, error) {
+	var req InitProducerIdReq
+	dec := NewDecoder(r)
 
-			if req.version == KafkaV1 {
-				part.TimeStamp = time.Unix(0, dec.DecodeInt64()*int64(time.Millisecond))
-			}
+	decodeHeader(dec, &req)
 
-			part.Metadata = dec.DecodeString()
-		}
-	}
+	req.TransactionalID = dec.DecodeString()
+	req.TransactionTimeout = dec.DecodeDuration32()
 
 	if dec.Err() != nil {
 		return nil, dec.Err()
@@ -1503,43 +5261,22 @@ func ReadOffsetCommitReq(r io.Reader) (*OffsetCommitReq, error) {
 	return &req, nil
 }
 
-func (r OffsetCommitReq) Kind() int16 {
-	return OffsetCommitReqKind
+func (r InitProducerIdReq) Kind() int16 {
+	return InitProducerIdReqKind
 }
 
-func (r *OffsetCommitReq) Bytes() ([]byte, error) {
+func (r *InitProducerIdReq) Bytes() ([]byte, error) {
 	var buf bytes.Buffer
 	enc := NewEncoder(&buf)
 
 	encodeHeader(enc, r)
 
-	enc.EncodeString(r.ConsumerGroup)
-
-	if r.version >= KafkaV1 {
-		enc.EncodeInt32(r.GroupGenerationID)
-		enc.EncodeString(r.MemberID)
-	}
-
-	if r.version >= KafkaV2 {
-		enc.EncodeInt64(r.RetentionTime)
-	}
-
-	enc.EncodeArrayLen(len(r.Topics))
-	for _, topic := range r.Topics {
-		enc.EncodeString(topic.Name)
-		enc.EncodeArrayLen(len(topic.Partitions))
-		for _, part := range topic.Partitions {
-			enc.EncodeInt32(part.ID)
-			enc.EncodeInt64(part.Offset)
-
-			if r.version == KafkaV1 {
-				// TODO(husio) is this really in milliseconds?
-				enc.EncodeInt64(part.TimeStamp.UnixNano() / int64(time.Millisecond))
-			}
-
-			enc.EncodeString(part.Metadata)
-		}
+	if r.TransactionalID == "" {
+		enc.EncodeInt16(-1) // null
+	} else {
+		enc.EncodeString(r.TransactionalID)
 	}
+	enc.EncodeDuration(r.TransactionTimeout)
 
 	if enc.Err() != nil {
 		return nil, enc.Err()
@@ -1552,71 +5289,39 @@ func (r *OffsetCommitReq) Bytes() ([]byte, error) {
 	return b, nil
 }
 
-func (r *OffsetCommitReq) WriteTo(w io.Writer) (int64, error) {
+func (r *InitProducerIdReq) WriteTo(w io.Writer) (int64, error) {
 	b, err := r.Bytes()
 	if err != nil {
 		return 0, err
 	}
-	n, err := w.Write(b)
-	return int64(n), err
+	return writeFull(w, b)
 }
 
-type OffsetCommitResp struct {
+type InitProducerIdResp struct {
 	Version       int16
 	CorrelationID int32
-	ThrottleTime  time.Duration // >= KafkaV3 only
-	Topics        []OffsetCommitRespTopic
-}
-
-type OffsetCommitRespTopic struct {
-	Name       string
-	Partitions []OffsetCommitRespPartition
-}
-
-type OffsetCommitRespPartition struct {
-	ID  int32
-	Err error
+	ThrottleTime  time.Duration
+	Err           error
+	ProducerID    int64
+	ProducerEpoch int16
 }
 
-func ReadOffsetCommitResp(r io.Reader) (*OffsetCommitResp, error) {
-	return ReadVersionedOffsetCommitResp(r, KafkaV0)
+func ReadInitProducerIdResp(r io.Reader) (*InitProducerIdResp, error) {
+	return ReadVersionedInitProducerIdResp(r, KafkaV0)
 }
 
-func ReadVersionedOffsetCommitResp(r io.Reader, version int16) (*OffsetCommitResp, error) {
-	var resp OffsetCommitResp
+func ReadVersionedInitProducerIdResp(r io.Reader, version int16) (*InitProducerIdResp, error) {
+	var resp InitProducerIdResp
 	resp.Version = version
 	dec := NewDecoder(r)
 
 	// total message size
 	_ = dec.DecodeInt32()
 	resp.CorrelationID = dec.DecodeInt32()
-
-	if version >= KafkaV3 {
-		resp.ThrottleTime = dec.DecodeDuration32()
-	}
-
-	len, err := dec.DecodeArrayLen()
-	if err != nil {
-		return nil, err
-	}
-	resp.Topics = make([]OffsetCommitRespTopic, len)
-
-	for ti := range resp.Topics {
-		var t = &resp.Topics[ti]
-		t.Name = dec.DecodeString()
-
-		len, err := dec.DecodeArrayLen()
-		if err != nil {
-			return nil, err
-		}
-		t.Partitions = make([]OffsetCommitRespPartition, len)
-
-		for pi := range t.Partitions {
-			var p = &t.Partitions[pi]
-			p.ID = dec.DecodeInt32()
-			p.Err = errFromNo(dec.DecodeInt16())
-		}
-	}
+	resp.ThrottleTime = dec.DecodeDuration32()
+	resp.Err = errFromNo(dec.DecodeInt16())
+	resp.ProducerID = dec.DecodeInt64()
+	resp.ProducerEpoch = dec.DecodeInt16()
 
 	if err := dec.Err(); err != nil {
 		return nil, err
@@ -1624,27 +5329,17 @@ func ReadVersionedOffsetCommitResp(r io.Reader, version int16) (*OffsetCommitRes
 	return &resp, nil
 }
 
-func (r *OffsetCommitResp) Bytes() ([]byte, error) {
+func (r *InitProducerIdResp) Bytes() ([]byte, error) {
 	var buf bytes.Buffer
 	enc := NewEncoder(&buf)
 
 	// message size - for now just placeholder
 	enc.EncodeInt32(0)
 	enc.EncodeInt32(r.CorrelationID)
-
-	if r.Version >= KafkaV3 {
-		enc.EncodeDuration(r.ThrottleTime)
-	}
-
-	enc.EncodeArrayLen(len(r.Topics))
-	for _, t := range r.Topics {
-		enc.EncodeString(t.Name)
-		enc.EncodeArrayLen(len(t.Partitions))
-		for _, p := range t.Partitions {
-			enc.EncodeInt32(p.ID)
-			enc.EncodeError(p.Err)
-		}
-	}
+	enc.EncodeDuration(r.ThrottleTime)
+	enc.EncodeError(r.Err)
+	enc.EncodeInt64(r.ProducerID)
+	enc.EncodeInt16(r.ProducerEpoch)
 
 	if enc.Err() != nil {
 		return nil, enc.Err()
@@ -1655,43 +5350,47 @@ func (r *OffsetCommitResp) Bytes() ([]byte, error) {
 	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
 
 	return b, nil
-
 }
 
-type OffsetFetchReq struct {
+// AddPartitionsToTxnReq adds partitions to the ongoing transaction. It must
+// be sent before producing to a partition within the transaction.
+type AddPartitionsToTxnReq struct {
 	RequestHeader
-	ConsumerGroup string
-	Topics        []OffsetFetchReqTopic
+	TransactionalID string
+	ProducerID      int64
+	ProducerEpoch   int16
+	Topics          []AddPartitionsToTxnReqTopic
 }
 
-type OffsetFetchReqTopic struct {
+type AddPartitionsToTxnReqTopic struct {
 	Name       string
 	Partitions []int32
 }
 
-func ReadOffsetFetchReq(r io.Reader) (*OffsetFetchReq, error) {
-	var req OffsetFetchReq
+func ReadAddPartitionsToTxnReq(r io.Reader) (*AddPartitionsToTxnReq, error) {
+	var req AddPartitionsToTxnReq
 	dec := NewDecoder(r)
 
 	decodeHeader(dec, &req)
 
-	req.ConsumerGroup = dec.DecodeString()
+	req.TransactionalID = dec.DecodeString()
+	req.ProducerID = dec.DecodeInt64()
+	req.ProducerEpoch = dec.DecodeInt16()
 
 	len, err := dec.DecodeArrayLen()
 	if err != nil {
 		return nil, err
 	}
-	req.Topics = make([]OffsetFetchReqTopic, len)
-
+	req.Topics = make([]AddPartitionsToTxnReqTopic, len)
 	for ti := range req.Topics {
 		var topic = &req.Topics[ti]
 		topic.Name = dec.DecodeString()
-		len, err = dec.DecodeArrayLen()
+
+		len, err := dec.DecodeArrayLen()
 		if err != nil {
 			return nil, err
 		}
 		topic.Partitions = make([]int32, len)
-
 		for pi := range topic.Partitions {
 			topic.Partitions[pi] = dec.DecodeInt32()
 		}
@@ -1703,21 +5402,23 @@ func ReadOffsetFetchReq(r io.Reader) (*OffsetFetchReq, error) {
 	return &req, nil
 }
 
-func (r OffsetFetchReq) Kind() int16 {
-	return OffsetFetchReqKind
+func (r AddPartitionsToTxnReq) Kind() int16 {
+	return AddPartitionsToTxnReqKind
 }
 
-func (r *OffsetFetchReq) Bytes() ([]byte, error) {
+func (r *AddPartitionsToTxnReq) Bytes() ([]byte, error) {
 	var buf bytes.Buffer
 	enc := NewEncoder(&buf)
 
 	encodeHeader(enc, r)
 
-	enc.EncodeString(r.ConsumerGroup)
+	enc.EncodeString(r.TransactionalID)
+	enc.EncodeInt64(r.ProducerID)
+	enc.EncodeInt16(r.ProducerEpoch)
 	enc.EncodeArrayLen(len(r.Topics))
-	for _, t := range r.Topics {
-		enc.EncodeString(t.Name)
-		enc.EncodeInt32s(t.Partitions)
+	for _, topic := range r.Topics {
+		enc.EncodeString(topic.Name)
+		enc.EncodeInt32s(topic.Partitions)
 	}
 
 	if enc.Err() != nil {
@@ -1731,116 +5432,90 @@ func (r *OffsetFetchReq) Bytes() ([]byte, error) {
 	return b, nil
 }
 
-func (r *OffsetFetchReq) WriteTo(w io.Writer) (int64, error) {
+func (r *AddPartitionsToTxnReq) WriteTo(w io.Writer) (int64, error) {
 	b, err := r.Bytes()
 	if err != nil {
 		return 0, err
 	}
-	n, err := w.Write(b)
-	return int64(n), err
+	return writeFull(w, b)
 }
 
-type OffsetFetchResp struct {
+type AddPartitionsToTxnResp struct {
 	Version       int16
 	CorrelationID int32
-	ThrottleTime  time.Duration // >= KafkaV3
-	Topics        []OffsetFetchRespTopic
-	Err           error // >= KafkaV2
+	ThrottleTime  time.Duration
+	Topics        []AddPartitionsToTxnRespTopic
 }
 
-type OffsetFetchRespTopic struct {
+type AddPartitionsToTxnRespTopic struct {
 	Name       string
-	Partitions []OffsetFetchRespPartition
+	Partitions []AddPartitionsToTxnRespPartition
 }
 
-type OffsetFetchRespPartition struct {
-	ID       int32
-	Offset   int64
-	Metadata string
-	Err      error
+type AddPartitionsToTxnRespPartition struct {
+	ID  int32
+	Err error
 }
 
-func ReadOffsetFetchResp(r io.Reader) (*OffsetFetchResp, error) {
-	return ReadVersionedOffsetFetchResp(r, KafkaV0)
+func ReadAddPartitionsToTxnResp(r io.Reader) (*AddPartitionsToTxnResp, error) {
+	return ReadVersionedAddPartitionsToTxnResp(r, KafkaV0)
 }
 
-func ReadVersionedOffsetFetchResp(r io.Reader, version int16) (*OffsetFetchResp, error) {
-	var resp OffsetFetchResp
+func ReadVersionedAddPartitionsToTxnResp(r io.Reader, version int16) (*AddPartitionsToTxnResp, error) {
+	var resp AddPartitionsToTxnResp
+	resp.Version = version
 	dec := NewDecoder(r)
 
 	// total message size
 	_ = dec.DecodeInt32()
 	resp.CorrelationID = dec.DecodeInt32()
-
-	resp.Version = version
-
-	if version >= KafkaV3 {
-		resp.ThrottleTime = dec.DecodeDuration32()
-	}
+	resp.ThrottleTime = dec.DecodeDuration32()
 
 	len, err := dec.DecodeArrayLen()
 	if err != nil {
 		return nil, err
 	}
-	resp.Topics = make([]OffsetFetchRespTopic, len)
-
+	resp.Topics = make([]AddPartitionsToTxnRespTopic, len)
 	for ti := range resp.Topics {
-		var t = &resp.Topics[ti]
-		t.Name = dec.DecodeString()
+		var topic = &resp.Topics[ti]
+		topic.Name = dec.DecodeString()
 
-		len, err = dec.DecodeArrayLen()
+		len, err := dec.DecodeArrayLen()
 		if err != nil {
 			return nil, err
 		}
-		t.Partitions = make([]OffsetFetchRespPartition, len)
-
-		for pi := range t.Partitions {
-			var p = &t.Partitions[pi]
-			p.ID = dec.DecodeInt32()
-			p.Offset = dec.DecodeInt64()
-			p.Metadata = dec.DecodeString()
-			p.Err = errFromNo(dec.DecodeInt16())
+		topic.Partitions = make([]AddPartitionsToTxnRespPartition, len)
+		for pi := range topic.Partitions {
+			var part = &topic.Partitions[pi]
+			part.ID = dec.DecodeInt32()
+			part.Err = errFromNo(dec.DecodeInt16())
 		}
 	}
 
-	if version >= KafkaV2 {
-		resp.Err = errFromNo(dec.DecodeInt16())
-	}
-
 	if err := dec.Err(); err != nil {
 		return nil, err
 	}
 	return &resp, nil
 }
 
-func (r *OffsetFetchResp) Bytes() ([]byte, error) {
+func (r *AddPartitionsToTxnResp) Bytes() ([]byte, error) {
 	var buf bytes.Buffer
 	enc := NewEncoder(&buf)
 
 	// message size - for now just placeholder
 	enc.EncodeInt32(0)
 	enc.EncodeInt32(r.CorrelationID)
-
-	if r.Version >= KafkaV3 {
-		enc.EncodeDuration(r.ThrottleTime)
-	}
-
+	enc.EncodeDuration(r.ThrottleTime)
 	enc.EncodeArrayLen(len(r.Topics))
 	for _, topic := range r.Topics {
 		enc.EncodeString(topic.Name)
 		enc.EncodeArrayLen(len(topic.Partitions))
 		for _, part := range topic.Partitions {
 			enc.EncodeInt32(part.ID)
-			enc.EncodeInt64(part.Offset)
-			enc.EncodeString(part.Metadata)
 			enc.EncodeError(part.Err)
 		}
 	}
 
-	if r.Version >= KafkaV2 {
-		enc.EncodeError(r.Err)
-	}
-
 	if enc.Err() != nil {
 		return nil, enc.Err()
 	}
@@ -1852,170 +5527,213 @@ func (r *OffsetFetchResp) Bytes() ([]byte, error) {
 	return b, nil
 }
 
-type ProduceReq struct {
+// AddOffsetsToTxnReq adds the offsets of given consumer group to the ongoing
+// transaction, so that they can be committed with TxnOffsetCommit request.
+type AddOffsetsToTxnReq struct {
 	RequestHeader
-	Compression     Compression // only used when sending ProduceReqs
 	TransactionalID string
-	RequiredAcks    int16
-	Timeout         time.Duration
-	Topics          []ProduceReqTopic
+	ProducerID      int64
+	ProducerEpoch   int16
+	ConsumerGroup   string
 }
 
-type ProduceReqTopic struct {
-	Name       string
-	Partitions []ProduceReqPartition
+func ReadAddOffsetsToTxnReq(r io.Reader) (*AddOffsetsToTxnReq, error) {
+	var req AddOffsetsToTxnReq
+	dec := NewDecoder(r)
+
+	decodeHeader(dec, &req)
+
+	req.TransactionalID = dec.DecodeString()
+	req.ProducerID = dec.DecodeInt64()
+	req.ProducerEpoch = dec.DecodeInt16()
+	req.ConsumerGroup = dec.DecodeString()
+
+	if dec.Err() != nil {
+		return nil, dec.Err()
+	}
+	return &req, nil
 }
 
-type ProduceReqPartition struct {
-	ID       int32
-	Messages []*Message
+func (r AddOffsetsToTxnReq) Kind() int16 {
+	return AddOffsetsToTxnReqKind
 }
 
-func ReadProduceReq(r io.Reader) (*ProduceReq, error) {
-	var req ProduceReq
-	dec := NewDecoder(r)
+func (r *AddOffsetsToTxnReq) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
 
-	decodeHeader(dec, &req)
+	encodeHeader(enc, r)
 
-	if req.version >= KafkaV3 {
-		req.TransactionalID = dec.DecodeString()
+	enc.EncodeString(r.TransactionalID)
+	enc.EncodeInt64(r.ProducerID)
+	enc.EncodeInt16(r.ProducerEpoch)
+	enc.EncodeString(r.ConsumerGroup)
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
 	}
 
-	req.RequiredAcks = dec.DecodeInt16()
-	req.Timeout = time.Duration(dec.DecodeInt32()) * time.Millisecond
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
 
-	len, err := dec.DecodeArrayLen()
+	return b, nil
+}
+
+func (r *AddOffsetsToTxnReq) WriteTo(w io.Writer) (int64, error) {
+	b, err := r.Bytes()
 	if err != nil {
+		return 0, err
+	}
+	return writeFull(w, b)
+}
+
+type AddOffsetsToTxnResp struct {
+	Version       int16
+	CorrelationID int32
+	ThrottleTime  time.Duration
+	Err           error
+}
+
+func ReadAddOffsetsToTxnResp(r io.Reader) (*AddOffsetsToTxnResp, error) {
+	return ReadVersionedAddOffsetsToTxnResp(r, KafkaV0)
+}
+
+func ReadVersionedAddOffsetsToTxnResp(r io.Reader, version int16) (*AddOffsetsToTxnResp, error) {
+	var resp AddOffsetsToTxnResp
+	resp.Version = version
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	resp.CorrelationID = dec.DecodeInt32()
+	resp.ThrottleTime = dec.DecodeDuration32()
+	resp.Err = errFromNo(dec.DecodeInt16())
+
+	if err := dec.Err(); err != nil {
 		return nil, err
 	}
-	req.Topics = make([]ProduceReqTopic, len)
+	return &resp, nil
+}
 
-	for ti := range req.Topics {
-		var topic = &req.Topics[ti]
-		topic.Name = dec.DecodeString()
+func (r *AddOffsetsToTxnResp) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
 
-		len, err = dec.DecodeArrayLen()
-		if err != nil {
-			return nil, err
-		}
-		topic.Partitions = make([]ProduceReqPartition, len)
+	// message size - for now just placeholder
+	enc.EncodeInt32(0)
+	enc.EncodeInt32(r.CorrelationID)
+	enc.EncodeDuration(r.ThrottleTime)
+	enc.EncodeError(r.Err)
 
-		for pi := range topic.Partitions {
-			var part = &topic.Partitions[pi]
-			part.ID = dec.DecodeInt32()
-			if dec.Err() != nil {
-				return nil, dec.Err()
-			}
-			msgSetSize := dec.DecodeInt32()
-			if dec.Err() != nil {
-				return nil, dec.Err()
-			}
-			var err error
-			if part.Messages, err = readMessageSet(r, msgSetSize); err != nil {
-				return nil, err
-			}
-		}
+	if enc.Err() != nil {
+		return nil, enc.Err()
 	}
 
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+// EndTxnReq commits or aborts the ongoing transaction.
+type EndTxnReq struct {
+	RequestHeader
+	TransactionalID string
+	ProducerID      int64
+	ProducerEpoch   int16
+	Commit          bool // false aborts the transaction
+}
+
+func ReadEndTxnReq(r io.Reader) (*EndTxnReq, error) {
+	var req EndTxnReq
+	dec := NewDecoder(r)
+
+	decodeHeader(dec, &req)
+
+	req.TransactionalID = dec.DecodeString()
+	req.ProducerID = dec.DecodeInt64()
+	req.ProducerEpoch = dec.DecodeInt16()
+	req.Commit = dec.DecodeInt8() != 0
+
 	if dec.Err() != nil {
 		return nil, dec.Err()
 	}
 	return &req, nil
 }
 
-func (r ProduceReq) Kind() int16 {
-	return ProduceReqKind
+func (r EndTxnReq) Kind() int16 {
+	return EndTxnReqKind
 }
 
-func (r *ProduceReq) Bytes() ([]byte, error) {
-	var buf buffer
+func (r *EndTxnReq) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
 	enc := NewEncoder(&buf)
 
 	encodeHeader(enc, r)
 
-	if r.version >= KafkaV3 {
-		enc.EncodeString(r.TransactionalID)
-	}
-
-	enc.EncodeInt16(r.RequiredAcks)
-	enc.EncodeInt32(int32(r.Timeout / time.Millisecond))
-	enc.EncodeArrayLen(len(r.Topics))
-	for _, t := range r.Topics {
-		enc.EncodeString(t.Name)
-		enc.EncodeArrayLen(len(t.Partitions))
-		for _, p := range t.Partitions {
-			enc.EncodeInt32(p.ID)
-			i := len(buf)
-			enc.EncodeInt32(0) // placeholder
-			n, err := writeMessageSet(&buf, p.Messages, r.Compression)
-			if err != nil {
-				return nil, err
-			}
-			binary.BigEndian.PutUint32(buf[i:i+4], uint32(n))
-		}
-	}
+	enc.EncodeString(r.TransactionalID)
+	enc.EncodeInt64(r.ProducerID)
+	enc.EncodeInt16(r.ProducerEpoch)
+	enc.EncodeInt8(boolToInt8(r.Commit))
 
 	if enc.Err() != nil {
 		return nil, enc.Err()
 	}
 
-	binary.BigEndian.PutUint32(buf[0:4], uint32(len(buf)-4))
-	return []byte(buf), nil
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
 }
 
-func (r *ProduceReq) WriteTo(w io.Writer) (int64, error) {
+func (r *EndTxnReq) WriteTo(w io.Writer) (int64, error) {
 	b, err := r.Bytes()
 	if err != nil {
 		return 0, err
 	}
-	n, err := w.Write(b)
-	return int64(n), err
+	return writeFull(w, b)
 }
 
-type ProduceResp struct {
+type EndTxnResp struct {
 	Version       int16
 	CorrelationID int32
-	Topics        []ProduceRespTopic
 	ThrottleTime  time.Duration
+	Err           error
 }
 
-type ProduceRespTopic struct {
-	Name       string
-	Partitions []ProduceRespPartition
-}
-
-type ProduceRespPartition struct {
-	ID            int32
-	Err           error
-	Offset        int64
-	LogAppendTime int64
+func ReadEndTxnResp(r io.Reader) (*EndTxnResp, error) {
+	return ReadVersionedEndTxnResp(r, KafkaV0)
 }
 
-func (r *ProduceResp) Bytes() ([]byte, error) {
-	var buf bytes.Buffer
-	enc := NewEncoder(&buf)
+func ReadVersionedEndTxnResp(r io.Reader, version int16) (*EndTxnResp, error) {
+	var resp EndTxnResp
+	resp.Version = version
+	dec := NewDecoder(r)
 
-	// message size - for now just placeholder
-	enc.EncodeInt32(0)
-	enc.EncodeInt32(r.CorrelationID)
-	enc.EncodeArrayLen(len(r.Topics))
-	for _, topic := range r.Topics {
-		enc.EncodeString(topic.Name)
-		enc.EncodeArrayLen(len(topic.Partitions))
-		for _, part := range topic.Partitions {
-			enc.EncodeInt32(part.ID)
-			enc.EncodeError(part.Err)
-			enc.EncodeInt64(part.Offset)
+	// total message size
+	_ = dec.DecodeInt32()
+	resp.CorrelationID = dec.DecodeInt32()
+	resp.ThrottleTime = dec.DecodeDuration32()
+	resp.Err = errFromNo(dec.DecodeInt16())
 
-			if r.Version >= KafkaV2 {
-				enc.EncodeInt64(part.LogAppendTime)
-			}
-		}
+	if err := dec.Err(); err != nil {
+		return nil, err
 	}
+	return &resp, nil
+}
 
-	if r.Version >= KafkaV1 {
-		enc.EncodeDuration(r.ThrottleTime)
-	}
+func (r *EndTxnResp) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.EncodeInt32(0)
+	enc.EncodeInt32(r.CorrelationID)
+	enc.EncodeDuration(r.ThrottleTime)
+	enc.EncodeError(r.Err)
 
 	if enc.Err() != nil {
 		return nil, enc.Err()
@@ -2028,116 +5746,148 @@ func (r *ProduceResp) Bytes() ([]byte, error) {
 	return b, nil
 }
 
-func ReadProduceResp(r io.Reader) (*ProduceResp, error) {
-	return ReadVersionedProduceResp(r, KafkaV0)
-}
-
-func ReadVersionedProduceResp(r io.Reader, version int16) (*ProduceResp, error) {
-	var resp ProduceResp
-	dec := NewDecoder(r)
-	resp.Version = version
-
-	// total message size
-	_ = dec.DecodeInt32()
-	resp.CorrelationID = dec.DecodeInt32()
-	len, err := dec.DecodeArrayLen()
-	if err != nil {
-		return nil, err
-	}
-	resp.Topics = make([]ProduceRespTopic, len)
+// Resource types of ACL bindings.
+const (
+	AclResourceUnknown         = 0
+	AclResourceAny             = 1 // only used by filters
+	AclResourceTopic           = 2
+	AclResourceGroup           = 3
+	AclResourceCluster         = 4
+	AclResourceTransactionalID = 5
+	AclResourceDelegationToken = 6
+)
 
-	for ti := range resp.Topics {
-		var t = &resp.Topics[ti]
-		t.Name = dec.DecodeString()
+// Pattern types of ACL binding resource names, supported by KafkaV1 and newer
+// ACL requests. Older versions always use AclPatternLiteral.
+const (
+	AclPatternUnknown  = 0
+	AclPatternAny      = 1 // only used by filters
+	AclPatternMatch    = 2 // only used by filters
+	AclPatternLiteral  = 3
+	AclPatternPrefixed = 4
+)
 
-		len, err = dec.DecodeArrayLen()
-		if err != nil {
-			return nil, err
-		}
-		t.Partitions = make([]ProduceRespPartition, len)
+// Operations of ACL bindings.
+const (
+	AclOperationUnknown         = 0
+	AclOperationAny             = 1 // only used by filters
+	AclOperationAll             = 2
+	AclOperationRead            = 3
+	AclOperationWrite           = 4
+	AclOperationCreate          = 5
+	AclOperationDelete          = 6
+	AclOperationAlter           = 7
+	AclOperationDescribe        = 8
+	AclOperationClusterAction   = 9
+	AclOperationDescribeConfigs = 10
+	AclOperationAlterConfigs    = 11
+	AclOperationIdempotentWrite = 12
+)
 
-		for pi := range t.Partitions {
-			var p = &t.Partitions[pi]
-			p.ID = dec.DecodeInt32()
-			p.Err = errFromNo(dec.DecodeInt16())
-			p.Offset = dec.DecodeInt64()
-			if resp.Version >= KafkaV2 {
-				p.LogAppendTime = dec.DecodeInt64()
-			}
-		}
-	}
+// Permission types of ACL bindings.
+const (
+	AclPermissionUnknown = 0
+	AclPermissionAny     = 1 // only used by filters
+	AclPermissionDeny    = 2
+	AclPermissionAllow   = 3
+)
 
-	if resp.Version >= KafkaV1 {
-		resp.ThrottleTime = dec.DecodeDuration32()
+// AclBinding grants or denies the principal connecting from the host an
+// operation on the resource.
+type AclBinding struct {
+	ResourceType   int8
+	ResourceName   string
+	PatternType    int8 // >= KafkaV1
+	Principal      string
+	Host           string
+	Operation      int8
+	PermissionType int8
+}
+
+func encodeAclBinding(enc *encoder, version int16, b *AclBinding) {
+	enc.EncodeInt8(b.ResourceType)
+	enc.EncodeString(b.ResourceName)
+	if version >= KafkaV1 {
+		enc.EncodeInt8(b.PatternType)
 	}
+	enc.EncodeString(b.Principal)
+	enc.EncodeString(b.Host)
+	enc.EncodeInt8(b.Operation)
+	enc.EncodeInt8(b.PermissionType)
+}
 
-	if err := dec.Err(); err != nil {
-		return nil, err
+func decodeAclBinding(dec *decoder, version int16, b *AclBinding) {
+	b.ResourceType = dec.DecodeInt8()
+	b.ResourceName = dec.DecodeString()
+	if version >= KafkaV1 {
+		b.PatternType = dec.DecodeInt8()
+	}
+	b.Principal = dec.DecodeString()
+	b.Host = dec.DecodeString()
+	b.Operation = dec.DecodeInt8()
+	b.PermissionType = dec.DecodeInt8()
+}
+
+// AclFilter selects ACL bindings. Resource name, principal and host are
+// nullable and empty string matches any value, while AclResourceAny,
+// AclPatternAny, AclOperationAny and AclPermissionAny match any resource
+// type, pattern type, operation and permission type.
+type AclFilter struct {
+	ResourceType   int8
+	ResourceName   string
+	PatternType    int8 // >= KafkaV1
+	Principal      string
+	Host           string
+	Operation      int8
+	PermissionType int8
+}
+
+// encodeNullableString encodes empty string as null.
+func encodeNullableString(enc *encoder, s string) {
+	if s == "" {
+		enc.EncodeInt16(-1) // null
+	} else {
+		enc.EncodeString(s)
 	}
-	return &resp, nil
 }
 
-type OffsetReq struct {
-	RequestHeader
-	ReplicaID      int32
-	IsolationLevel int8
-	Topics         []OffsetReqTopic
+func encodeAclFilter(enc *encoder, version int16, f *AclFilter) {
+	enc.EncodeInt8(f.ResourceType)
+	encodeNullableString(enc, f.ResourceName)
+	if version >= KafkaV1 {
+		enc.EncodeInt8(f.PatternType)
+	}
+	encodeNullableString(enc, f.Principal)
+	encodeNullableString(enc, f.Host)
+	enc.EncodeInt8(f.Operation)
+	enc.EncodeInt8(f.PermissionType)
 }
 
-type OffsetReqTopic struct {
-	Name       string
-	Partitions []OffsetReqPartition
+func decodeAclFilter(dec *decoder, version int16, f *AclFilter) {
+	f.ResourceType = dec.DecodeInt8()
+	f.ResourceName = dec.DecodeString()
+	if version >= KafkaV1 {
+		f.PatternType = dec.DecodeInt8()
+	}
+	f.Principal = dec.DecodeString()
+	f.Host = dec.DecodeString()
+	f.Operation = dec.DecodeInt8()
+	f.PermissionType = dec.DecodeInt8()
 }
 
-type OffsetReqPartition struct {
-	ID         int32
-	TimeMs     int64 // cannot be time.Time because of negative values
-	MaxOffsets int32 // == KafkaV0 only
+// DescribeAclsReq lists ACL bindings matching the filter.
+type DescribeAclsReq struct {
+	RequestHeader
+	Filter AclFilter
 }
 
-func ReadOffsetReq(r io.Reader) (*OffsetReq, error) {
-	var req OffsetReq
+func ReadDescribeAclsReq(r io.Reader) (*DescribeAclsReq, error) {
+	var req DescribeAclsReq
 	dec := NewDecoder(r)
 
-	// total message size
-	_ = dec.DecodeInt32()
-	// api key
-	_ = dec.DecodeInt16()
-	req.version = dec.DecodeInt16()
-	req.correlationID = dec.DecodeInt32()
-	req.ClientID = dec.DecodeString()
-	req.ReplicaID = dec.DecodeInt32()
-
-	if req.version >= KafkaV2 {
-		req.IsolationLevel = dec.DecodeInt8()
-	}
-
-	len, err := dec.DecodeArrayLen()
-	if err != nil {
-		return nil, err
-	}
-	req.Topics = make([]OffsetReqTopic, len)
-
-	for ti := range req.Topics {
-		var topic = &req.Topics[ti]
-		topic.Name = dec.DecodeString()
-
-		len, err = dec.DecodeArrayLen()
-		if err != nil {
-			return nil, err
-		}
-		topic.Partitions = make([]OffsetReqPartition, len)
-
-		for pi := range topic.Partitions {
-			var part = &topic.Partitions[pi]
-			part.ID = dec.DecodeInt32()
-			part.TimeMs = dec.DecodeInt64()
+	decodeHeader(dec, &req)
 
-			if req.version == KafkaV0 {
-				part.MaxOffsets = dec.DecodeInt32()
-			}
-		}
-	}
+	decodeAclFilter(dec, req.version, &req.Filter)
 
 	if dec.Err() != nil {
 		return nil, dec.Err()
@@ -2145,36 +5895,17 @@ func ReadOffsetReq(r io.Reader) (*OffsetReq, error) {
 	return &req, nil
 }
 
-func (r OffsetReq) Kind() int16 {
-	return OffsetReqKind
+func (r DescribeAclsReq) Kind() int16 {
+	return DescribeAclsReqKind
 }
 
-func (r *OffsetReq) Bytes() ([]byte, error) {
+func (r *DescribeAclsReq) Bytes() ([]byte, error) {
 	var buf bytes.Buffer
 	enc := NewEncoder(&buf)
 
 	encodeHeader(enc, r)
 
-	//enc.Encode(r.ReplicaID)
-	enc.EncodeInt32(-1)
-
-	if r.version >= KafkaV2 {
-		enc.EncodeInt8(r.IsolationLevel)
-	}
-
-	enc.EncodeArrayLen(len(r.Topics))
-	for _, topic := range r.Topics {
-		enc.EncodeString(topic.Name)
-		enc.EncodeArrayLen(len(topic.Partitions))
-		for _, part := range topic.Partitions {
-			enc.EncodeInt32(part.ID)
-			enc.EncodeInt64(part.TimeMs)
-
-			if r.version == KafkaV0 {
-				enc.EncodeInt32(part.MaxOffsets)
-			}
-		}
-	}
+	encodeAclFilter(enc, r.version, &r.Filter)
 
 	if enc.Err() != nil {
 		return nil, enc.Err()
@@ -2187,90 +5918,96 @@ func (r *OffsetReq) Bytes() ([]byte, error) {
 	return b, nil
 }
 
-func (r *OffsetReq) WriteTo(w io.Writer) (int64, error) {
+func (r *DescribeAclsReq) WriteTo(w io.Writer) (int64, error) {
 	b, err := r.Bytes()
 	if err != nil {
 		return 0, err
 	}
-	n, err := w.Write(b)
-	return int64(n), err
+	return writeFull(w, b)
 }
 
-type OffsetResp struct {
+type DescribeAclsResp struct {
 	Version       int16
 	CorrelationID int32
 	ThrottleTime  time.Duration
-	Topics        []OffsetRespTopic
-}
-
-type OffsetRespTopic struct {
-	Name       string
-	Partitions []OffsetRespPartition
-}
-
-type OffsetRespPartition struct {
-	ID        int32
-	Err       error
-	TimeStamp time.Time // >= KafkaV1 only
-	Offsets   []int64   // used in KafkaV0
+	Err           error
+	ErrorMessage  string
+	Resources     []DescribeAclsRespResource
+}
+
+type DescribeAclsRespResource struct {
+	ResourceType int8
+	ResourceName string
+	PatternType  int8 // >= KafkaV1
+	Acls         []DescribeAclsRespAcl
+}
+
+type DescribeAclsRespAcl struct {
+	Principal      string
+	Host           string
+	Operation      int8
+	PermissionType int8
+}
+
+// Bindings returns the ACL bindings of all resources of the response.
+func (r *DescribeAclsResp) Bindings() []AclBinding {
+	var bindings []AclBinding
+	for _, res := range r.Resources {
+		for _, acl := range res.Acls {
+			bindings = append(bindings, AclBinding{
+				ResourceType:   res.ResourceType,
+				ResourceName:   res.ResourceName,
+				PatternType:    res.PatternType,
+				Principal:      acl.Principal,
+				Host:           acl.Host,
+				Operation:      acl.Operation,
+				PermissionType: acl.PermissionType,
+			})
+		}
+	}
+	return bindings
 }
 
-func ReadOffsetResp(r io.Reader) (*OffsetResp, error) {
-	return ReadVersionedOffsetResp(r, KafkaV0)
+func ReadDescribeAclsResp(r io.Reader) (*DescribeAclsResp, error) {
+	return ReadVersionedDescribeAclsResp(r, KafkaV0)
 }
 
-func ReadVersionedOffsetResp(r io.Reader, version int16) (*OffsetResp, error) {
-	var resp OffsetResp
-	dec := NewDecoder(r)
+func ReadVersionedDescribeAclsResp(r io.Reader, version int16) (*DescribeAclsResp, error) {
+	var resp DescribeAclsResp
 	resp.Version = version
+	dec := NewDecoder(r)
 
 	// total message size
 	_ = dec.DecodeInt32()
 	resp.CorrelationID = dec.DecodeInt32()
-
-	if version >= KafkaV2 {
-		resp.ThrottleTime = dec.DecodeDuration32()
-	}
+	resp.ThrottleTime = dec.DecodeDuration32()
+	resp.Err = errFromNo(dec.DecodeInt16())
+	resp.ErrorMessage = dec.DecodeString()
 
 	len, err := dec.DecodeArrayLen()
 	if err != nil {
 		return nil, err
 	}
-	resp.Topics = make([]OffsetRespTopic, len)
-
-	for ti := range resp.Topics {
-		var t = &resp.Topics[ti]
-		t.Name = dec.DecodeString()
+	resp.Resources = make([]DescribeAclsRespResource, len)
+	for i := range resp.Resources {
+		var res = &resp.Resources[i]
+		res.ResourceType = dec.DecodeInt8()
+		res.ResourceName = dec.DecodeString()
+		if version >= KafkaV1 {
+			res.PatternType = dec.DecodeInt8()
+		}
 
-		len, err = dec.DecodeArrayLen()
+		len, err := dec.DecodeArrayLen()
 		if err != nil {
 			return nil, err
 		}
-		t.Partitions = make([]OffsetRespPartition, len)
-
-		for pi := range t.Partitions {
-			var p = &t.Partitions[pi]
-			p.ID = dec.DecodeInt32()
-			p.Err = errFromNo(dec.DecodeInt16())
-
-			if version >= KafkaV1 {
-				p.TimeStamp = time.Unix(0, dec.DecodeInt64()*int64(time.Millisecond))
-
-				// in kafka >= KafkaV1 offset can be only one number.
-				// But for compatibility we still use slice
-				offset := dec.DecodeInt64()
-				p.Offsets = []int64{offset}
-			} else {
-				len, err = dec.DecodeArrayLen()
-				if err != nil {
-					return nil, err
-				}
-				p.Offsets = make([]int64, len)
-
-				for oi := range p.Offsets {
-					p.Offsets[oi] = dec.DecodeInt64()
-				}
-			}
+		res.Acls = make([]DescribeAclsRespAcl, len)
+		for ai := range res.Acls {
+			var acl = &res.Acls[ai]
+			acl.Principal = dec.DecodeString()
+			acl.Host = dec.DecodeString()
+			acl.Operation = dec.DecodeInt8()
+			acl.PermissionType = dec.DecodeInt8()
 		}
 	}
 
@@ -2280,39 +6017,29 @@ func ReadVersionedOffsetResp(r io.Reader, version int16) (*OffsetResp, error) {
 	return &resp, nil
 }
 
-func (r *OffsetResp) Bytes() ([]byte, error) {
+func (r *DescribeAclsResp) Bytes() ([]byte, error) {
 	var buf bytes.Buffer
 	enc := NewEncoder(&buf)
 
 	// message size - for now just placeholder
 	enc.EncodeInt32(0)
 	enc.EncodeInt32(r.CorrelationID)
-
-	if r.Version >= KafkaV2 {
-		enc.EncodeDuration(r.ThrottleTime)
-	}
-
-	enc.EncodeArrayLen(len(r.Topics))
-	for _, topic := range r.Topics {
-		enc.EncodeString(topic.Name)
-		enc.EncodeArrayLen(len(topic.Partitions))
-		for _, part := range topic.Partitions {
-			enc.EncodeInt32(part.ID)
-			enc.EncodeError(part.Err)
-
-			if r.Version >= KafkaV1 {
-				enc.EncodeInt64(part.TimeStamp.UnixNano() / int64(time.Millisecond))
-
-				// in kafka >= KafkaV1 offset can be only one value.
-				// In this case we use first element of slice
-				var offset int64
-				if len(part.Offsets) > 0 {
-					offset = part.Offsets[0]
-				}
-				enc.EncodeInt64(offset)
-			} else {
-				enc.EncodeInt64s(part.Offsets)
-			}
+	enc.EncodeDuration(r.ThrottleTime)
+	enc.EncodeError(r.Err)
+	encodeNullableString(enc, r.ErrorMessage)
+	enc.EncodeArrayLen(len(r.Resources))
+	for _, res := range r.Resources {
+		enc.EncodeInt8(res.ResourceType)
+		enc.EncodeString(res.ResourceName)
+		if r.Version >= KafkaV1 {
+			enc.EncodeInt8(res.PatternType)
+		}
+		enc.EncodeArrayLen(len(res.Acls))
+		for _, acl := range res.Acls {
+			enc.EncodeString(acl.Principal)
+			enc.EncodeString(acl.Host)
+			enc.EncodeInt8(acl.Operation)
+			enc.EncodeInt8(acl.PermissionType)
 		}
 	}
 
@@ -2324,35 +6051,18 @@ func (r *OffsetResp) Bytes() ([]byte, error) {
 	b := buf.Bytes()
 	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
 
-	return b, nil
-}
-
-type ReplicaAssignment struct {
-	Partition int32
-	Replicas  []int32
-}
-type ConfigEntry struct {
-	ConfigName  string
-	ConfigValue string
-}
-
-type TopicInfo struct {
-	Topic              string
-	NumPartitions      int32
-	ReplicationFactor  int16
-	ReplicaAssignments []ReplicaAssignment
-	ConfigEntries      []ConfigEntry
+	return b, nil
 }
 
-type CreateTopicsReq struct {
+// CreateAclsReq creates ACL bindings. Each creation is reported with its own
+// result in the response.
+type CreateAclsReq struct {
 	RequestHeader
-	CreateTopicsRequests []TopicInfo
-	Timeout              time.Duration
-	ValidateOnly         bool
+	Creations []AclBinding
 }
 
-func ReadCreateTopicsReq(r io.Reader) (*CreateTopicsReq, error) {
-	var req CreateTopicsReq
+func ReadCreateAclsReq(r io.Reader) (*CreateAclsReq, error) {
+	var req CreateAclsReq
 	dec := NewDecoder(r)
 
 	decodeHeader(dec, &req)
@@ -2361,46 +6071,9 @@ func ReadCreateTopicsReq(r io.Reader) (*CreateTopicsReq, error) {
 	if err != nil {
 		return nil, err
 	}
-	req.CreateTopicsRequests = make([]TopicInfo, len)
-
-	for i := range req.CreateTopicsRequests {
-		ti := TopicInfo{}
-		ti.Topic = dec.DecodeString()
-		ti.NumPartitions = dec.DecodeInt32()
-		ti.ReplicationFactor = dec.DecodeInt16()
-		len, err := dec.DecodeArrayLen()
-		if err != nil {
-			return nil, err
-		}
-
-		ti.ReplicaAssignments = make([]ReplicaAssignment, len)
-		for j := range ti.ReplicaAssignments {
-			ra := ReplicaAssignment{}
-			ra.Partition = dec.DecodeInt32()
-			len, err = dec.DecodeArrayLen()
-			ra.Replicas = make([]int32, len)
-			for k := range ra.Replicas {
-				ra.Replicas[k] = dec.DecodeInt32()
-			}
-
-			ti.ReplicaAssignments[j] = ra
-		}
-		len, err = dec.DecodeArrayLen()
-		ti.ConfigEntries = make([]ConfigEntry, len)
-		for l := range ti.ConfigEntries {
-			ce := ConfigEntry{}
-			ce.ConfigName = dec.DecodeString()
-			ce.ConfigValue = dec.DecodeString()
-			ti.ConfigEntries[l] = ce
-		}
-
-		req.CreateTopicsRequests[i] = ti
-	}
-
-	req.Timeout = dec.DecodeDuration32()
-
-	if req.version >= KafkaV1 {
-		req.ValidateOnly = dec.DecodeInt8() != 0
+	req.Creations = make([]AclBinding, len)
+	for i := range req.Creations {
+		decodeAclBinding(dec, req.version, &req.Creations[i])
 	}
 
 	if dec.Err() != nil {
@@ -2409,38 +6082,19 @@ func ReadCreateTopicsReq(r io.Reader) (*CreateTopicsReq, error) {
 	return &req, nil
 }
 
-func (r CreateTopicsReq) Kind() int16 {
-	return CreateTopicsReqKind
+func (r CreateAclsReq) Kind() int16 {
+	return CreateAclsReqKind
 }
 
-func (r *CreateTopicsReq) Bytes() ([]byte, error) {
+func (r *CreateAclsReq) Bytes() ([]byte, error) {
 	var buf bytes.Buffer
 	enc := NewEncoder(&buf)
 
 	encodeHeader(enc, r)
 
-	enc.EncodeArrayLen(len(r.CreateTopicsRequests))
-	for _, topicInfo := range r.CreateTopicsRequests {
-		enc.EncodeString(topicInfo.Topic)
-		enc.EncodeInt32(topicInfo.NumPartitions)
-		enc.EncodeInt16(topicInfo.ReplicationFactor)
-		enc.EncodeArrayLen(len(topicInfo.ReplicaAssignments))
-		for _, replicaAssignment := range topicInfo.ReplicaAssignments {
-			enc.EncodeInt32(replicaAssignment.Partition)
-			enc.EncodeInt32s(replicaAssignment.Replicas)
-		}
-
-		enc.EncodeArrayLen(len(topicInfo.ConfigEntries))
-		for _, ce := range topicInfo.ConfigEntries {
-			enc.EncodeString(ce.ConfigName)
-			enc.EncodeString(ce.ConfigValue)
-		}
-	}
-
-	enc.EncodeDuration(r.Timeout)
-
-	if r.version >= KafkaV1 {
-		enc.EncodeInt8(boolToInt8(r.ValidateOnly))
+	enc.EncodeArrayLen(len(r.Creations))
+	for i := range r.Creations {
+		encodeAclBinding(enc, r.version, &r.Creations[i])
 	}
 
 	if enc.Err() != nil {
@@ -2454,49 +6108,68 @@ func (r *CreateTopicsReq) Bytes() ([]byte, error) {
 	return b, nil
 }
 
-func (r *CreateTopicsReq) WriteTo(w io.Writer) (int64, error) {
+func (r *CreateAclsReq) WriteTo(w io.Writer) (int64, error) {
 	b, err := r.Bytes()
 	if err != nil {
 		return 0, err
 	}
-	n, err := w.Write(b)
-	return int64(n), err
+	return writeFull(w, b)
 }
 
-type TopicError struct {
-	Topic        string
-	ErrorCode    int16
-	ErrorMessage string // >= KafkaV1
+type CreateAclsResp struct {
+	Version       int16
+	CorrelationID int32
+	ThrottleTime  time.Duration
+	Results       []CreateAclsRespResult // in order of the request creations
+}
+
+type CreateAclsRespResult struct {
 	Err          error
+	ErrorMessage string
 }
 
-type CreateTopicsResp struct {
-	Version       int16
-	CorrelationID int32
-	TopicErrors   []TopicError
-	ThrottleTime  time.Duration // >= KafkaV2
+func ReadCreateAclsResp(r io.Reader) (*CreateAclsResp, error) {
+	return ReadVersionedCreateAclsResp(r, KafkaV0)
 }
 
-func (r *CreateTopicsResp) Bytes() ([]byte, error) {
+func ReadVersionedCreateAclsResp(r io.Reader, version int16) (*CreateAclsResp, error) {
+	var resp CreateAclsResp
+	resp.Version = version
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	resp.CorrelationID = dec.DecodeInt32()
+	resp.ThrottleTime = dec.DecodeDuration32()
+
+	len, err := dec.DecodeArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	resp.Results = make([]CreateAclsRespResult, len)
+	for i := range resp.Results {
+		resp.Results[i].Err = errFromNo(dec.DecodeInt16())
+		resp.Results[i].ErrorMessage = dec.DecodeString()
+	}
+
+	if err := dec.Err(); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (r *CreateAclsResp) Bytes() ([]byte, error) {
 	var buf bytes.Buffer
 	enc := NewEncoder(&buf)
 
 	// message size - for now just placeholder
 	enc.EncodeInt32(0)
 	enc.EncodeInt32(r.CorrelationID)
-
-	if r.Version >= KafkaV2 {
-		enc.EncodeDuration(r.ThrottleTime)
-	}
-
-	enc.EncodeArrayLen(len(r.TopicErrors))
-	for _, te := range r.TopicErrors {
-		enc.EncodeString(te.Topic)
-		enc.EncodeInt16(te.ErrorCode)
-		if r.Version >= KafkaV1 {
-			enc.EncodeString(te.ErrorMessage)
-		}
-
+	enc.EncodeDuration(r.ThrottleTime)
+	enc.EncodeArrayLen(len(r.Results))
+	for _, res := range r.Results {
+		enc.EncodeError(res.Err)
+		encodeNullableString(enc, res.ErrorMessage)
 	}
 
 	if enc.Err() != nil {
@@ -2510,66 +6183,26 @@ func (r *CreateTopicsResp) Bytes() ([]byte, error) {
 	return b, nil
 }
 
-func ReadCreateTopicsResp(r io.Reader) (*CreateTopicsResp, error) {
-	return ReadVersionedCreateTopicsResp(r, KafkaV0)
+// DeleteAclsReq deletes all ACL bindings matching any of the filters.
+type DeleteAclsReq struct {
+	RequestHeader
+	Filters []AclFilter
 }
 
-func ReadVersionedCreateTopicsResp(r io.Reader, version int16) (*CreateTopicsResp, error) {
-	var resp CreateTopicsResp
-	resp.Version = version
+func ReadDeleteAclsReq(r io.Reader) (*DeleteAclsReq, error) {
+	var req DeleteAclsReq
 	dec := NewDecoder(r)
 
-	// total message size
-	_ = dec.DecodeInt32()
-	resp.CorrelationID = dec.DecodeInt32()
-
-	if resp.Version >= KafkaV2 {
-		resp.ThrottleTime = dec.DecodeDuration32()
-	}
+	decodeHeader(dec, &req)
 
 	len, err := dec.DecodeArrayLen()
 	if err != nil {
 		return nil, err
 	}
-	resp.TopicErrors = make([]TopicError, len)
-
-	for i := range resp.TopicErrors {
-		var te = &resp.TopicErrors[i]
-		te.Topic = dec.DecodeString()
-		te.ErrorCode = dec.DecodeInt16()
-		if resp.Version >= KafkaV1 {
-			te.ErrorMessage = dec.DecodeString()
-		}
-		te.Err = errFromNo(te.ErrorCode)
-	}
-
-	if dec.Err() != nil {
-		return nil, dec.Err()
+	req.Filters = make([]AclFilter, len)
+	for i := range req.Filters {
+		decodeAclFilter(dec, req.version, &req.Filters[i])
 	}
-	return &resp, nil
-}
-
-type buffer []byte
-
-func (b *buffer) Write(p []byte) (int, error) {
-	*b = append(*b, p...)
-	return len(p), nil
-}
-
-type APIVersionsReq struct {
-	RequestHeader
-}
-
-func ReadAPIVersionsReq(r io.Reader) (*APIVersionsReq, error) {
-	var req APIVersionsReq
-	dec := NewDecoder(r)
-
-	// total message size
-	_ = dec.DecodeInt32()
-	// api key + api version
-	_ = dec.DecodeInt32()
-	req.correlationID = dec.DecodeInt32()
-	req.ClientID = dec.DecodeString()
 
 	if dec.Err() != nil {
 		return nil, dec.Err()
@@ -2577,16 +6210,21 @@ func ReadAPIVersionsReq(r io.Reader) (*APIVersionsReq, error) {
 	return &req, nil
 }
 
-func (r APIVersionsReq) Kind() int16 {
-	return APIVersionsReqKind
+func (r DeleteAclsReq) Kind() int16 {
+	return DeleteAclsReqKind
 }
 
-func (r *APIVersionsReq) Bytes() ([]byte, error) {
+func (r *DeleteAclsReq) Bytes() ([]byte, error) {
 	var buf bytes.Buffer
 	enc := NewEncoder(&buf)
 
 	encodeHeader(enc, r)
 
+	enc.EncodeArrayLen(len(r.Filters))
+	for i := range r.Filters {
+		encodeAclFilter(enc, r.version, &r.Filters[i])
+	}
+
 	if enc.Err() != nil {
 		return nil, enc.Err()
 	}
@@ -2598,95 +6236,106 @@ func (r *APIVersionsReq) Bytes() ([]byte, error) {
 	return b, nil
 }
 
-func (r *APIVersionsReq) WriteTo(w io.Writer) (int64, error) {
+func (r *DeleteAclsReq) WriteTo(w io.Writer) (int64, error) {
 	b, err := r.Bytes()
 	if err != nil {
 		return 0, err
 	}
-	n, err := w.Write(b)
-	return int64(n), err
+	return writeFull(w, b)
 }
 
-type APIVersionsResp struct {
+type DeleteAclsResp struct {
 	Version       int16
 	CorrelationID int32
-	APIVersions   []SupportedVersion
 	ThrottleTime  time.Duration
+	Results       []DeleteAclsRespResult // in order of the request filters
 }
 
-type SupportedVersion struct {
-	APIKey     int16
-	MinVersion int16
-	MaxVersion int16
+type DeleteAclsRespResult struct {
+	Err          error
+	ErrorMessage string
+	MatchingAcls []DeleteAclsRespMatchingAcl
 }
 
-func (r *APIVersionsResp) Bytes() ([]byte, error) {
-	var buf bytes.Buffer
-	enc := NewEncoder(&buf)
-
-	// message size - for now just placeholder
-	enc.EncodeInt32(0)
-	enc.EncodeInt32(r.CorrelationID)
-	//error code
-	enc.EncodeInt16(0)
-	enc.EncodeArrayLen(len(r.APIVersions))
-	for _, api := range r.APIVersions {
-		enc.EncodeInt16(api.APIKey)
-		enc.EncodeInt16(api.MinVersion)
-		enc.EncodeInt16(api.MaxVersion)
-	}
-
-	if r.Version >= KafkaV1 {
-		enc.EncodeDuration(r.ThrottleTime)
-	}
-
-	if enc.Err() != nil {
-		return nil, enc.Err()
-	}
-
-	// update the message size information
-	b := buf.Bytes()
-	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
-
-	return b, nil
+// DeleteAclsRespMatchingAcl is the ACL binding matching the filter, with the
+// result of its deletion.
+type DeleteAclsRespMatchingAcl struct {
+	Err          error
+	ErrorMessage string
+	AclBinding
 }
 
-func ReadAPIVersionsResp(r io.Reader) (*APIVersionsResp, error) {
-	return ReadVersionedAPIVersionsResp(r, KafkaV0)
+func ReadDeleteAclsResp(r io.Reader) (*DeleteAclsResp, error) {
+	return ReadVersionedDeleteAclsResp(r, KafkaV0)
 }
 
-func ReadVersionedAPIVersionsResp(r io.Reader, version int16) (*APIVersionsResp, error) {
-	var resp APIVersionsResp
+func ReadVersionedDeleteAclsResp(r io.Reader, version int16) (*DeleteAclsResp, error) {
+	var resp DeleteAclsResp
 	resp.Version = version
 	dec := NewDecoder(r)
 
 	// total message size
 	_ = dec.DecodeInt32()
 	resp.CorrelationID = dec.DecodeInt32()
-	errcode := dec.DecodeInt16()
-	if errcode != 0 {
-		//TODO fill app error
-		return nil, fmt.Errorf("versioning error: %d", errcode)
-	}
+	resp.ThrottleTime = dec.DecodeDuration32()
+
 	len, err := dec.DecodeArrayLen()
 	if err != nil {
 		return nil, err
 	}
+	resp.Results = make([]DeleteAclsRespResult, len)
+	for i := range resp.Results {
+		var res = &resp.Results[i]
+		res.Err = errFromNo(dec.DecodeInt16())
+		res.ErrorMessage = dec.DecodeString()
 
-	resp.APIVersions = make([]SupportedVersion, len)
-	for i := range resp.APIVersions {
-		api := &resp.APIVersions[i]
-		api.APIKey = dec.DecodeInt16()
-		api.MinVersion = dec.DecodeInt16()
-		api.MaxVersion = dec.DecodeInt16()
+		len, err := dec.DecodeArrayLen()
+		if err != nil {
+			return nil, err
+		}
+		res.MatchingAcls = make([]DeleteAclsRespMatchingAcl, len)
+		for ai := range res.MatchingAcls {
+			var acl = &res.MatchingAcls[ai]
+			acl.Err = errFromNo(dec.DecodeInt16())
+			acl.ErrorMessage = dec.DecodeString()
+			decodeAclBinding(dec, version, &acl.AclBinding)
+		}
 	}
 
-	if version >= KafkaV1 {
-		resp.ThrottleTime = dec.DecodeDuration32()
+	if err := dec.Err(); err != nil {
+		return nil, err
 	}
+	return &resp, nil
+}
 
-	if dec.Err() != nil {
-		return nil, dec.Err()
+func (r *DeleteAclsResp) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.EncodeInt32(0)
+	enc.EncodeInt32(r.CorrelationID)
+	enc.EncodeDuration(r.ThrottleTime)
+	enc.EncodeArrayLen(len(r.Results))
+	for _, res := range r.Results {
+		enc.EncodeError(res.Err)
+		encodeNullableString(enc, res.ErrorMessage)
+		enc.EncodeArrayLen(len(res.MatchingAcls))
+		for i := range res.MatchingAcls {
+			acl := &res.MatchingAcls[i]
+			enc.EncodeError(acl.Err)
+			encodeNullableString(enc, acl.ErrorMessage)
+			encodeAclBinding(enc, r.Version, &acl.AclBinding)
+		}
 	}
-	return &resp, nil
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
 }
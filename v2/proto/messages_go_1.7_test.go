@@ -28,6 +28,8 @@ func TestProduceRequest(t *testing.T) {
 								Crc:    3099221847,
 								Key:    []byte("foo"),
 								Value:  []byte("bar"),
+
+								TimestampMs: NoTimestamp,
 							},
 						},
 					},
@@ -1,11 +1,23 @@
 package proto
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/golang/snappy"
 )
 
 func testRequestSerialization(t *testing.T, r Request) {
@@ -24,6 +36,126 @@ func testRequestSerialization(t *testing.T, r Request) {
 	}
 }
 
+func TestReadRespInsufficientData(t *testing.T) {
+	resp := []byte{0x0, 0x0, 0x0, 0x8, 0x0, 0x0, 0x0, 0x2a, 0x1, 0x2, 0x3, 0x4}
+
+	correlationID, b, err := ReadResp(bytes.NewReader(resp))
+	if err != nil {
+		t.Fatalf("cannot read response: %s", err)
+	}
+	if correlationID != 42 || !bytes.Equal(b, resp) {
+		t.Fatalf("unexpected response %d: %#v", correlationID, b)
+	}
+
+	if _, _, err := ReadResp(bytes.NewReader(nil)); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+
+	_, _, err = ReadResp(bytes.NewReader(resp[:6]))
+	expected := &InsufficientDataError{Expected: 12, Got: 6}
+	if !reflect.DeepEqual(err, expected) {
+		t.Fatalf("expected %#v, got %#v", expected, err)
+	}
+}
+
+func TestReadWriteFrame(t *testing.T) {
+	var buf bytes.Buffer
+	expected := []byte{0x0, 0x0, 0x0, 0x3, 0x1, 0x2, 0x3}
+	n, err := WriteFrame(&buf, expected)
+	if err != nil {
+		t.Fatalf("cannot write frame: %s", err)
+	}
+	if n != len(expected) || !bytes.Equal(buf.Bytes(), expected) {
+		t.Fatalf("expected %#v, got %d bytes: %#v", expected, n, buf.Bytes())
+	}
+	if _, err := WriteFrame(&buf, []byte{0x0, 0x0, 0x0, 0x0}); err != nil {
+		t.Fatalf("cannot write frame: %s", err)
+	}
+	// frames not matching their size are not written
+	for _, b := range [][]byte{nil, {0x0, 0x0}, {0x0, 0x0, 0x0, 0x2, 0x1}} {
+		if _, err := WriteFrame(&buf, b); err == nil {
+			t.Fatalf("expected frame %#v to be rejected", b)
+		}
+	}
+
+	b, err := ReadFrame(&buf)
+	if err != nil {
+		t.Fatalf("cannot read frame: %s", err)
+	}
+	if !bytes.Equal(b, expected) {
+		t.Fatalf("expected %#v, got %#v", expected, b)
+	}
+	b, err = ReadFrame(&buf)
+	if err != nil || !bytes.Equal(b, []byte{0x0, 0x0, 0x0, 0x0}) {
+		t.Fatalf("expected empty frame, got %#v, %v", b, err)
+	}
+	if _, err := ReadFrame(&buf); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+
+	// frame written by the request can be read whole and decoded
+	req := &MetadataReq{RequestHeader: RequestHeader{correlationID: 1, ClientID: "test"}, Topics: []string{"foo"}}
+	if _, err := req.WriteTo(&buf); err != nil {
+		t.Fatalf("cannot write request: %s", err)
+	}
+	b, err = ReadFrame(&buf)
+	if err != nil {
+		t.Fatalf("cannot read frame: %s", err)
+	}
+	if r, err := ReadMetadataReq(bytes.NewReader(b)); err != nil || !reflect.DeepEqual(r, req) {
+		t.Fatalf("expected %#v, got %#v, %v", req, r, err)
+	}
+	// and written back unchanged
+	var out bytes.Buffer
+	if _, err := WriteFrame(&out, b); err != nil || !bytes.Equal(out.Bytes(), b) {
+		t.Fatalf("expected %#v, got %#v, %v", b, out.Bytes(), err)
+	}
+	// request readers use the same framing
+	kind, rb, err := ReadReq(&out)
+	if err != nil || kind != MetadataReqKind || !bytes.Equal(rb, b) {
+		t.Fatalf("expected %#v, got %d %#v, %v", b, kind, rb, err)
+	}
+	if _, _, err := ReadReq(bytes.NewReader([]byte{0x0, 0x0, 0x0, 0x1, 0x0})); err == nil {
+		t.Fatal("expected frame without request kind to be rejected")
+	}
+
+	_, err = ReadFrame(bytes.NewReader([]byte{0x0, 0x0, 0x0, 0x5, 0x1}))
+	if serr, ok := err.(*InsufficientDataError); !ok || serr.Expected != 9 || serr.Got != 5 {
+		t.Fatalf("expected insufficient data error, got %#v", err)
+	}
+	if _, err := ReadFrame(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xfe, 0x1})); err == nil {
+		t.Fatal("expected negative frame size to be rejected")
+	}
+}
+
+func TestPeekResponseHeader(t *testing.T) {
+	resp := []byte{0x0, 0x0, 0x0, 0x8, 0x0, 0x0, 0x0, 0x2a, 0x1, 0x2, 0x3, 0x4}
+
+	r := bytes.NewReader(resp)
+	size, correlationID, err := PeekResponseHeader(r)
+	if err != nil {
+		t.Fatalf("cannot peek response header: %s", err)
+	}
+	if size != 8 || correlationID != 42 {
+		t.Fatalf("unexpected header: size %d, correlation ID %d", size, correlationID)
+	}
+	if r.Len() != int(size)-4 {
+		t.Fatalf("expected %d bytes of body left, got %d", size-4, r.Len())
+	}
+
+	if _, _, err := PeekResponseHeader(bytes.NewReader(nil)); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+	_, _, err = PeekResponseHeader(bytes.NewReader(resp[:6]))
+	expected := &InsufficientDataError{Expected: 8, Got: 6}
+	if !reflect.DeepEqual(err, expected) {
+		t.Fatalf("expected %#v, got %#v", expected, err)
+	}
+	if _, _, err := PeekResponseHeader(bytes.NewReader([]byte{0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0x1})); err == nil {
+		t.Fatal("expected message size error")
+	}
+}
+
 func TestMetadataRequest(t *testing.T) {
 	req1 := &MetadataReq{
 		RequestHeader: RequestHeader{correlationID: 123, ClientID: "testcli", version: KafkaV0},
@@ -68,6 +200,37 @@ func TestMetadataRequest(t *testing.T) {
 	}
 }
 
+func TestMetadataRequestAllTopics(t *testing.T) {
+	header := []byte{0x0, 0x3, 0x0, 0x1, 0x0, 0x0, 0x0, 0x7b, 0x0, 0x7, 0x74, 0x65, 0x73, 0x74, 0x63, 0x6c, 0x69}
+	tests := []struct {
+		Topics   []string
+		Expected []byte
+	}{
+		{Topics: nil, Expected: []byte{0xff, 0xff, 0xff, 0xff}},
+		{Topics: []string{}, Expected: []byte{0x0, 0x0, 0x0, 0x0}},
+	}
+
+	for _, tt := range tests {
+		req := &MetadataReq{
+			RequestHeader: RequestHeader{correlationID: 123, ClientID: "testcli", version: KafkaV1},
+			Topics:        tt.Topics,
+		}
+		testRequestSerialization(t, req)
+		b, _ := req.Bytes()
+		if !bytes.Equal(b[4:], append(header, tt.Expected...)) {
+			t.Fatalf("expected different bytes representation: %v", b)
+		}
+
+		r, err := ReadMetadataReq(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("cannot read request: %s", err)
+		}
+		if !reflect.DeepEqual(r, req) {
+			t.Fatalf("expected %#v, got %#v", req, r)
+		}
+	}
+}
+
 func TestMetadataResponse(t *testing.T) {
 	msgb := []byte{0x0, 0x0, 0x1, 0xc7, 0x0, 0x0, 0x0, 0x7b, 0x0, 0x0, 0x0, 0x4, 0x0, 0x0, 0xc0, 0x10, 0x0, 0xb, 0x31, 0x37, 0x32, 0x2e, 0x31, 0x37, 0x2e, 0x34, 0x32, 0x2e, 0x31, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0xc0, 0x12, 0x0, 0xb, 0x31, 0x37, 0x32, 0x2e, 0x31, 0x37, 0x2e, 0x34, 0x32, 0x2e, 0x31, 0x0, 0x0, 0xc0, 0x12, 0x0, 0x0, 0xc0, 0x11, 0x0, 0xb, 0x31, 0x37, 0x32, 0x2e, 0x31, 0x37, 0x2e, 0x34, 0x32, 0x2e, 0x31, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0xc0, 0x13, 0x0, 0xb, 0x31, 0x37, 0x32, 0x2e, 0x31, 0x37, 0x2e, 0x34, 0x32, 0x2e, 0x31, 0x0, 0x0, 0xc0, 0x13, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0x3, 0x66, 0x6f, 0x6f, 0x0, 0x0, 0x0, 0x6, 0x0, 0x0, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0xc0, 0x13, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x13, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x13, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0x0, 0x0, 0x0, 0x5, 0x0, 0x0, 0xc0, 0x12, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x12, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x12, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0x0, 0x0, 0x0, 0x4, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0xc0, 0x13, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0xc0, 0x13, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0xc0, 0x12, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x12, 0x0, 0x0, 0xc0, 0x13, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x12, 0x0, 0x0, 0xc0, 0x13, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0xc0, 0x12, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0xc0, 0x12, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0xc0, 0x12, 0x0, 0x0, 0xc0, 0x13, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0xc0, 0x12, 0x0, 0x0, 0xc0, 0x13, 0x0, 0x0, 0x0, 0x4, 0x74, 0x65, 0x73, 0x74, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0xc0, 0x12, 0x0, 0x0, 0xc0, 0x13, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0xc0, 0x12, 0x0, 0x0, 0xc0, 0x13, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0xc0, 0x12, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0xc0, 0x12}
 	resp, err := ReadVersionedMetadataResp(bytes.NewBuffer(msgb), 0)
@@ -229,6 +392,493 @@ func TestMetadataResponseVersions(t *testing.T) {
 
 }
 
+func TestMetadataResponseRack(t *testing.T) {
+	b := mustDecodeHex(t,
+		"0000002c", // size
+		"00000007", // correlation id
+		"00000002", // brokers
+		"00000001", // node id
+		"000161",   // host "a"
+		"00002384", // port
+		"ffff",     // no rack
+		"00000002", // node id
+		"000162",   // host "b"
+		"00002384", // port
+		"00027231", // rack "r1"
+		"00000001", // controller id
+		"00000000", // topics
+	)
+	expected := &MetadataResp{
+		Version:       KafkaV1,
+		CorrelationID: 7,
+		ControllerID:  1,
+		Brokers: []MetadataRespBroker{
+			{NodeID: 1, Host: "a", Port: 9092},
+			{NodeID: 2, Host: "b", Port: 9092, Rack: "r1"},
+		},
+		Topics: []MetadataRespTopic{},
+	}
+	resp, err := ReadVersionedMetadataResp(bytes.NewReader(b), KafkaV1)
+	if err != nil {
+		t.Fatalf("cannot read response: %s", err)
+	}
+	if !reflect.DeepEqual(resp, expected) {
+		t.Fatalf("expected %#v, got %#v", expected, resp)
+	}
+	if got, err := resp.Bytes(); err != nil || !bytes.Equal(got, b) {
+		t.Fatalf("expected % x, got % x (%v)", b, got, err)
+	}
+
+	if broker, ok := resp.Broker(2); !ok || broker.Rack != "r1" {
+		t.Fatalf("expected broker 2 in rack r1, got %#v, %v", broker, ok)
+	}
+	if _, ok := resp.Broker(3); ok {
+		t.Fatal("expected broker 3 not to be found")
+	}
+
+	// rack is not sent before KafkaV1
+	resp.Version = KafkaV0
+	v0, err := resp.Bytes()
+	if err != nil {
+		t.Fatalf("cannot serialize response: %s", err)
+	}
+	got, err := ReadVersionedMetadataResp(bytes.NewReader(v0), KafkaV0)
+	if err != nil {
+		t.Fatalf("cannot read response: %s", err)
+	}
+	for _, broker := range got.Brokers {
+		if broker.Rack != "" {
+			t.Fatalf("expected no rack, got %q", broker.Rack)
+		}
+	}
+}
+
+func TestMetadataResponseController(t *testing.T) {
+	brokers := []MetadataRespBroker{
+		{NodeID: 1, Host: "localhost", Port: 9092},
+		{NodeID: 2, Host: "localhost", Port: 9093},
+	}
+	tests := []struct {
+		Version      int16
+		ControllerID int32
+		Expected     MetadataRespBroker
+		Found        bool
+	}{
+		{Version: KafkaV1, ControllerID: 2, Expected: brokers[1], Found: true},
+		{Version: KafkaV0, ControllerID: 2},
+		{Version: KafkaV1, ControllerID: -1},
+		{Version: KafkaV1, ControllerID: 3},
+	}
+
+	for _, tt := range tests {
+		resp := &MetadataResp{Version: tt.Version, ControllerID: tt.ControllerID, Brokers: brokers}
+		b, ok := resp.Controller()
+		if ok != tt.Found || b != tt.Expected {
+			t.Fatalf("version %d, controller %d: expected %#v, %v, got %#v, %v",
+				tt.Version, tt.ControllerID, tt.Expected, tt.Found, b, ok)
+		}
+	}
+}
+
+func TestMergeMetadata(t *testing.T) {
+	first := &MetadataResp{
+		Version:      KafkaV1,
+		ControllerID: 1,
+		Brokers: []MetadataRespBroker{
+			{NodeID: 1, Host: "a", Port: 9092},
+			{NodeID: 2, Host: "b", Port: 9092},
+		},
+		Topics: []MetadataRespTopic{
+			{Name: "foo", Partitions: []MetadataRespPartition{{ID: 0, Leader: 1}}},
+			{Name: "bar", Partitions: []MetadataRespPartition{{ID: 0, Leader: 2}}},
+		},
+	}
+	second := &MetadataResp{
+		Version:      KafkaV1,
+		ControllerID: 2,
+		Brokers: []MetadataRespBroker{
+			{NodeID: 2, Host: "b2", Port: 9093},
+			{NodeID: 3, Host: "c", Port: 9092},
+		},
+		Topics: []MetadataRespTopic{
+			{Name: "foo", Partitions: []MetadataRespPartition{{ID: 0, Leader: 3}}},
+			{Name: "bar", Err: ErrLeaderNotAvailable},
+			{Name: "baz", Partitions: []MetadataRespPartition{{ID: 0, Leader: 2}}},
+		},
+	}
+
+	merged := MergeMetadata(first, nil, second)
+	expected := &MetadataResp{
+		Version:      KafkaV1,
+		ControllerID: 2,
+		Brokers: []MetadataRespBroker{
+			{NodeID: 1, Host: "a", Port: 9092},
+			{NodeID: 2, Host: "b2", Port: 9093},
+			{NodeID: 3, Host: "c", Port: 9092},
+		},
+		Topics: []MetadataRespTopic{
+			{Name: "foo", Partitions: []MetadataRespPartition{{ID: 0, Leader: 3}}},
+			{Name: "bar", Partitions: []MetadataRespPartition{{ID: 0, Leader: 2}}},
+			{Name: "baz", Partitions: []MetadataRespPartition{{ID: 0, Leader: 2}}},
+		},
+	}
+	if !reflect.DeepEqual(merged, expected) {
+		t.Fatalf("expected %#v, got %#v", expected, merged)
+	}
+
+	if merged := MergeMetadata(); len(merged.Brokers) != 0 || len(merged.Topics) != 0 {
+		t.Fatalf("expected empty metadata, got %#v", merged)
+	}
+}
+
+func TestDiffMetadata(t *testing.T) {
+	from := &MetadataResp{
+		Brokers: []MetadataRespBroker{
+			{NodeID: 1, Host: "a", Port: 9092},
+			{NodeID: 2, Host: "b", Port: 9092},
+		},
+		Topics: []MetadataRespTopic{
+			{Name: "foo", Partitions: []MetadataRespPartition{{ID: 0, Leader: 1}, {ID: 1, Leader: 2}}},
+			{Name: "bar", Partitions: []MetadataRespPartition{{ID: 0, Leader: 2}}},
+			{Name: "baz", Partitions: []MetadataRespPartition{{ID: 0, Leader: 1}}},
+			{Name: "qux", Partitions: []MetadataRespPartition{{ID: 0, Leader: 1}}},
+		},
+	}
+	to := &MetadataResp{
+		Brokers: []MetadataRespBroker{
+			{NodeID: 2, Host: "b", Port: 9092},
+			{NodeID: 3, Host: "c", Port: 9092},
+		},
+		Topics: []MetadataRespTopic{
+			{Name: "foo", Partitions: []MetadataRespPartition{{ID: 0, Leader: 3}, {ID: 1, Leader: 2}, {ID: 2, Leader: -1}}},
+			{Name: "bar", Err: ErrLeaderNotAvailable},
+			{Name: "qux", Partitions: []MetadataRespPartition{{ID: 0, Leader: 1}}},
+			{Name: "new", Partitions: []MetadataRespPartition{{ID: 0, Leader: 2}}},
+		},
+	}
+
+	changes := DiffMetadata(from, to)
+	expected := MetadataChanges{
+		LeaderChanges: []LeaderChange{
+			{Topic: "foo", Partition: 0, OldLeader: 1, NewLeader: 3},
+		},
+		AddedPartitions: []MetadataPartitionRef{
+			{Topic: "foo", Partition: 2},
+			{Topic: "new", Partition: 0},
+		},
+		RemovedPartitions: []MetadataPartitionRef{
+			{Topic: "baz", Partition: 0},
+		},
+		AddedBrokers:   []MetadataRespBroker{{NodeID: 3, Host: "c", Port: 9092}},
+		RemovedBrokers: []MetadataRespBroker{{NodeID: 1, Host: "a", Port: 9092}},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Fatalf("expected %#v, got %#v", expected, changes)
+	}
+
+	if changes := DiffMetadata(to, to); !changes.Empty() {
+		t.Fatalf("expected no changes, got %#v", changes)
+	}
+	changes = DiffMetadata(nil, &MetadataResp{Topics: to.Topics[:1]})
+	if len(changes.AddedPartitions) != 3 || changes.Empty() {
+		t.Fatalf("expected all partitions to be added, got %#v", changes)
+	}
+}
+
+func TestProduceRequestCompressionLevel(t *testing.T) {
+	payload := benchmarkPayload()
+	sizes := make(map[CompressionLevel]int)
+	for _, level := range []CompressionLevel{CompressionLevelFastest, CompressionLevelDefault, CompressionLevelBest} {
+		req := &ProduceReq{
+			RequestHeader:    RequestHeader{correlationID: 241, ClientID: "test", version: KafkaV2},
+			Compression:      CompressionGzip,
+			CompressionLevel: level,
+			RequiredAcks:     RequiredAcksAll,
+			Timeout:          time.Second,
+			Topics: []ProduceReqTopic{
+				{
+					Name: "foo",
+					Partitions: []ProduceReqPartition{
+						{ID: 0, Messages: []*Message{{Value: payload}}},
+					},
+				},
+			},
+		}
+		b, err := req.Bytes()
+		if err != nil {
+			t.Fatalf("cannot serialize request: %s", err)
+		}
+		sizes[level] = len(b)
+
+		r, err := ReadProduceReq(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("cannot read request: %s", err)
+		}
+		messages := r.Topics[0].Partitions[0].Messages
+		if len(messages) != 1 || !bytes.Equal(messages[0].Value, payload) {
+			t.Fatalf("level %d: payload not round tripped", level)
+		}
+	}
+	if sizes[CompressionLevelBest] >= sizes[CompressionLevelFastest] {
+		t.Fatalf("expected best level to produce smaller request than fastest: %v", sizes)
+	}
+}
+
+func TestProduceRequestExpectsResponse(t *testing.T) {
+	cases := map[int16]bool{
+		RequiredAcksNone:  false,
+		RequiredAcksLocal: true,
+		RequiredAcksAll:   true,
+	}
+	for acks, expected := range cases {
+		req := &ProduceReq{RequiredAcks: acks}
+		if got := req.ExpectsResponse(); got != expected {
+			t.Errorf("acks %d: expected %v, got %v", acks, expected, got)
+		}
+	}
+}
+
+func TestProduceRequestValidation(t *testing.T) {
+	testCases := []struct {
+		version         int16
+		acks            int16
+		transactionalID string
+		expected        error
+	}{
+		{KafkaV3, RequiredAcksAll, "", nil},
+		{KafkaV3, RequiredAcksLocal, "", nil},
+		{KafkaV3, RequiredAcksNone, "", nil},
+		{KafkaV3, 2, "", ErrInvalidRequiredAcks},
+		{KafkaV3, -2, "", ErrInvalidRequiredAcks},
+		{KafkaV3, RequiredAcksAll, "txn", nil},
+		{KafkaV3, RequiredAcksLocal, "txn", ErrTransactionalRequiredAcks},
+		{KafkaV3, RequiredAcksNone, "txn", ErrTransactionalRequiredAcks},
+		{KafkaV3, 2, "txn", ErrInvalidRequiredAcks},
+		// transactional ID is not sent before KafkaV3
+		{KafkaV2, RequiredAcksLocal, "txn", nil},
+		{KafkaV2, 2, "txn", ErrInvalidRequiredAcks},
+	}
+	for i, tc := range testCases {
+		req := &ProduceReq{
+			RequestHeader:   RequestHeader{correlationID: 241, ClientID: "test", version: tc.version},
+			TransactionalID: tc.transactionalID,
+			RequiredAcks:    tc.acks,
+			Timeout:         time.Second,
+		}
+		if _, err := req.Bytes(); err != tc.expected {
+			t.Errorf("%d: expected %v, got %v", i, tc.expected, err)
+		}
+		if _, err := req.WriteTo(ioutil.Discard); err != tc.expected {
+			t.Errorf("%d: expected %v from WriteTo, got %v", i, tc.expected, err)
+		}
+	}
+}
+
+func TestProduceRequestSequentialOffsets(t *testing.T) {
+	for _, compression := range []Compression{CompressionNone, CompressionGzip} {
+		messages := []*Message{
+			{Value: []byte("a")},
+			{Value: []byte("b"), Offset: 42},
+			{Value: []byte("c")},
+		}
+		req := &ProduceReq{
+			RequestHeader:     RequestHeader{correlationID: 241, ClientID: "test", version: KafkaV2},
+			Compression:       compression,
+			RequiredAcks:      RequiredAcksAll,
+			Timeout:           time.Second,
+			SequentialOffsets: true,
+			Topics: []ProduceReqTopic{
+				{
+					Name: "foo",
+					Partitions: []ProduceReqPartition{
+						{ID: 0, Messages: messages},
+					},
+				},
+			},
+		}
+		b, err := req.Bytes()
+		if err != nil {
+			t.Fatalf("cannot serialize request: %s", err)
+		}
+		r, err := ReadProduceReq(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("cannot read request: %s", err)
+		}
+		var offsets []int64
+		for _, m := range r.Topics[0].Partitions[0].Messages {
+			offsets = append(offsets, m.Offset)
+		}
+		if expected := []int64{0, 1, 2}; !reflect.DeepEqual(offsets, expected) {
+			t.Fatalf("compression %d: expected offsets %v, got %v", compression, expected, offsets)
+		}
+		if messages[1].Offset != 42 {
+			t.Fatalf("compression %d: message was modified: %#v", compression, messages[1])
+		}
+	}
+}
+
+func TestProduceRequestStreaming(t *testing.T) {
+	for _, version := range []int16{KafkaV0, KafkaV2, KafkaV3} {
+		req := &ProduceReq{
+			RequestHeader:     RequestHeader{correlationID: 241, ClientID: "test", version: version},
+			TransactionalID:   "tx",
+			RequiredAcks:      RequiredAcksAll,
+			Timeout:           time.Second,
+			SequentialOffsets: true,
+			Topics: []ProduceReqTopic{
+				{
+					Name: "foo",
+					Partitions: []ProduceReqPartition{
+						{ID: 0, Messages: []*Message{
+							{Key: []byte("k"), Value: bytes.Repeat([]byte("a"), 10000), TimestampMs: 1500000000000},
+							{Value: nil, TimestampMs: NoTimestamp},
+						}},
+						{ID: 1},
+					},
+				},
+				{
+					Name: "bar",
+					Partitions: []ProduceReqPartition{
+						{ID: 3, Messages: []*Message{{Value: []byte("b"), TimestampMs: 1500000000001}}},
+					},
+				},
+			},
+		}
+		testRequestSerialization(t, req)
+
+		var buf bytes.Buffer
+		if _, err := req.WriteTo(&buf); err != nil {
+			t.Fatalf("version %d: cannot write request: %s", version, err)
+		}
+		got, err := ReadProduceReq(&buf)
+		if err != nil {
+			t.Fatalf("version %d: cannot read request: %s", version, err)
+		}
+		msgs := got.Topics[0].Partitions[0].Messages
+		if len(msgs) != 2 || len(msgs[0].Value) != 10000 || msgs[1].Value != nil || msgs[1].Offset != 1 {
+			t.Fatalf("version %d: unexpected messages: %#v", version, msgs)
+		}
+		if msgs := got.Topics[1].Partitions[0].Messages; len(msgs) != 1 || string(msgs[0].Value) != "b" {
+			t.Fatalf("version %d: unexpected messages: %#v", version, msgs)
+		}
+	}
+
+	// failing writer stops the request
+	req := &ProduceReq{
+		RequiredAcks: RequiredAcksAll,
+		Topics: []ProduceReqTopic{
+			{Name: "foo", Partitions: []ProduceReqPartition{{Messages: []*Message{{Value: []byte("a")}}}}},
+		},
+	}
+	werr := errors.New("write failed")
+	if _, err := req.WriteTo(&failingWriter{err: werr}); err != werr {
+		t.Fatalf("expected %v, got %v", werr, err)
+	}
+}
+
+type failingWriter struct {
+	err error
+}
+
+func (w *failingWriter) Write(b []byte) (int, error) {
+	return 0, w.err
+}
+
+func TestProduceRequestDefaultTimestamp(t *testing.T) {
+	for _, compression := range []Compression{CompressionNone, CompressionGzip} {
+		req := &ProduceReq{
+			RequestHeader: RequestHeader{correlationID: 241, ClientID: "test", version: KafkaV2},
+			Compression:   compression,
+			RequiredAcks:  RequiredAcksAll,
+			Timeout:       time.Second,
+			Topics: []ProduceReqTopic{
+				{
+					Name: "foo",
+					Partitions: []ProduceReqPartition{
+						{
+							ID: 0,
+							Messages: []*Message{
+								{Value: []byte("now")},
+								{Value: []byte("explicit"), TimestampMs: 1500000000000},
+								{Value: []byte("unset"), TimestampMs: NoTimestamp},
+							},
+						},
+					},
+				},
+			},
+		}
+
+		before := time.Now().UnixNano() / int64(time.Millisecond)
+		b, err := req.Bytes()
+		if err != nil {
+			t.Fatalf("cannot serialize request: %s", err)
+		}
+		after := time.Now().UnixNano() / int64(time.Millisecond)
+
+		r, err := ReadProduceReq(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("cannot read request: %s", err)
+		}
+		messages := r.Topics[0].Partitions[0].Messages
+		if len(messages) != 3 {
+			t.Fatalf("expected 3 messages, got %d", len(messages))
+		}
+		if ts := messages[0].TimestampMs; ts < before || ts > after {
+			t.Fatalf("expected timestamp between %d and %d, got %d", before, after, ts)
+		}
+		if ts := messages[1].TimestampMs; ts != 1500000000000 {
+			t.Fatalf("expected explicit timestamp, got %d", ts)
+		}
+		if ts := messages[2].TimestampMs; ts != NoTimestamp {
+			t.Fatalf("expected no timestamp, got %d", ts)
+		}
+		if req.Topics[0].Partitions[0].Messages[0].TimestampMs != 0 {
+			t.Fatal("request message must not be modified")
+		}
+	}
+}
+
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time {
+	return time.Time(c)
+}
+
+func TestProduceRequestClock(t *testing.T) {
+	req := &ProduceReq{
+		RequestHeader: RequestHeader{correlationID: 241, ClientID: "test", version: KafkaV2},
+		RequiredAcks:  RequiredAcksAll,
+		Timeout:       time.Second,
+		Clock:         fixedClock(time.Unix(1500000000, 0)),
+		Topics: []ProduceReqTopic{
+			{Name: "foo", Partitions: []ProduceReqPartition{{ID: 0, Messages: []*Message{{Value: []byte("v")}}}}},
+		},
+	}
+	expected := mustDecodeHex(t,
+		"0000004c",           // size
+		"00000002000000f1",   // kind, version, correlation id
+		"000474657374",       // client id
+		"ffff000003e8",       // required acks, timeout
+		"000000010003666f6f", // topics
+		"0000000100000000",   // partitions
+		"00000023",           // message set size
+		"0000000000000000",   // offset
+		"00000017",           // message size
+		"3335d115",           // crc
+		"0100",               // magic, attributes
+		"0000015d3ef79800",   // timestamp from the clock
+		"ffffffff0000000176", // key, value
+	)
+	b, err := req.Bytes()
+	if err != nil {
+		t.Fatalf("cannot serialize request: %s", err)
+	}
+	if !bytes.Equal(b, expected) {
+		t.Fatalf("expected\n% x\ngot\n% x", expected, b)
+	}
+	testRequestSerialization(t, req)
+}
+
 func TestProduceResponse(t *testing.T) {
 	msgb1 := []byte{0x0, 0x0, 0x0, 0x22, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x0, 0x0, 0x1, 0x0, 0x6, 0x66, 0x72, 0x75, 0x69, 0x74, 0x73, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x5d, 0x0, 0x3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
 	resp1, err := ReadVersionedProduceResp(bytes.NewBuffer(msgb1), KafkaV0)
@@ -294,27 +944,124 @@ func TestProduceResponse(t *testing.T) {
 	}
 }
 
-func TestProduceResponseWithVersions(t *testing.T) {
-	produceRespV1 := ProduceResp{
-		Version:       1,
-		CorrelationID: 0,
+func TestProduceResponseThrottleTimeGolden(t *testing.T) {
+	resp := ProduceResp{
+		CorrelationID: 7,
 		Topics: []ProduceRespTopic{
-			ProduceRespTopic{
-				Name: "",
-				Partitions: []ProduceRespPartition{
-					ProduceRespPartition{
-						ID:            0,
-						Err:           nil,
-						Offset:        0,
-						LogAppendTime: 0,
-					},
-				},
-			},
+			{Name: "foo", Partitions: []ProduceRespPartition{{ID: 1, Offset: 9, LogStartOffset: 2}}},
 		},
-		ThrottleTime: time.Second,
-	}
-
-	b, err := produceRespV1.Bytes()
+		ThrottleTime: 5 * time.Millisecond,
+	}
+	partition := []string{
+		"00000001",         // topics
+		"0003666f6f",       // topic name
+		"00000001",         // partitions
+		"00000001",         // partition id
+		"0000",             // error code
+		"0000000000000009", // offset
+	}
+	// every case starts with the size and the correlation id
+	cases := []struct {
+		version int16
+		parts   []string
+	}{
+		{
+			version: KafkaV0,
+			parts:   append([]string{"0000001f", "00000007"}, partition...),
+		},
+		{
+			version: KafkaV1,
+			parts: append(append([]string{"00000023", "00000007"}, partition...),
+				"00000005", // throttle time
+			),
+		},
+		{
+			version: KafkaV2,
+			parts: append(append([]string{"0000002b", "00000007"}, partition...),
+				"ffffffffffffffff", // log append time
+				"00000005",         // throttle time
+			),
+		},
+		{
+			version: KafkaV5,
+			parts: append(append([]string{"00000033", "00000007"}, partition...),
+				"ffffffffffffffff", // log append time
+				"0000000000000002", // log start offset
+				"00000005",         // throttle time
+			),
+		},
+		{
+			version: KafkaV8,
+			parts: append(append([]string{"00000039", "00000007"}, partition...),
+				"ffffffffffffffff", // log append time
+				"0000000000000002", // log start offset
+				"00000000",         // record errors
+				"0000",             // error message
+				"00000005",         // throttle time
+			),
+		},
+	}
+
+	for _, tc := range cases {
+		expected := mustDecodeHex(t, tc.parts...)
+		resp.Version = tc.version
+		b, err := resp.Bytes()
+		if err != nil {
+			t.Fatalf("v%d: cannot serialize response: %s", tc.version, err)
+		}
+		if !bytes.Equal(b, expected) {
+			t.Fatalf("v%d: expected different bytes representation:\n%s", tc.version, hex.Dump(b))
+		}
+
+		got, err := ReadVersionedProduceResp(bytes.NewReader(expected), tc.version)
+		if err != nil {
+			t.Fatalf("v%d: cannot read response: %s", tc.version, err)
+		}
+		var throttle time.Duration
+		if tc.version >= KafkaV1 {
+			throttle = resp.ThrottleTime
+		}
+		if got.ThrottleTime != throttle {
+			t.Fatalf("v%d: expected throttle time %s, got %s", tc.version, throttle, got.ThrottleTime)
+		}
+		if part := got.Topics[0].Partitions[0]; part.ID != 1 || part.Offset != 9 {
+			t.Fatalf("v%d: unexpected partition %#v", tc.version, part)
+		}
+	}
+}
+
+// copyProduceResp returns a copy of the response with its own topics and
+// partitions, so that changing them does not change the original.
+func copyProduceResp(resp ProduceResp) ProduceResp {
+	topics := make([]ProduceRespTopic, len(resp.Topics))
+	for i, topic := range resp.Topics {
+		topic.Partitions = append([]ProduceRespPartition(nil), topic.Partitions...)
+		topics[i] = topic
+	}
+	resp.Topics = topics
+	return resp
+}
+
+func TestProduceResponseWithVersions(t *testing.T) {
+	produceRespV1 := ProduceResp{
+		Version:       1,
+		CorrelationID: 0,
+		Topics: []ProduceRespTopic{
+			ProduceRespTopic{
+				Name: "",
+				Partitions: []ProduceRespPartition{
+					ProduceRespPartition{
+						ID:     0,
+						Err:    nil,
+						Offset: 0,
+					},
+				},
+			},
+		},
+		ThrottleTime: time.Second,
+	}
+
+	b, err := produceRespV1.Bytes()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -327,9 +1074,9 @@ func TestProduceResponseWithVersions(t *testing.T) {
 	if !reflect.DeepEqual(produceRespV1, *resp) {
 		t.Errorf("Not equal")
 	}
-	produceRespV2 := produceRespV1
+	produceRespV2 := copyProduceResp(produceRespV1)
 	produceRespV2.Version = KafkaV2
-	produceRespV2.Topics[0].Partitions[0].LogAppendTime = 5
+	produceRespV2.Topics[0].Partitions[0].LogAppendTime = time.Unix(0, 5*int64(time.Millisecond))
 
 	b, err = produceRespV2.Bytes()
 	if err != nil {
@@ -344,6 +1091,48 @@ func TestProduceResponseWithVersions(t *testing.T) {
 		t.Errorf("Not equal")
 	}
 
+	produceRespV5 := copyProduceResp(produceRespV2)
+	produceRespV5.Version = KafkaV5
+	produceRespV5.Topics[0].Partitions[0].LogStartOffset = 3
+
+	b, err = produceRespV5.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = ReadVersionedProduceResp(bytes.NewBuffer(b), produceRespV5.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(produceRespV5, *resp) {
+		t.Errorf("Not equal %+v", *resp)
+	}
+
+	produceRespV8 := copyProduceResp(produceRespV5)
+	produceRespV8.Version = KafkaV8
+	produceRespV8.Topics[0].Partitions[0].Err = ErrInvalidMessage
+	produceRespV8.Topics[0].Partitions[0].RecordErrors = []RecordError{
+		{BatchIndex: 2, Message: "compacted topic cannot accept message without key"},
+	}
+	produceRespV8.Topics[0].Partitions[0].ErrMsg = "batch rejected"
+
+	b, err = produceRespV8.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = ReadVersionedProduceResp(bytes.NewBuffer(b), produceRespV8.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(produceRespV8, *resp) {
+		t.Errorf("Not equal %+v", *resp)
+	}
+
+	// earlier cases are not changed by the later ones
+	if part := produceRespV1.Topics[0].Partitions[0]; !part.LogAppendTime.IsZero() || part.LogStartOffset != 0 || part.Err != nil {
+		t.Errorf("v1 response changed: %+v", part)
+	}
 }
 
 func TestFetchRequest(t *testing.T) {
@@ -376,489 +1165,1950 @@ func TestFetchRequest(t *testing.T) {
 	}
 }
 
-func TestFetchResponse(t *testing.T) {
-	expected1 := &FetchResp{
-		CorrelationID: 241,
-		Topics: []FetchRespTopic{
+func TestFetchRequestMaxBytes(t *testing.T) {
+	req := &FetchReq{
+		RequestHeader: RequestHeader{correlationID: 241, ClientID: "test", version: KafkaV3},
+		ReplicaID:     -1,
+		MaxWaitTime:   time.Second * 2,
+		MinBytes:      1,
+		MaxBytes:      1 << 20,
+		Topics: []FetchReqTopic{
 			{
 				Name: "foo",
-				Partitions: []FetchRespPartition{
-					{
-						ID:        0,
-						Err:       error(nil),
-						TipOffset: 4,
-						Messages: []*Message{
-							{Offset: 2, Crc: 0xb8ba5f57, Key: []byte("foo"), Value: []byte("bar"), Topic: "foo", Partition: 0, TipOffset: 4},
-							{Offset: 3, Crc: 0xb8ba5f57, Key: []byte("foo"), Value: []byte("bar"), Topic: "foo", Partition: 0, TipOffset: 4},
-						},
-					},
-					{
-						ID:        1,
-						Err:       ErrUnknownTopicOrPartition,
-						TipOffset: -1,
-						Messages:  nil,
-					},
+				Partitions: []FetchReqPartition{
+					{ID: 0, FetchOffset: 11, MaxBytes: 92},
 				},
 			},
 		},
 	}
+	testRequestSerialization(t, req)
+	b, _ := req.Bytes()
+	expected := []byte{0x0, 0x0, 0x0, 0x3b, 0x0, 0x1, 0x0, 0x3, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x4, 0x74, 0x65, 0x73, 0x74, 0xff, 0xff, 0xff, 0xff, 0x0, 0x0, 0x7, 0xd0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x10, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0x66, 0x6f, 0x6f, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0xb, 0x0, 0x0, 0x0, 0x5c}
+	if !bytes.Equal(b, expected) {
+		t.Fatalf("expected different bytes representation: %#v", b)
+	}
 
-	tests := []struct {
-		Bytes     []byte
-		RoundTrip bool // whether to compare re-serialized version
-		Expected  *FetchResp
-	}{
-		{ // CompressionNone
-			Bytes:     []byte{0x0, 0x0, 0x0, 0x75, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0x66, 0x6f, 0x6f, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x4, 0x0, 0x0, 0x0, 0x40, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0x14, 0xb8, 0xba, 0x5f, 0x57, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x66, 0x6f, 0x6f, 0x0, 0x0, 0x0, 0x3, 0x62, 0x61, 0x72, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0x0, 0x14, 0xb8, 0xba, 0x5f, 0x57, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x66, 0x6f, 0x6f, 0x0, 0x0, 0x0, 0x3, 0x62, 0x61, 0x72, 0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x0, 0x0, 0x0, 0x0},
-			RoundTrip: true,
-			Expected:  expected1,
-		},
-		{ // CompressionGzip
-			Bytes:     []byte{0x0, 0x0, 0x0, 0x81, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0x66, 0x6f, 0x6f, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x4, 0x0, 0x0, 0x0, 0x4c, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0x0, 0x40, 0x7, 0x3c, 0x17, 0x35, 0x0, 0x1, 0xff, 0xff, 0xff, 0xff, 0x0, 0x0, 0x0, 0x32, 0x1f, 0x8b, 0x8, 0x0, 0x0, 0x9, 0x6e, 0x88, 0x0, 0xff, 0x62, 0x80, 0x0, 0x26, 0x20, 0x16, 0xd9, 0xb1, 0x2b, 0x3e, 0x1c, 0xcc, 0x63, 0x4e, 0xcb, 0xcf, 0x7, 0x51, 0x49, 0x89, 0x45, 0x50, 0x79, 0x66, 0x5c, 0xf2, 0x80, 0x0, 0x0, 0x0, 0xff, 0xff, 0xab, 0xcc, 0x83, 0x80, 0x40, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x0, 0x0, 0x0, 0x0},
-			RoundTrip: false,
-			Expected:  expected1,
-		},
-		{ // CompressionSnappy
-			Bytes:     []byte{0x0, 0x0, 0x0, 0x75, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0x66, 0x6f, 0x6f, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x4, 0x0, 0x0, 0x0, 0x40, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0x0, 0x34, 0x6, 0x8d, 0xfe, 0xe2, 0x0, 0x2, 0xff, 0xff, 0xff, 0xff, 0x0, 0x0, 0x0, 0x26, 0x40, 0x0, 0x0, 0x9, 0x1, 0x20, 0x2, 0x0, 0x0, 0x0, 0x14, 0xb8, 0xba, 0x5f, 0x57, 0x5, 0xf, 0x28, 0x3, 0x66, 0x6f, 0x6f, 0x0, 0x0, 0x0, 0x3, 0x62, 0x61, 0x72, 0x5, 0x10, 0x8, 0x0, 0x0, 0x3, 0x5e, 0x20, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x0, 0x0, 0x0, 0x0},
-			RoundTrip: false,
-			Expected:  expected1,
-		},
-		{
-			Bytes:     []byte{0x0, 0x0, 0x0, 0x48, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x0, 0x0, 0x1, 0x0, 0x4, 0x74, 0x65, 0x73, 0x74, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x8, 0x0, 0x3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x0, 0x0, 0x0, 0x0},
-			RoundTrip: true,
-			Expected: &FetchResp{
-				CorrelationID: 241,
-				Topics: []FetchRespTopic{
-					{
-						Name: "test",
-						Partitions: []FetchRespPartition{
-							{
-								ID:        0,
-								Err:       ErrUnknownTopicOrPartition,
-								TipOffset: -1,
-								Messages:  nil,
-							},
-							{
-								ID:        1,
-								Err:       ErrUnknownTopicOrPartition,
-								TipOffset: -1,
-								Messages:  nil,
-							},
-							{
-								ID:        8,
-								Err:       ErrUnknownTopicOrPartition,
-								TipOffset: -1,
-								Messages:  nil,
-							},
-						},
-					},
-				},
-			},
-		},
+	r, _ := ReadFetchReq(bytes.NewBuffer(expected))
+	if !reflect.DeepEqual(r, req) {
+		t.Fatalf("malformed request: %#v", r)
 	}
 
-	for _, tt := range tests {
-		resp, err := ReadVersionedFetchResp(bytes.NewBuffer(tt.Bytes), KafkaV0)
+	// not supported by older versions
+	req.version = KafkaV2
+	b, err := req.Bytes()
+	if err != nil {
+		t.Fatalf("cannot serialize request: %s", err)
+	}
+	if r, err = ReadFetchReq(bytes.NewBuffer(b)); err != nil {
+		t.Fatalf("cannot read request: %s", err)
+	}
+	if r.MaxBytes != 0 {
+		t.Fatalf("expected max bytes to be ignored, got %d", r.MaxBytes)
+	}
+}
+
+func TestFetchRequestReplicaID(t *testing.T) {
+	// unset replica id is sent as a consumer fetch, and so is replica id
+	// without the follower flag
+	for _, req := range []*FetchReq{
+		{Topics: []FetchReqTopic{{Name: "foo", Partitions: []FetchReqPartition{{MaxBytes: 92}}}}},
+		{ReplicaID: 3, Topics: []FetchReqTopic{{Name: "foo", Partitions: []FetchReqPartition{{MaxBytes: 92}}}}},
+	} {
+		b, err := req.Bytes()
 		if err != nil {
-			t.Fatalf("could not read fetch response: %s", err)
+			t.Fatalf("cannot serialize request: %s", err)
 		}
-		if !reflect.DeepEqual(resp, tt.Expected) {
-			t.Fatalf("expected different message: %#v", resp)
+		// replica id follows the header with "" client id
+		if id := b[14:18]; !bytes.Equal(id, []byte{0xff, 0xff, 0xff, 0xff}) {
+			t.Fatalf("expected consumer replica id, got %#v", id)
 		}
-		if tt.RoundTrip {
-			b, err := resp.Bytes()
-			if err != nil {
-				t.Fatalf("cannot serialize response: %s", err)
-			}
-			if !bytes.Equal(b, tt.Bytes) {
-				t.Fatalf("serialized representation different from expected: %#v", b)
-			}
+		r, err := ReadFetchReq(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("cannot read request: %s", err)
+		}
+		if r.Follower || r.ReplicaID != -1 {
+			t.Fatalf("expected consumer request, got replica id %d", r.ReplicaID)
 		}
 	}
+
+	// follower fetch
+	req := NewSinglePartitionFetch("foo", 0, 11, 92)
+	req.ReplicaID = 0
+	req.Follower = true
+	b, err := req.Bytes()
+	if err != nil {
+		t.Fatalf("cannot serialize request: %s", err)
+	}
+	if id := b[14:18]; !bytes.Equal(id, []byte{0x0, 0x0, 0x0, 0x0}) {
+		t.Fatalf("expected replica id 0, got %#v", id)
+	}
+	r, err := ReadFetchReq(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("cannot read request: %s", err)
+	}
+	if !r.Follower || r.ReplicaID != 0 {
+		t.Fatalf("expected follower request of replica 0, got %d", r.ReplicaID)
+	}
 }
 
-func TestOffsetFetchWithVersions(t *testing.T) {
-	respV0 := OffsetFetchResp{
-		Version:       0,
-		CorrelationID: 0,
-		ThrottleTime:  0,
-		Topics: []OffsetFetchRespTopic{
-			OffsetFetchRespTopic{
-				Name: "",
-				Partitions: []OffsetFetchRespPartition{
-					OffsetFetchRespPartition{
-						ID:       0,
-						Offset:   0,
-						Metadata: "",
-						Err:      nil,
-					},
-				},
+func TestBuildBudgetedFetch(t *testing.T) {
+	partitions := []TopicPartition{
+		{Topic: "foo", Partition: 0},
+		{Topic: "bar", Partition: 3},
+		{Topic: "foo", Partition: 1},
+	}
+	offsets := map[string]map[int32]int64{
+		"foo": {0: 10, 1: 20},
+		"bar": {3: 30},
+	}
+	req := BuildBudgetedFetch(partitions, offsets, 1000)
+	if err := req.Validate(); err != nil {
+		t.Fatalf("expected valid request, got %s", err)
+	}
+	if req.MaxBytes != 1000 || req.Follower || req.Session {
+		t.Fatalf("unexpected request: %+v", req)
+	}
+	expected := []FetchReqTopic{
+		{
+			Name: "foo",
+			Partitions: []FetchReqPartition{
+				{ID: 0, FetchOffset: 10, MaxBytes: 334},
+				{ID: 1, FetchOffset: 20, MaxBytes: 333},
+			},
+		},
+		{
+			Name: "bar",
+			Partitions: []FetchReqPartition{
+				{ID: 3, FetchOffset: 30, MaxBytes: 333},
 			},
 		},
-		Err: nil,
 	}
-
-	b0, err := respV0.Bytes()
-	if err != nil {
-		t.Fatal(err)
+	if !reflect.DeepEqual(req.Topics, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, req.Topics)
 	}
 
-	r0, err := ReadVersionedOffsetFetchResp(bytes.NewReader(b0), respV0.Version)
-	if err != nil {
-		t.Fatal(err)
+	req = BuildBudgetedFetch(partitions, offsets, 2)
+	if err := req.Validate(); !errors.Is(err, ErrInvalidPartitionMaxBytes) {
+		t.Fatalf("expected %q, got %v", ErrInvalidPartitionMaxBytes, err)
 	}
-
-	if !reflect.DeepEqual(respV0, *r0) {
-		t.Errorf("Expected \n %#+v\n fot \n %#+v\n", respV0, *r0)
+	if req := BuildBudgetedFetch(nil, nil, 1000); len(req.Topics) != 0 {
+		t.Fatalf("expected no topics, got %+v", req.Topics)
 	}
+}
 
-	respV2 := respV0
-	respV2.Version = KafkaV2
-	respV2.Err = errnoToErr[-1]
-
-	b2, err := respV2.Bytes()
-	if err != nil {
-		t.Fatal(err)
+func TestFetchRequestValidate(t *testing.T) {
+	if err := NewSinglePartitionFetch("foo", 0, 11, 92).Validate(); err != nil {
+		t.Fatalf("expected valid request, got %s", err)
 	}
 
-	r2, err := ReadVersionedOffsetFetchResp(bytes.NewReader(b2), respV2.Version)
-	if err != nil {
-		t.Fatal(err)
+	cases := map[error]func(*FetchReq){
+		ErrNoFetchPartitions: func(r *FetchReq) {
+			r.Topics = nil
+		},
+		ErrInvalidPartitionMaxBytes: func(r *FetchReq) {
+			r.Topics[0].Partitions[0].MaxBytes = 0
+		},
+		ErrInvalidMinBytes: func(r *FetchReq) {
+			r.MinBytes = -1
+		},
+		ErrInvalidMaxWaitTime: func(r *FetchReq) {
+			r.MaxWaitTime = 30 * 24 * time.Hour
+		},
 	}
-
-	if !reflect.DeepEqual(respV2, *r2) {
-		t.Errorf("Expected \n %#+v\n fot \n %#+v\n", respV2, *r2)
+	for expected, modify := range cases {
+		req := NewSinglePartitionFetch("foo", 0, 11, 92)
+		modify(req)
+		err := req.Validate()
+		verr, ok := err.(*ValidationError)
+		if !ok || len(verr.Errs) != 1 || !errors.Is(err, expected) {
+			t.Errorf("expected %q, got %v", expected, err)
+		}
 	}
 
-	respV3 := respV2
-	respV3.Version = KafkaV3
-	respV3.ThrottleTime = 10 * time.Second
-
-	b3, err := respV3.Bytes()
-	if err != nil {
-		t.Fatal(err)
+	// all problems are reported at once
+	req := NewSinglePartitionFetch("foo", 0, 11, 0)
+	req.Topics = append(req.Topics, req.Topics[0])
+	req.MinBytes = -1
+	req.MaxWaitTime = -time.Second
+	err := req.Validate()
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("expected validation error, got %v", err)
 	}
-
-	r3, err := ReadVersionedOffsetFetchResp(bytes.NewReader(b3), respV3.Version)
-	if err != nil {
-		t.Fatal(err)
+	// max bytes of both partitions are invalid
+	if len(verr.Errs) != 5 {
+		t.Fatalf("expected 5 errors, got %s", err)
 	}
-
-	if !reflect.DeepEqual(respV3, *r3) {
-		t.Errorf("Expected \n %#+v\n fot \n %#+v\n", respV3, *r3)
+	for _, expected := range []error{ErrInvalidPartitionMaxBytes, ErrInvalidMinBytes, ErrInvalidMaxWaitTime} {
+		if !errors.Is(err, expected) {
+			t.Errorf("expected %q in %s", expected, err)
+		}
+	}
+	if errors.Is(err, ErrNoFetchPartitions) {
+		t.Errorf("unexpected %q in %s", ErrNoFetchPartitions, err)
+	}
+	var dup *DuplicatePartitionError
+	if !errors.As(err, &dup) || dup.Topic != "foo" || dup.Partition != 0 {
+		t.Errorf("expected duplicate partition error in %s", err)
 	}
 }
 
-func TestFetchResponseWithVersions(t *testing.T) {
-
-	// Test version 0
-
-	fetchRespV0 := FetchResp{
-		Version:       KafkaV0,
-		CorrelationID: 1,
-		Topics: []FetchRespTopic{
-			FetchRespTopic{
-				Name: "Topic1",
-				Partitions: []FetchRespPartition{
-					FetchRespPartition{
-						ID:        1,
-						Err:       nil,
-						TipOffset: 1,
-						Messages:  nil,
-					},
-				},
-			},
+func TestFetchRequestDuplicatePartition(t *testing.T) {
+	req := &FetchReq{
+		MaxWaitTime: time.Second,
+		Topics: []FetchReqTopic{
+			{Name: "foo", Partitions: []FetchReqPartition{{ID: 0, MaxBytes: 100}, {ID: 1, MaxBytes: 100}}},
+			{Name: "bar", Partitions: []FetchReqPartition{{ID: 1, MaxBytes: 100}}},
 		},
 	}
+	if _, err := req.Bytes(); err != nil {
+		t.Fatalf("same partition of different topics is not a duplicate: %s", err)
+	}
 
-	b0, err := fetchRespV0.Bytes()
-	if err != nil {
-		t.Fatal(err)
+	// duplicates are detected across topic entries of the same name
+	req.Topics = append(req.Topics, FetchReqTopic{Name: "foo", Partitions: []FetchReqPartition{{ID: 1, MaxBytes: 100}}})
+	expected := &DuplicatePartitionError{Topic: "foo", Partition: 1}
+	if _, err := req.Bytes(); !reflect.DeepEqual(err, expected) {
+		t.Fatalf("expected %v, got %v", expected, err)
 	}
+	err := req.Validate()
+	verr, ok := err.(*ValidationError)
+	if !ok || len(verr.Errs) != 1 || !reflect.DeepEqual(verr.Errs[0], expected) {
+		t.Fatalf("expected %v, got %v", expected, err)
+	}
+}
 
-	resp0, err := ReadVersionedFetchResp(bytes.NewReader(b0), fetchRespV0.Version)
-	if err != nil {
-		t.Fatal(err)
+func TestFetchRequestMaxBytesZero(t *testing.T) {
+	req := NewSinglePartitionFetch("foo", 0, 11, 92)
+	req.MaxBytes = 0
+	SetVersion(&req.RequestHeader, KafkaV3)
+	if err := req.Validate(); err != nil {
+		t.Fatalf("expected zero max bytes to be valid, got %s", err)
 	}
 
-	if !reflect.DeepEqual(&fetchRespV0, resp0) {
-		t.Fatalf("Not equal %+#v ,  %+#v", fetchRespV0, resp0)
+	// max bytes follows replica id, max wait time and min bytes
+	const at = 4 + 2 + 2 + 4 + 2 + 4 + 4 + 4
+	cases := map[int32][]byte{
+		0:             {0x7f, 0xff, 0xff, 0xff},
+		1:             {0x0, 0x0, 0x0, 0x1},
+		math.MaxInt32: {0x7f, 0xff, 0xff, 0xff},
+	}
+	for maxBytes, expected := range cases {
+		req.MaxBytes = maxBytes
+		b, err := req.Bytes()
+		if err != nil {
+			t.Fatalf("cannot serialize request: %s", err)
+		}
+		if got := b[at : at+4]; !bytes.Equal(got, expected) {
+			t.Fatalf("max bytes %d: expected % x, got % x", maxBytes, expected, got)
+		}
 	}
 
-	// Test version 1
+	req.MaxBytes = -1
+	if err := req.Validate(); !errors.Is(err, ErrInvalidMaxBytes) {
+		t.Fatalf("expected %v, got %v", ErrInvalidMaxBytes, err)
+	}
+}
 
-	fetchRespV1 := fetchRespV0
-	fetchRespV1.Version = KafkaV1
-	fetchRespV1.ThrottleTime = time.Second
+func TestFetchRequestMaxWaitTime(t *testing.T) {
+	cases := map[time.Duration][]byte{
+		0:                       {0x0, 0x0, 0x0, 0x0},
+		500 * time.Microsecond:  {0x0, 0x0, 0x0, 0x1},
+		time.Millisecond:        {0x0, 0x0, 0x0, 0x1},
+		1500 * time.Microsecond: {0x0, 0x0, 0x0, 0x1},
+		time.Second:             {0x0, 0x0, 0x3, 0xe8},
+	}
+	for wait, expected := range cases {
+		req := NewSinglePartitionFetch("foo", 0, 11, 92)
+		req.MaxWaitTime = wait
+		b, err := req.Bytes()
+		if err != nil {
+			t.Fatalf("cannot serialize request: %s", err)
+		}
+		// max wait time follows the replica id
+		if got := b[18:22]; !bytes.Equal(got, expected) {
+			t.Errorf("%s: expected %#v, got %#v", wait, expected, got)
+		}
+	}
+}
 
-	b1, err := fetchRespV1.Bytes()
+func TestFetchRequestUnsetEpochs(t *testing.T) {
+	req := &FetchReq{
+		RequestHeader: RequestHeader{version: KafkaV11},
+		Topics: []FetchReqTopic{
+			{Name: "foo", Partitions: []FetchReqPartition{{ID: 0, MaxBytes: 92}}},
+		},
+	}
+	b, err := req.Bytes()
 	if err != nil {
-		t.Fatal(err)
+		t.Fatalf("cannot serialize request: %s", err)
 	}
-
-	resp1, err := ReadVersionedFetchResp(bytes.NewBuffer(b1), fetchRespV1.Version)
-	if !reflect.DeepEqual(&fetchRespV1, resp1) {
-		t.Fatalf("Not equal %+#v ,  %+#v", fetchRespV1, resp1)
+	// session fields follow the header with "" client id, replica id,
+	// max wait time, min bytes, max bytes and isolation level
+	if session := b[31:39]; !bytes.Equal(session, []byte{0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff}) {
+		t.Fatalf("expected no session, got %#v", session)
+	}
+	// leader epoch follows the topic name and the partition id
+	if epoch := b[56:60]; !bytes.Equal(epoch, []byte{0xff, 0xff, 0xff, 0xff}) {
+		t.Fatalf("expected no leader epoch, got %#v", epoch)
+	}
+	r, err := ReadFetchReq(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("cannot read request: %s", err)
+	}
+	if r.Session || r.SessionEpoch != -1 || r.Topics[0].Partitions[0].CheckLeaderEpoch || r.Topics[0].Partitions[0].CurrentLeaderEpoch != -1 {
+		t.Fatalf("expected no session and leader epoch, got %+v", r)
 	}
 
-	// Test version 4
+	// zero epochs are sent when set explicitly
+	req.Session = true
+	req.Topics[0].Partitions[0].CheckLeaderEpoch = true
+	if b, err = req.Bytes(); err != nil {
+		t.Fatalf("cannot serialize request: %s", err)
+	}
+	if session := b[31:39]; !bytes.Equal(session, make([]byte, 8)) {
+		t.Fatalf("expected new session, got %#v", session)
+	}
+	if epoch := b[56:60]; !bytes.Equal(epoch, make([]byte, 4)) {
+		t.Fatalf("expected zero leader epoch, got %#v", epoch)
+	}
+	if r, err = ReadFetchReq(bytes.NewReader(b)); err != nil {
+		t.Fatalf("cannot read request: %s", err)
+	}
+	if !r.Session || !r.Topics[0].Partitions[0].CheckLeaderEpoch {
+		t.Fatalf("expected session and leader epoch, got %+v", r)
+	}
+}
 
-	fetchRespV4 := fetchRespV1
-	fetchRespV4.Version = KafkaV4
-	fetchRespV4.Topics[0].Partitions[0].LastStableOffset = 1
-	fetchRespV4.Topics[0].Partitions[0].AbortedTransactions = []FetchRespAbortedTransaction{
-		FetchRespAbortedTransaction{
-			ProducerID:  1,
-			FirstOffset: 1,
+func TestFetchRequestV11(t *testing.T) {
+	req := &FetchReq{
+		RequestHeader:  RequestHeader{correlationID: 241, ClientID: "test", version: KafkaV11},
+		ReplicaID:      -1,
+		MaxWaitTime:    time.Second * 2,
+		MinBytes:       1,
+		MaxBytes:       1 << 20,
+		IsolationLevel: 1,
+		SessionID:      7,
+		SessionEpoch:   3,
+		Session:        true,
+		Topics: []FetchReqTopic{
+			{
+				Name: "foo",
+				Partitions: []FetchReqPartition{
+					{ID: 0, CurrentLeaderEpoch: 5, CheckLeaderEpoch: true, FetchOffset: 11, LogStartOffset: -1, MaxBytes: 92},
+				},
+			},
 		},
+		ForgottenTopics: []FetchReqForgottenTopic{
+			{Name: "bar", Partitions: []int32{1}},
+		},
+		RackID: "a",
 	}
-
-	b4, err := fetchRespV4.Bytes()
+	testRequestSerialization(t, req)
+	b, err := req.Bytes()
 	if err != nil {
-		t.Fatal(err)
+		t.Fatalf("cannot serialize request: %s", err)
 	}
-
-	resp4, err := ReadVersionedFetchResp(bytes.NewBuffer(b4), fetchRespV4.Version)
-	if !reflect.DeepEqual(&fetchRespV4, resp4) {
-		t.Fatalf("Not equal %+#v ,  %+#v", fetchRespV4, resp4)
+	// forgotten topics and rack id end the request
+	expectedTail := mustDecodeHex(t,
+		"00000001",         // forgotten topics
+		"0003626172",       // name
+		"0000000100000001", // partitions
+		"000161",           // rack id
+	)
+	if !bytes.HasSuffix(b, expectedTail) {
+		t.Fatalf("expected request to end with %#v, got %#v", expectedTail, b)
 	}
 
-	// Test version 5
-
-	fetchRespV5 := fetchRespV4
-	fetchRespV5.Version = KafkaV5
-
-	fetchRespV5.Topics[0].Partitions[0].LogStartOffset = 1
-
-	b5, err := fetchRespV5.Bytes()
+	r, err := ReadFetchReq(bytes.NewReader(b))
 	if err != nil {
-		t.Fatal(err)
+		t.Fatalf("cannot read request: %s", err)
 	}
-
-	resp5, err := ReadVersionedFetchResp(bytes.NewBuffer(b5), fetchRespV5.Version)
-	if !reflect.DeepEqual(&fetchRespV5, resp5) {
-		t.Fatalf("Not equal %+#v ,  %+#v", fetchRespV5, resp5)
+	if !reflect.DeepEqual(r, req) {
+		t.Fatalf("expected %#v, got %#v", req, r)
 	}
 
-}
-
-func TestFetchResponseWithRecordBatchAndGZIP(t *testing.T) {
-	data := []byte{
-		0x00, 0x00, 0x00, 0x99, // Size
-		0x00, 0x00, 0x00, 0x04, // CorrelationID
-		0x00, 0x00, 0x00, 0x00, // ThrottleTime
-		0x00, 0x00, 0x00, 0x01, // Number of topics
-		0x00, 0x06, 0x54, 0x6f, 0x70, 0x69, 0x63, 0x34, // "topic4"
-		0x00, 0x00, 0x00, 0x01, // Number of partition
-		0x00, 0x00, 0x00, 0x00, // Partition id
-		0x00, 0x00, // Error
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, // High watermark offset
-		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // Last stable offset
-		0xff, 0xff, 0xff, 0xff, // Numbet of aborted transactions
-		// Record Batch
-		0x00, 0x00, 0x00, 0x63, // Size
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // First offset
-		0x00, 0x00, 0x00, 0x57, // Length
-		0x00, 0x00, 0x00, 0x00, // Partition leader epoch
-		0x02,                   // Magic byte (version of message)
-		0x04, 0xf7, 0xab, 0xb5, // CRC
-		0x00, 0x01, // Attributes
-		0x00, 0x00, 0x00, 0x00, // Last offset delta
-		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // First timestamp
-		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // Producer ID
-		0xff, 0xff, // Producer epoch
-		0xff, 0xff, 0xff, 0xff, // First Sequence
-		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00, 0x00, 0x00, 0x01, 0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x53, 0x62, 0x60, 0x60, 0x60, 0x14, 0xcb, 0x48, 0xcd, 0xc9, 0xc9, 0x57, 0x28, 0xcf, 0x2f, 0xca, 0x49, 0x61, 0x00, 0x00, 0xd3, 0x90, 0x6c, 0x82, 0x12, 0x00, 0x00, 0x00,
+	// no rack is encoded as empty string
+	req.RackID = ""
+	if b, err = req.Bytes(); err != nil {
+		t.Fatalf("cannot serialize request: %s", err)
+	}
+	if !bytes.HasSuffix(b, []byte{0x0, 0x0, 0x0, 0x1, 0x0, 0x0}) {
+		t.Fatalf("expected empty rack id, got %#v", b)
 	}
 
-	resp, err := ReadVersionedFetchResp(bytes.NewReader(data), 4)
-	if err != nil {
-		t.Fatal(err)
+	// rack id is not supported by older versions
+	req.RackID = "a"
+	req.version = KafkaV10
+	if b, err = req.Bytes(); err != nil {
+		t.Fatalf("cannot serialize request: %s", err)
 	}
-	if string(resp.Topics[0].Partitions[0].RecordBatches[0].Records[0].Value) != "hello world" {
-		t.Fatal("Wrong response")
+	if r, err = ReadFetchReq(bytes.NewReader(b)); err != nil {
+		t.Fatalf("cannot read request: %s", err)
+	}
+	if r.RackID != "" {
+		t.Fatalf("expected rack id to be ignored, got %q", r.RackID)
+	}
+	if size := req.EncodedSize(); size != len(b) {
+		t.Fatalf("expected size %d, got %d", len(b), size)
 	}
 }
 
-func TestFetchResponseWithRecordBatch(t *testing.T) {
-	oneMessageFetchResponseV4error := []byte{
-		0x00, 0x00, 0x00, 0x00, // Fake size (just random number)
-		0x00, 0x00, 0x00, 0x05, //CorrelationID
-		0x00, 0x00, 0x00, 0x00, //ThrottleTime
-		0x00, 0x00, 0x00, 0x01, //Number of topics
-		0x00, 0x06, 0x54, 0x6f, 0x70, 0x69, 0x63, 0x34, // 'topic4'
-		0x00, 0x00, 0x00, 0x01, // number of Partition
-		0x00, 0x00, 0x00, 0x00, // partition id
-		0x00, 0x00, // Error
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, // High watermark Offset
-		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // Last stable offset
-		0xff, 0xff, 0xff, 0xff, // Number of aborted Transactions
-		//RecordBatch
-		0x00, 0x00, 0x00, 0x4f, // Size ???
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // FirstOffset
-		0x00, 0x00, 0x00, 0x43, // Length
-		0x00, 0x00, 0x00, 0x00, // PartitionLeaderEpoch
-		0x02,                   // Magic
-		0x34, 0xa1, 0x4e, 0x1d, // CRC
-		0x00, 0x00, //Attributes
-		0x00, 0x00, 0x00, 0x00, // LastOffsetDelte
-		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, //FirstTimestamp
-		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // ProducerId
-		0xff, 0xff, //ProducerEpoch
-		0xff, 0xff, 0xff, 0xff, // FirstSequence
-		//Record
-		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00, 0x00, 0x00, 0x01, 0x22, 0x00, 0x00, 0x00, 0x01, 0x16, 0x68, 0x65, 0x6c, 0x6c, 0x6f, 0x20, 0x77, 0x6f, 0x72, 0x6c, 0x64, 0x00,
+// mustDecodeHex joins hex dumped parts, so that golden bytes can be annotated
+// field by field.
+func mustDecodeHex(t *testing.T, parts ...string) []byte {
+	b, err := hex.DecodeString(strings.Join(parts, ""))
+	if err != nil {
+		t.Fatalf("invalid hex dump: %s", err)
 	}
+	return b
+}
 
-	resp, err := ReadVersionedFetchResp(bytes.NewReader(oneMessageFetchResponseV4error), 4)
+func TestFetchRequestGolden(t *testing.T) {
+	req := &FetchReq{
+		RequestHeader:  RequestHeader{correlationID: 7, ClientID: "golden", version: KafkaV5},
+		ReplicaID:      -1,
+		MaxWaitTime:    500 * time.Millisecond,
+		MinBytes:       1,
+		MaxBytes:       1 << 20,
+		IsolationLevel: 1,
+		Topics: []FetchReqTopic{
+			{
+				Name: "events",
+				Partitions: []FetchReqPartition{
+					{ID: 3, FetchOffset: 1000, LogStartOffset: 10, MaxBytes: 65536},
+				},
+			},
+		},
+	}
+	expected := mustDecodeHex(t,
+		"00000049",         // size
+		"0001",             // api key
+		"0005",             // api version
+		"00000007",         // correlation id
+		"0006676f6c64656e", // client id
+		"ffffffff",         // replica id
+		"000001f4",         // max wait time
+		"00000001",         // min bytes
+		"00100000",         // max bytes
+		"01",               // isolation level
+		"00000001",         // topics
+		"00066576656e7473", // topic name
+		"00000001",         // partitions
+		"00000003",         // partition id
+		"00000000000003e8", // fetch offset
+		"000000000000000a", // log start offset
+		"00010000",         // partition max bytes
+	)
+	b, err := req.Bytes()
 	if err != nil {
-		t.Fatal(err)
+		t.Fatalf("cannot serialize request: %s", err)
 	}
-	if string(resp.Topics[0].Partitions[0].RecordBatches[0].Records[0].Value) != "hello world" {
-		t.Fatal("Wrong response")
+	if !bytes.Equal(b, expected) {
+		t.Fatalf("expected different bytes representation:\n%s", hex.Dump(b))
 	}
+}
 
+func TestMessageChecksum(t *testing.T) {
+	data := []byte("123456789")
+	cases := map[MessageVersion]uint32{
+		MessageV0: 0xcbf43926, // IEEE
+		MessageV1: 0xcbf43926, // IEEE
+		MessageV2: 0xe3069283, // Castagnoli
+	}
+	for version, expected := range cases {
+		if crc := messageChecksum(version, data); crc != expected {
+			t.Errorf("version %d: expected %#x, got %#x", version, expected, crc)
+		}
+	}
 }
 
-func TestFetchResponseWithRecordBatch2(t *testing.T) {
-	oneMessageFetchResponseV4error := []byte{
-		0x00, 0x00, 0x00, 0x85, // Size
-		0x00, 0x00, 0x00, 0x0a, // CorrelationID
-		0x00, 0x00, 0x00, 0x00, // ThrottleTime
-		0x00, 0x00, 0x00, 0x01, // Number of topics
-		0x00, 0x06, 0x54, 0x6f, 0x70, 0x69, 0x63, 0x33, // "topic3"
-		0x00, 0x00, 0x00, 0x01, // number of partitions
-		0x00, 0x00, 0x00, 0x00, // Partions id
-		0x00, 0x00, // Error
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, // High Watermark offset
-		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // Last stable offset
-		0xff, 0xff, 0xff, 0xff, // Number of aborted transactions
-		// Record Batch
-		0x00, 0x00, 0x00, 0x4f, // Size
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // First Offset
-		0x00, 0x00, 0x00, 0x43, // Length
-		0x00, 0x00, 0x00, 0x00, // Partition Leader Epoch
-		0x02,                   // Magic byte (version)
-		0x34, 0xa1, 0x4e, 0x1d, // CRC
-		0x00, 0x00, // Attributes
-		0x00, 0x00, 0x00, 0x00, // Last offset delta
-		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // FirstTimespamp
-		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // Producer ID
-		0xff, 0xff, // Producer Epoch
-		0xff, 0xff, 0xff, 0xff, // first sequence
-		// Record
-		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00, 0x00, 0x00, 0x01, 0x22, 0x00, 0x00, 0x00, 0x01, 0x16, 0x68, 0x65, 0x6c, 0x6c, 0x6f, 0x20, 0x77, 0x6f, 0x72, 0x6c, 0x64, 0x00,
+func TestMessageGolden(t *testing.T) {
+	msg := &Message{Offset: 5, Key: []byte("key"), Value: []byte("value"), TimestampMs: 1500000000000}
+	cases := map[MessageVersion][]byte{
+		MessageV0: mustDecodeHex(t,
+			"0000000000000005",   // offset
+			"00000016",           // size
+			"2356c137",           // crc
+			"00",                 // magic byte
+			"00",                 // attributes
+			"000000036b6579",     // key
+			"0000000576616c7565", // value
+		),
+		MessageV1: mustDecodeHex(t,
+			"0000000000000005",   // offset
+			"0000001e",           // size
+			"d0faf5a0",           // crc
+			"01",                 // magic byte
+			"00",                 // attributes
+			"0000015d3ef79800",   // timestamp
+			"000000036b6579",     // key
+			"0000000576616c7565", // value
+		),
+	}
+	for version, expected := range cases {
+		var buf bytes.Buffer
+		if _, err := writeMessageSetVersioned(&buf, []*Message{msg}, CompressionNone, version); err != nil {
+			t.Fatalf("cannot serialize message: %s", err)
+		}
+		if !bytes.Equal(buf.Bytes(), expected) {
+			t.Fatalf("expected different bytes representation of version %d message:\n%s", version, hex.Dump(buf.Bytes()))
+		}
 	}
+}
 
-	resp, err := ReadVersionedFetchResp(bytes.NewReader(oneMessageFetchResponseV4error), 4)
-	if err != nil {
-		t.Fatal(err)
+func TestNewSinglePartitionFetch(t *testing.T) {
+	req := NewSinglePartitionFetch("foo", 3, 529, 4096)
+	expected := &FetchReq{
+		MaxWaitTime: 100 * time.Millisecond,
+		MinBytes:    1,
+		MaxBytes:    4096,
+		Topics: []FetchReqTopic{
+			{
+				Name: "foo",
+				Partitions: []FetchReqPartition{
+					{ID: 3, FetchOffset: 529, MaxBytes: 4096},
+				},
+			},
+		},
 	}
-	if string(resp.Topics[0].Partitions[0].RecordBatches[0].Records[0].Value) != "hello world" {
-		t.Fatal("Wrong response")
+	if !reflect.DeepEqual(req, expected) {
+		t.Fatalf("expected %#v, got %#v", expected, req)
 	}
-
+	testRequestSerialization(t, req)
 }
 
-func TestFetchResponseWithRecordBatchWithMultipleRecords(t *testing.T) {
+func TestFetchRequestEncodedSize(t *testing.T) {
+	for version := KafkaV0; version <= KafkaV11; version++ {
+		req := &FetchReq{
+			RequestHeader: RequestHeader{correlationID: 241, ClientID: "test", version: version},
+			MaxWaitTime:   time.Second,
+			MinBytes:      1,
+			MaxBytes:      1 << 20,
+			ForgottenTopics: []FetchReqForgottenTopic{
+				{Name: "baz", Partitions: []int32{1, 2}},
+			},
+			RackID: "eu-west-1a",
+			Topics: []FetchReqTopic{
+				{
+					Name: "foo",
+					Partitions: []FetchReqPartition{
+						{ID: 421, FetchOffset: 529, MaxBytes: 4921},
+						{ID: 0, FetchOffset: 11, MaxBytes: 92},
+					},
+				},
+				{
+					Name:       "bar",
+					Partitions: []FetchReqPartition{{ID: 1, FetchOffset: 1, MaxBytes: 1}},
+				},
+			},
+		}
+		b, err := req.Bytes()
+		if err != nil {
+			t.Fatalf("version %d: cannot serialize request: %s", version, err)
+		}
+		if size := req.EncodedSize(); size != len(b) {
+			t.Fatalf("version %d: expected size %d, got %d", version, len(b), size)
+		}
+	}
+}
 
-	messageFetchResponseV5MultipleRecords := []byte{
-		0, 0, 1, 205, //size
-		0, 0, 0, 63, //correlation, id
-		0, 0, 0, 0, //throttle, time
-		0, 0, 0, 1, //number, of, topics
-		0, 4, 97, 117, 116, 104, // name of the topic ( auth)
-		0, 0, 0, 1, //number of partitions
-		0, 0, 0, 0, // partition id
-		0, 0, // error
-		0, 0, 0, 0, 0, 0, 1, 121, //, hight, water, martk
-		255, 255, 255, 255, 255, 255, 255, 255, //, last, stable, offset
-		0, 0, 0, 0, 0, 0, 0, 0, //, log, start, offset
-		255, 255, 255, 255, //, ,
-		0, 0, 1, 145, //, size, of, batch
-		0, 0, 0, 0, 0, 0, 1, 72, //, first, offset
-		0, 0, 1, 133, //, length
-		0, 0, 0, 2, //, partition, leader, epoch
-		2,                //, magic,
-		7, 177, 219, 215, //crc,
-		0, 0, //, attr
-		0, 0, 0, 1, //, last, offset, delta
-		255, 255, 255, 255, 255, 255, 255, 255, //first, timestampt
-		255, 255, 255, 255, 255, 255, 255, 255, //, max, timestampt
-		255, 255, 255, 255, 255, 255, 255, 255, //, producer, id
-		255, 255, //, producer, epoch
-		255, 255, 255, 255, //, base, sequence
-		0, 0, 0, 2, //, number, of, records
-		212, 2, //size,
-		0,                                                                                                                       //, attribute
-		0,                                                                                                                       //, timestampt, delta
-		0,                                                                                                                       //, offset, delta
-		28,                                                                                                                      //, key, length
-		8, 128, 254, 7, 16, 131, 214, 136, 178, 165, 138, 220, 153, 2, 170, 2, 1, 1, 16, 17, 2, 32, 246, 240, 230, 136, 163, 28, //, key
-		67, //,
-		50, 175, 30, 87, 26, 228, 189, 143, 130, 80, 116, 194, 56, 70, 130, 136, 212, 23, 149, 222, 38, 125, 51, 192, 151, 107, 0, 0, 0, 10, 52, 10, 24, 102, 113, 109, 111, 106, 116, 50, 97, 113, 108, 119, 121, 101, 51, 118, 103, 116, 118, 114, 118, 105, 108, 119, 112, 24, 180, 149, 247, 197, 241, 159, 161, 188, 21,
-		32, 180, 249, 142, 150, 132, 160, 161, 188, 21, 42, 4, 104, 116, 116, 112, 18, 32, 246, 240, 230, 136, 163, 28, 67, 50, 175, 30, 87, 26, 228, 189, 143, 130, 80, 116, 194, 56, 70, 130, 136, 212, 23, 149, 222, 38, 125, 51, 192, 151, 26, 17, 111, 114, 103, 97, 110, 105, 122, 97, 116, 105, 111, 110, 58, 114, 101, 97, 100, 0,
-		204, 2, 0, 0, 2, 28, 8, 128, 254, 7, 16, 132, 214, 136, 178, 165, 138, 220, 153, 2, 162, 2, 1, 1, 16, 17, 2, 32, 246, 240, 230, 136, 163, 28, 67, 50, 175, 30, 87, 26, 228, 189, 143, 130, 80, 116, 194, 56, 70, 130, 136, 212, 23, 149, 222, 38, 125, 51, 192, 151, 103, 0, 0, 0, 10, 52, 10, 24, 119, 51, 120, 104, 55, 107, 118, 104, 104, 118, 112, 55, 104, 113, 111, 103, 119, 97, 108, 53, 55, 102, 100, 102, 24, 229, 183, 247, 197, 241, 159, 161, 188, 21, 32, 229, 155, 143, 150, 132, 160, 161, 188, 21, 42, 4, 104, 116, 116, 112, 18, 32, 246, 240, 230, 136, 163, 28, 67, 50, 175, 30, 87, 26, 228, 189, 143, 130, 80, 116, 194, 56, 70, 130, 136, 212, 23, 149, 222, 38, 125, 51, 192, 151, 26, 13, 115, 117, 112, 112, 108, 105, 101, 114, 58, 114, 101, 97, 100, 0,
+func TestFetchResponse(t *testing.T) {
+	expected1 := &FetchResp{
+		CorrelationID: 241,
+		Topics: []FetchRespTopic{
+			{
+				Name: "foo",
+				Partitions: []FetchRespPartition{
+					{
+						ID:        0,
+						Err:       error(nil),
+						TipOffset: 4,
+						Messages: []*Message{
+							{Offset: 2, Crc: 0xb8ba5f57, Key: []byte("foo"), Value: []byte("bar"), Topic: "foo", Partition: 0, TipOffset: 4, TimestampMs: NoTimestamp},
+							{Offset: 3, Crc: 0xb8ba5f57, Key: []byte("foo"), Value: []byte("bar"), Topic: "foo", Partition: 0, TipOffset: 4, TimestampMs: NoTimestamp},
+						},
+					},
+					{
+						ID:        1,
+						Err:       ErrUnknownTopicOrPartition,
+						TipOffset: -1,
+						Messages:  nil,
+					},
+				},
+			},
+		},
 	}
 
-	resp, err := ReadVersionedFetchResp(bytes.NewReader(messageFetchResponseV5MultipleRecords), 5)
+	tests := []struct {
+		Bytes     []byte
+		RoundTrip bool // whether to compare re-serialized version
+		Expected  *FetchResp
+	}{
+		{ // CompressionNone
+			Bytes:     []byte{0x0, 0x0, 0x0, 0x75, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0x66, 0x6f, 0x6f, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x4, 0x0, 0x0, 0x0, 0x40, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0x14, 0xb8, 0xba, 0x5f, 0x57, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x66, 0x6f, 0x6f, 0x0, 0x0, 0x0, 0x3, 0x62, 0x61, 0x72, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0x0, 0x14, 0xb8, 0xba, 0x5f, 0x57, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x66, 0x6f, 0x6f, 0x0, 0x0, 0x0, 0x3, 0x62, 0x61, 0x72, 0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x0, 0x0, 0x0, 0x0},
+			RoundTrip: true,
+			Expected:  expected1,
+		},
+		{ // CompressionGzip
+			Bytes:     []byte{0x0, 0x0, 0x0, 0x81, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0x66, 0x6f, 0x6f, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x4, 0x0, 0x0, 0x0, 0x4c, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0x0, 0x40, 0x7, 0x3c, 0x17, 0x35, 0x0, 0x1, 0xff, 0xff, 0xff, 0xff, 0x0, 0x0, 0x0, 0x32, 0x1f, 0x8b, 0x8, 0x0, 0x0, 0x9, 0x6e, 0x88, 0x0, 0xff, 0x62, 0x80, 0x0, 0x26, 0x20, 0x16, 0xd9, 0xb1, 0x2b, 0x3e, 0x1c, 0xcc, 0x63, 0x4e, 0xcb, 0xcf, 0x7, 0x51, 0x49, 0x89, 0x45, 0x50, 0x79, 0x66, 0x5c, 0xf2, 0x80, 0x0, 0x0, 0x0, 0xff, 0xff, 0xab, 0xcc, 0x83, 0x80, 0x40, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x0, 0x0, 0x0, 0x0},
+			RoundTrip: false,
+			Expected:  expected1,
+		},
+		{ // CompressionSnappy
+			Bytes:     []byte{0x0, 0x0, 0x0, 0x75, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0x66, 0x6f, 0x6f, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x4, 0x0, 0x0, 0x0, 0x40, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0x0, 0x34, 0x6, 0x8d, 0xfe, 0xe2, 0x0, 0x2, 0xff, 0xff, 0xff, 0xff, 0x0, 0x0, 0x0, 0x26, 0x40, 0x0, 0x0, 0x9, 0x1, 0x20, 0x2, 0x0, 0x0, 0x0, 0x14, 0xb8, 0xba, 0x5f, 0x57, 0x5, 0xf, 0x28, 0x3, 0x66, 0x6f, 0x6f, 0x0, 0x0, 0x0, 0x3, 0x62, 0x61, 0x72, 0x5, 0x10, 0x8, 0x0, 0x0, 0x3, 0x5e, 0x20, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x0, 0x0, 0x0, 0x0},
+			RoundTrip: false,
+			Expected:  expected1,
+		},
+		{
+			Bytes:     []byte{0x0, 0x0, 0x0, 0x48, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x0, 0x0, 0x1, 0x0, 0x4, 0x74, 0x65, 0x73, 0x74, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x8, 0x0, 0x3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x0, 0x0, 0x0, 0x0},
+			RoundTrip: true,
+			Expected: &FetchResp{
+				CorrelationID: 241,
+				Topics: []FetchRespTopic{
+					{
+						Name: "test",
+						Partitions: []FetchRespPartition{
+							{
+								ID:        0,
+								Err:       ErrUnknownTopicOrPartition,
+								TipOffset: -1,
+								Messages:  nil,
+							},
+							{
+								ID:        1,
+								Err:       ErrUnknownTopicOrPartition,
+								TipOffset: -1,
+								Messages:  nil,
+							},
+							{
+								ID:        8,
+								Err:       ErrUnknownTopicOrPartition,
+								TipOffset: -1,
+								Messages:  nil,
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		resp, err := ReadVersionedFetchResp(bytes.NewBuffer(tt.Bytes), KafkaV0)
+		if err != nil {
+			t.Fatalf("could not read fetch response: %s", err)
+		}
+		if !reflect.DeepEqual(resp, tt.Expected) {
+			t.Fatalf("expected different message: %#v", resp)
+		}
+		if tt.RoundTrip {
+			b, err := resp.Bytes()
+			if err != nil {
+				t.Fatalf("cannot serialize response: %s", err)
+			}
+			if !bytes.Equal(b, tt.Bytes) {
+				t.Fatalf("serialized representation different from expected: %#v", b)
+			}
+		}
+	}
+}
+
+func TestOffsetRequestIsolationLevel(t *testing.T) {
+	for _, level := range []int8{IsolationReadUncommitted, IsolationReadCommitted} {
+		req := &OffsetReq{
+			RequestHeader:  RequestHeader{correlationID: 241, ClientID: "test", version: KafkaV2},
+			ReplicaID:      -1,
+			IsolationLevel: level,
+			Topics: []OffsetReqTopic{
+				{
+					Name:       "foo",
+					Partitions: []OffsetReqPartition{{ID: 0, TimeMs: OffsetReqTimeLatest}},
+				},
+			},
+		}
+		testRequestSerialization(t, req)
+		b, err := req.Bytes()
+		if err != nil {
+			t.Fatalf("cannot serialize request: %s", err)
+		}
+		// isolation level follows the replica id
+		if b[22] != byte(level) {
+			t.Fatalf("expected isolation level %d, got %#v", level, b)
+		}
+		r, err := ReadOffsetReq(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("cannot read request: %s", err)
+		}
+		if !reflect.DeepEqual(r, req) {
+			t.Fatalf("expected %#v, got %#v", req, r)
+		}
+
+		// not supported by older versions
+		req.version = KafkaV1
+		if b, err = req.Bytes(); err != nil {
+			t.Fatalf("cannot serialize request: %s", err)
+		}
+		if r, err = ReadOffsetReq(bytes.NewReader(b)); err != nil {
+			t.Fatalf("cannot read request: %s", err)
+		}
+		if r.IsolationLevel != IsolationReadUncommitted {
+			t.Fatalf("expected isolation level to be ignored, got %d", r.IsolationLevel)
+		}
+	}
+}
+
+func TestOffsetFetchWithVersions(t *testing.T) {
+	respV0 := OffsetFetchResp{
+		Version:       0,
+		CorrelationID: 0,
+		ThrottleTime:  0,
+		Topics: []OffsetFetchRespTopic{
+			OffsetFetchRespTopic{
+				Name: "",
+				Partitions: []OffsetFetchRespPartition{
+					OffsetFetchRespPartition{
+						ID:       0,
+						Offset:   0,
+						Metadata: "",
+						Err:      nil,
+					},
+				},
+			},
+		},
+		Err: nil,
+	}
+
+	b0, err := respV0.Bytes()
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	records := resp.Topics[0].Partitions[0].RecordBatches[0].Records
+	r0, err := ReadVersionedOffsetFetchResp(bytes.NewReader(b0), respV0.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	if len(records) != 2 {
-		t.Fatal("Expect 2 records")
+	if !reflect.DeepEqual(respV0, *r0) {
+		t.Errorf("Expected \n %#+v\n fot \n %#+v\n", respV0, *r0)
 	}
 
-	if records[0].Length != 170 {
-		t.Fatal("Wrong record length")
+	respV2 := respV0
+	respV2.Version = KafkaV2
+	respV2.Err = errnoToErr[-1]
+
+	b2, err := respV2.Bytes()
+	if err != nil {
+		t.Fatal(err)
 	}
-	if records[1].Length != 166 {
-		t.Fatal("Wrong record length")
+
+	r2, err := ReadVersionedOffsetFetchResp(bytes.NewReader(b2), respV2.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(respV2, *r2) {
+		t.Errorf("Expected \n %#+v\n fot \n %#+v\n", respV2, *r2)
+	}
+
+	respV3 := respV2
+	respV3.Version = KafkaV3
+	respV3.ThrottleTime = 10 * time.Second
+
+	b3, err := respV3.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r3, err := ReadVersionedOffsetFetchResp(bytes.NewReader(b3), respV3.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(respV3, *r3) {
+		t.Errorf("Expected \n %#+v\n fot \n %#+v\n", respV3, *r3)
 	}
 }
 
-func TestFetchResponseWithMultipleRecordBatches(t *testing.T) {
-	messageFetchResponseV5MultipleBatches := []byte{
-		0x00, 0x00, 0x02, 0x98, // size
-		0x00, 0x00, 0x00, 0xa7, // correlation id
-		0x00, 0x00, 0x00, 0x00, // throttle time
-		0x00, 0x00, 0x00, 0x01, // array size
-		0x00, 0x0c, // string length
-		0x6c, 0x65, 0x67, 0x61, 0x6c, 0x2d, 0x65, 0x76, 0x65, 0x6e, 0x74, 0x73, // topic name
-		0x00, 0x00, 0x00, 0x01, // array size
-		0x00, 0x00, 0x00, 0x00, // partition id
-		0x00, 0x00, // error
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x18, // tip offset
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x18, // last stable offset
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // log start offset
-		0xff, 0xff, 0xff, 0xff, // array length
-		0x00, 0x00, 0x02, 0x54, // message set size
+func TestOffsetFetchResponseLegacy(t *testing.T) {
+	b := mustDecodeHex(t,
+		"00000032",         // size
+		"00000005",         // correlation id
+		"00000001",         // topics
+		"0003666f6f",       // "foo"
+		"00000002",         // partitions
+		"00000000",         // id
+		"000000000000000a", // offset
+		"00016d",           // metadata "m"
+		"0000",             // error
+		"00000001",         // id
+		"ffffffffffffffff", // no offset committed
+		"0000",             // metadata
+		"0000",             // error
+	)
+	expected := &OffsetFetchResp{
+		CorrelationID: 5,
+		Topics: []OffsetFetchRespTopic{
+			{Name: "foo", Partitions: []OffsetFetchRespPartition{
+				{ID: 0, Offset: 10, Metadata: "m"},
+				{ID: 1, Offset: -1},
+			}},
+		},
+	}
+	for _, version := range []int16{KafkaV0, KafkaV1} {
+		expected.Version = version
+		resp, err := ReadVersionedOffsetFetchResp(bytes.NewReader(b), version)
+		if err != nil {
+			t.Fatalf("version %d: cannot read response: %s", version, err)
+		}
+		if !reflect.DeepEqual(resp, expected) {
+			t.Fatalf("version %d: expected %#v, got %#v", version, expected, resp)
+		}
+		if got, err := resp.Bytes(); err != nil || !bytes.Equal(got, b) {
+			t.Fatalf("version %d: expected % x, got % x (%v)", version, b, got, err)
+		}
+	}
+	// newer versions end with the error code
+	if _, err := ReadVersionedOffsetFetchResp(bytes.NewReader(b), KafkaV2); err == nil {
+		t.Fatal("expected legacy response not to be read as version 2")
+	}
 
-		// Batch 1:
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x16, // first offset
-		0x00, 0x00, 0x01, 0x1e, // length
-		0x00, 0x00, 0x00, 0x04, // partition leader epoch
-		0x02,                   // message version
-		0xbc, 0x45, 0x46, 0x64, // crc
-		0x00, 0x00, // attributes
-		0x00, 0x00, 0x00, 0x00, // last offset delta
-		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // first timestamp
-		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // max timestamp
-		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // producer id
-		0xff, 0xff, // producer epoch
-		0xff, 0xff, 0xff, 0xff, // first sequence
-		0x00, 0x00, 0x00, 0x01, // array length
-		0xd6, 0x03, // record length
-		0x00,                                           // attributes
-		0x00,                                           // timestamp delta
-		0x00,                                           // offset delta
-		0x10,                                           // key length
-		0x08, 0x80, 0x82, 0x94, 0x09, 0x10, 0xf7, 0x07, // key
-		0xb8, 0x03, // value length (220)
-		0x01, 0x01, 0x50, 0x12, 0x04, 0x18, 0x77, 0x70, 0x77, 0x6a, 0x36, 0x61, 0x62, 0x6c, 0x75, 0x7a, // value...
+	resp, err := ReadVersionedOffsetFetchResp(bytes.NewReader(b), KafkaV0)
+	if err != nil {
+		t.Fatalf("cannot read response: %s", err)
+	}
+	resp.Topics = append(resp.Topics, OffsetFetchRespTopic{Name: "bar", Partitions: []OffsetFetchRespPartition{
+		{ID: 0, Offset: 3, Err: ErrUnknownTopicOrPartition},
+	}})
+	offsets := resp.CommittedOffsets()
+	if exp := map[string]map[int32]int64{"foo": {0: 10}}; !reflect.DeepEqual(offsets, exp) {
+		t.Fatalf("expected %v, got %v", exp, offsets)
+	}
+}
+
+func TestOffsetFetchAllPartitions(t *testing.T) {
+	req := &OffsetFetchReq{
+		RequestHeader: RequestHeader{correlationID: 1, ClientID: "test", version: KafkaV2},
+		ConsumerGroup: "group",
+	}
+	testRequestSerialization(t, req)
+	b, _ := req.Bytes()
+	if !bytes.HasSuffix(b, []byte{0x0, 0x5, 'g', 'r', 'o', 'u', 'p', 0xff, 0xff, 0xff, 0xff}) {
+		t.Fatalf("expected null topics: %#v", b)
+	}
+	r, err := ReadOffsetFetchReq(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("cannot read request: %s", err)
+	}
+	if !reflect.DeepEqual(r, req) {
+		t.Fatalf("expected %#v, got %#v", req, r)
+	}
+
+	// empty topics are not the same as all partitions
+	req.Topics = []OffsetFetchReqTopic{}
+	b, _ = req.Bytes()
+	if r, err := ReadOffsetFetchReq(bytes.NewReader(b)); err != nil || r.Topics == nil || len(r.Topics) != 0 {
+		t.Fatalf("expected empty topics, got %#v, %v", r, err)
+	}
+
+	// older versions cannot express null topics
+	req.Topics = nil
+	SetVersion(&req.RequestHeader, KafkaV1)
+	b, _ = req.Bytes()
+	if !bytes.HasSuffix(b, []byte{0x0, 0x0, 0x0, 0x0}) {
+		t.Fatalf("expected empty topics: %#v", b)
+	}
+
+	// response lists all committed partitions of the group
+	resp := &OffsetFetchResp{Version: KafkaV3, CorrelationID: 1}
+	for ti := 0; ti < 50; ti++ {
+		topic := OffsetFetchRespTopic{Name: fmt.Sprintf("topic-%d", ti)}
+		for pi := int32(0); pi < 100; pi++ {
+			topic.Partitions = append(topic.Partitions, OffsetFetchRespPartition{ID: pi, Offset: int64(ti) * int64(pi)})
+		}
+		resp.Topics = append(resp.Topics, topic)
+	}
+	b, err = resp.Bytes()
+	if err != nil {
+		t.Fatalf("cannot serialize response: %s", err)
+	}
+	got, err := ReadVersionedOffsetFetchResp(bytes.NewReader(b), KafkaV3)
+	if err != nil {
+		t.Fatalf("cannot read response: %s", err)
+	}
+	if !reflect.DeepEqual(got, resp) {
+		t.Fatal("expected decoded response to match the encoded one")
+	}
+}
+
+func TestFetchResponseHeaderGolden(t *testing.T) {
+	cases := []struct {
+		version int16
+		resp    FetchResp
+		parts   []string
+	}{
+		{
+			version: KafkaV1,
+			resp: FetchResp{
+				CorrelationID: 7,
+				ThrottleTime:  5 * time.Millisecond,
+				Topics: []FetchRespTopic{
+					{Name: "foo", Partitions: []FetchRespPartition{{ID: 1, TipOffset: 9}}},
+				},
+			},
+			parts: []string{
+				"00000027",         // size
+				"00000007",         // correlation id
+				"00000005",         // throttle time
+				"00000001",         // topics
+				"0003666f6f",       // topic name
+				"00000001",         // partitions
+				"00000001",         // partition id
+				"0000",             // error code
+				"0000000000000009", // high watermark
+				"00000000",         // message set size
+			},
+		},
+		{
+			version: KafkaV4,
+			resp: FetchResp{
+				CorrelationID: 7,
+				ThrottleTime:  5 * time.Millisecond,
+				Topics: []FetchRespTopic{
+					{Name: "foo", Partitions: []FetchRespPartition{{
+						ID:                  1,
+						TipOffset:           9,
+						LastStableOffset:    8,
+						AbortedTransactions: []FetchRespAbortedTransaction{{ProducerID: 3, FirstOffset: 4}},
+					}}},
+				},
+			},
+			parts: []string{
+				"00000043",         // size
+				"00000007",         // correlation id
+				"00000005",         // throttle time
+				"00000001",         // topics
+				"0003666f6f",       // topic name
+				"00000001",         // partitions
+				"00000001",         // partition id
+				"0000",             // error code
+				"0000000000000009", // high watermark
+				"0000000000000008", // last stable offset
+				"00000001",         // aborted transactions
+				"0000000000000003", // producer id
+				"0000000000000004", // first offset
+				"00000000",         // message set size
+			},
+		},
+		{
+			version: KafkaV7,
+			resp: FetchResp{
+				CorrelationID: 7,
+				ThrottleTime:  5 * time.Millisecond,
+				Err:           ErrFetchSessionIdNotFound,
+				SessionID:     11,
+				Topics: []FetchRespTopic{
+					{Name: "foo", Partitions: []FetchRespPartition{{
+						ID:                  1,
+						TipOffset:           9,
+						LastStableOffset:    8,
+						LogStartOffset:      2,
+						AbortedTransactions: []FetchRespAbortedTransaction{{ProducerID: 3, FirstOffset: 4}},
+					}}},
+				},
+			},
+			parts: []string{
+				"00000051",         // size
+				"00000007",         // correlation id
+				"00000005",         // throttle time
+				"0046",             // error code
+				"0000000b",         // session id
+				"00000001",         // topics
+				"0003666f6f",       // topic name
+				"00000001",         // partitions
+				"00000001",         // partition id
+				"0000",             // error code
+				"0000000000000009", // high watermark
+				"0000000000000008", // last stable offset
+				"0000000000000002", // log start offset
+				"00000001",         // aborted transactions
+				"0000000000000003", // producer id
+				"0000000000000004", // first offset
+				"00000000",         // message set size
+			},
+		},
+		{
+			version: KafkaV11,
+			resp: FetchResp{
+				CorrelationID: 7,
+				ThrottleTime:  5 * time.Millisecond,
+				SessionID:     11,
+				Topics: []FetchRespTopic{
+					{Name: "foo", Partitions: []FetchRespPartition{{
+						ID:                   1,
+						TipOffset:            9,
+						LastStableOffset:     8,
+						LogStartOffset:       2,
+						AbortedTransactions:  []FetchRespAbortedTransaction{{ProducerID: 3, FirstOffset: 4}},
+						PreferredReadReplica: 6,
+					}}},
+				},
+			},
+			parts: []string{
+				"00000055",         // size
+				"00000007",         // correlation id
+				"00000005",         // throttle time
+				"0000",             // error code
+				"0000000b",         // session id
+				"00000001",         // topics
+				"0003666f6f",       // topic name
+				"00000001",         // partitions
+				"00000001",         // partition id
+				"0000",             // error code
+				"0000000000000009", // high watermark
+				"0000000000000008", // last stable offset
+				"0000000000000002", // log start offset
+				"00000001",         // aborted transactions
+				"0000000000000003", // producer id
+				"0000000000000004", // first offset
+				"00000006",         // preferred read replica
+				"00000000",         // message set size
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		expected := mustDecodeHex(t, tc.parts...)
+		tc.resp.Version = tc.version
+		b, err := tc.resp.Bytes()
+		if err != nil {
+			t.Fatalf("v%d: cannot serialize response: %s", tc.version, err)
+		}
+		if !bytes.Equal(b, expected) {
+			t.Fatalf("v%d: expected different bytes representation:\n%s", tc.version, hex.Dump(b))
+		}
+
+		resp, err := ReadVersionedFetchResp(bytes.NewReader(expected), tc.version)
+		if err != nil {
+			t.Fatalf("v%d: cannot read response: %s", tc.version, err)
+		}
+		if resp.CorrelationID != tc.resp.CorrelationID || resp.ThrottleTime != tc.resp.ThrottleTime ||
+			resp.Err != tc.resp.Err || resp.SessionID != tc.resp.SessionID {
+			t.Fatalf("v%d: expected header %#v, got %#v", tc.version, tc.resp, resp)
+		}
+		got, want := resp.Topics[0].Partitions[0], tc.resp.Topics[0].Partitions[0]
+		if got.ID != want.ID || got.TipOffset != want.TipOffset ||
+			got.LastStableOffset != want.LastStableOffset || got.LogStartOffset != want.LogStartOffset ||
+			got.PreferredReadReplica != want.PreferredReadReplica ||
+			!reflect.DeepEqual(got.AbortedTransactions, want.AbortedTransactions) {
+			t.Fatalf("v%d: expected partition %#v, got %#v", tc.version, want, got)
+		}
+	}
+}
+
+func TestFetchResponseWithoutTopics(t *testing.T) {
+	// incremental fetch response without changed partitions
+	resp := &FetchResp{
+		Version:       KafkaV7,
+		CorrelationID: 3,
+		ThrottleTime:  time.Millisecond,
+		SessionID:     42,
+		Topics:        []FetchRespTopic{},
+	}
+	b, err := resp.Bytes()
+	if err != nil {
+		t.Fatalf("cannot serialize response: %s", err)
+	}
+	// size, correlation id, throttle time, session error and id, topics
+	if len(b) != 4+4+4+2+4+4 {
+		t.Fatalf("unexpected response size %d: %#v", len(b), b)
+	}
+
+	got, err := ReadVersionedFetchResp(bytes.NewReader(b), KafkaV7)
+	if err != nil {
+		t.Fatalf("cannot read response: %s", err)
+	}
+	if !reflect.DeepEqual(got, resp) {
+		t.Fatalf("expected %#v, got %#v", resp, got)
+	}
+
+	var into FetchResp
+	if err := ReadVersionedFetchRespInto(bytes.NewReader(b), KafkaV7, &into); err != nil {
+		t.Fatalf("cannot read response: %s", err)
+	}
+	if into.SessionID != 42 || len(into.Topics) != 0 {
+		t.Fatalf("unexpected response: %#v", into)
+	}
+
+	_, err = ReadVersionedFetchRespFunc(bytes.NewReader(b), KafkaV7, func(topic string, part FetchRespPartition) error {
+		t.Fatalf("unexpected partition %s:%d", topic, part.ID)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("cannot read response: %s", err)
+	}
+}
+
+func TestFetchResponseMaxMessages(t *testing.T) {
+	resp := &FetchResp{
+		CorrelationID: 1,
+		Topics: []FetchRespTopic{
+			{
+				Name: "foo",
+				Partitions: []FetchRespPartition{
+					{ID: 0, Messages: []*Message{{Offset: 1, Value: []byte("a")}, {Offset: 2, Value: []byte("b")}}},
+					{ID: 1, Messages: []*Message{{Offset: 1, Value: []byte("c")}, {Offset: 2, Value: []byte("d")}}},
+				},
+			},
+			{
+				Name: "bar",
+				Partitions: []FetchRespPartition{
+					{ID: 0, Messages: []*Message{{Offset: 5, Value: []byte("e")}}},
+				},
+			},
+		},
+	}
+	b, err := resp.Bytes()
+	if err != nil {
+		t.Fatalf("cannot serialize response: %s", err)
+	}
+	defer ConfigureParser(ParserConfig{})
+
+	// decoded partitions by topic name
+	partitions := func(resp *FetchResp) map[string]int {
+		res := make(map[string]int)
+		for _, topic := range resp.Topics {
+			res[topic.Name] = len(topic.Partitions)
+		}
+		return res
+	}
+
+	cases := []struct {
+		max        int
+		partitions map[string]int
+		truncated  bool
+	}{
+		{max: 0, partitions: map[string]int{"foo": 2, "bar": 1}},
+		{max: 1, partitions: map[string]int{"foo": 1}, truncated: true},
+		{max: 2, partitions: map[string]int{"foo": 1}, truncated: true},
+		{max: 3, partitions: map[string]int{"foo": 2}, truncated: true},
+		{max: 5, partitions: map[string]int{"foo": 2, "bar": 1}},
+	}
+	for _, tc := range cases {
+		if err := ConfigureParser(ParserConfig{MaxMessages: tc.max}); err != nil {
+			t.Fatalf("cannot configure parser: %s", err)
+		}
+
+		// the whole response must be read over, even if truncated,
+		// so that the next one can be read from the same stream
+		r := bytes.NewReader(b)
+		got, err := ReadFetchResp(r)
+		if err != nil {
+			t.Fatalf("max %d: cannot read response: %s", tc.max, err)
+		}
+		if r.Len() != 0 {
+			t.Fatalf("max %d: %d bytes left unread", tc.max, r.Len())
+		}
+		if got.Truncated != tc.truncated || !reflect.DeepEqual(partitions(got), tc.partitions) {
+			t.Fatalf("max %d: expected %v (truncated %v), got %v (truncated %v)",
+				tc.max, tc.partitions, tc.truncated, partitions(got), got.Truncated)
+		}
+
+		var into FetchResp
+		r.Reset(b)
+		if err := ReadFetchRespInto(r, &into); err != nil {
+			t.Fatalf("max %d: cannot read response: %s", tc.max, err)
+		}
+		if r.Len() != 0 {
+			t.Fatalf("max %d: %d bytes left unread", tc.max, r.Len())
+		}
+		if into.Truncated != tc.truncated || !reflect.DeepEqual(partitions(&into), tc.partitions) {
+			t.Fatalf("max %d: expected %v (truncated %v), got %v (truncated %v)",
+				tc.max, tc.partitions, tc.truncated, partitions(&into), into.Truncated)
+		}
+
+		called := make(map[string]int)
+		r.Reset(b)
+		got, err = ReadFetchRespFunc(r, func(topic string, part FetchRespPartition) error {
+			called[topic]++
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("max %d: cannot read response: %s", tc.max, err)
+		}
+		if r.Len() != 0 {
+			t.Fatalf("max %d: %d bytes left unread", tc.max, r.Len())
+		}
+		if got.Truncated != tc.truncated || !reflect.DeepEqual(called, tc.partitions) {
+			t.Fatalf("max %d: expected %v (truncated %v), got %v (truncated %v)",
+				tc.max, tc.partitions, tc.truncated, called, got.Truncated)
+		}
+	}
+}
+
+func TestFetchResponseTrackOffsets(t *testing.T) {
+	newResp := func(offset int64) []byte {
+		resp := &FetchResp{
+			Topics: []FetchRespTopic{
+				{
+					Name: "foo",
+					Partitions: []FetchRespPartition{
+						{ID: 0, Messages: []*Message{{Offset: offset, Value: []byte("a")}, {Offset: offset + 1, Value: []byte("b")}}},
+						{ID: 1, Err: ErrNotLeaderForPartition},
+					},
+				},
+				{
+					Name: "bar",
+					Partitions: []FetchRespPartition{
+						{ID: 2, Messages: []*Message{{Offset: 3, Value: []byte("c")}}},
+					},
+				},
+			},
+		}
+		b, err := resp.Bytes()
+		if err != nil {
+			t.Fatalf("cannot serialize response: %s", err)
+		}
+		return b
+	}
+
+	var offsets map[string]map[int32]int64
+	track := func(b []byte) {
+		resp, err := ReadFetchResp(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("cannot read response: %s", err)
+		}
+		offsets = resp.TrackOffsets(offsets)
+	}
+
+	track(newResp(10))
+	expected := map[string]map[int32]int64{
+		"foo": {0: 11},
+		"bar": {2: 3},
+	}
+	if !reflect.DeepEqual(offsets, expected) {
+		t.Fatalf("expected %v, got %v", expected, offsets)
+	}
+
+	// offsets are never moved back
+	track(newResp(5))
+	if !reflect.DeepEqual(offsets, expected) {
+		t.Fatalf("expected %v, got %v", expected, offsets)
+	}
+
+	track(newResp(20))
+	expected["foo"][0] = 21
+	if !reflect.DeepEqual(offsets, expected) {
+		t.Fatalf("expected %v, got %v", expected, offsets)
+	}
+}
+
+func TestFetchResponseNextOffsets(t *testing.T) {
+	resp := &FetchResp{
+		Topics: []FetchRespTopic{
+			{
+				Name: "foo",
+				Partitions: []FetchRespPartition{
+					{ID: 0, Messages: []*Message{{Offset: 10}, {Offset: 11}}},
+					{ID: 1, Err: ErrNotLeaderForPartition},
+					{ID: 2},
+					{ID: 3, RecordBatches: []*RecordBatch{{FirstOffset: 20, LastOffsetDelta: 4}}},
+					// compressed set starting before the fetch offset
+					{ID: 4, Messages: []*Message{{Offset: 3}, {Offset: 4}}},
+				},
+			},
+			{
+				Name: "bar",
+				Partitions: []FetchRespPartition{
+					{ID: 0, Messages: []*Message{{Offset: 1}}},
+				},
+			},
+		},
+	}
+	prev := map[string]map[int32]int64{
+		"foo": {0: 10, 1: 7, 2: 3, 3: 20, 4: 8},
+	}
+	expected := map[string]map[int32]int64{
+		"foo": {0: 12, 1: 7, 2: 3, 3: 25, 4: 8},
+		"bar": {0: 2},
+	}
+	next := resp.NextOffsets(prev)
+	if !reflect.DeepEqual(next, expected) {
+		t.Fatalf("expected %v, got %v", expected, next)
+	}
+	if prev["foo"][0] != 10 {
+		t.Fatal("previous offsets must not be modified")
+	}
+}
+
+func TestFetchResponseTotalLag(t *testing.T) {
+	resp := &FetchResp{
+		Topics: []FetchRespTopic{
+			{
+				Name: "foo",
+				Partitions: []FetchRespPartition{
+					{ID: 0, TipOffset: 100},
+					{ID: 1, TipOffset: 50, Err: ErrNotLeaderForPartition},
+					// consumed past the watermark of a stale response
+					{ID: 2, TipOffset: 10},
+					{ID: 3, TipOffset: 30, LogStartOffset: 20},
+				},
+			},
+			{
+				Name: "bar",
+				Partitions: []FetchRespPartition{
+					{ID: 0, TipOffset: 7},
+				},
+			},
+		},
+	}
+	consumed := map[string]map[int32]int64{
+		"foo": {0: 90, 1: 0, 2: 12},
+		"bar": {0: 5},
+	}
+	if lag := resp.TotalLag(consumed); lag != 12 {
+		t.Fatalf("expected lag 12, got %d", lag)
+	}
+
+	consumed["foo"][3] = resp.Topics[0].Partitions[3].LogStartOffset
+	if lag := resp.TotalLag(consumed); lag != 22 {
+		t.Fatalf("expected lag 22, got %d", lag)
+	}
+	if lag := resp.TotalLag(nil); lag != 0 {
+		t.Fatalf("expected no lag, got %d", lag)
+	}
+}
+
+func TestFetchResponseMissing(t *testing.T) {
+	req := &FetchReq{
+		Topics: []FetchReqTopic{
+			{
+				Name: "foo",
+				Partitions: []FetchReqPartition{
+					{ID: 0}, {ID: 1}, {ID: 2},
+				},
+			},
+			{
+				Name:       "bar",
+				Partitions: []FetchReqPartition{{ID: 4}},
+			},
+		},
+	}
+	resp := &FetchResp{
+		Topics: []FetchRespTopic{
+			{
+				Name: "foo",
+				Partitions: []FetchRespPartition{
+					{ID: 2},
+					// errored partitions are not missing
+					{ID: 0, Err: ErrNotLeaderForPartition},
+					// not requested
+					{ID: 7},
+				},
+			},
+		},
+	}
+	expected := []TopicPartition{
+		{Topic: "foo", Partition: 1},
+		{Topic: "bar", Partition: 4},
+	}
+	if got := resp.Missing(req); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, got)
+	}
+
+	resp.Topics = append(resp.Topics, FetchRespTopic{
+		Name:       "bar",
+		Partitions: []FetchRespPartition{{ID: 4}},
+	})
+	resp.Topics[0].Partitions = append(resp.Topics[0].Partitions, FetchRespPartition{ID: 1})
+	if got := resp.Missing(req); len(got) != 0 {
+		t.Fatalf("expected no missing partitions, got %+v", got)
+	}
+}
+
+func TestFetchResponseTruncated(t *testing.T) {
+	resp := &FetchResp{
+		Version:       KafkaV4,
+		CorrelationID: 42,
+		Topics: []FetchRespTopic{
+			{
+				Name: "foo",
+				Partitions: []FetchRespPartition{
+					{ID: 0, TipOffset: 5, Messages: []*Message{{Offset: 1, Value: []byte("first")}}},
+					{ID: 1, RecordBatches: []*RecordBatch{{Records: []*Record{{Value: []byte("second")}}}}},
+					// data cut within the message set of the last partition
+					// is taken as partial set
+					{ID: 2, Err: ErrNotLeaderForPartition},
+				},
+			},
+		},
+	}
+	b, err := resp.Bytes()
+	if err != nil {
+		t.Fatalf("cannot serialize response: %s", err)
+	}
+	expected := &TruncatedResponseError{CorrelationID: 42, Size: int32(len(b) - 4)}
+
+	readers := map[string]func(r io.Reader) error{
+		"ReadVersionedFetchResp": func(r io.Reader) error {
+			_, err := ReadVersionedFetchResp(r, KafkaV4)
+			return err
+		},
+		"ReadVersionedFetchRespInto": func(r io.Reader) error {
+			return ReadVersionedFetchRespInto(r, KafkaV4, &FetchResp{})
+		},
+		"ReadVersionedFetchRespFunc": func(r io.Reader) error {
+			_, err := ReadVersionedFetchRespFunc(r, KafkaV4, func(string, FetchRespPartition) error { return nil })
+			return err
+		},
+	}
+	for name, read := range readers {
+		// body ends right after the correlation ID or anywhere later
+		for n := 8; n < len(b); n++ {
+			if err := read(bytes.NewReader(b[:n])); !reflect.DeepEqual(err, expected) {
+				t.Fatalf("%s of %d bytes: expected %v, got %v", name, n, expected, err)
+			}
+		}
+		// correlation ID is not known
+		if err := read(bytes.NewReader(b[:6])); err != io.ErrUnexpectedEOF {
+			t.Fatalf("%s: expected %v, got %v", name, io.ErrUnexpectedEOF, err)
+		}
+		if err := read(bytes.NewReader(nil)); err != io.EOF {
+			t.Fatalf("%s: expected %v, got %v", name, io.EOF, err)
+		}
+		if err := read(bytes.NewReader(b)); err != nil {
+			t.Fatalf("%s: cannot read response: %s", name, err)
+		}
+	}
+}
+
+func TestFetchResponseVersionMismatch(t *testing.T) {
+	resp := &FetchResp{Version: KafkaV7, CorrelationID: 3, SessionID: 0}
+	b, err := resp.Bytes()
+	if err != nil {
+		t.Fatalf("cannot serialize response: %s", err)
+	}
+
+	readers := map[string]func(r io.Reader, version int16) error{
+		"ReadVersionedFetchResp": func(r io.Reader, version int16) error {
+			_, err := ReadVersionedFetchResp(r, version)
+			return err
+		},
+		"ReadVersionedFetchRespInto": func(r io.Reader, version int16) error {
+			return ReadVersionedFetchRespInto(r, version, &FetchResp{})
+		},
+		"ReadVersionedFetchRespFunc": func(r io.Reader, version int16) error {
+			_, err := ReadVersionedFetchRespFunc(r, version, func(string, FetchRespPartition) error { return nil })
+			return err
+		},
+	}
+	for name, read := range readers {
+		if err := read(bytes.NewReader(b), KafkaV7); err != nil {
+			t.Fatalf("%s: cannot read response: %s", name, err)
+		}
+		// error code and session ID of v7 are taken as empty topics of v1,
+		// leaving the real topics count unread
+		r := bytes.NewReader(append(b, 0xff))
+		if err := read(r, KafkaV1); !errors.Is(err, ErrVersionMismatch) {
+			t.Fatalf("%s: expected %v, got %v", name, ErrVersionMismatch, err)
+		}
+		if r.Len() != 1 {
+			t.Fatalf("%s: expected the rest of the response to be read over, %d bytes left", name, r.Len())
+		}
+	}
+
+	// declared size larger than the data is not a mismatch
+	short := append([]byte{}, b...)
+	binary.BigEndian.PutUint32(short, uint32(len(b)+10))
+	if _, err := ReadVersionedFetchResp(bytes.NewReader(short), KafkaV7); err != nil {
+		t.Fatalf("cannot read response: %s", err)
+	}
+}
+
+func TestFetchResponseWithVersions(t *testing.T) {
+
+	// Test version 0
+
+	fetchRespV0 := FetchResp{
+		Version:       KafkaV0,
+		CorrelationID: 1,
+		Topics: []FetchRespTopic{
+			FetchRespTopic{
+				Name: "Topic1",
+				Partitions: []FetchRespPartition{
+					FetchRespPartition{
+						ID:        1,
+						Err:       nil,
+						TipOffset: 1,
+						Messages:  nil,
+					},
+				},
+			},
+		},
+	}
+
+	b0, err := fetchRespV0.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp0, err := ReadVersionedFetchResp(bytes.NewReader(b0), fetchRespV0.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(&fetchRespV0, resp0) {
+		t.Fatalf("Not equal %+#v ,  %+#v", fetchRespV0, resp0)
+	}
+
+	// Test version 1
+
+	fetchRespV1 := fetchRespV0
+	fetchRespV1.Version = KafkaV1
+	fetchRespV1.ThrottleTime = time.Second
+
+	b1, err := fetchRespV1.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp1, err := ReadVersionedFetchResp(bytes.NewBuffer(b1), fetchRespV1.Version)
+	if !reflect.DeepEqual(&fetchRespV1, resp1) {
+		t.Fatalf("Not equal %+#v ,  %+#v", fetchRespV1, resp1)
+	}
+
+	// Test version 4
+
+	fetchRespV4 := fetchRespV1
+	fetchRespV4.Version = KafkaV4
+	fetchRespV4.Topics[0].Partitions[0].LastStableOffset = 1
+	fetchRespV4.Topics[0].Partitions[0].AbortedTransactions = []FetchRespAbortedTransaction{
+		FetchRespAbortedTransaction{
+			ProducerID:  1,
+			FirstOffset: 1,
+		},
+	}
+
+	b4, err := fetchRespV4.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp4, err := ReadVersionedFetchResp(bytes.NewBuffer(b4), fetchRespV4.Version)
+	if !reflect.DeepEqual(&fetchRespV4, resp4) {
+		t.Fatalf("Not equal %+#v ,  %+#v", fetchRespV4, resp4)
+	}
+
+	// Test version 5
+
+	fetchRespV5 := fetchRespV4
+	fetchRespV5.Version = KafkaV5
+
+	fetchRespV5.Topics[0].Partitions[0].LogStartOffset = 1
+
+	b5, err := fetchRespV5.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp5, err := ReadVersionedFetchResp(bytes.NewBuffer(b5), fetchRespV5.Version)
+	if !reflect.DeepEqual(&fetchRespV5, resp5) {
+		t.Fatalf("Not equal %+#v ,  %+#v", fetchRespV5, resp5)
+	}
+
+	// Test version 7
+
+	fetchRespV7 := fetchRespV5
+	fetchRespV7.Version = KafkaV7
+	fetchRespV7.Err = ErrInvalidFetchSessionEpoch
+	fetchRespV7.SessionID = 42
+
+	b7, err := fetchRespV7.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// session error and id follow the throttle time
+	if expected := []byte{0x0, 0x47, 0x0, 0x0, 0x0, 0x2a}; !bytes.Equal(b7[12:18], expected) {
+		t.Fatalf("expected session fields %#v, got %#v", expected, b7[12:18])
+	}
+
+	resp7, err := ReadVersionedFetchResp(bytes.NewBuffer(b7), fetchRespV7.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&fetchRespV7, resp7) {
+		t.Fatalf("Not equal %+#v ,  %+#v", fetchRespV7, resp7)
+	}
+
+	// Test version 11
+
+	fetchRespV11 := fetchRespV7
+	fetchRespV11.Version = KafkaV11
+	fetchRespV11.Topics[0].Partitions[0].PreferredReadReplica = 3
+
+	b11, err := fetchRespV11.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp11, err := ReadVersionedFetchResp(bytes.NewBuffer(b11), fetchRespV11.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&fetchRespV11, resp11) {
+		t.Fatalf("Not equal %+#v ,  %+#v", fetchRespV11, resp11)
+	}
+	// preferred read replica is not part of older versions
+	resp7, err = ReadVersionedFetchResp(bytes.NewBuffer(b7), fetchRespV7.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replica := resp7.Topics[0].Partitions[0].PreferredReadReplica; replica != 0 {
+		t.Fatalf("expected no preferred read replica, got %d", replica)
+	}
+
+}
+
+func TestFetchResponseWithRecordBatchAndGZIP(t *testing.T) {
+	data := []byte{
+		0x00, 0x00, 0x00, 0x99, // Size
+		0x00, 0x00, 0x00, 0x04, // CorrelationID
+		0x00, 0x00, 0x00, 0x00, // ThrottleTime
+		0x00, 0x00, 0x00, 0x01, // Number of topics
+		0x00, 0x06, 0x54, 0x6f, 0x70, 0x69, 0x63, 0x34, // "topic4"
+		0x00, 0x00, 0x00, 0x01, // Number of partition
+		0x00, 0x00, 0x00, 0x00, // Partition id
+		0x00, 0x00, // Error
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, // High watermark offset
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // Last stable offset
+		0xff, 0xff, 0xff, 0xff, // Numbet of aborted transactions
+		// Record Batch
+		0x00, 0x00, 0x00, 0x63, // Size
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // First offset
+		0x00, 0x00, 0x00, 0x57, // Length
+		0x00, 0x00, 0x00, 0x00, // Partition leader epoch
+		0x02,                   // Magic byte (version of message)
+		0x04, 0xf7, 0xab, 0xb5, // CRC
+		0x00, 0x01, // Attributes
+		0x00, 0x00, 0x00, 0x00, // Last offset delta
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // First timestamp
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // Producer ID
+		0xff, 0xff, // Producer epoch
+		0xff, 0xff, 0xff, 0xff, // First Sequence
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00, 0x00, 0x00, 0x01, 0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x53, 0x62, 0x60, 0x60, 0x60, 0x14, 0xcb, 0x48, 0xcd, 0xc9, 0xc9, 0x57, 0x28, 0xcf, 0x2f, 0xca, 0x49, 0x61, 0x00, 0x00, 0xd3, 0x90, 0x6c, 0x82, 0x12, 0x00, 0x00, 0x00,
+	}
+
+	resp, err := ReadVersionedFetchResp(bytes.NewReader(data), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Topics[0].Partitions[0].RecordBatches[0].Records[0].Value) != "hello world" {
+		t.Fatal("Wrong response")
+	}
+}
+
+func TestFetchResponseWithRecordBatch(t *testing.T) {
+	oneMessageFetchResponseV4error := []byte{
+		0x00, 0x00, 0x00, 0x00, // Fake size (just random number)
+		0x00, 0x00, 0x00, 0x05, //CorrelationID
+		0x00, 0x00, 0x00, 0x00, //ThrottleTime
+		0x00, 0x00, 0x00, 0x01, //Number of topics
+		0x00, 0x06, 0x54, 0x6f, 0x70, 0x69, 0x63, 0x34, // 'topic4'
+		0x00, 0x00, 0x00, 0x01, // number of Partition
+		0x00, 0x00, 0x00, 0x00, // partition id
+		0x00, 0x00, // Error
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, // High watermark Offset
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // Last stable offset
+		0xff, 0xff, 0xff, 0xff, // Number of aborted Transactions
+		//RecordBatch
+		0x00, 0x00, 0x00, 0x4f, // Size ???
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // FirstOffset
+		0x00, 0x00, 0x00, 0x43, // Length
+		0x00, 0x00, 0x00, 0x00, // PartitionLeaderEpoch
+		0x02,                   // Magic
+		0x34, 0xa1, 0x4e, 0x1d, // CRC
+		0x00, 0x00, //Attributes
+		0x00, 0x00, 0x00, 0x00, // LastOffsetDelte
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, //FirstTimestamp
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // ProducerId
+		0xff, 0xff, //ProducerEpoch
+		0xff, 0xff, 0xff, 0xff, // FirstSequence
+		//Record
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00, 0x00, 0x00, 0x01, 0x22, 0x00, 0x00, 0x00, 0x01, 0x16, 0x68, 0x65, 0x6c, 0x6c, 0x6f, 0x20, 0x77, 0x6f, 0x72, 0x6c, 0x64, 0x00,
+	}
+
+	resp, err := ReadVersionedFetchResp(bytes.NewReader(oneMessageFetchResponseV4error), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Topics[0].Partitions[0].RecordBatches[0].Records[0].Value) != "hello world" {
+		t.Fatal("Wrong response")
+	}
+
+}
+
+func TestFetchResponseWithRecordBatch2(t *testing.T) {
+	oneMessageFetchResponseV4error := []byte{
+		0x00, 0x00, 0x00, 0x85, // Size
+		0x00, 0x00, 0x00, 0x0a, // CorrelationID
+		0x00, 0x00, 0x00, 0x00, // ThrottleTime
+		0x00, 0x00, 0x00, 0x01, // Number of topics
+		0x00, 0x06, 0x54, 0x6f, 0x70, 0x69, 0x63, 0x33, // "topic3"
+		0x00, 0x00, 0x00, 0x01, // number of partitions
+		0x00, 0x00, 0x00, 0x00, // Partions id
+		0x00, 0x00, // Error
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, // High Watermark offset
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // Last stable offset
+		0xff, 0xff, 0xff, 0xff, // Number of aborted transactions
+		// Record Batch
+		0x00, 0x00, 0x00, 0x4f, // Size
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // First Offset
+		0x00, 0x00, 0x00, 0x43, // Length
+		0x00, 0x00, 0x00, 0x00, // Partition Leader Epoch
+		0x02,                   // Magic byte (version)
+		0x34, 0xa1, 0x4e, 0x1d, // CRC
+		0x00, 0x00, // Attributes
+		0x00, 0x00, 0x00, 0x00, // Last offset delta
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // FirstTimespamp
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // Producer ID
+		0xff, 0xff, // Producer Epoch
+		0xff, 0xff, 0xff, 0xff, // first sequence
+		// Record
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00, 0x00, 0x00, 0x01, 0x22, 0x00, 0x00, 0x00, 0x01, 0x16, 0x68, 0x65, 0x6c, 0x6c, 0x6f, 0x20, 0x77, 0x6f, 0x72, 0x6c, 0x64, 0x00,
+	}
+
+	resp, err := ReadVersionedFetchResp(bytes.NewReader(oneMessageFetchResponseV4error), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Topics[0].Partitions[0].RecordBatches[0].Records[0].Value) != "hello world" {
+		t.Fatal("Wrong response")
+	}
+
+}
+
+func TestFetchResponseWithRecordBatchWithMultipleRecords(t *testing.T) {
+
+	messageFetchResponseV5MultipleRecords := []byte{
+		0, 0, 1, 205, //size
+		0, 0, 0, 63, //correlation, id
+		0, 0, 0, 0, //throttle, time
+		0, 0, 0, 1, //number, of, topics
+		0, 4, 97, 117, 116, 104, // name of the topic ( auth)
+		0, 0, 0, 1, //number of partitions
+		0, 0, 0, 0, // partition id
+		0, 0, // error
+		0, 0, 0, 0, 0, 0, 1, 121, //, hight, water, martk
+		255, 255, 255, 255, 255, 255, 255, 255, //, last, stable, offset
+		0, 0, 0, 0, 0, 0, 0, 0, //, log, start, offset
+		255, 255, 255, 255, //, ,
+		0, 0, 1, 145, //, size, of, batch
+		0, 0, 0, 0, 0, 0, 1, 72, //, first, offset
+		0, 0, 1, 133, //, length
+		0, 0, 0, 2, //, partition, leader, epoch
+		2,                //, magic,
+		7, 177, 219, 215, //crc,
+		0, 0, //, attr
+		0, 0, 0, 1, //, last, offset, delta
+		255, 255, 255, 255, 255, 255, 255, 255, //first, timestampt
+		255, 255, 255, 255, 255, 255, 255, 255, //, max, timestampt
+		255, 255, 255, 255, 255, 255, 255, 255, //, producer, id
+		255, 255, //, producer, epoch
+		255, 255, 255, 255, //, base, sequence
+		0, 0, 0, 2, //, number, of, records
+		212, 2, //size,
+		0,                                                                                                                       //, attribute
+		0,                                                                                                                       //, timestampt, delta
+		0,                                                                                                                       //, offset, delta
+		28,                                                                                                                      //, key, length
+		8, 128, 254, 7, 16, 131, 214, 136, 178, 165, 138, 220, 153, 2, 170, 2, 1, 1, 16, 17, 2, 32, 246, 240, 230, 136, 163, 28, //, key
+		67, //,
+		50, 175, 30, 87, 26, 228, 189, 143, 130, 80, 116, 194, 56, 70, 130, 136, 212, 23, 149, 222, 38, 125, 51, 192, 151, 107, 0, 0, 0, 10, 52, 10, 24, 102, 113, 109, 111, 106, 116, 50, 97, 113, 108, 119, 121, 101, 51, 118, 103, 116, 118, 114, 118, 105, 108, 119, 112, 24, 180, 149, 247, 197, 241, 159, 161, 188, 21,
+		32, 180, 249, 142, 150, 132, 160, 161, 188, 21, 42, 4, 104, 116, 116, 112, 18, 32, 246, 240, 230, 136, 163, 28, 67, 50, 175, 30, 87, 26, 228, 189, 143, 130, 80, 116, 194, 56, 70, 130, 136, 212, 23, 149, 222, 38, 125, 51, 192, 151, 26, 17, 111, 114, 103, 97, 110, 105, 122, 97, 116, 105, 111, 110, 58, 114, 101, 97, 100, 0,
+		204, 2, 0, 0, 2, 28, 8, 128, 254, 7, 16, 132, 214, 136, 178, 165, 138, 220, 153, 2, 162, 2, 1, 1, 16, 17, 2, 32, 246, 240, 230, 136, 163, 28, 67, 50, 175, 30, 87, 26, 228, 189, 143, 130, 80, 116, 194, 56, 70, 130, 136, 212, 23, 149, 222, 38, 125, 51, 192, 151, 103, 0, 0, 0, 10, 52, 10, 24, 119, 51, 120, 104, 55, 107, 118, 104, 104, 118, 112, 55, 104, 113, 111, 103, 119, 97, 108, 53, 55, 102, 100, 102, 24, 229, 183, 247, 197, 241, 159, 161, 188, 21, 32, 229, 155, 143, 150, 132, 160, 161, 188, 21, 42, 4, 104, 116, 116, 112, 18, 32, 246, 240, 230, 136, 163, 28, 67, 50, 175, 30, 87, 26, 228, 189, 143, 130, 80, 116, 194, 56, 70, 130, 136, 212, 23, 149, 222, 38, 125, 51, 192, 151, 26, 13, 115, 117, 112, 112, 108, 105, 101, 114, 58, 114, 101, 97, 100, 0,
+	}
+
+	resp, err := ReadVersionedFetchResp(bytes.NewReader(messageFetchResponseV5MultipleRecords), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := resp.Topics[0].Partitions[0].RecordBatches[0].Records
+
+	if len(records) != 2 {
+		t.Fatal("Expect 2 records")
+	}
+
+	if records[0].Length != 170 {
+		t.Fatal("Wrong record length")
+	}
+	if records[1].Length != 166 {
+		t.Fatal("Wrong record length")
+	}
+}
+
+func TestFetchResponseWithMultipleRecordBatches(t *testing.T) {
+	messageFetchResponseV5MultipleBatches := []byte{
+		0x00, 0x00, 0x02, 0x98, // size
+		0x00, 0x00, 0x00, 0xa7, // correlation id
+		0x00, 0x00, 0x00, 0x00, // throttle time
+		0x00, 0x00, 0x00, 0x01, // array size
+		0x00, 0x0c, // string length
+		0x6c, 0x65, 0x67, 0x61, 0x6c, 0x2d, 0x65, 0x76, 0x65, 0x6e, 0x74, 0x73, // topic name
+		0x00, 0x00, 0x00, 0x01, // array size
+		0x00, 0x00, 0x00, 0x00, // partition id
+		0x00, 0x00, // error
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x18, // tip offset
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x18, // last stable offset
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // log start offset
+		0xff, 0xff, 0xff, 0xff, // array length
+		0x00, 0x00, 0x02, 0x54, // message set size
+
+		// Batch 1:
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x16, // first offset
+		0x00, 0x00, 0x01, 0x1e, // length
+		0x00, 0x00, 0x00, 0x04, // partition leader epoch
+		0x02,                   // message version
+		0xbc, 0x45, 0x46, 0x64, // crc
+		0x00, 0x00, // attributes
+		0x00, 0x00, 0x00, 0x00, // last offset delta
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // first timestamp
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // max timestamp
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // producer id
+		0xff, 0xff, // producer epoch
+		0xff, 0xff, 0xff, 0xff, // first sequence
+		0x00, 0x00, 0x00, 0x01, // array length
+		0xd6, 0x03, // record length
+		0x00,                                           // attributes
+		0x00,                                           // timestamp delta
+		0x00,                                           // offset delta
+		0x10,                                           // key length
+		0x08, 0x80, 0x82, 0x94, 0x09, 0x10, 0xf7, 0x07, // key
+		0xb8, 0x03, // value length (220)
+		0x01, 0x01, 0x50, 0x12, 0x04, 0x18, 0x77, 0x70, 0x77, 0x6a, 0x36, 0x61, 0x62, 0x6c, 0x75, 0x7a, // value...
+		0x72, 0x62, 0x7a, 0x64, 0x72, 0x36, 0x6f, 0x62, 0x67, 0x6f, 0x62, 0x7a, 0x6d, 0x35, 0xba, 0x00,
+		0x00, 0x00, 0x0a, 0x44, 0x0a, 0x18, 0x76, 0x6a, 0x67, 0x65, 0x72, 0x6d, 0x73, 0x34, 0x32, 0x68,
+		0x6b, 0x35, 0x6f, 0x63, 0x74, 0x37, 0x70, 0x66, 0x33, 0x7a, 0x79, 0x35, 0x74, 0x34, 0x12, 0x07,
+		0x62, 0x30, 0x34, 0x39, 0x38, 0x65, 0x34, 0x18, 0xc3, 0xf6, 0xb0, 0xc2, 0x9e, 0x8f, 0x90, 0xcd,
+		0x15, 0x22, 0x15, 0x0a, 0x08, 0x44, 0x45, 0x41, 0x44, 0x42, 0x45, 0x45, 0x46, 0x12, 0x09, 0x68,
+		0x74, 0x74, 0x70, 0x2d, 0x66, 0x61, 0x6b, 0x65, 0x12, 0x18, 0x77, 0x70, 0x77, 0x6a, 0x36, 0x61,
+		0x62, 0x6c, 0x75, 0x7a, 0x72, 0x62, 0x7a, 0x64, 0x72, 0x36, 0x6f, 0x62, 0x67, 0x6f, 0x62, 0x7a,
+		0x6d, 0x35, 0x1a, 0x16, 0x44, 0x45, 0x38, 0x39, 0x33, 0x37, 0x30, 0x34, 0x30, 0x30, 0x34, 0x34,
+		0x30, 0x35, 0x33, 0x32, 0x30, 0x31, 0x33, 0x30, 0x30, 0x30, 0x20, 0x91, 0xd1, 0xb2, 0xc0, 0x9e,
+		0x8f, 0x90, 0xcd, 0x15, 0x28, 0x91, 0xd1, 0xfa, 0xb7, 0x9a, 0x9c, 0xa6, 0x85, 0x16, 0x32, 0x12,
+		0x44, 0x45, 0x35, 0x39, 0x5a, 0x5a, 0x5a, 0x30, 0x30, 0x30, 0x30, 0x31, 0x35, 0x32, 0x35, 0x34,
+		0x39, 0x33, 0x3a, 0x18, 0x73, 0x76, 0x7a, 0x76, 0x6c, 0x63, 0x73, 0x79, 0x71, 0x6f, 0x64, 0x76,
+		0x73, 0x6f, 0x61, 0x65, 0x68, 0x75, 0x6e, 0x6b, 0x69, 0x6c, 0x69, 0x6d, // ...value
+		0x00, // headers length
+
+		// Batch 2:
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x17, // first offset
+		0x00, 0x00, 0x01, 0x1e, // length
+		0x00, 0x00, 0x00, 0x04, // partition leader epoch
+		0x02,                   // message version
+		0x31, 0x04, 0x90, 0xb6, // crc
+		0x00, 0x00, // attributes
+		0x00, 0x00, 0x00, 0x00, // last offset delta
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // first timestamp
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // max timestamp
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // producer id
+		0xff, 0xff, // producer epoch
+		0xff, 0xff, 0xff, 0xff, // first sequence
+		0x00, 0x00, 0x00, 0x01, // array length
+		0xd6, 0x03, // record length
+		0x00,                                           // attributes
+		0x00,                                           // attribute delta
+		0x00,                                           // offset delta
+		0x10,                                           // key length
+		0x08, 0x80, 0x82, 0x94, 0x09, 0x10, 0xa6, 0x08, // key
+		0xb8, 0x03, // value length (220)
+		0x01, 0x01, 0x50, 0x12, 0x04, 0x18, 0x6d, 0x6c, 0x72, 0x35, 0x68, 0x65, 0x6e, 0x6d, 0x61, 0x64, // value...
+		0x77, 0x64, 0x78, 0x6a, 0x73, 0x36, 0x35, 0x6f, 0x6e, 0x74, 0x6f, 0x62, 0x35, 0x77, 0xba, 0x00,
+		0x00, 0x00, 0x0a, 0x44, 0x0a, 0x18, 0x36, 0x62, 0x76, 0x76, 0x64, 0x68, 0x36, 0x68, 0x66, 0x74,
+		0x70, 0x6e, 0x68, 0x63, 0x35, 0x35, 0x33, 0x79, 0x70, 0x67, 0x6c, 0x78, 0x72, 0x69, 0x12, 0x07,
+		0x62, 0x30, 0x34, 0x39, 0x38, 0x65, 0x34, 0x18, 0xfb, 0x88, 0xc4, 0xed, 0x93, 0xaa, 0x90, 0xcd,
+		0x15, 0x22, 0x15, 0x0a, 0x08, 0x44, 0x45, 0x41, 0x44, 0x42, 0x45, 0x45, 0x46, 0x12, 0x09, 0x68,
+		0x74, 0x74, 0x70, 0x2d, 0x66, 0x61, 0x6b, 0x65, 0x12, 0x18, 0x6d, 0x6c, 0x72, 0x35, 0x68, 0x65,
+		0x6e, 0x6d, 0x61, 0x64, 0x77, 0x64, 0x78, 0x6a, 0x73, 0x36, 0x35, 0x6f, 0x6e, 0x74, 0x6f, 0x62,
+		0x35, 0x77, 0x1a, 0x16, 0x44, 0x45, 0x38, 0x39, 0x33, 0x37, 0x30, 0x34, 0x30, 0x30, 0x34, 0x34,
+		0x30, 0x35, 0x33, 0x32, 0x30, 0x31, 0x33, 0x30, 0x30, 0x30, 0x20, 0xeb, 0xad, 0xd3, 0xeb, 0x93,
+		0xaa, 0x90, 0xcd, 0x15, 0x28, 0xeb, 0xad, 0x9b, 0xe3, 0x8f, 0xb7, 0xa6, 0x85, 0x16, 0x32, 0x12,
+		0x44, 0x45, 0x35, 0x39, 0x5a, 0x5a, 0x5a, 0x30, 0x30, 0x30, 0x30, 0x31, 0x35, 0x32, 0x35, 0x34,
+		0x39, 0x33, 0x3a, 0x18, 0x69, 0x6a, 0x71, 0x73, 0x6e, 0x33, 0x67, 0x6d, 0x67, 0x75, 0x65, 0x77,
+		0x67, 0x77, 0x63, 0x6d, 0x6e, 0x64, 0x73, 0x75, 0x62, 0x79, 0x68, 0x64, // ...value
+		0x00, // headers length
+	}
+
+	resp, err := ReadVersionedFetchResp(bytes.NewReader(messageFetchResponseV5MultipleBatches), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batches := resp.Topics[0].Partitions[0].RecordBatches
+	if got, exp := len(batches), 2; got != exp {
+		t.Fatalf("expected %d batches, got %d", exp, got)
+	}
+
+	if got, exp := len(batches[0].Records), 1; got != exp {
+		t.Fatalf("expected %d records in batch 0, got %d", exp, got)
+	}
+	if got, exp := batches[0].Records[0].Key, []byte{0x08, 0x80, 0x82, 0x94, 0x09, 0x10, 0xf7, 0x07}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected key 0 %x, got %x", exp, got)
+	}
+	if got, exp := len(batches[0].Records[0].Value), 220; got != exp {
+		t.Fatalf("expected value 0 length %d, got %d", exp, got)
+	}
+
+	if got, exp := len(batches[1].Records), 1; got != exp {
+		t.Fatalf("expected %d records in batch 1, got %d", exp, got)
+	}
+	if got, exp := batches[1].Records[0].Key, []byte{0x08, 0x80, 0x82, 0x94, 0x09, 0x10, 0xa6, 0x08}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected key 1 %x, got %x", exp, got)
+	}
+	if got, exp := len(batches[1].Records[0].Value), 220; got != exp {
+		t.Fatalf("expected value 1 length %d, got %d", exp, got)
+	}
+}
+
+func TestFetchResponseWithPartialFinalBatch(t *testing.T) {
+	headerAndBatch1 := []byte{
+		0x00, 0x00, 0x02, 0x98, // size
+		0x00, 0x00, 0x00, 0xa7, // correlation id
+		0x00, 0x00, 0x00, 0x00, // throttle time
+		0x00, 0x00, 0x00, 0x01, // array size
+		0x00, 0x0c, // string length
+		0x6c, 0x65, 0x67, 0x61, 0x6c, 0x2d, 0x65, 0x76, 0x65, 0x6e, 0x74, 0x73, // topic name
+		0x00, 0x00, 0x00, 0x01, // array size
+		0x00, 0x00, 0x00, 0x00, // partition id
+		0x00, 0x00, // error
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x18, // tip offset
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x18, // last stable offset
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // log start offset
+		0xff, 0xff, 0xff, 0xff, // array length
+		0x00, 0x00, 0x02, 0x54, // message set size
+
+		// Batch 1:
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x16, // first offset
+		0x00, 0x00, 0x01, 0x1e, // length
+		0x00, 0x00, 0x00, 0x04, // partition leader epoch
+		0x02,                   // message version
+		0xbc, 0x45, 0x46, 0x64, // crc
+		0x00, 0x00, // attributes
+		0x00, 0x00, 0x00, 0x00, // last offset delta
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // first timestamp
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // max timestamp
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // producer id
+		0xff, 0xff, // producer epoch
+		0xff, 0xff, 0xff, 0xff, // first sequence
+		0x00, 0x00, 0x00, 0x01, // array length
+		0xd6, 0x03, // record length
+		0x00,                                           // attributes
+		0x00,                                           // timestamp delta
+		0x00,                                           // offset delta
+		0x10,                                           // key length
+		0x08, 0x80, 0x82, 0x94, 0x09, 0x10, 0xf7, 0x07, // key
+		0xb8, 0x03, // value length (220)
+		0x01, 0x01, 0x50, 0x12, 0x04, 0x18, 0x77, 0x70, 0x77, 0x6a, 0x36, 0x61, 0x62, 0x6c, 0x75, 0x7a, // value...
 		0x72, 0x62, 0x7a, 0x64, 0x72, 0x36, 0x6f, 0x62, 0x67, 0x6f, 0x62, 0x7a, 0x6d, 0x35, 0xba, 0x00,
 		0x00, 0x00, 0x0a, 0x44, 0x0a, 0x18, 0x76, 0x6a, 0x67, 0x65, 0x72, 0x6d, 0x73, 0x34, 0x32, 0x68,
 		0x6b, 0x35, 0x6f, 0x63, 0x74, 0x37, 0x70, 0x66, 0x33, 0x7a, 0x79, 0x35, 0x74, 0x34, 0x12, 0x07,
@@ -873,384 +3123,2027 @@ func TestFetchResponseWithMultipleRecordBatches(t *testing.T) {
 		0x39, 0x33, 0x3a, 0x18, 0x73, 0x76, 0x7a, 0x76, 0x6c, 0x63, 0x73, 0x79, 0x71, 0x6f, 0x64, 0x76,
 		0x73, 0x6f, 0x61, 0x65, 0x68, 0x75, 0x6e, 0x6b, 0x69, 0x6c, 0x69, 0x6d, // ...value
 		0x00, // headers length
+	}
+
+	batch2 := []byte{
+		// Batch 2:
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x17, // first offset
+		0x00, 0x00, 0x01, 0x1e, // length
+		0x00, 0x00, 0x00, 0x04, // partition leader epoch
+		0x02,                   // message version
+		0x31, 0x04, 0x90, 0xb6, // crc
+		0x00, 0x00, // attributes
+		0x00, 0x00, 0x00, 0x00, // last offset delta
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // first timestamp
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // max timestamp
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // producer id
+		0xff, 0xff, // producer epoch
+		0xff, 0xff, 0xff, 0xff, // first sequence
+		0x00, 0x00, 0x00, 0x01, // array length
+		0xd6, 0x03, // record length
+		0x00,                                           // attributes
+		0x00,                                           // attribute delta
+		0x00,                                           // offset delta
+		0x10,                                           // key length
+		0x08, 0x80, 0x82, 0x94, 0x09, 0x10, 0xa6, 0x08, // key
+		0xb8, 0x03, // value length (220)
+		0x01, 0x01, 0x50, 0x12, 0x04, 0x18, 0x6d, 0x6c, 0x72, 0x35, 0x68, 0x65, 0x6e, 0x6d, 0x61, 0x64, // value...
+		0x77, 0x64, 0x78, 0x6a, 0x73, 0x36, 0x35, 0x6f, 0x6e, 0x74, 0x6f, 0x62, 0x35, 0x77, 0xba, 0x00,
+		0x00, 0x00, 0x0a, 0x44, 0x0a, 0x18, 0x36, 0x62, 0x76, 0x76, 0x64, 0x68, 0x36, 0x68, 0x66, 0x74,
+		0x70, 0x6e, 0x68, 0x63, 0x35, 0x35, 0x33, 0x79, 0x70, 0x67, 0x6c, 0x78, 0x72, 0x69, 0x12, 0x07,
+		0x62, 0x30, 0x34, 0x39, 0x38, 0x65, 0x34, 0x18, 0xfb, 0x88, 0xc4, 0xed, 0x93, 0xaa, 0x90, 0xcd,
+		0x15, 0x22, 0x15, 0x0a, 0x08, 0x44, 0x45, 0x41, 0x44, 0x42, 0x45, 0x45, 0x46, 0x12, 0x09, 0x68,
+		0x74, 0x74, 0x70, 0x2d, 0x66, 0x61, 0x6b, 0x65, 0x12, 0x18, 0x6d, 0x6c, 0x72, 0x35, 0x68, 0x65,
+		0x6e, 0x6d, 0x61, 0x64, 0x77, 0x64, 0x78, 0x6a, 0x73, 0x36, 0x35, 0x6f, 0x6e, 0x74, 0x6f, 0x62,
+		0x35, 0x77, 0x1a, 0x16, 0x44, 0x45, 0x38, 0x39, 0x33, 0x37, 0x30, 0x34, 0x30, 0x30, 0x34, 0x34,
+		0x30, 0x35, 0x33, 0x32, 0x30, 0x31, 0x33, 0x30, 0x30, 0x30, 0x20, 0xeb, 0xad, 0xd3, 0xeb, 0x93,
+		0xaa, 0x90, 0xcd, 0x15, 0x28, 0xeb, 0xad, 0x9b, 0xe3, 0x8f, 0xb7, 0xa6, 0x85, 0x16, 0x32, 0x12,
+		0x44, 0x45, 0x35, 0x39, 0x5a, 0x5a, 0x5a, 0x30, 0x30, 0x30, 0x30, 0x31, 0x35, 0x32, 0x35, 0x34,
+		0x39, 0x33, 0x3a, 0x18, 0x69, 0x6a, 0x71, 0x73, 0x6e, 0x33, 0x67, 0x6d, 0x67, 0x75, 0x65, 0x77,
+		0x67, 0x77, 0x63, 0x6d, 0x6e, 0x64, 0x73, 0x75, 0x62, 0x79, 0x68, 0x64, // ...value
+		0x00, // headers length
+	}
+
+	// It's fairly easy to test all cutoff points within batch2.
+	// NB: we're not testing an empty or complete batch2 here.
+	for cutoff := 1; cutoff < len(batch2); cutoff++ {
+		cutoff := cutoff
+		t.Run(fmt.Sprintf("cutoff%d", cutoff), func(t *testing.T) {
+			t.Parallel()
+
+			input := append(headerAndBatch1, batch2[:cutoff]...)
+			resp, err := ReadVersionedFetchResp(bytes.NewReader(input), 5)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			batches := resp.Topics[0].Partitions[0].RecordBatches
+			if got, exp := len(batches), 1; got != exp {
+				t.Fatalf("expected %d batches, got %d", exp, got)
+			}
+			if got, exp := len(batches[0].Records), 1; got != exp {
+				t.Fatalf("expected %d records in batch 0, got %d", exp, got)
+			}
+			got, exp := batches[0].Records[0].Key, []byte{0x08, 0x80, 0x82, 0x94, 0x09, 0x10, 0xf7, 0x07}
+			if !reflect.DeepEqual(got, exp) {
+				t.Fatalf("expected key 0 %x, got %x", exp, got)
+			}
+			if got := resp.Topics[0].Partitions[0].TruncatedBytes; got != cutoff {
+				t.Fatalf("expected %d truncated bytes, got %d", cutoff, got)
+			}
+		})
+	}
+}
+
+func TestConsumerMetadataWithVersions(t *testing.T) {
+	respV0 := ConsumerMetadataResp{
+		Version:         0,
+		CorrelationID:   1,
+		ThrottleTime:    0,
+		Err:             nil,
+		ErrMsg:          "",
+		CoordinatorID:   1,
+		CoordinatorHost: "host",
+		CoordinatorPort: 33333,
+	}
+
+	b0, err := respV0.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r0, err := ReadVersionedConsumerMetadataResp(bytes.NewReader(b0), respV0.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(respV0, *r0) {
+		t.Errorf("Expected \n %#+v\n fot \n %#+v\n", respV0, *r0)
+	}
+
+	respV1 := respV0
+	respV1.Version = KafkaV1
+	respV1.ThrottleTime = 10 * time.Second
+	respV1.ErrMsg = "My error"
+
+	b1, err := respV1.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r1, err := ReadVersionedConsumerMetadataResp(bytes.NewReader(b1), respV1.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(respV1, *r1) {
+		t.Errorf("Expected \n %#+v\n fot \n %#+v\n", respV1, *r1)
+	}
+}
+
+func TestConsumerMetadataRequestWithVersions(t *testing.T) {
+	req := &ConsumerMetadataReq{
+		RequestHeader:   RequestHeader{correlationID: 1, ClientID: "test", version: KafkaV1},
+		ConsumerGroup:   "group",
+		CoordinatorType: CorrelationTypeGroup,
+	}
+	testRequestSerialization(t, req)
+	b, _ := req.Bytes()
+	r, err := ReadConsumerMetadataReq(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("cannot read request: %s", err)
+	}
+	if !reflect.DeepEqual(r, req) {
+		t.Fatalf("expected %#v, got %#v", req, r)
+	}
+}
+
+func TestFindCoordinatorRequest(t *testing.T) {
+	req := &FindCoordinatorReq{
+		RequestHeader: RequestHeader{correlationID: 1, ClientID: "test", version: KafkaV1},
+		Key:           "txn",
+		KeyType:       CorrelationTypeTransaction,
+	}
+	testRequestSerialization(t, req)
+	b, _ := req.Bytes()
+	expected := []byte{0x0, 0x0, 0x0, 0x14, 0x0, 0xa, 0x0, 0x1, 0x0, 0x0, 0x0, 0x1, 0x0, 0x4, 0x74, 0x65, 0x73, 0x74, 0x0, 0x3, 0x74, 0x78, 0x6e, 0x1}
+	if !bytes.Equal(b, expected) {
+		t.Fatalf("expected different bytes representation: %#v", b)
+	}
+
+	r, err := ReadFindCoordinatorReq(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("cannot read request: %s", err)
+	}
+	if !reflect.DeepEqual(r, req) {
+		t.Fatalf("expected %#v, got %#v", req, r)
+	}
+
+	// key type is not supported by KafkaV0
+	req.version = KafkaV0
+	b, _ = req.Bytes()
+	expected = []byte{0x0, 0x0, 0x0, 0x13, 0x0, 0xa, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x4, 0x74, 0x65, 0x73, 0x74, 0x0, 0x3, 0x74, 0x78, 0x6e}
+	if !bytes.Equal(b, expected) {
+		t.Fatalf("expected different bytes representation: %#v", b)
+	}
+}
+
+func TestFindCoordinatorResponseWithVersions(t *testing.T) {
+	resp := FindCoordinatorResp{
+		Version:       KafkaV0,
+		CorrelationID: 1,
+		Err:           ErrNoCoordinator,
+		NodeID:        1,
+		Host:          "host",
+		Port:          9092,
+	}
+	for _, version := range []int16{KafkaV0, KafkaV1} {
+		resp.Version = version
+		if version >= KafkaV1 {
+			resp.ThrottleTime = time.Second
+			resp.ErrMsg = "not available"
+		}
+		b, err := resp.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := ReadVersionedFindCoordinatorResp(bytes.NewReader(b), version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(&resp, r) {
+			t.Fatalf("expected %#v, got %#v", resp, r)
+		}
+	}
+}
+
+func TestTransactionRequests(t *testing.T) {
+	reqs := []Request{
+		&InitProducerIdReq{
+			RequestHeader:      RequestHeader{correlationID: 1, ClientID: "test"},
+			TransactionalID:    "txn",
+			TransactionTimeout: time.Minute,
+		},
+		&AddPartitionsToTxnReq{
+			RequestHeader:   RequestHeader{correlationID: 2, ClientID: "test"},
+			TransactionalID: "txn",
+			ProducerID:      42,
+			ProducerEpoch:   3,
+			Topics: []AddPartitionsToTxnReqTopic{
+				{Name: "foo", Partitions: []int32{0, 2}},
+			},
+		},
+		&AddOffsetsToTxnReq{
+			RequestHeader:   RequestHeader{correlationID: 3, ClientID: "test"},
+			TransactionalID: "txn",
+			ProducerID:      42,
+			ProducerEpoch:   3,
+			ConsumerGroup:   "group",
+		},
+		&EndTxnReq{
+			RequestHeader:   RequestHeader{correlationID: 4, ClientID: "test"},
+			TransactionalID: "txn",
+			ProducerID:      42,
+			ProducerEpoch:   3,
+			Commit:          true,
+		},
+	}
+	for _, req := range reqs {
+		testRequestSerialization(t, req)
+	}
+
+	// idempotent producer sends null transactional id
+	req := &InitProducerIdReq{
+		RequestHeader:      RequestHeader{correlationID: 1, ClientID: "test"},
+		TransactionTimeout: time.Second,
+	}
+	b, _ := req.Bytes()
+	expected := []byte{0x0, 0x0, 0x0, 0x14, 0x0, 0x16, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x4, 0x74, 0x65, 0x73, 0x74, 0xff, 0xff, 0x0, 0x0, 0x3, 0xe8}
+	if !bytes.Equal(b, expected) {
+		t.Fatalf("expected different bytes representation: %#v", b)
+	}
+	r, err := ReadInitProducerIdReq(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("cannot read request: %s", err)
+	}
+	if !reflect.DeepEqual(r, req) {
+		t.Fatalf("expected %#v, got %#v", req, r)
+	}
+}
+
+func TestTransactionResponses(t *testing.T) {
+	initResp := &InitProducerIdResp{
+		CorrelationID: 1,
+		ThrottleTime:  time.Second,
+		ProducerID:    42,
+		ProducerEpoch: 3,
+	}
+	b, err := initResp.Bytes()
+	if err != nil {
+		t.Fatalf("cannot serialize response: %s", err)
+	}
+	r1, err := ReadInitProducerIdResp(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("cannot read response: %s", err)
+	}
+	if !reflect.DeepEqual(r1, initResp) {
+		t.Fatalf("expected %#v, got %#v", initResp, r1)
+	}
+
+	addResp := &AddPartitionsToTxnResp{
+		CorrelationID: 2,
+		Topics: []AddPartitionsToTxnRespTopic{
+			{
+				Name: "foo",
+				Partitions: []AddPartitionsToTxnRespPartition{
+					{ID: 0, Err: nil},
+					{ID: 2, Err: ErrInvalidProducerEpoch},
+				},
+			},
+		},
+	}
+	b, err = addResp.Bytes()
+	if err != nil {
+		t.Fatalf("cannot serialize response: %s", err)
+	}
+	r2, err := ReadAddPartitionsToTxnResp(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("cannot read response: %s", err)
+	}
+	if !reflect.DeepEqual(r2, addResp) {
+		t.Fatalf("expected %#v, got %#v", addResp, r2)
+	}
+
+	offsetsResp := &AddOffsetsToTxnResp{CorrelationID: 3, Err: ErrInvalidTxnState}
+	b, err = offsetsResp.Bytes()
+	if err != nil {
+		t.Fatalf("cannot serialize response: %s", err)
+	}
+	r3, err := ReadAddOffsetsToTxnResp(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("cannot read response: %s", err)
+	}
+	if !reflect.DeepEqual(r3, offsetsResp) {
+		t.Fatalf("expected %#v, got %#v", offsetsResp, r3)
+	}
+
+	endResp := &EndTxnResp{CorrelationID: 4, Err: ErrInvalidProducerEpoch}
+	b, err = endResp.Bytes()
+	if err != nil {
+		t.Fatalf("cannot serialize response: %s", err)
+	}
+	r4, err := ReadEndTxnResp(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("cannot read response: %s", err)
+	}
+	if !reflect.DeepEqual(r4, endResp) {
+		t.Fatalf("expected %#v, got %#v", endResp, r4)
+	}
+}
+
+func TestAclRequests(t *testing.T) {
+	for _, version := range []int16{KafkaV0, KafkaV1} {
+		var pattern int8
+		if version >= KafkaV1 {
+			pattern = AclPatternLiteral
+		}
+		filter := AclFilter{
+			ResourceType:   AclResourceTopic,
+			ResourceName:   "foo",
+			PatternType:    pattern,
+			Operation:      AclOperationAny,
+			PermissionType: AclPermissionAllow,
+		}
+		binding := AclBinding{
+			ResourceType:   AclResourceTopic,
+			ResourceName:   "foo",
+			PatternType:    pattern,
+			Principal:      "User:alice",
+			Host:           "*",
+			Operation:      AclOperationWrite,
+			PermissionType: AclPermissionAllow,
+		}
+
+		describe := &DescribeAclsReq{
+			RequestHeader: RequestHeader{correlationID: 1, ClientID: "test", version: version},
+			Filter:        filter,
+		}
+		testRequestSerialization(t, describe)
+		b, _ := describe.Bytes()
+		r1, err := ReadDescribeAclsReq(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("v%d: cannot read request: %s", version, err)
+		}
+		if !reflect.DeepEqual(r1, describe) {
+			t.Fatalf("v%d: expected %#v, got %#v", version, describe, r1)
+		}
+
+		create := &CreateAclsReq{
+			RequestHeader: RequestHeader{correlationID: 2, ClientID: "test", version: version},
+			Creations:     []AclBinding{binding},
+		}
+		testRequestSerialization(t, create)
+		b, _ = create.Bytes()
+		r2, err := ReadCreateAclsReq(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("v%d: cannot read request: %s", version, err)
+		}
+		if !reflect.DeepEqual(r2, create) {
+			t.Fatalf("v%d: expected %#v, got %#v", version, create, r2)
+		}
+
+		del := &DeleteAclsReq{
+			RequestHeader: RequestHeader{correlationID: 3, ClientID: "test", version: version},
+			Filters:       []AclFilter{filter, {ResourceType: AclResourceAny}},
+		}
+		testRequestSerialization(t, del)
+		b, _ = del.Bytes()
+		r3, err := ReadDeleteAclsReq(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("v%d: cannot read request: %s", version, err)
+		}
+		if !reflect.DeepEqual(r3, del) {
+			t.Fatalf("v%d: expected %#v, got %#v", version, del, r3)
+		}
+	}
+
+	// null filter fields match any value
+	req := &DescribeAclsReq{
+		RequestHeader: RequestHeader{correlationID: 1, ClientID: "test", version: KafkaV1},
+		Filter: AclFilter{
+			ResourceType:   AclResourceAny,
+			PatternType:    AclPatternAny,
+			Operation:      AclOperationAny,
+			PermissionType: AclPermissionAny,
+		},
+	}
+	b, _ := req.Bytes()
+	expected := mustDecodeHex(t,
+		"00000018",     // size
+		"001d",         // api key
+		"0001",         // api version
+		"00000001",     // correlation id
+		"000474657374", // client id
+		"01",           // resource type
+		"ffff",         // resource name
+		"01",           // pattern type
+		"ffff",         // principal
+		"ffff",         // host
+		"01",           // operation
+		"01",           // permission type
+	)
+	if !bytes.Equal(b, expected) {
+		t.Fatalf("expected different bytes representation:\n%s", hex.Dump(b))
+	}
+}
+
+func TestAclResponses(t *testing.T) {
+	for _, version := range []int16{KafkaV0, KafkaV1} {
+		var pattern int8
+		if version >= KafkaV1 {
+			pattern = AclPatternPrefixed
+		}
+
+		describe := &DescribeAclsResp{
+			Version:       version,
+			CorrelationID: 1,
+			ThrottleTime:  time.Millisecond,
+			Resources: []DescribeAclsRespResource{
+				{
+					ResourceType: AclResourceTopic,
+					ResourceName: "foo",
+					PatternType:  pattern,
+					Acls: []DescribeAclsRespAcl{
+						{Principal: "User:alice", Host: "*", Operation: AclOperationRead, PermissionType: AclPermissionAllow},
+						{Principal: "User:bob", Host: "10.0.0.1", Operation: AclOperationWrite, PermissionType: AclPermissionDeny},
+					},
+				},
+			},
+		}
+		b, err := describe.Bytes()
+		if err != nil {
+			t.Fatalf("v%d: cannot serialize response: %s", version, err)
+		}
+		r1, err := ReadVersionedDescribeAclsResp(bytes.NewReader(b), version)
+		if err != nil {
+			t.Fatalf("v%d: cannot read response: %s", version, err)
+		}
+		if !reflect.DeepEqual(r1, describe) {
+			t.Fatalf("v%d: expected %#v, got %#v", version, describe, r1)
+		}
+		bindings := r1.Bindings()
+		if len(bindings) != 2 || bindings[1].ResourceName != "foo" || bindings[1].PatternType != pattern || bindings[1].Principal != "User:bob" {
+			t.Fatalf("v%d: unexpected bindings: %#v", version, bindings)
+		}
+
+		create := &CreateAclsResp{
+			Version:       version,
+			CorrelationID: 2,
+			Results: []CreateAclsRespResult{
+				{},
+				{Err: ErrSecurityDisabled, ErrorMessage: "no authorizer"},
+			},
+		}
+		b, err = create.Bytes()
+		if err != nil {
+			t.Fatalf("v%d: cannot serialize response: %s", version, err)
+		}
+		r2, err := ReadVersionedCreateAclsResp(bytes.NewReader(b), version)
+		if err != nil {
+			t.Fatalf("v%d: cannot read response: %s", version, err)
+		}
+		if !reflect.DeepEqual(r2, create) {
+			t.Fatalf("v%d: expected %#v, got %#v", version, create, r2)
+		}
+
+		del := &DeleteAclsResp{
+			Version:       version,
+			CorrelationID: 3,
+			Results: []DeleteAclsRespResult{
+				{
+					MatchingAcls: []DeleteAclsRespMatchingAcl{
+						{AclBinding: AclBinding{
+							ResourceType:   AclResourceGroup,
+							ResourceName:   "group",
+							PatternType:    pattern,
+							Principal:      "User:alice",
+							Host:           "*",
+							Operation:      AclOperationRead,
+							PermissionType: AclPermissionAllow,
+						}},
+					},
+				},
+				{Err: ErrSecurityDisabled, MatchingAcls: []DeleteAclsRespMatchingAcl{}},
+			},
+		}
+		b, err = del.Bytes()
+		if err != nil {
+			t.Fatalf("v%d: cannot serialize response: %s", version, err)
+		}
+		r3, err := ReadVersionedDeleteAclsResp(bytes.NewReader(b), version)
+		if err != nil {
+			t.Fatalf("v%d: cannot read response: %s", version, err)
+		}
+		if !reflect.DeepEqual(r3, del) {
+			t.Fatalf("v%d: expected %#v, got %#v", version, del, r3)
+		}
+	}
+}
+
+func TestOffsetCommitResponseWithVersions(t *testing.T) {
+	respV0 := OffsetCommitResp{
+		Version:       KafkaV0,
+		CorrelationID: 1,
+		ThrottleTime:  0,
+		Topics: []OffsetCommitRespTopic{
+			OffsetCommitRespTopic{
+				Name: "test",
+				Partitions: []OffsetCommitRespPartition{
+					OffsetCommitRespPartition{
+						ID:  1,
+						Err: nil,
+					},
+				},
+			},
+		},
+	}
+
+	b0, err := respV0.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp0, err := ReadVersionedOffsetCommitResp(bytes.NewReader(b0), respV0.Version)
+
+	if !reflect.DeepEqual(&respV0, resp0) {
+		t.Fatalf("Not equal %+#v ,  %+#v", respV0, resp0)
+	}
+
+	respV3 := respV0
+	respV3.Version = KafkaV3
+	respV3.ThrottleTime = 2 * time.Second
+
+	b3, err := respV3.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp3, err := ReadVersionedOffsetCommitResp(bytes.NewReader(b3), respV3.Version)
+
+	if !reflect.DeepEqual(respV3, *resp3) {
+		t.Fatalf("Not equal \n%+#v ,  \n%+#v", respV3, *resp3)
+	}
+
+}
+
+func TestAPIVersionsResponseWithVersions(t *testing.T) {
+	respV0 := APIVersionsResp{
+		CorrelationID: 1,
+		APIVersions: []SupportedVersion{
+			SupportedVersion{
+				APIKey:     1,
+				MinVersion: 0,
+				MaxVersion: 2,
+			},
+		},
+	}
+
+	b0, err := respV0.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp0, err := ReadVersionedAPIVersionsResp(bytes.NewReader(b0), respV0.Version)
+
+	if !reflect.DeepEqual(respV0, *resp0) {
+		t.Fatalf("Not equal \n %+#v  ,  \n %+#v", respV0, *resp0)
+	}
+
+	respV1 := respV0
+	respV1.Version = KafkaV1
+	respV1.ThrottleTime = 2 * time.Second
+
+	b1, err := respV1.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp1, err := ReadVersionedAPIVersionsResp(bytes.NewReader(b1), respV1.Version)
+
+	if !reflect.DeepEqual(respV1, *resp1) {
+		t.Fatalf("Not equal \n%+#v ,  \n%+#v", respV1, *resp1)
+	}
+
+}
+
+func TestAPIVersionsResponseUnsupportedVersion(t *testing.T) {
+	// rejected KafkaV3 request is answered in the KafkaV0 format, without
+	// throttle time
+	b := mustDecodeHex(t,
+		"00000016",     // size
+		"00000007",     // correlation id
+		"0023",         // unsupported version
+		"00000002",     // api versions
+		"000000000007", // produce
+		"001200000002", // api versions
+	)
+	resp, err := ReadVersionedAPIVersionsResp(bytes.NewReader(b), KafkaV3)
+	if err != nil {
+		t.Fatalf("cannot read response: %s", err)
+	}
+	expected := &APIVersionsResp{
+		Version:       KafkaV3,
+		CorrelationID: 7,
+		Err:           ErrUnsupportedVersion,
+		APIVersions: []SupportedVersion{
+			{APIKey: ProduceReqKind, MinVersion: 0, MaxVersion: 7},
+			{APIKey: APIVersionsReqKind, MinVersion: 0, MaxVersion: 2},
+		},
+	}
+	if !reflect.DeepEqual(resp, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, resp)
+	}
+	if version, ok := resp.RetryVersion(); !ok || version != KafkaV1 {
+		t.Fatalf("expected retry with version %d, got %d, %v", KafkaV1, version, ok)
+	}
+
+	got, err := resp.Bytes()
+	if err != nil {
+		t.Fatalf("cannot serialize response: %s", err)
+	}
+	if !bytes.Equal(got, b) {
+		t.Fatalf("expected % x, got % x", b, got)
+	}
+
+	resp.APIVersions = resp.APIVersions[:1]
+	if _, ok := resp.RetryVersion(); ok {
+		t.Fatal("expected no retry without api versions range")
+	}
+	resp.Err = nil
+	if _, ok := resp.RetryVersion(); ok {
+		t.Fatal("expected no retry of successful response")
+	}
+}
+
+func TestSerializeEmptyMessageSet(t *testing.T) {
+	var buf bytes.Buffer
+	messages := []*Message{}
+	n, err := writeMessageSet(&buf, messages, CompressionNone)
+	if err != nil {
+		t.Fatalf("cannot serialize messages: %s", err)
+	}
+	if n != 0 {
+		t.Fatalf("got n=%d result from writeMessageSet; want 0", n)
+	}
+	if l := len(buf.Bytes()); l != 0 {
+		t.Fatalf("got len=%d for empty message set; should be 0", l)
+	}
+}
+
+func TestReadIncompleteMessage(t *testing.T) {
+	var buf bytes.Buffer
+	_, err := writeMessageSet(&buf, []*Message{
+		{Value: []byte("111111111111111")},
+		{Value: []byte("222222222222222")},
+		{Value: []byte("333333333333333")},
+	}, CompressionNone)
+	if err != nil {
+		t.Fatalf("cannot serialize messages: %s", err)
+	}
+
+	b := buf.Bytes()
+	// cut off the last bytes as kafka can do
+	b = b[:len(b)-4]
+	messages, skipped, err := readMessageSet(bytes.NewBuffer(b), int32(len(b)))
+	if err != nil {
+		t.Fatalf("cannot deserialize messages: %s", err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(messages))
+	}
+	// the last message takes 41 bytes, 4 of which were cut off
+	if skipped != 37 {
+		t.Fatalf("expected 37 skipped bytes, got %d", skipped)
+	}
+	if messages[0].Value[0] != '1' || messages[1].Value[0] != '2' {
+		t.Fatal("expected different messages content")
+	}
+}
+
+func TestReadEmptyMessage(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	message := Message{}
+	enc.EncodeInt64(message.Offset)
+	enc.EncodeInt32(0)
+	if err := enc.Err(); err != nil {
+		t.Fatalf("encoding error: %s", err)
+	}
+
+	b := buf.Bytes()
+	messages, _, err := readMessageSet(bytes.NewBuffer(b), int32(len(b)))
+	if err != nil {
+		t.Fatalf("cannot deserialize messages: %s", err)
+	}
+	if len(messages) != 0 {
+		t.Fatalf("expected 0 messages, got %d", len(messages))
+	}
+}
+
+func TestMessageValidate(t *testing.T) {
+	msg := &Message{Key: []byte("key"), Value: []byte("value")}
+	for _, version := range []MessageVersion{MessageV0, MessageV1} {
+		var buf bytes.Buffer
+		if _, err := writeMessageSetVersioned(&buf, []*Message{msg}, CompressionNone, version); err != nil {
+			t.Fatalf("cannot serialize message: %s", err)
+		}
+		if got := msg.encodedSize(version); got != buf.Len() {
+			t.Fatalf("version %d: expected encoded size %d, got %d", version, buf.Len(), got)
+		}
+	}
+
+	// the size is checked in MessageV1 format, including the timestamp
+	size := 34 + len(msg.Key) + len(msg.Value)
+
+	if err := msg.Validate(size); err != nil {
+		t.Fatalf("message of exact size should be valid: %s", err)
+	}
+	if err := msg.Validate(0); err != nil {
+		t.Fatalf("zero size limit should disable the check: %s", err)
+	}
+	if err := msg.Validate(size - 1); err != ErrMessageSizeTooLarge {
+		t.Fatalf("expected %s, got %v", ErrMessageSizeTooLarge, err)
+	}
+}
+
+func TestReadMessageSetTolerateCrcMismatch(t *testing.T) {
+	var set bytes.Buffer
+	_, err := writeMessageSet(&set, []*Message{
+		{Offset: 1, Value: []byte("first")},
+		{Offset: 2, Value: []byte("second")},
+		{Offset: 3, Value: []byte("third")},
+	}, CompressionNone)
+	if err != nil {
+		t.Fatalf("cannot serialize messages: %s", err)
+	}
+	_, err = writeMessageSet(&set, []*Message{
+		{Offset: 4, Value: []byte("fourth")},
+		{Offset: 5, Value: []byte("fifth")},
+	}, CompressionGzip)
+	if err != nil {
+		t.Fatalf("cannot serialize messages: %s", err)
+	}
+	b := set.Bytes()
+	// corrupt the crc of the second message and of the compressed wrapper
+	// following the three uncompressed messages
+	b[31+12] ^= 0xff
+	b[31+32+31+12] ^= 0xff
+
+	messages, _, err := readMessageSet(bytes.NewReader(b), int32(len(b)))
+	if err != nil {
+		t.Fatalf("cannot read message set: %s", err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("expected only the first message, got %d", len(messages))
+	}
+
+	if err := ConfigureParser(ParserConfig{TolerateCrcMismatch: true}); err != nil {
+		t.Fatalf("cannot configure parser: %s", err)
+	}
+	defer ConfigureParser(ParserConfig{})
+
+	messages, _, err = readMessageSet(bytes.NewReader(b), int32(len(b)))
+	if err != nil {
+		t.Fatalf("cannot read message set: %s", err)
+	}
+	var values []string
+	for _, m := range messages {
+		values = append(values, string(m.Value))
+	}
+	if expected := []string{"first", "second", "third", "fourth", "fifth"}; !reflect.DeepEqual(values, expected) {
+		t.Fatalf("expected %v, got %v", expected, values)
+	}
+	if offsets := CrcMismatches(messages); !reflect.DeepEqual(offsets, []int64{2, 4, 5}) {
+		t.Fatalf("unexpected crc mismatches: %v", offsets)
+	}
+}
+
+func TestMessageVerifyCRC(t *testing.T) {
+	if err := ConfigureParser(ParserConfig{TolerateCrcMismatch: true}); err != nil {
+		t.Fatalf("cannot configure parser: %s", err)
+	}
+	defer ConfigureParser(ParserConfig{})
+
+	for _, version := range []MessageVersion{MessageV0, MessageV1} {
+		var set bytes.Buffer
+		_, err := writeMessageSetVersioned(&set, []*Message{
+			{Offset: 1, Key: []byte("key"), Value: []byte("first")},
+			{Offset: 2, Key: []byte{}, Value: nil},
+			{Offset: 3, Value: []byte{}},
+		}, CompressionNone, version)
+		if err != nil {
+			t.Fatalf("cannot serialize messages: %s", err)
+		}
+		_, err = writeMessageSetVersioned(&set, []*Message{
+			{Offset: 4, Value: []byte("fourth")},
+		}, CompressionSnappy, version)
+		if err != nil {
+			t.Fatalf("cannot serialize messages: %s", err)
+		}
+
+		messages, _, err := readMessageSet(bytes.NewReader(set.Bytes()), int32(set.Len()))
+		if err != nil {
+			t.Fatalf("cannot read message set: %s", err)
+		}
+		if len(messages) != 4 {
+			t.Fatalf("expected 4 messages, got %d", len(messages))
+		}
+		for _, m := range messages {
+			if m.MessageVersion != version {
+				t.Fatalf("expected message version %d, got %d", version, m.MessageVersion)
+			}
+			if !m.VerifyCRC() {
+				t.Fatalf("version %d: expected valid checksum of message %d", version, m.Offset)
+			}
+		}
+
+		messages[0].Value[0] = 'F'
+		if messages[0].VerifyCRC() {
+			t.Fatalf("version %d: expected modified message to fail the check", version)
+		}
+		messages[3].Crc++
+		if messages[3].VerifyCRC() {
+			t.Fatalf("version %d: expected invalid checksum to fail the check", version)
+		}
+	}
+
+	unverifiable := []*Message{
+		{MessageVersion: MessageV2, Value: []byte("a")},
+	}
+	if err := ConfigureParser(ParserConfig{SkipMessageValues: true}); err != nil {
+		t.Fatalf("cannot configure parser: %s", err)
+	}
+	var set bytes.Buffer
+	if _, err := writeMessageSet(&set, []*Message{{Value: []byte("skipped")}}, CompressionNone); err != nil {
+		t.Fatalf("cannot serialize messages: %s", err)
+	}
+	skipped, _, err := readMessageSet(bytes.NewReader(set.Bytes()), int32(set.Len()))
+	if err != nil || len(skipped) != 1 {
+		t.Fatalf("cannot read message set: %v, %d messages", err, len(skipped))
+	}
+	unverifiable = append(unverifiable, skipped[0])
+	for i, m := range unverifiable {
+		if m.VerifyCRC() {
+			t.Errorf("%d: expected unverifiable message to fail the check", i)
+		}
+	}
+}
+
+func TestReadFetchResponsesFromSharedReader(t *testing.T) {
+	var set bytes.Buffer
+	_, err := writeMessageSet(&set, []*Message{
+		{Offset: 1, Value: []byte("first")},
+		{Offset: 2, Value: []byte("second")},
+		{Offset: 3, Value: []byte("third")},
+	}, CompressionNone)
+	if err != nil {
+		t.Fatalf("cannot serialize messages: %s", err)
+	}
+	// corrupt the crc of the second message so that the rest of the set is
+	// ignored by the parser
+	setb := set.Bytes()
+	setb[8+4+5+26] ^= 0xff
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.EncodeInt32(0) // placeholder
+	enc.EncodeInt32(1)
+	enc.EncodeArrayLen(1)
+	enc.EncodeString("foo")
+	enc.EncodeArrayLen(1)
+	enc.EncodeInt32(0)
+	enc.EncodeInt16(0)
+	enc.EncodeInt64(4)
+	enc.EncodeBytes(setb)
+	if err := enc.Err(); err != nil {
+		t.Fatalf("encoding error: %s", err)
+	}
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	second := &FetchResp{
+		CorrelationID: 2,
+		Topics: []FetchRespTopic{
+			{
+				Name: "bar",
+				Partitions: []FetchRespPartition{
+					{
+						ID:        1,
+						TipOffset: 8,
+						Messages: []*Message{
+							{Offset: 7, Value: []byte("last")},
+						},
+					},
+				},
+			},
+		},
+	}
+	b2, err := second.Bytes()
+	if err != nil {
+		t.Fatalf("cannot serialize response: %s", err)
+	}
+
+	rd := bufio.NewReader(bytes.NewReader(append(b, b2...)))
+
+	resp, err := ReadFetchResp(rd)
+	if err != nil {
+		t.Fatalf("cannot read first response: %s", err)
+	}
+	messages := resp.Topics[0].Partitions[0].Messages
+	if len(messages) != 1 || string(messages[0].Value) != "first" {
+		t.Fatalf("unexpected messages in first response: %#v", messages)
+	}
+
+	resp, err = ReadFetchResp(rd)
+	if err != nil {
+		t.Fatalf("cannot read second response: %s", err)
+	}
+	if resp.CorrelationID != 2 || resp.Topics[0].Name != "bar" {
+		t.Fatalf("unexpected second response: %#v", resp)
+	}
+	messages = resp.Topics[0].Partitions[0].Messages
+	if len(messages) != 1 || string(messages[0].Value) != "last" {
+		t.Fatalf("unexpected messages in second response: %#v", messages)
+	}
+
+	if _, err := rd.Peek(1); err != io.EOF {
+		t.Fatalf("expected reader to be exhausted, got %v", err)
+	}
+}
+
+// rawMessage returns wire representation of a single legacy message, to
+// be used as a part of a message set.
+func rawMessage(offset int64, magic, attributes int8, timestamp int64, key, value []byte) []byte {
+	var body bytes.Buffer
+	enc := NewEncoder(&body)
+	enc.EncodeInt8(magic)
+	enc.EncodeInt8(attributes)
+	if magic == int8(MessageV1) {
+		enc.EncodeInt64(timestamp)
+	}
+	enc.EncodeBytes(key)
+	enc.EncodeBytes(value)
+
+	var buf bytes.Buffer
+	enc = NewEncoder(&buf)
+	enc.EncodeInt64(offset)
+	enc.EncodeInt32(int32(4 + body.Len()))
+	enc.EncodeUint32(crc32.ChecksumIEEE(body.Bytes()))
+	buf.Write(body.Bytes())
+	return buf.Bytes()
+}
+
+// rawRecordBatch returns the binary representation of a record batch holding
+// records with given values and no keys.
+func rawRecordBatch(firstOffset int64, compression Compression, values ...[]byte) []byte {
+	appendVarint := func(b []byte, v int64) []byte {
+		var buf [binary.MaxVarintLen64]byte
+		return append(b, buf[:binary.PutVarint(buf[:], v)]...)
+	}
+
+	var records bytes.Buffer
+	for i, value := range values {
+		var rec []byte
+		rec = append(rec, 0) // attributes
+		rec = appendVarint(rec, 0)
+		rec = appendVarint(rec, int64(i))
+		rec = appendVarint(rec, -1) // no key
+		rec = appendVarint(rec, int64(len(value)))
+		rec = append(rec, value...)
+		rec = appendVarint(rec, 0) // no headers
+
+		records.Write(appendVarint(nil, int64(len(rec))))
+		records.Write(rec)
+	}
+
+	data := records.Bytes()
+	switch compression {
+	case CompressionGzip:
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		_, _ = gz.Write(data)
+		_ = gz.Close()
+		data = buf.Bytes()
+	case CompressionSnappy:
+		data = snappy.Encode(nil, data)
+	case CompressionLZ4:
+		data, _ = lz4Encode(data, false)
+	case CompressionZstd:
+		data = zstdEncode(data, CompressionLevelDefault)
+	}
+
+	var body bytes.Buffer
+	enc := NewEncoder(&body)
+	enc.EncodeInt16(int16(compression))
+	enc.EncodeInt32(int32(len(values) - 1))
+	enc.EncodeInt64(1500000000000)
+	enc.EncodeInt64(1500000000000)
+	enc.EncodeInt64(-1)
+	enc.EncodeInt16(-1)
+	enc.EncodeInt32(-1)
+	enc.EncodeInt32(int32(len(values)))
+	body.Write(data)
+
+	var buf bytes.Buffer
+	enc = NewEncoder(&buf)
+	enc.EncodeInt64(firstOffset)
+	enc.EncodeInt32(int32(4 + 1 + 4 + body.Len()))
+	enc.EncodeInt32(0) // partition leader epoch
+	enc.EncodeInt8(int8(MessageV2))
+	enc.EncodeUint32(crc32.Checksum(body.Bytes(), crc32.MakeTable(crc32.Castagnoli)))
+	buf.Write(body.Bytes())
+	return buf.Bytes()
+}
+
+func TestRecordBatchPartitionLeaderEpoch(t *testing.T) {
+	raw := rawRecordBatch(3, CompressionNone, []byte("a"))
+	// epoch follows first offset and length and is not covered by CRC
+	binary.BigEndian.PutUint32(raw[12:16], 7)
+
+	batch, err := readRecordBatch(bytes.NewReader(raw), nil, nil, nil)
+	if err != nil {
+		t.Fatalf("cannot read record batch: %s", err)
+	}
+	if batch.PartitionLeaderEpoch != 7 {
+		t.Fatalf("expected partition leader epoch 7, got %d", batch.PartitionLeaderEpoch)
+	}
+
+	resp := &FetchResp{
+		Version: KafkaV4,
+		Topics: []FetchRespTopic{
+			{Name: "foo", Partitions: []FetchRespPartition{{RecordBatches: []*RecordBatch{batch}}}},
+		},
+	}
+	b, err := resp.Bytes()
+	if err != nil {
+		t.Fatalf("cannot serialize response: %s", err)
+	}
+	if !bytes.Contains(b, raw[:16]) {
+		t.Fatalf("expected batch header % x in % x", raw[:16], b)
+	}
+	got, err := ReadVersionedFetchResp(bytes.NewReader(b), KafkaV4)
+	if err != nil {
+		t.Fatalf("cannot read response: %s", err)
+	}
+	if epoch := got.Topics[0].Partitions[0].RecordBatches[0].PartitionLeaderEpoch; epoch != 7 {
+		t.Fatalf("expected partition leader epoch 7, got %d", epoch)
+	}
+}
+
+func TestControlBatch(t *testing.T) {
+	ts := time.Unix(1500000000, 0)
+	batch := NewControlBatch(ControlRecordCommit, 42, 3, 5, ts)
+	if !batch.IsControl() || !batch.IsTransactional() || batch.Compression() != CompressionNone {
+		t.Fatalf("unexpected attributes %#x", batch.Attributes)
+	}
+
+	b, err := batch.Bytes()
+	if err != nil {
+		t.Fatalf("cannot serialize batch: %s", err)
+	}
+	got, err := readRecordBatch(bytes.NewReader(b), nil, nil, nil)
+	if err != nil {
+		t.Fatalf("cannot read batch: %s", err)
+	}
+	if got.Attributes != 0x30 || got.ProducerId != 42 || got.ProducerEpoch != 3 || got.FirstSequence != -1 ||
+		got.LastOffsetDelta != 0 || got.FirstTimestamp != 1500000000000 || got.MaxTimestamp != 1500000000000 {
+		t.Fatalf("unexpected batch header: %#v", got)
+	}
+	if len(got.Records) != 1 {
+		t.Fatalf("expected single marker record, got %d", len(got.Records))
+	}
+	rec := got.Records[0]
+	if expected := []byte{0, 0, 0, 1}; !bytes.Equal(rec.Key, expected) {
+		t.Fatalf("expected key % x, got % x", expected, rec.Key)
+	}
+	if expected := []byte{0, 0, 0, 0, 0, 5}; !bytes.Equal(rec.Value, expected) {
+		t.Fatalf("expected value % x, got % x", expected, rec.Value)
+	}
+
+	abort := NewControlBatch(ControlRecordAbort, 42, 3, 5, ts)
+	if key := abort.Records[0].Key; !bytes.Equal(key, []byte{0, 0, 0, 0}) {
+		t.Fatalf("unexpected abort marker key % x", key)
+	}
+	if (&RecordBatch{}).IsControl() || (&RecordBatch{}).IsTransactional() {
+		t.Fatal("expected plain batch not to be control nor transactional")
+	}
+}
+
+func TestReadCompressedRecordBatches(t *testing.T) {
+	set := rawRecordBatch(0, CompressionGzip, []byte("a"), []byte("b"))
+	set = append(set, rawRecordBatch(2, CompressionSnappy, []byte("c"))...)
+	set = append(set, rawRecordBatch(3, CompressionNone, []byte("d"))...)
+	set = append(set, rawRecordBatch(4, CompressionGzip, []byte("e"))...)
+	set = append(set, rawRecordBatch(5, CompressionZstd, []byte("f"), []byte("g"))...)
+	set = append(set, rawRecordBatch(7, CompressionLZ4, []byte("h"))...)
+	// partial last batch is ignored
+	last := rawRecordBatch(8, CompressionSnappy, []byte("i"))
+	set = append(set, last[:len(last)-2]...)
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.EncodeInt32(0)  // partition id
+	enc.EncodeInt16(0)  // error
+	enc.EncodeInt64(9)  // high watermark
+	enc.EncodeInt64(-1) // last stable offset
+	enc.EncodeInt32(-1) // aborted transactions
+	enc.EncodeInt32(int32(len(set)))
+	buf.Write(set)
+
+	var part FetchRespPartition
+	if err := readFetchRespPartition(NewDecoder(&buf), &buf, KafkaV4, "foo", &part); err != nil {
+		t.Fatalf("cannot read partition: %s", err)
+	}
+	var values []string
+	for _, rb := range part.RecordBatches {
+		for _, rec := range rb.Records {
+			values = append(values, string(rec.Value))
+		}
+	}
+	if expected := []string{"a", "b", "c", "d", "e", "f", "g", "h"}; !reflect.DeepEqual(values, expected) {
+		t.Fatalf("expected %v, got %v", expected, values)
+	}
+}
+
+func TestReadRecordBatchesTruncatedAtMaxBytes(t *testing.T) {
+	complete := rawRecordBatch(0, CompressionNone, []byte("a"), []byte("b"))
+	complete = append(complete, rawRecordBatch(2, CompressionGzip, []byte("c"))...)
+	last := rawRecordBatch(3, CompressionNone, []byte("d"), []byte("e"))
+
+	partition := func(buf *bytes.Buffer, id int32, set []byte) {
+		enc := NewEncoder(buf)
+		enc.EncodeInt32(id)
+		enc.EncodeInt16(0)  // error
+		enc.EncodeInt64(5)  // high watermark
+		enc.EncodeInt64(-1) // last stable offset
+		enc.EncodeInt32(-1) // aborted transactions
+		enc.EncodeInt32(int32(len(set)))
+		buf.Write(set)
+	}
+
+	for cutoff := 1; cutoff < len(last); cutoff++ {
+		for _, prefix := range [][]byte{complete, nil} {
+			// the broker cuts the last batch off at MaxBytes and sends the
+			// message set size of the data actually returned
+			set := append(append([]byte{}, prefix...), last[:cutoff]...)
+
+			var buf bytes.Buffer
+			partition(&buf, 0, set)
+			partition(&buf, 1, nil)
+
+			var part FetchRespPartition
+			if err := readFetchRespPartition(NewDecoder(&buf), &buf, KafkaV4, "foo", &part); err != nil {
+				t.Fatalf("cutoff %d: cannot read partition: %s", cutoff, err)
+			}
+			var values []string
+			for _, rb := range part.RecordBatches {
+				for _, rec := range rb.Records {
+					values = append(values, string(rec.Value))
+				}
+			}
+			var expected []string
+			if prefix != nil {
+				expected = []string{"a", "b", "c"}
+			}
+			if !reflect.DeepEqual(values, expected) {
+				t.Fatalf("cutoff %d: expected %v, got %v", cutoff, expected, values)
+			}
+			if part.TruncatedBytes != cutoff {
+				t.Fatalf("cutoff %d: expected %d truncated bytes, got %d", cutoff, cutoff, part.TruncatedBytes)
+			}
+
+			// the stream is positioned at the following partition
+			if err := readFetchRespPartition(NewDecoder(&buf), &buf, KafkaV4, "foo", &part); err != nil || part.ID != 1 {
+				t.Fatalf("cutoff %d: cannot read next partition: %v", cutoff, err)
+			}
+		}
+	}
+}
+
+func TestReadRecordBatchesSkipped(t *testing.T) {
+	type header struct {
+		topic           string
+		partition       int32
+		firstOffset     int64
+		lastOffsetDelta int32
+	}
+	var headers []header
+	err := ConfigureParser(ParserConfig{
+		SkipRecordBatch: func(topic string, partition int32, rb *RecordBatch) bool {
+			headers = append(headers, header{topic, partition, rb.FirstOffset, rb.LastOffsetDelta})
+			// skip batches already processed up to offset 3
+			return rb.FirstOffset+int64(rb.LastOffsetDelta) < 3
+		},
+	})
+	if err != nil {
+		t.Fatalf("cannot configure parser: %s", err)
+	}
+	defer ConfigureParser(ParserConfig{})
+
+	set := rawRecordBatch(0, CompressionGzip, []byte("a"), []byte("b"))
+	set = append(set, rawRecordBatch(2, CompressionNone, []byte("c"))...)
+	set = append(set, rawRecordBatch(3, CompressionSnappy, []byte("d"), []byte("e"))...)
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.EncodeInt32(7)  // partition id
+	enc.EncodeInt16(0)  // error
+	enc.EncodeInt64(5)  // high watermark
+	enc.EncodeInt64(-1) // last stable offset
+	enc.EncodeInt32(-1) // aborted transactions
+	enc.EncodeInt32(int32(len(set)))
+	buf.Write(set)
+
+	var part FetchRespPartition
+	if err := readFetchRespPartition(NewDecoder(&buf), &buf, KafkaV4, "foo", &part); err != nil {
+		t.Fatalf("cannot read partition: %s", err)
+	}
+	expectedHeaders := []header{{"foo", 7, 0, 1}, {"foo", 7, 2, 0}, {"foo", 7, 3, 1}}
+	if !reflect.DeepEqual(headers, expectedHeaders) {
+		t.Fatalf("expected %v, got %v", expectedHeaders, headers)
+	}
+	if len(part.RecordBatches) != 3 {
+		t.Fatalf("expected 3 batches, got %d", len(part.RecordBatches))
+	}
+	var values []string
+	for i, rb := range part.RecordBatches {
+		if skipped := i < 2; skipped != (rb.Records == nil) || skipped != rb.Skipped {
+			t.Fatalf("batch %d: unexpected records %v (skipped %t)", i, rb.Records, rb.Skipped)
+		}
+		for _, rec := range rb.Records {
+			values = append(values, string(rec.Value))
+		}
+	}
+	if expected := []string{"d", "e"}; !reflect.DeepEqual(values, expected) {
+		t.Fatalf("expected %v, got %v", expected, values)
+	}
+
+	// skipped batch must not be written as a batch without records
+	if _, err := part.RecordBatches[0].Bytes(); err != ErrSkippedRecordBatch {
+		t.Fatalf("expected %s, got %v", ErrSkippedRecordBatch, err)
+	}
+}
+
+func TestFetchResponseDropBefore(t *testing.T) {
+	var set bytes.Buffer
+	_, err := writeMessageSetVersioned(&set, []*Message{
+		{Offset: 10, Value: []byte("a")},
+		{Offset: 11, Value: []byte("b")},
+		{Offset: 12, Value: []byte("c")},
+	}, CompressionGzip, MessageV1)
+	if err != nil {
+		t.Fatalf("cannot serialize messages: %s", err)
+	}
+	_, err = writeMessageSetVersioned(&set, []*Message{
+		{Offset: 13, Value: []byte("d")},
+	}, CompressionNone, MessageV1)
+	if err != nil {
+		t.Fatalf("cannot serialize messages: %s", err)
+	}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.EncodeInt32(0) // size
+	enc.EncodeInt32(1) // correlation id
+	enc.EncodeArrayLen(2)
+	for _, topic := range []string{"foo", "bar"} {
+		enc.EncodeString(topic)
+		enc.EncodeArrayLen(1)
+		enc.EncodeInt32(0)  // partition id
+		enc.EncodeInt16(0)  // error
+		enc.EncodeInt64(14) // high watermark
+		enc.EncodeInt32(int32(set.Len()))
+		buf.Write(set.Bytes())
+	}
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	values := func(part FetchRespPartition) []string {
+		var values []string
+		for _, msg := range part.Messages {
+			values = append(values, fmt.Sprintf("%d:%s", msg.Offset, msg.Value))
+		}
+		return values
+	}
+	req := NewSinglePartitionFetch("foo", 0, 12, 1024)
+
+	var resp FetchResp
+	for i := 0; i < 2; i++ {
+		// message structs of the previous decoding are reused
+		if err := ReadFetchRespInto(bytes.NewReader(b), &resp); err != nil {
+			t.Fatalf("cannot read response: %s", err)
+		}
+		if expected := []string{"10:a", "11:b", "12:c", "13:d"}; !reflect.DeepEqual(values(resp.Topics[0].Partitions[0]), expected) {
+			t.Fatalf("expected %v, got %v", expected, values(resp.Topics[0].Partitions[0]))
+		}
+
+		resp.DropBefore(req)
+		if expected := []string{"12:c", "13:d"}; !reflect.DeepEqual(values(resp.Topics[0].Partitions[0]), expected) {
+			t.Fatalf("expected %v, got %v", expected, values(resp.Topics[0].Partitions[0]))
+		}
+		// partitions not in the request are not filtered
+		if got := resp.Topics[1].Partitions[0].Messages; len(got) != 4 {
+			t.Fatalf("expected all messages, got %v", values(resp.Topics[1].Partitions[0]))
+		}
+	}
+
+	seen := make(map[*Message]bool)
+	msgs := resp.Topics[0].Partitions[0].Messages
+	for _, msg := range msgs[:cap(msgs)] {
+		if seen[msg] {
+			t.Fatalf("message struct %p returned twice", msg)
+		}
+		seen[msg] = true
+	}
+}
+
+func TestReadMixedMessageFormats(t *testing.T) {
+	var set bytes.Buffer
+	_, err := writeMessageSetVersioned(&set, []*Message{
+		{Offset: 0, Value: []byte("a")},
+		{Offset: 1, Value: []byte("b")},
+	}, CompressionNone, MessageV0)
+	if err != nil {
+		t.Fatalf("cannot serialize messages: %s", err)
+	}
+	_, err = writeMessageSetVersioned(&set, []*Message{
+		{Offset: 2, Value: []byte("c"), TimestampMs: 1500000000000},
+	}, CompressionGzip, MessageV1)
+	if err != nil {
+		t.Fatalf("cannot serialize messages: %s", err)
+	}
+	set.Write(rawRecordBatch(3, CompressionNone, []byte("d"), []byte("e")))
+	set.Write(rawRecordBatch(5, CompressionSnappy, []byte("f")))
+	// partial last batch is ignored
+	last := rawRecordBatch(6, CompressionNone, []byte("g"))
+	set.Write(last[:len(last)-2])
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.EncodeInt32(0)  // partition id
+	enc.EncodeInt16(0)  // error
+	enc.EncodeInt64(7)  // high watermark
+	enc.EncodeInt64(-1) // last stable offset
+	enc.EncodeInt32(-1) // aborted transactions
+	enc.EncodeInt32(int32(set.Len()))
+	buf.Write(set.Bytes())
+	buf.WriteString("tail")
+
+	var part FetchRespPartition
+	if err := readFetchRespPartition(NewDecoder(&buf), &buf, KafkaV4, "foo", &part); err != nil {
+		t.Fatalf("cannot read partition: %s", err)
+	}
+	if part.MessageVersion != MessageV0 {
+		t.Fatalf("expected message version %d, got %d", MessageV0, part.MessageVersion)
+	}
+	var values []string
+	for _, msg := range part.Messages {
+		if msg.Topic != "foo" || msg.TipOffset != 7 {
+			t.Fatalf("unexpected message metadata: %+v", msg)
+		}
+		values = append(values, string(msg.Value))
+	}
+	for _, rb := range part.RecordBatches {
+		for _, rec := range rb.Records {
+			values = append(values, string(rec.Value))
+		}
+	}
+	if expected := []string{"a", "b", "c", "d", "e", "f"}; !reflect.DeepEqual(values, expected) {
+		t.Fatalf("expected %v, got %v", expected, values)
+	}
+	if part.TruncatedBytes != len(last)-2 {
+		t.Fatalf("expected %d truncated bytes, got %d", len(last)-2, part.TruncatedBytes)
+	}
+	if rest := buf.String(); rest != "tail" {
+		t.Fatalf("expected stream to be positioned after the set, got %q", rest)
+	}
+}
+
+func TestReadLogSegment(t *testing.T) {
+	var segment bytes.Buffer
+	_, err := writeMessageSetVersioned(&segment, []*Message{
+		{Offset: 0, Key: []byte("key"), Value: []byte("a")},
+		{Offset: 1, Value: []byte("b")},
+	}, CompressionNone, MessageV0)
+	if err != nil {
+		t.Fatalf("cannot serialize messages: %s", err)
+	}
+	segment.Write(rawRecordBatch(2, CompressionNone, []byte("c"), []byte("d")))
+	_, err = writeMessageSetVersioned(&segment, []*Message{
+		{Offset: 4, Value: []byte("e"), TimestampMs: 1500000000000},
+	}, CompressionGzip, MessageV1)
+	if err != nil {
+		t.Fatalf("cannot serialize messages: %s", err)
+	}
+	segment.Write(rawRecordBatch(5, CompressionSnappy, []byte("f"), []byte("g")))
+	b := segment.Bytes()
+
+	type entry struct {
+		Offset int64
+		Value  string
+	}
+	expected := []entry{{0, "a"}, {1, "b"}, {2, "c"}, {3, "d"}, {4, "e"}, {5, "f"}, {6, "g"}}
+
+	// incomplete batch at the end of the segment is ignored
+	last := rawRecordBatch(7, CompressionNone, []byte("h"))
+	for _, tail := range [][]byte{nil, last[:len(last)-2], last[:10]} {
+		messages, err := ReadLogSegment(bytes.NewReader(append(append([]byte{}, b...), tail...)))
+		if err != nil {
+			t.Fatalf("cannot read segment: %s", err)
+		}
+		var got []entry
+		for _, m := range messages {
+			got = append(got, entry{m.Offset, string(m.Value)})
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Fatalf("expected %v, got %v", expected, got)
+		}
+		if string(messages[0].Key) != "key" || messages[4].TimestampMs != 1500000000000 {
+			t.Fatalf("unexpected messages: %+v, %+v", messages[0], messages[4])
+		}
+	}
 
-		// Batch 2:
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x17, // first offset
-		0x00, 0x00, 0x01, 0x1e, // length
-		0x00, 0x00, 0x00, 0x04, // partition leader epoch
-		0x02,                   // message version
-		0x31, 0x04, 0x90, 0xb6, // crc
-		0x00, 0x00, // attributes
-		0x00, 0x00, 0x00, 0x00, // last offset delta
-		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // first timestamp
-		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // max timestamp
-		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // producer id
-		0xff, 0xff, // producer epoch
-		0xff, 0xff, 0xff, 0xff, // first sequence
-		0x00, 0x00, 0x00, 0x01, // array length
-		0xd6, 0x03, // record length
-		0x00,                                           // attributes
-		0x00,                                           // attribute delta
-		0x00,                                           // offset delta
-		0x10,                                           // key length
-		0x08, 0x80, 0x82, 0x94, 0x09, 0x10, 0xa6, 0x08, // key
-		0xb8, 0x03, // value length (220)
-		0x01, 0x01, 0x50, 0x12, 0x04, 0x18, 0x6d, 0x6c, 0x72, 0x35, 0x68, 0x65, 0x6e, 0x6d, 0x61, 0x64, // value...
-		0x77, 0x64, 0x78, 0x6a, 0x73, 0x36, 0x35, 0x6f, 0x6e, 0x74, 0x6f, 0x62, 0x35, 0x77, 0xba, 0x00,
-		0x00, 0x00, 0x0a, 0x44, 0x0a, 0x18, 0x36, 0x62, 0x76, 0x76, 0x64, 0x68, 0x36, 0x68, 0x66, 0x74,
-		0x70, 0x6e, 0x68, 0x63, 0x35, 0x35, 0x33, 0x79, 0x70, 0x67, 0x6c, 0x78, 0x72, 0x69, 0x12, 0x07,
-		0x62, 0x30, 0x34, 0x39, 0x38, 0x65, 0x34, 0x18, 0xfb, 0x88, 0xc4, 0xed, 0x93, 0xaa, 0x90, 0xcd,
-		0x15, 0x22, 0x15, 0x0a, 0x08, 0x44, 0x45, 0x41, 0x44, 0x42, 0x45, 0x45, 0x46, 0x12, 0x09, 0x68,
-		0x74, 0x74, 0x70, 0x2d, 0x66, 0x61, 0x6b, 0x65, 0x12, 0x18, 0x6d, 0x6c, 0x72, 0x35, 0x68, 0x65,
-		0x6e, 0x6d, 0x61, 0x64, 0x77, 0x64, 0x78, 0x6a, 0x73, 0x36, 0x35, 0x6f, 0x6e, 0x74, 0x6f, 0x62,
-		0x35, 0x77, 0x1a, 0x16, 0x44, 0x45, 0x38, 0x39, 0x33, 0x37, 0x30, 0x34, 0x30, 0x30, 0x34, 0x34,
-		0x30, 0x35, 0x33, 0x32, 0x30, 0x31, 0x33, 0x30, 0x30, 0x30, 0x20, 0xeb, 0xad, 0xd3, 0xeb, 0x93,
-		0xaa, 0x90, 0xcd, 0x15, 0x28, 0xeb, 0xad, 0x9b, 0xe3, 0x8f, 0xb7, 0xa6, 0x85, 0x16, 0x32, 0x12,
-		0x44, 0x45, 0x35, 0x39, 0x5a, 0x5a, 0x5a, 0x30, 0x30, 0x30, 0x30, 0x31, 0x35, 0x32, 0x35, 0x34,
-		0x39, 0x33, 0x3a, 0x18, 0x69, 0x6a, 0x71, 0x73, 0x6e, 0x33, 0x67, 0x6d, 0x67, 0x75, 0x65, 0x77,
-		0x67, 0x77, 0x63, 0x6d, 0x6e, 0x64, 0x73, 0x75, 0x62, 0x79, 0x68, 0x64, // ...value
-		0x00, // headers length
+	if messages, err := ReadLogSegment(bytes.NewReader(nil)); err != nil || len(messages) != 0 {
+		t.Fatalf("expected no messages, got %v, %v", messages, err)
 	}
+}
 
-	resp, err := ReadVersionedFetchResp(bytes.NewReader(messageFetchResponseV5MultipleBatches), 5)
+func TestFetchResponseRoundTrip(t *testing.T) {
+	batches := rawRecordBatch(0, CompressionNone, []byte("a"), []byte("b"))
+	batches = append(batches, rawRecordBatch(2, CompressionGzip, []byte("c"))...)
+	batches = append(batches, rawRecordBatch(3, CompressionZstd, []byte("d"), []byte("e"))...)
+
+	var messages bytes.Buffer
+	_, err := writeMessageSetVersioned(&messages, []*Message{
+		{Offset: 5, Key: []byte("key"), Value: []byte("f"), TimestampMs: 1500000000000},
+		{Offset: 6, Value: []byte("g"), TimestampMs: NoTimestamp},
+	}, CompressionNone, MessageV1)
 	if err != nil {
-		t.Fatal(err)
+		t.Fatalf("cannot serialize messages: %s", err)
 	}
 
-	batches := resp.Topics[0].Partitions[0].RecordBatches
-	if got, exp := len(batches), 2; got != exp {
-		t.Fatalf("expected %d batches, got %d", exp, got)
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.EncodeInt32(0)      // size, ignored
+	enc.EncodeInt32(1)      // correlation id
+	enc.EncodeInt32(0)      // throttle time
+	enc.EncodeArrayLen(1)   // topics
+	enc.EncodeString("foo") // topic name
+	enc.EncodeArrayLen(2)   // partitions
+	for i, set := range [][]byte{batches, messages.Bytes()} {
+		enc.EncodeInt32(int32(i)) // partition id
+		enc.EncodeInt16(0)        // error
+		enc.EncodeInt64(7)        // high watermark
+		enc.EncodeInt64(7)        // last stable offset
+		enc.EncodeInt64(0)        // log start offset
+		enc.EncodeInt32(0)        // aborted transactions
+		enc.EncodeInt32(int32(len(set)))
+		buf.Write(set)
 	}
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
 
-	if got, exp := len(batches[0].Records), 1; got != exp {
-		t.Fatalf("expected %d records in batch 0, got %d", exp, got)
+	resp, err := ReadVersionedFetchResp(bytes.NewReader(b), KafkaV5)
+	if err != nil {
+		t.Fatalf("cannot read response: %s", err)
 	}
-	if got, exp := batches[0].Records[0].Key, []byte{0x08, 0x80, 0x82, 0x94, 0x09, 0x10, 0xf7, 0x07}; !reflect.DeepEqual(got, exp) {
-		t.Fatalf("expected key 0 %x, got %x", exp, got)
+	if n := len(resp.Topics[0].Partitions[0].RecordBatches); n != 3 {
+		t.Fatalf("expected 3 record batches, got %d", n)
 	}
-	if got, exp := len(batches[0].Records[0].Value), 220; got != exp {
-		t.Fatalf("expected value 0 length %d, got %d", exp, got)
+	if n := len(resp.Topics[0].Partitions[1].Messages); n != 2 {
+		t.Fatalf("expected 2 messages, got %d", n)
 	}
 
-	if got, exp := len(batches[1].Records), 1; got != exp {
-		t.Fatalf("expected %d records in batch 1, got %d", exp, got)
+	var out bytes.Buffer
+	if _, err := resp.WriteTo(&out); err != nil {
+		t.Fatalf("cannot serialize response: %s", err)
 	}
-	if got, exp := batches[1].Records[0].Key, []byte{0x08, 0x80, 0x82, 0x94, 0x09, 0x10, 0xa6, 0x08}; !reflect.DeepEqual(got, exp) {
-		t.Fatalf("expected key 1 %x, got %x", exp, got)
+	// data compressed by the same encoders is encoded byte for byte
+	if !bytes.Equal(out.Bytes(), b) {
+		t.Fatalf("expected %#v, got %#v", b, out.Bytes())
 	}
-	if got, exp := len(batches[1].Records[0].Value), 220; got != exp {
-		t.Fatalf("expected value 1 length %d, got %d", exp, got)
+	again, err := ReadVersionedFetchResp(bytes.NewReader(out.Bytes()), KafkaV5)
+	if err != nil {
+		t.Fatalf("cannot read serialized response: %s", err)
+	}
+	if !reflect.DeepEqual(again, resp) {
+		t.Fatalf("expected %#v, got %#v", resp, again)
 	}
 }
 
-func TestFetchResponseWithPartialFinalBatch(t *testing.T) {
-	headerAndBatch1 := []byte{
-		0x00, 0x00, 0x02, 0x98, // size
-		0x00, 0x00, 0x00, 0xa7, // correlation id
-		0x00, 0x00, 0x00, 0x00, // throttle time
-		0x00, 0x00, 0x00, 0x01, // array size
-		0x00, 0x0c, // string length
-		0x6c, 0x65, 0x67, 0x61, 0x6c, 0x2d, 0x65, 0x76, 0x65, 0x6e, 0x74, 0x73, // topic name
-		0x00, 0x00, 0x00, 0x01, // array size
-		0x00, 0x00, 0x00, 0x00, // partition id
-		0x00, 0x00, // error
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x18, // tip offset
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x18, // last stable offset
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // log start offset
-		0xff, 0xff, 0xff, 0xff, // array length
-		0x00, 0x00, 0x02, 0x54, // message set size
+func TestReadCompressedMessageOffsets(t *testing.T) {
+	gzipped := func(b []byte) []byte {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(b); err != nil {
+			t.Fatalf("cannot compress: %s", err)
+		}
+		if err := gz.Close(); err != nil {
+			t.Fatalf("cannot compress: %s", err)
+		}
+		return buf.Bytes()
+	}
 
-		// Batch 1:
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x16, // first offset
-		0x00, 0x00, 0x01, 0x1e, // length
-		0x00, 0x00, 0x00, 0x04, // partition leader epoch
-		0x02,                   // message version
-		0xbc, 0x45, 0x46, 0x64, // crc
-		0x00, 0x00, // attributes
-		0x00, 0x00, 0x00, 0x00, // last offset delta
-		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // first timestamp
-		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // max timestamp
-		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // producer id
-		0xff, 0xff, // producer epoch
-		0xff, 0xff, 0xff, 0xff, // first sequence
-		0x00, 0x00, 0x00, 0x01, // array length
-		0xd6, 0x03, // record length
-		0x00,                                           // attributes
-		0x00,                                           // timestamp delta
-		0x00,                                           // offset delta
-		0x10,                                           // key length
-		0x08, 0x80, 0x82, 0x94, 0x09, 0x10, 0xf7, 0x07, // key
-		0xb8, 0x03, // value length (220)
-		0x01, 0x01, 0x50, 0x12, 0x04, 0x18, 0x77, 0x70, 0x77, 0x6a, 0x36, 0x61, 0x62, 0x6c, 0x75, 0x7a, // value...
-		0x72, 0x62, 0x7a, 0x64, 0x72, 0x36, 0x6f, 0x62, 0x67, 0x6f, 0x62, 0x7a, 0x6d, 0x35, 0xba, 0x00,
-		0x00, 0x00, 0x0a, 0x44, 0x0a, 0x18, 0x76, 0x6a, 0x67, 0x65, 0x72, 0x6d, 0x73, 0x34, 0x32, 0x68,
-		0x6b, 0x35, 0x6f, 0x63, 0x74, 0x37, 0x70, 0x66, 0x33, 0x7a, 0x79, 0x35, 0x74, 0x34, 0x12, 0x07,
-		0x62, 0x30, 0x34, 0x39, 0x38, 0x65, 0x34, 0x18, 0xc3, 0xf6, 0xb0, 0xc2, 0x9e, 0x8f, 0x90, 0xcd,
-		0x15, 0x22, 0x15, 0x0a, 0x08, 0x44, 0x45, 0x41, 0x44, 0x42, 0x45, 0x45, 0x46, 0x12, 0x09, 0x68,
-		0x74, 0x74, 0x70, 0x2d, 0x66, 0x61, 0x6b, 0x65, 0x12, 0x18, 0x77, 0x70, 0x77, 0x6a, 0x36, 0x61,
-		0x62, 0x6c, 0x75, 0x7a, 0x72, 0x62, 0x7a, 0x64, 0x72, 0x36, 0x6f, 0x62, 0x67, 0x6f, 0x62, 0x7a,
-		0x6d, 0x35, 0x1a, 0x16, 0x44, 0x45, 0x38, 0x39, 0x33, 0x37, 0x30, 0x34, 0x30, 0x30, 0x34, 0x34,
-		0x30, 0x35, 0x33, 0x32, 0x30, 0x31, 0x33, 0x30, 0x30, 0x30, 0x20, 0x91, 0xd1, 0xb2, 0xc0, 0x9e,
-		0x8f, 0x90, 0xcd, 0x15, 0x28, 0x91, 0xd1, 0xfa, 0xb7, 0x9a, 0x9c, 0xa6, 0x85, 0x16, 0x32, 0x12,
-		0x44, 0x45, 0x35, 0x39, 0x5a, 0x5a, 0x5a, 0x30, 0x30, 0x30, 0x30, 0x31, 0x35, 0x32, 0x35, 0x34,
-		0x39, 0x33, 0x3a, 0x18, 0x73, 0x76, 0x7a, 0x76, 0x6c, 0x63, 0x73, 0x79, 0x71, 0x6f, 0x64, 0x76,
-		0x73, 0x6f, 0x61, 0x65, 0x68, 0x75, 0x6e, 0x6b, 0x69, 0x6c, 0x69, 0x6d, // ...value
-		0x00, // headers length
+	// MessageV1 inner offsets are relative
+	inner := append(rawMessage(0, int8(MessageV1), 0, 1500000000000, nil, []byte("a")),
+		rawMessage(1, int8(MessageV1), 0, 1500000000001, nil, []byte("b"))...)
+	inner = append(inner, rawMessage(2, int8(MessageV1), 0, 1500000000002, nil, []byte("c"))...)
+	b := rawMessage(102, int8(MessageV1), int8(CompressionGzip), 1500000000002, nil, gzipped(inner))
+
+	// MessageV0 inner offsets are absolute
+	inner = append(rawMessage(103, int8(MessageV0), 0, 0, nil, []byte("d")),
+		rawMessage(104, int8(MessageV0), 0, 0, nil, []byte("e"))...)
+	b = append(b, rawMessage(104, int8(MessageV0), int8(CompressionGzip), 0, nil, gzipped(inner))...)
+
+	messages, _, err := readMessageSet(bytes.NewReader(b), int32(len(b)))
+	if err != nil {
+		t.Fatalf("cannot deserialize messages: %s", err)
+	}
+	var offsets []int64
+	for _, m := range messages {
+		offsets = append(offsets, m.Offset)
+	}
+	if expected := []int64{100, 101, 102, 103, 104}; !reflect.DeepEqual(offsets, expected) {
+		t.Fatalf("expected offsets %v, got %v", expected, offsets)
+	}
+}
+
+func TestCompressionFromAttributes(t *testing.T) {
+	cases := []struct {
+		attr     int16
+		expected Compression
+	}{
+		{0x00, CompressionNone},
+		{0x01, CompressionGzip},
+		{0x02, CompressionSnappy},
+		{0x03, CompressionLZ4},
+		{0x04, CompressionZstd},
+		// timestamp type and transactional flags are ignored
+		{0x08 | 0x02, CompressionSnappy},
+		{0x10 | 0x04, CompressionZstd},
+	}
+	for _, tc := range cases {
+		if c := compressionFromAttributes(int8(tc.attr)); c != tc.expected {
+			t.Errorf("attributes %#x: expected %d, got %d", tc.attr, tc.expected, c)
+		}
+		if c := compressionFromBatchAttributes(tc.attr | 0x20); c != tc.expected {
+			t.Errorf("batch attributes %#x: expected %d, got %d", tc.attr|0x20, tc.expected, c)
+		}
 	}
+}
 
-	batch2 := []byte{
-		// Batch 2:
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x17, // first offset
-		0x00, 0x00, 0x01, 0x1e, // length
-		0x00, 0x00, 0x00, 0x04, // partition leader epoch
-		0x02,                   // message version
-		0x31, 0x04, 0x90, 0xb6, // crc
-		0x00, 0x00, // attributes
-		0x00, 0x00, 0x00, 0x00, // last offset delta
-		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // first timestamp
-		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // max timestamp
-		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // producer id
-		0xff, 0xff, // producer epoch
-		0xff, 0xff, 0xff, 0xff, // first sequence
-		0x00, 0x00, 0x00, 0x01, // array length
-		0xd6, 0x03, // record length
-		0x00,                                           // attributes
-		0x00,                                           // attribute delta
-		0x00,                                           // offset delta
-		0x10,                                           // key length
-		0x08, 0x80, 0x82, 0x94, 0x09, 0x10, 0xa6, 0x08, // key
-		0xb8, 0x03, // value length (220)
-		0x01, 0x01, 0x50, 0x12, 0x04, 0x18, 0x6d, 0x6c, 0x72, 0x35, 0x68, 0x65, 0x6e, 0x6d, 0x61, 0x64, // value...
-		0x77, 0x64, 0x78, 0x6a, 0x73, 0x36, 0x35, 0x6f, 0x6e, 0x74, 0x6f, 0x62, 0x35, 0x77, 0xba, 0x00,
-		0x00, 0x00, 0x0a, 0x44, 0x0a, 0x18, 0x36, 0x62, 0x76, 0x76, 0x64, 0x68, 0x36, 0x68, 0x66, 0x74,
-		0x70, 0x6e, 0x68, 0x63, 0x35, 0x35, 0x33, 0x79, 0x70, 0x67, 0x6c, 0x78, 0x72, 0x69, 0x12, 0x07,
-		0x62, 0x30, 0x34, 0x39, 0x38, 0x65, 0x34, 0x18, 0xfb, 0x88, 0xc4, 0xed, 0x93, 0xaa, 0x90, 0xcd,
-		0x15, 0x22, 0x15, 0x0a, 0x08, 0x44, 0x45, 0x41, 0x44, 0x42, 0x45, 0x45, 0x46, 0x12, 0x09, 0x68,
-		0x74, 0x74, 0x70, 0x2d, 0x66, 0x61, 0x6b, 0x65, 0x12, 0x18, 0x6d, 0x6c, 0x72, 0x35, 0x68, 0x65,
-		0x6e, 0x6d, 0x61, 0x64, 0x77, 0x64, 0x78, 0x6a, 0x73, 0x36, 0x35, 0x6f, 0x6e, 0x74, 0x6f, 0x62,
-		0x35, 0x77, 0x1a, 0x16, 0x44, 0x45, 0x38, 0x39, 0x33, 0x37, 0x30, 0x34, 0x30, 0x30, 0x34, 0x34,
-		0x30, 0x35, 0x33, 0x32, 0x30, 0x31, 0x33, 0x30, 0x30, 0x30, 0x20, 0xeb, 0xad, 0xd3, 0xeb, 0x93,
-		0xaa, 0x90, 0xcd, 0x15, 0x28, 0xeb, 0xad, 0x9b, 0xe3, 0x8f, 0xb7, 0xa6, 0x85, 0x16, 0x32, 0x12,
-		0x44, 0x45, 0x35, 0x39, 0x5a, 0x5a, 0x5a, 0x30, 0x30, 0x30, 0x30, 0x31, 0x35, 0x32, 0x35, 0x34,
-		0x39, 0x33, 0x3a, 0x18, 0x69, 0x6a, 0x71, 0x73, 0x6e, 0x33, 0x67, 0x6d, 0x67, 0x75, 0x65, 0x77,
-		0x67, 0x77, 0x63, 0x6d, 0x6e, 0x64, 0x73, 0x75, 0x62, 0x79, 0x68, 0x64, // ...value
-		0x00, // headers length
+func TestReadMessageAttributes(t *testing.T) {
+	b := append(
+		rawMessage(1, int8(MessageV1), 0x08, 1500000000000, nil, []byte("foo")),
+		rawMessage(2, int8(MessageV0), 0, 0, nil, []byte("bar"))...)
+
+	messages, _, err := readMessageSet(bytes.NewReader(b), int32(len(b)))
+	if err != nil {
+		t.Fatalf("cannot deserialize messages: %s", err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(messages))
+	}
+	if messages[0].Attributes != 0x08 {
+		t.Fatalf("expected timestamp type bit to be preserved, got %#x", messages[0].Attributes)
 	}
+	if messages[1].Attributes != 0 {
+		t.Fatalf("expected no attributes, got %#x", messages[1].Attributes)
+	}
+}
 
-	// It's fairly easy to test all cutoff points within batch2.
-	// NB: we're not testing an empty or complete batch2 here.
-	for cutoff := 1; cutoff < len(batch2); cutoff++ {
-		cutoff := cutoff
-		t.Run(fmt.Sprintf("cutoff%d", cutoff), func(t *testing.T) {
-			t.Parallel()
+// chunkedReader returns data in chunks of given sizes, repeating the last
+// size, the way a proxy can split the stream. The last chunk is returned
+// together with io.EOF.
+type chunkedReader struct {
+	r     *bytes.Reader
+	sizes []int
+}
 
-			input := append(headerAndBatch1, batch2[:cutoff]...)
-			resp, err := ReadVersionedFetchResp(bytes.NewReader(input), 5)
-			if err != nil {
-				t.Fatal(err)
-			}
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	size := c.sizes[0]
+	if len(c.sizes) > 1 {
+		c.sizes = c.sizes[1:]
+	}
+	if len(p) > size {
+		p = p[:size]
+	}
+	n, err := c.r.Read(p)
+	if err == nil && c.r.Len() == 0 {
+		err = io.EOF
+	}
+	return n, err
+}
 
-			batches := resp.Topics[0].Partitions[0].RecordBatches
-			if got, exp := len(batches), 1; got != exp {
-				t.Fatalf("expected %d batches, got %d", exp, got)
-			}
-			if got, exp := len(batches[0].Records), 1; got != exp {
-				t.Fatalf("expected %d records in batch 0, got %d", exp, got)
-			}
-			got, exp := batches[0].Records[0].Key, []byte{0x08, 0x80, 0x82, 0x94, 0x09, 0x10, 0xf7, 0x07}
-			if !reflect.DeepEqual(got, exp) {
-				t.Fatalf("expected key 0 %x, got %x", exp, got)
-			}
-		})
+func TestReadFetchResponseSplitReads(t *testing.T) {
+	resp := &FetchResp{
+		Version:       KafkaV4,
+		CorrelationID: 1,
+		ThrottleTime:  time.Second,
+		Topics: []FetchRespTopic{
+			{
+				Name: "foo",
+				Partitions: []FetchRespPartition{
+					{
+						ID:        0,
+						TipOffset: 3,
+						Messages: []*Message{
+							{Offset: 1, Value: []byte("a")},
+							{Offset: 2, Value: []byte("b")},
+						},
+					},
+				},
+			},
+		},
+	}
+	b, err := resp.Bytes()
+	if err != nil {
+		t.Fatalf("cannot serialize response: %s", err)
+	}
+	expected, err := ReadVersionedFetchResp(bytes.NewReader(b), KafkaV4)
+	if err != nil {
+		t.Fatalf("cannot read response: %s", err)
+	}
+
+	splits := [][]int{
+		{1},                // byte by byte
+		{2, 3, 1, 7},       // size prefix split in the middle
+		{4, len(b) - 4},    // size prefix and body separately
+		{5, 11, 13, 17, 3}, // boundaries within the message set
+	}
+	for _, sizes := range splits {
+		r := &chunkedReader{r: bytes.NewReader(b), sizes: sizes}
+		got, err := ReadVersionedFetchResp(r, KafkaV4)
+		if err != nil {
+			t.Fatalf("%v: cannot read response: %s", sizes, err)
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Fatalf("%v: expected %#v, got %#v", sizes, expected, got)
+		}
+
+		r = &chunkedReader{r: bytes.NewReader(b), sizes: sizes}
+		_, raw, err := ReadResp(r)
+		if err != nil {
+			t.Fatalf("%v: cannot read response: %s", sizes, err)
+		}
+		if !bytes.Equal(raw, b) {
+			t.Fatalf("%v: expected %#v, got %#v", sizes, b, raw)
+		}
+	}
+}
+
+func TestReadFetchResponsePartial(t *testing.T) {
+	resp := &FetchResp{
+		CorrelationID: 1,
+		Topics: []FetchRespTopic{
+			{
+				Name: "foo",
+				Partitions: []FetchRespPartition{
+					{ID: 0, TipOffset: 2, Messages: []*Message{{Offset: 1, Value: []byte("a")}}},
+				},
+			},
+			{
+				Name: "bar",
+				Partitions: []FetchRespPartition{
+					{ID: 0, TipOffset: 2, Messages: []*Message{{Offset: 1, Value: []byte("b")}}},
+					{ID: 1, TipOffset: 2, Messages: []*Message{{Offset: 1, Value: []byte("c")}}},
+				},
+			},
+		},
+	}
+	b, err := resp.Bytes()
+	if err != nil {
+		t.Fatalf("cannot serialize response: %s", err)
 	}
-}
+	// break the magic byte of the very last message
+	b[len(b)-11] = 7
 
-func TestConsumerMetadataWithVersions(t *testing.T) {
-	respV0 := ConsumerMetadataResp{
-		Version:         0,
-		CorrelationID:   1,
-		ThrottleTime:    0,
-		Err:             nil,
-		ErrMsg:          "",
-		CoordinatorID:   1,
-		CoordinatorHost: "host",
-		CoordinatorPort: 33333,
+	if _, err := ReadFetchResp(bytes.NewReader(b)); err == nil {
+		t.Fatal("expected decoding error")
 	}
 
-	b0, err := respV0.Bytes()
-	if err != nil {
-		t.Fatal(err)
+	partial, err := ReadFetchRespPartial(bytes.NewReader(b))
+	if err == nil {
+		t.Fatal("expected decoding error")
+	}
+	if partial == nil || len(partial.Topics) != 2 {
+		t.Fatalf("expected two topics, got %#v", partial)
+	}
+	if len(partial.Topics[0].Partitions) != 1 || len(partial.Topics[0].Partitions[0].Messages) != 1 {
+		t.Fatalf("first topic should be fully decoded: %#v", partial.Topics[0])
 	}
+	if parts := partial.Topics[1].Partitions; len(parts) != 1 || string(parts[0].Messages[0].Value) != "b" {
+		t.Fatalf("expected only first partition of second topic: %#v", parts)
+	}
+}
 
-	r0, err := ReadVersionedConsumerMetadataResp(bytes.NewReader(b0), respV0.Version)
-	if err != nil {
-		t.Fatal(err)
+func TestReadMessageSetSkipValues(t *testing.T) {
+	if err := ConfigureParser(ParserConfig{SkipMessageValues: true}); err != nil {
+		t.Fatalf("cannot configure parser: %s", err)
 	}
+	defer ConfigureParser(ParserConfig{})
 
-	if !reflect.DeepEqual(respV0, *r0) {
-		t.Errorf("Expected \n %#+v\n fot \n %#+v\n", respV0, *r0)
+	var compressed bytes.Buffer
+	_, err := writeMessageSet(&compressed, []*Message{
+		{Offset: 3, Key: []byte("k3"), Value: []byte("compressed")},
+	}, CompressionGzip)
+	if err != nil {
+		t.Fatalf("cannot serialize messages: %s", err)
 	}
 
-	respV1 := respV0
-	respV1.Version = KafkaV1
-	respV1.ThrottleTime = 10 * time.Second
-	respV1.ErrMsg = "My error"
+	b := append(rawMessage(1, int8(MessageV1), 0, 1500000000123, []byte("k1"), []byte("first value")),
+		rawMessage(2, int8(MessageV0), 0, 0, nil, []byte("second value"))...)
+	b = append(b, compressed.Bytes()...)
+	last := rawMessage(4, int8(MessageV0), 0, 0, []byte("k4"), []byte("truncated"))
+	b = append(b, last[:len(last)-3]...)
 
-	b1, err := respV1.Bytes()
+	messages, _, err := readMessageSet(bytes.NewReader(b), int32(len(b)))
 	if err != nil {
-		t.Fatal(err)
+		t.Fatalf("cannot deserialize messages: %s", err)
 	}
+	expected := []*Message{
+		{Offset: 1, Key: []byte("k1"), TimestampMs: 1500000000123},
+		{Offset: 2, TimestampMs: NoTimestamp},
+		{Offset: 3, Key: []byte("k3"), TimestampMs: NoTimestamp},
+	}
+	if len(messages) != len(expected) {
+		t.Fatalf("expected %d messages, got %d", len(expected), len(messages))
+	}
+	for i, m := range messages {
+		e := expected[i]
+		if m.Offset != e.Offset || !bytes.Equal(m.Key, e.Key) || m.TimestampMs != e.TimestampMs || m.Value != nil {
+			t.Fatalf("message %d: expected %#v, got %#v", i, e, m)
+		}
+	}
+}
 
-	r1, err := ReadVersionedConsumerMetadataResp(bytes.NewReader(b1), respV1.Version)
-	if err != nil {
-		t.Fatal(err)
+func TestReadFetchResponseInto(t *testing.T) {
+	first := &FetchResp{
+		CorrelationID: 1,
+		Topics: []FetchRespTopic{
+			{
+				Name: "foo",
+				Partitions: []FetchRespPartition{
+					{ID: 0, TipOffset: 3, Messages: []*Message{{Offset: 1, Value: []byte("a")}, {Offset: 2, Value: []byte("b")}}},
+				},
+			},
+		},
+	}
+	second := &FetchResp{
+		CorrelationID: 2,
+		Topics: []FetchRespTopic{
+			{
+				Name: "foo",
+				Partitions: []FetchRespPartition{
+					{ID: 0, TipOffset: 6, Messages: []*Message{{Offset: 3, Value: []byte("c")}, {Offset: 4, Value: []byte("d")}, {Offset: 5, Value: []byte("e")}}},
+					{ID: 1, TipOffset: 2, Messages: []*Message{{Offset: 1, Value: []byte("f")}}},
+				},
+			},
+			{
+				Name: "bar",
+				Partitions: []FetchRespPartition{
+					{ID: 0, TipOffset: 0},
+				},
+			},
+		},
 	}
 
-	if !reflect.DeepEqual(respV1, *r1) {
-		t.Errorf("Expected \n %#+v\n fot \n %#+v\n", respV1, *r1)
+	var resp FetchResp
+	for _, expected := range []*FetchResp{first, second, first} {
+		b, err := expected.Bytes()
+		if err != nil {
+			t.Fatalf("cannot serialize response: %s", err)
+		}
+		var reused *Message
+		if len(resp.Topics) > 0 {
+			reused = resp.Topics[0].Partitions[0].Messages[0]
+		}
+		if err := ReadFetchRespInto(bytes.NewReader(b), &resp); err != nil {
+			t.Fatalf("cannot read response: %s", err)
+		}
+		fresh, err := ReadFetchResp(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("cannot read response: %s", err)
+		}
+		if !reflect.DeepEqual(&resp, fresh) {
+			t.Fatalf("expected %#v, got %#v", fresh, &resp)
+		}
+		if reused != nil && resp.Topics[0].Partitions[0].Messages[0] != reused {
+			t.Fatal("expected message struct to be reused")
+		}
 	}
 }
 
-func TestOffsetCommitResponseWithVersions(t *testing.T) {
-	respV0 := OffsetCommitResp{
-		Version:       KafkaV0,
+func TestReadFetchResponseFunc(t *testing.T) {
+	resp := &FetchResp{
+		Version:       KafkaV1,
 		CorrelationID: 1,
-		ThrottleTime:  0,
-		Topics: []OffsetCommitRespTopic{
-			OffsetCommitRespTopic{
-				Name: "test",
-				Partitions: []OffsetCommitRespPartition{
-					OffsetCommitRespPartition{
-						ID:  1,
-						Err: nil,
-					},
+		ThrottleTime:  time.Second,
+		Topics: []FetchRespTopic{
+			{
+				Name: "foo",
+				Partitions: []FetchRespPartition{
+					{ID: 0, TipOffset: 2, Messages: []*Message{{Offset: 1, Value: []byte("a")}}},
+					{ID: 1, TipOffset: 0},
+				},
+			},
+			{
+				Name: "bar",
+				Partitions: []FetchRespPartition{
+					{ID: 2, TipOffset: 2, Messages: []*Message{{Offset: 1, Value: []byte("b")}}},
 				},
 			},
 		},
 	}
-
-	b0, err := respV0.Bytes()
+	b, err := resp.Bytes()
 	if err != nil {
-		t.Fatal(err)
+		t.Fatalf("cannot serialize response: %s", err)
 	}
-	resp0, err := ReadVersionedOffsetCommitResp(bytes.NewReader(b0), respV0.Version)
-
-	if !reflect.DeepEqual(&respV0, resp0) {
-		t.Fatalf("Not equal %+#v ,  %+#v", respV0, resp0)
+	expected, err := ReadVersionedFetchResp(bytes.NewReader(b), KafkaV1)
+	if err != nil {
+		t.Fatalf("cannot read response: %s", err)
 	}
 
-	respV3 := respV0
-	respV3.Version = KafkaV3
-	respV3.ThrottleTime = 2 * time.Second
-
-	b3, err := respV3.Bytes()
+	var topics []FetchRespTopic
+	got, err := ReadVersionedFetchRespFunc(bytes.NewReader(b), KafkaV1, func(topic string, part FetchRespPartition) error {
+		if n := len(topics); n == 0 || topics[n-1].Name != topic {
+			topics = append(topics, FetchRespTopic{Name: topic})
+		}
+		last := &topics[len(topics)-1]
+		last.Partitions = append(last.Partitions, part)
+		return nil
+	})
 	if err != nil {
-		t.Fatal(err)
+		t.Fatalf("cannot read response: %s", err)
 	}
-	resp3, err := ReadVersionedOffsetCommitResp(bytes.NewReader(b3), respV3.Version)
-
-	if !reflect.DeepEqual(respV3, *resp3) {
-		t.Fatalf("Not equal \n%+#v ,  \n%+#v", respV3, *resp3)
+	if got.CorrelationID != 1 || got.ThrottleTime != time.Second || got.Topics != nil {
+		t.Fatalf("unexpected response: %#v", got)
+	}
+	if !reflect.DeepEqual(topics, expected.Topics) {
+		t.Fatalf("expected %#v, got %#v", expected.Topics, topics)
 	}
 
+	// decoding stops at the first callback error
+	errStop := errors.New("stop")
+	calls := 0
+	_, err = ReadVersionedFetchRespFunc(bytes.NewReader(b), KafkaV1, func(topic string, part FetchRespPartition) error {
+		calls++
+		return errStop
+	})
+	if err != errStop || calls != 1 {
+		t.Fatalf("expected single call and %v, got %d calls and %v", errStop, calls, err)
+	}
 }
 
-func TestAPIVersionsResponseWithVersions(t *testing.T) {
-	respV0 := APIVersionsResp{
+func TestFetchResponsePartitionDecodedHook(t *testing.T) {
+	type decoded struct {
+		topic     string
+		partition int32
+		messages  int
+	}
+	var got []decoded
+	err := ConfigureParser(ParserConfig{
+		OnPartitionDecoded: func(topic string, partition int32, messages int, dur time.Duration) {
+			if dur < 0 {
+				t.Errorf("negative duration: %s", dur)
+			}
+			got = append(got, decoded{topic, partition, messages})
+		},
+	})
+	if err != nil {
+		t.Fatalf("cannot configure parser: %s", err)
+	}
+	defer ConfigureParser(ParserConfig{})
+
+	resp := &FetchResp{
 		CorrelationID: 1,
-		APIVersions: []SupportedVersion{
-			SupportedVersion{
-				APIKey:     1,
-				MinVersion: 0,
-				MaxVersion: 2,
+		Topics: []FetchRespTopic{
+			{
+				Name: "foo",
+				Partitions: []FetchRespPartition{
+					{ID: 0, TipOffset: 3, Messages: []*Message{{Offset: 1, Value: []byte("a")}, {Offset: 2, Value: []byte("b")}}},
+					{ID: 1, TipOffset: 0},
+				},
+			},
+			{
+				Name: "bar",
+				Partitions: []FetchRespPartition{
+					{ID: 2, TipOffset: 2, Messages: []*Message{{Offset: 1, Value: []byte("c")}}},
+				},
 			},
 		},
 	}
-
-	b0, err := respV0.Bytes()
+	b, err := resp.Bytes()
 	if err != nil {
-		t.Fatal(err)
+		t.Fatalf("cannot serialize response: %s", err)
 	}
-	resp0, err := ReadVersionedAPIVersionsResp(bytes.NewReader(b0), respV0.Version)
+	if _, err := ReadFetchResp(bytes.NewReader(b)); err != nil {
+		t.Fatalf("cannot read response: %s", err)
+	}
+	expected := []decoded{{"foo", 0, 2}, {"foo", 1, 0}, {"bar", 2, 1}}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+}
 
-	if !reflect.DeepEqual(respV0, *resp0) {
-		t.Fatalf("Not equal \n %+#v  ,  \n %+#v", respV0, *resp0)
+func TestReadMessageSetValidateOffsets(t *testing.T) {
+	if err := ConfigureParser(ParserConfig{ValidateOffsets: true}); err != nil {
+		t.Fatalf("cannot configure parser: %s", err)
 	}
+	defer ConfigureParser(ParserConfig{})
 
-	respV1 := respV0
-	respV1.Version = KafkaV1
-	respV1.ThrottleTime = 2 * time.Second
+	cases := []struct {
+		offsets  []int64
+		expected error
+	}{
+		{[]int64{4, 5, 7}, nil},
+		{[]int64{4, 4}, ErrNonMonotonicOffsets},
+		{[]int64{4, 6, 5}, ErrNonMonotonicOffsets},
+	}
+	for _, tc := range cases {
+		var messages []*Message
+		for _, offset := range tc.offsets {
+			messages = append(messages, &Message{Offset: offset, Value: []byte("foo")})
+		}
+		var buf bytes.Buffer
+		if _, err := writeMessageSet(&buf, messages, CompressionNone); err != nil {
+			t.Fatalf("cannot serialize messages: %s", err)
+		}
+		b := buf.Bytes()
+		if _, _, err := readMessageSet(bytes.NewReader(b), int32(len(b))); err != tc.expected {
+			t.Errorf("offsets %v: expected %v, got %v", tc.offsets, tc.expected, err)
+		}
+	}
+}
 
-	b1, err := respV1.Bytes()
+func TestReadMessageTimestamp(t *testing.T) {
+	b := append(
+		rawMessage(1, int8(MessageV1), 0, 1500000000123, nil, []byte("foo")),
+		rawMessage(2, int8(MessageV0), 0, 0, nil, []byte("bar"))...)
+
+	messages, _, err := readMessageSet(bytes.NewReader(b), int32(len(b)))
 	if err != nil {
-		t.Fatal(err)
+		t.Fatalf("cannot deserialize messages: %s", err)
 	}
-	resp1, err := ReadVersionedAPIVersionsResp(bytes.NewReader(b1), respV1.Version)
-
-	if !reflect.DeepEqual(respV1, *resp1) {
-		t.Fatalf("Not equal \n%+#v ,  \n%+#v", respV1, *resp1)
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(messages))
 	}
 
-}
+	if messages[0].TimestampMs != 1500000000123 {
+		t.Fatalf("unexpected timestamp: %d", messages[0].TimestampMs)
+	}
+	expected := time.Date(2017, 7, 14, 2, 40, 0, 123000000, time.UTC)
+	if got := messages[0].Time(); !got.Equal(expected) {
+		t.Fatalf("expected %s time, got %s", expected, got)
+	}
 
-func TestSerializeEmptyMessageSet(t *testing.T) {
-	var buf bytes.Buffer
-	messages := []*Message{}
-	n, err := writeMessageSet(&buf, messages, CompressionNone)
-	if err != nil {
-		t.Fatalf("cannot serialize messages: %s", err)
+	if messages[1].TimestampMs != NoTimestamp {
+		t.Fatalf("expected no timestamp, got %d", messages[1].TimestampMs)
 	}
-	if n != 0 {
-		t.Fatalf("got n=%d result from writeMessageSet; want 0", n)
+	if got := messages[1].Time(); !got.IsZero() {
+		t.Fatalf("expected zero time, got %s", got)
 	}
-	if l := len(buf.Bytes()); l != 0 {
-		t.Fatalf("got len=%d for empty message set; should be 0", l)
+
+	epoch := &Message{TimestampMs: 0}
+	if got := epoch.Time(); got.IsZero() || got.Unix() != 0 {
+		t.Fatalf("expected unix epoch, got %s", got)
 	}
 }
 
-func TestReadIncompleteMessage(t *testing.T) {
-	var buf bytes.Buffer
-	_, err := writeMessageSet(&buf, []*Message{
-		{Value: []byte("111111111111111")},
-		{Value: []byte("222222222222222")},
-		{Value: []byte("333333333333333")},
-	}, CompressionNone)
+func TestReadCompressedMessageTimestamps(t *testing.T) {
+	var set bytes.Buffer
+	_, err := writeMessageSetVersioned(&set, []*Message{
+		{Offset: 0, Value: []byte("a"), TimestampMs: 1500000000100},
+		{Offset: 1, Value: []byte("b"), TimestampMs: 1500000000300},
+		{Offset: 2, Value: []byte("c"), TimestampMs: 1500000000200},
+	}, CompressionGzip, MessageV1)
 	if err != nil {
 		t.Fatalf("cannot serialize messages: %s", err)
 	}
-
-	b := buf.Bytes()
-	// cut off the last bytes as kafka can do
-	b = b[:len(b)-4]
-	messages, err := readMessageSet(bytes.NewBuffer(b), int32(len(b)))
-	if err != nil {
-		t.Fatalf("cannot deserialize messages: %s", err)
+	b := set.Bytes()
+	// wrapper carries the maximum timestamp of the inner messages
+	if ts := int64(binary.BigEndian.Uint64(b[18:26])); ts != 1500000000300 {
+		t.Fatalf("unexpected wrapper timestamp %d", ts)
 	}
-	if len(messages) != 2 {
-		t.Fatalf("expected 2 messages, got %d", len(messages))
+
+	timestamps := func() []int64 {
+		messages, _, err := readMessageSet(bytes.NewReader(b), int32(len(b)))
+		if err != nil {
+			t.Fatalf("cannot deserialize messages: %s", err)
+		}
+		var res []int64
+		for _, m := range messages {
+			res = append(res, m.TimestampMs)
+		}
+		return res
 	}
-	if messages[0].Value[0] != '1' || messages[1].Value[0] != '2' {
-		t.Fatal("expected different messages content")
+	if got, expected := timestamps(), []int64{1500000000100, 1500000000300, 1500000000200}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected create times %v, got %v", expected, got)
 	}
-}
 
-func TestReadEmptyMessage(t *testing.T) {
-	var buf bytes.Buffer
-	enc := NewEncoder(&buf)
-	message := Message{}
-	enc.EncodeInt64(message.Offset)
-	enc.EncodeInt32(0)
-	if err := enc.Err(); err != nil {
-		t.Fatalf("encoding error: %s", err)
+	// with log append time the wrapper timestamp applies to all messages
+	b[17] |= logAppendTimeFlag
+	binary.BigEndian.PutUint64(b[18:26], 1500000000999)
+	binary.BigEndian.PutUint32(b[12:16], messageChecksum(MessageV1, b[16:]))
+	if got, expected := timestamps(), []int64{1500000000999, 1500000000999, 1500000000999}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected log append times %v, got %v", expected, got)
 	}
 
-	b := buf.Bytes()
-	messages, err := readMessageSet(bytes.NewBuffer(b), int32(len(b)))
+	// checksums of inner messages still cover their create time
+	messages, _, err := readMessageSet(bytes.NewReader(b), int32(len(b)))
 	if err != nil {
 		t.Fatalf("cannot deserialize messages: %s", err)
 	}
-	if len(messages) != 0 {
-		t.Fatalf("expected 0 messages, got %d", len(messages))
+	for _, m := range messages {
+		if !m.VerifyCRC() {
+			t.Errorf("message %d: checksum not verified", m.Offset)
+		}
 	}
 }
 
@@ -1574,6 +5467,65 @@ func BenchmarkProduceRequestMarshal(b *testing.B) {
 	}
 }
 
+func BenchmarkWriteMessageSetLargeValue(b *testing.B) {
+	value := bytes.Repeat([]byte("0123456789abcdef"), 1<<16) // 1MB
+	messages := []*Message{{Key: []byte("key"), Value: value}}
+	b.SetBytes(int64(len(value)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := writeMessageSetVersioned(ioutil.Discard, messages, CompressionNone, MessageV1); err != nil {
+			b.Fatalf("could not serialize messages: %s", err)
+		}
+	}
+}
+
+// benchmarkLargeProduceRequest compares memory used by streaming large
+// produce request using WriteTo with serializing it first using Bytes.
+func benchmarkLargeProduceRequest(b *testing.B, write func(req *ProduceReq) error) {
+	value := bytes.Repeat([]byte("0123456789abcdef"), 1<<16) // 1MB
+	messages := make([]*Message, 32)
+	for i := range messages {
+		messages[i] = &Message{Value: value}
+	}
+	req := &ProduceReq{
+		RequestHeader: RequestHeader{correlationID: 241, ClientID: "test", version: KafkaV2},
+		RequiredAcks:  RequiredAcksAll,
+		Timeout:       time.Second,
+		Topics: []ProduceReqTopic{
+			{Name: "foo", Partitions: []ProduceReqPartition{{ID: 0, Messages: messages}}},
+		},
+	}
+	b.SetBytes(int64(len(messages) * len(value)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := write(req); err != nil {
+			b.Fatalf("could not write request: %s", err)
+		}
+	}
+}
+
+func BenchmarkProduceRequestLargeBytes(b *testing.B) {
+	benchmarkLargeProduceRequest(b, func(req *ProduceReq) error {
+		buf, err := req.Bytes()
+		if err != nil {
+			return err
+		}
+		_, err = ioutil.Discard.Write(buf)
+		return err
+	})
+}
+
+func BenchmarkProduceRequestLargeWriteTo(b *testing.B) {
+	benchmarkLargeProduceRequest(b, func(req *ProduceReq) error {
+		_, err := req.WriteTo(ioutil.Discard)
+		return err
+	})
+}
+
 func BenchmarkProduceResponseUnmarshal(b *testing.B) {
 	resp := &ProduceResp{
 		CorrelationID: 241,
@@ -1739,3 +5691,25 @@ func BenchmarkFetchResponseV5Unmarshal(b *testing.B) {
 		}
 	}
 }
+
+func BenchmarkReadMessageSetUncompressed(b *testing.B) {
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < 1<<20; i++ {
+		_, err := writeMessageSet(&buf, []*Message{
+			{Offset: int64(i), Key: []byte("key"), Value: []byte("small message value")},
+		}, CompressionNone)
+		if err != nil {
+			b.Fatalf("cannot serialize messages: %s", err)
+		}
+	}
+	raw := buf.Bytes()
+	b.SetBytes(int64(len(raw)))
+	b.ResetTimer()
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if _, _, err := readMessageSet(bytes.NewReader(raw), int32(len(raw))); err != nil {
+			b.Fatalf("could not deserialize messages: %s", err)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+// Capture is a single request or response recorded by the Recorder.
+type Capture struct {
+	Response bool
+	Kind     int16
+	Version  int16
+	// Bytes is the wire representation of the message, including the size
+	// prefix, so that it can be passed directly to the matching reader, for
+	// example ReadVersionedFetchResp.
+	Bytes []byte
+}
+
+type capturedReq struct {
+	kind    int16
+	version int16
+}
+
+// Recorder tees requests written and responses read to given writer, so that
+// they can be replayed later using ReadCapture. Failing to record does not
+// affect the communication with the broker, use Err to check if all the
+// data was written.
+type Recorder struct {
+	mu      sync.Mutex
+	w       io.Writer
+	err     error
+	pending map[int32]capturedReq
+}
+
+// NewRecorder returns recorder writing the captures to w.
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{
+		w:       w,
+		pending: make(map[int32]capturedReq),
+	}
+}
+
+// WriteRequest records the request and writes it to w. The request is
+// recorded even if writing it fails.
+func (rec *Recorder) WriteRequest(w io.Writer, req Request) (int64, error) {
+	b, err := req.Bytes()
+	if err != nil {
+		return 0, err
+	}
+
+	// the request is registered and recorded before it is written, because
+	// the response can be read by another goroutine as soon as it is sent
+	correlationID := req.GetCorrelationID()
+	// there is no response to produce request without acks
+	expectsResp := true
+	if p, ok := req.(*ProduceReq); ok {
+		expectsResp = p.ExpectsResponse()
+	}
+	rec.mu.Lock()
+	if expectsResp {
+		rec.pending[correlationID] = capturedReq{kind: req.Kind(), version: req.GetVersion()}
+	}
+	rec.record(&Capture{Kind: req.Kind(), Version: req.GetVersion(), Bytes: b})
+	rec.mu.Unlock()
+
+	n, err := writeFull(w, b)
+	if err != nil && expectsResp {
+		rec.mu.Lock()
+		delete(rec.pending, correlationID)
+		rec.mu.Unlock()
+	}
+	return n, err
+}
+
+// ReadResp works as ReadResp, but records the response. Kind and version of
+// the response are taken from the request with the same correlation ID
+// written using WriteRequest.
+func (rec *Recorder) ReadResp(r io.Reader) (correlationID int32, b []byte, err error) {
+	correlationID, b, err = ReadResp(r)
+	if err != nil {
+		return correlationID, b, err
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	req, ok := rec.pending[correlationID]
+	if !ok {
+		req = capturedReq{kind: -1, version: -1}
+	}
+	delete(rec.pending, correlationID)
+	rec.record(&Capture{Response: true, Kind: req.kind, Version: req.version, Bytes: b})
+	return correlationID, b, nil
+}
+
+// Err returns the first error that occurred while writing the captures.
+func (rec *Recorder) Err() error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.err
+}
+
+func (rec *Recorder) record(c *Capture) {
+	if rec.err != nil {
+		return
+	}
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.EncodeInt8(boolToInt8(c.Response))
+	enc.EncodeInt16(c.Kind)
+	enc.EncodeInt16(c.Version)
+	if rec.err = enc.Err(); rec.err != nil {
+		return
+	}
+	buf.Write(c.Bytes)
+	_, rec.err = rec.w.Write(buf.Bytes())
+}
+
+// ReadCapture reads single capture written by the Recorder. io.EOF is
+// returned when there are no more captures to read.
+func ReadCapture(r io.Reader) (*Capture, error) {
+	var c Capture
+	dec := NewDecoder(r)
+
+	c.Response = dec.DecodeInt8() != 0
+	if err := dec.Err(); err != nil {
+		return nil, err
+	}
+	c.Kind = dec.DecodeInt16()
+	c.Version = dec.DecodeInt16()
+	size := dec.DecodeInt32()
+	if err := dec.Err(); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	b, err := allocParseBuf(int(size) + 4)
+	if err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint32(b, uint32(size))
+	if _, err := io.ReadFull(r, b[4:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	c.Bytes = b
+	return &c, nil
+}
@@ -0,0 +1,152 @@
+package proto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRecorder(t *testing.T) {
+	var capture bytes.Buffer
+	rec := NewRecorder(&capture)
+
+	req := &FetchReq{
+		RequestHeader: RequestHeader{correlationID: 241, ClientID: "test", version: KafkaV1},
+		ReplicaID:     -1,
+		MaxWaitTime:   time.Second,
+		MinBytes:      1,
+		Topics: []FetchReqTopic{
+			{Name: "foo", Partitions: []FetchReqPartition{{ID: 0, FetchOffset: 2, MaxBytes: 1024}}},
+		},
+	}
+	var conn bytes.Buffer
+	if _, err := rec.WriteRequest(&conn, req); err != nil {
+		t.Fatalf("cannot write request: %s", err)
+	}
+	reqb, _ := req.Bytes()
+	if !bytes.Equal(conn.Bytes(), reqb) {
+		t.Fatalf("expected request to be written: %#v", conn.Bytes())
+	}
+
+	resp := &FetchResp{
+		Version:       KafkaV1,
+		CorrelationID: 241,
+		ThrottleTime:  time.Second,
+		Topics: []FetchRespTopic{
+			{
+				Name: "foo",
+				Partitions: []FetchRespPartition{
+					{
+						ID:        0,
+						TipOffset: 4,
+						Messages: []*Message{
+							{Offset: 2, Crc: 0xb8ba5f57, Key: []byte("foo"), Value: []byte("bar"), Topic: "foo", TipOffset: 4, TimestampMs: NoTimestamp},
+						},
+					},
+				},
+			},
+		},
+	}
+	respb, err := resp.Bytes()
+	if err != nil {
+		t.Fatalf("cannot serialize response: %s", err)
+	}
+	correlationID, b, err := rec.ReadResp(bytes.NewReader(respb))
+	if err != nil {
+		t.Fatalf("cannot read response: %s", err)
+	}
+	if correlationID != 241 || !bytes.Equal(b, respb) {
+		t.Fatalf("unexpected response %d: %#v", correlationID, b)
+	}
+	if err := rec.Err(); err != nil {
+		t.Fatalf("cannot record: %s", err)
+	}
+
+	c, err := ReadCapture(&capture)
+	if err != nil {
+		t.Fatalf("cannot read request capture: %s", err)
+	}
+	expected := &Capture{Kind: FetchReqKind, Version: KafkaV1, Bytes: reqb}
+	if !reflect.DeepEqual(c, expected) {
+		t.Fatalf("expected %#v, got %#v", expected, c)
+	}
+
+	c, err = ReadCapture(&capture)
+	if err != nil {
+		t.Fatalf("cannot read response capture: %s", err)
+	}
+	expected = &Capture{Response: true, Kind: FetchReqKind, Version: KafkaV1, Bytes: respb}
+	if !reflect.DeepEqual(c, expected) {
+		t.Fatalf("expected %#v, got %#v", expected, c)
+	}
+	replayed, err := ReadVersionedFetchResp(bytes.NewReader(c.Bytes), c.Version)
+	if err != nil {
+		t.Fatalf("cannot replay response: %s", err)
+	}
+	if !reflect.DeepEqual(replayed, resp) {
+		t.Fatalf("expected %#v, got %#v", resp, replayed)
+	}
+
+	if _, err := ReadCapture(&capture); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+// respondingWriter reads the response as soon as the request is written,
+// before WriteRequest returns, as the connection read loop might.
+type respondingWriter struct {
+	rec  *Recorder
+	resp []byte
+	err  error
+}
+
+func (w *respondingWriter) Write(b []byte) (int, error) {
+	_, _, w.err = w.rec.ReadResp(bytes.NewReader(w.resp))
+	return len(b), nil
+}
+
+func TestRecorderEarlyResponse(t *testing.T) {
+	var capture bytes.Buffer
+	rec := NewRecorder(&capture)
+
+	req := &APIVersionsReq{RequestHeader: RequestHeader{correlationID: 7, version: KafkaV1}}
+	respb, err := (&APIVersionsResp{Version: KafkaV1, CorrelationID: 7}).Bytes()
+	if err != nil {
+		t.Fatalf("cannot serialize response: %s", err)
+	}
+	w := &respondingWriter{rec: rec, resp: respb}
+	if _, err := rec.WriteRequest(w, req); err != nil {
+		t.Fatalf("cannot write request: %s", err)
+	}
+	if w.err != nil {
+		t.Fatalf("cannot read response: %s", w.err)
+	}
+
+	// request is recorded before the response it is answered with
+	c, err := ReadCapture(&capture)
+	if err != nil {
+		t.Fatalf("cannot read request capture: %s", err)
+	}
+	if c.Response || c.Kind != APIVersionsReqKind {
+		t.Fatalf("unexpected request capture: %#v", c)
+	}
+	c, err = ReadCapture(&capture)
+	if err != nil {
+		t.Fatalf("cannot read response capture: %s", err)
+	}
+	if !c.Response || c.Kind != APIVersionsReqKind || c.Version != KafkaV1 {
+		t.Fatalf("unexpected response capture: %#v", c)
+	}
+
+	// request that could not be written is not expecting a response
+	werr := errors.New("broken pipe")
+	if _, err := rec.WriteRequest(&failingWriter{err: werr}, req); err != werr {
+		t.Fatalf("expected %v, got %v", werr, err)
+	}
+	if len(rec.pending) != 0 {
+		t.Fatalf("expected no pending requests, got %v", rec.pending)
+	}
+}
@@ -0,0 +1,76 @@
+package proto
+
+import (
+	"math"
+)
+
+// SequenceManager assigns sequence numbers to record batches written by an
+// idempotent producer. The first sequence of every batch must continue where
+// the previous batch of the same partition ended, without gaps, or the broker
+// rejects it with ErrOutOfOrderSequenceNumber. A batch the broker already
+// appended is rejected with ErrDuplicateSequenceNumber, which means the retry
+// is not needed and can be treated as a success.
+//
+// ProducerID and ProducerEpoch are returned by InitProducerIdResp. The zero
+// value of SequenceManager starts all partitions with sequence 0.
+type SequenceManager struct {
+	ProducerID    int64
+	ProducerEpoch int16
+
+	next map[TopicPartition]int32
+}
+
+// Next returns the sequence the next batch of given topic and partition
+// starts with.
+func (s *SequenceManager) Next(topic string, partition int32) int32 {
+	return s.next[TopicPartition{Topic: topic, Partition: partition}]
+}
+
+// Stamp sets the producer ID, epoch and the first sequence of the batch, and
+// advances the sequence of given topic and partition by the number of its
+// records. Batches of a partition must be sent in the order they are stamped.
+func (s *SequenceManager) Stamp(topic string, partition int32, rb *RecordBatch) {
+	tp := TopicPartition{Topic: topic, Partition: partition}
+	if s.next == nil {
+		s.next = make(map[TopicPartition]int32)
+	}
+	seq := s.next[tp]
+	rb.ProducerId = s.ProducerID
+	rb.ProducerEpoch = s.ProducerEpoch
+	rb.FirstSequence = seq
+	s.next[tp] = incrementSequence(seq, len(rb.Records))
+}
+
+// EncodeBatch stamps the batch, see Stamp, and returns its binary
+// representation. The sequence of the partition is advanced only if the
+// batch was encoded successfully.
+func (s *SequenceManager) EncodeBatch(topic string, partition int32, rb *RecordBatch) ([]byte, error) {
+	tp := TopicPartition{Topic: topic, Partition: partition}
+	seq := s.next[tp]
+	s.Stamp(topic, partition, rb)
+	b, err := rb.Bytes()
+	if err != nil {
+		s.next[tp] = seq
+		return nil, err
+	}
+	return b, nil
+}
+
+// Reset forgets the sequences of all partitions and sets new producer ID and
+// epoch. After ErrOutOfOrderSequenceNumber the producer has to request a new
+// ID or epoch with InitProducerIdReq, as sequences can only start from 0
+// again with a new one.
+func (s *SequenceManager) Reset(producerID int64, producerEpoch int16) {
+	s.ProducerID = producerID
+	s.ProducerEpoch = producerEpoch
+	s.next = nil
+}
+
+// incrementSequence returns the sequence following n records starting with
+// seq. Sequences wrap around to 0 after math.MaxInt32, as the broker expects.
+func incrementSequence(seq int32, n int) int32 {
+	if int64(seq)+int64(n) > math.MaxInt32 {
+		return int32(int64(seq) + int64(n) - math.MaxInt32 - 1)
+	}
+	return seq + int32(n)
+}
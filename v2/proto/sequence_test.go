@@ -0,0 +1,87 @@
+package proto
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func testBatch(n int) *RecordBatch {
+	rb := &RecordBatch{Magic: int8(MessageV2), LastOffsetDelta: int32(n - 1)}
+	for i := 0; i < n; i++ {
+		rb.Records = append(rb.Records, &Record{OffsetDelta: int64(i), Value: []byte("x")})
+	}
+	return rb
+}
+
+func TestSequenceManager(t *testing.T) {
+	seq := &SequenceManager{ProducerID: 42, ProducerEpoch: 3}
+
+	first := testBatch(3)
+	seq.Stamp("foo", 0, first)
+	if first.ProducerId != 42 || first.ProducerEpoch != 3 || first.FirstSequence != 0 {
+		t.Fatalf("unexpected batch header: %#v", first)
+	}
+	second := testBatch(2)
+	seq.Stamp("foo", 0, second)
+	if second.FirstSequence != 3 {
+		t.Fatalf("expected sequence 3, got %d", second.FirstSequence)
+	}
+	other := testBatch(1)
+	seq.Stamp("foo", 1, other)
+	if other.FirstSequence != 0 {
+		t.Fatalf("expected partitions to be sequenced independently, got %d", other.FirstSequence)
+	}
+	if next := seq.Next("foo", 0); next != 5 {
+		t.Fatalf("expected next sequence 5, got %d", next)
+	}
+
+	b, err := seq.EncodeBatch("bar", 0, testBatch(4))
+	if err != nil {
+		t.Fatalf("cannot encode batch: %s", err)
+	}
+	got, err := readRecordBatch(bytes.NewReader(b), nil, nil, nil)
+	if err != nil {
+		t.Fatalf("cannot read batch: %s", err)
+	}
+	if got.ProducerId != 42 || got.ProducerEpoch != 3 || got.FirstSequence != 0 || len(got.Records) != 4 {
+		t.Fatalf("unexpected batch: %#v", got)
+	}
+
+	// unknown compression cannot be encoded
+	broken := testBatch(2)
+	broken.Attributes = 7
+	if _, err := seq.EncodeBatch("bar", 0, broken); err == nil {
+		t.Fatal("expected encoding error")
+	}
+	if next := seq.Next("bar", 0); next != 4 {
+		t.Fatalf("expected failed batch not to advance sequence, got %d", next)
+	}
+
+	seq.Reset(43, 0)
+	if next := seq.Next("foo", 0); next != 0 {
+		t.Fatalf("expected reset sequence, got %d", next)
+	}
+	seq.Stamp("foo", 0, first)
+	if first.ProducerId != 43 || first.ProducerEpoch != 0 || first.FirstSequence != 0 {
+		t.Fatalf("unexpected batch header after reset: %#v", first)
+	}
+}
+
+func TestSequenceManagerWrapAround(t *testing.T) {
+	if seq := incrementSequence(math.MaxInt32-1, 1); seq != math.MaxInt32 {
+		t.Fatalf("expected %d, got %d", int32(math.MaxInt32), seq)
+	}
+	if seq := incrementSequence(math.MaxInt32-1, 3); seq != 1 {
+		t.Fatalf("expected sequence to wrap to 1, got %d", seq)
+	}
+}
+
+func TestSequenceErrors(t *testing.T) {
+	if err := errFromNo(45); err != ErrOutOfOrderSequenceNumber {
+		t.Fatalf("expected %v, got %v", ErrOutOfOrderSequenceNumber, err)
+	}
+	if err := errFromNo(46); err != ErrDuplicateSequenceNumber {
+		t.Fatalf("expected %v, got %v", ErrDuplicateSequenceNumber, err)
+	}
+}
@@ -5,20 +5,35 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
 	"time"
+	"unicode/utf8"
 )
 
 const (
 	maxParseArrayLen = 256
 )
 
+// maxEncodedLen is the largest length of encoded bytes or message that fits
+// its int32 length prefix. It is only lowered by tests, so that they do not
+// have to allocate gigabytes of memory.
+var maxEncodedLen int64 = math.MaxInt32
+
 var ErrNotEnoughData = errors.New("not enough data")
 var ErrInvalidArrayLen = errors.New("invalid array length")
+var ErrValueTooLarge = errors.New("value too large to encode")
+var ErrInvalidUTF8 = errors.New("invalid UTF-8 string")
 
 type decoder struct {
 	buf []byte
 	r   io.Reader
 	err error
+
+	// arena, if set, is used by DecodeVarBytes to allocate the bytes
+	arena *Arena
+	// stats, if set, counts the data decoded by fetch response readers
+	stats *FetchStats
 }
 
 func NewDecoder(r io.Reader) *decoder {
@@ -32,6 +47,27 @@ func (d *decoder) SetReader(r io.Reader) {
 	d.r = r
 }
 
+// Skip advances the reader by n bytes without allocating them, so that
+// fields the caller is not interested in can be stepped over. If the reader
+// ends before n bytes were skipped, io.ErrUnexpectedEOF is recorded, or
+// io.EOF if nothing could be skipped.
+func (d *decoder) Skip(n int) {
+	if d.err != nil {
+		return
+	}
+	if n < 0 {
+		d.err = messageSizeError(n)
+		return
+	}
+	skipped, err := io.CopyN(ioutil.Discard, d.r, int64(n))
+	if err != nil {
+		if err == io.EOF && skipped > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		d.err = err
+	}
+}
+
 func (d *decoder) DecodeInt8() int8 {
 	if d.err != nil {
 		return 0
@@ -153,6 +189,10 @@ func (d *decoder) DecodeString() string {
 		d.err = ErrNotEnoughData
 		return ""
 	}
+	if conf.ValidateUTF8 && !utf8.Valid(b) {
+		d.err = ErrInvalidUTF8
+		return ""
+	}
 	return string(b)
 }
 
@@ -171,6 +211,16 @@ func (d *decoder) DecodeArrayLen() (int, error) {
 	return len, nil
 }
 
+// DecodeNullableArrayLen works as DecodeArrayLen, but returns -1 for null
+// arrays, so that they can be told apart from empty ones.
+func (d *decoder) DecodeNullableArrayLen() (int, error) {
+	len := int(d.DecodeInt32())
+	if len < -1 {
+		return 0, ErrInvalidArrayLen
+	}
+	return len, nil
+}
+
 func (d *decoder) DecodeBytes() []byte {
 	if d.err != nil {
 		return nil
@@ -215,6 +265,9 @@ func (d *decoder) ReadByte() (byte, error) {
 	return d.buf[0], err
 }
 
+// DecodeVarBytes decodes bytes of a record. Because only record keys and
+// values (including header values) are encoded this way, the buffer is taken
+// from the arena of the decoder if it is set.
 func (d *decoder) DecodeVarBytes() []byte {
 	slen := d.DecodeVarInt()
 
@@ -222,7 +275,7 @@ func (d *decoder) DecodeVarBytes() []byte {
 		return nil
 	}
 
-	b, err := allocParseBuf(int(slen))
+	b, err := allocValueBuf(d.arena, int(slen))
 	if err != nil {
 		d.err = err
 		return nil
@@ -271,9 +324,27 @@ func (d *decoder) DecodeVarString() string {
 		d.err = ErrNotEnoughData
 		return ""
 	}
+	if conf.ValidateUTF8 && !utf8.Valid(b) {
+		d.err = ErrInvalidUTF8
+		return ""
+	}
 	return string(b)
 }
 
+// DecodeUvarint decodes unsigned varint, as used by flexible versions of the
+// protocol for compact lengths and tagged fields.
+func (d *decoder) DecodeUvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	res, err := binary.ReadUvarint(d)
+	if err != nil {
+		d.err = err
+		return 0
+	}
+	return res
+}
+
 func (d *decoder) Err() error {
 	return d.err
 }
@@ -384,6 +455,11 @@ func (e *encoder) EncodeBytes(val []byte) {
 		e.err = writeAll(e.w, buf)
 		return
 	}
+	// length is sent as int32, larger values would be encoded as negative
+	if int64(len(val)) > maxEncodedLen {
+		e.err = ErrValueTooLarge
+		return
+	}
 
 	binary.BigEndian.PutUint32(buf, uint32(len(val)))
 	e.err = writeAll(e.w, buf)
@@ -406,6 +482,44 @@ func (e *encoder) EncodeString(val string) {
 	}
 }
 
+func (e *encoder) EncodeVarInt(val int64) {
+	if e.err != nil {
+		return
+	}
+
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(buf[:], val)
+	e.err = writeAll(e.w, buf[:n])
+}
+
+func (e *encoder) EncodeVarBytes(val []byte) {
+	if val == nil {
+		e.EncodeVarInt(-1)
+		return
+	}
+	e.EncodeVarInt(int64(len(val)))
+	if e.err == nil {
+		e.err = writeAll(e.w, val)
+	}
+}
+
+func (e *encoder) EncodeVarString(val string) {
+	e.EncodeVarInt(int64(len(val)))
+	if e.err == nil {
+		e.err = writeAll(e.w, []byte(val))
+	}
+}
+
+func (e *encoder) EncodeUvarint(val uint64) {
+	if e.err != nil {
+		return
+	}
+
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], val)
+	e.err = writeAll(e.w, buf[:n])
+}
+
 func (e *encoder) EncodeError(err error) {
 	b := e.buf[:2]
 
@@ -414,12 +528,18 @@ func (e *encoder) EncodeError(err error) {
 		e.err = writeAll(e.w, b)
 		return
 	}
-	kerr, ok := err.(*KafkaError)
-	if !ok {
+	var errno int16
+	switch kerr := err.(type) {
+	case *KafkaError:
+		errno = kerr.Code
+	case *UnknownBrokerError:
+		errno = kerr.Code
+	default:
 		e.err = fmt.Errorf("cannot encode error of type %T", err)
+		return
 	}
 
-	binary.BigEndian.PutUint16(b, uint16(kerr.errno))
+	binary.BigEndian.PutUint16(b, uint16(errno))
 	e.err = writeAll(e.w, b)
 }
 
@@ -431,6 +551,25 @@ func (e *encoder) Err() error {
 	return e.err
 }
 
+// writeFull writes b to w and returns the number of bytes written. Short
+// writes are retried, even though io.Writer must return an error for them,
+// while a write making no progress results in io.ErrShortWrite.
+func writeFull(w io.Writer, b []byte) (int64, error) {
+	var written int64
+	for len(b) > 0 {
+		n, err := w.Write(b)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			return written, io.ErrShortWrite
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
 func writeAll(w io.Writer, b []byte) error {
 	n, err := w.Write(b)
 	if err != nil {
@@ -2,6 +2,8 @@ package proto
 
 import (
 	"bytes"
+	"errors"
+	"io"
 	"testing"
 )
 
@@ -42,6 +44,27 @@ func TestEncoder(t *testing.T) {
 	}
 }
 
+func TestEncodeTooLargeValue(t *testing.T) {
+	defer func(max int64) { maxEncodedLen = max }(maxEncodedLen)
+	maxEncodedLen = 16
+	huge := make([]byte, maxEncodedLen+1)
+
+	e := getTestEncoder()
+	e.EncodeBytes(huge)
+	if e.Err() != ErrValueTooLarge {
+		t.Fatalf("expected %v, got %v", ErrValueTooLarge, e.Err())
+	}
+	if b.Len() != 0 {
+		t.Fatalf("expected nothing to be written, got %d bytes", b.Len())
+	}
+
+	var buf bytes.Buffer
+	_, err := writeMessageSet(&buf, []*Message{{Key: []byte("foo"), Value: huge[:maxEncodedLen-10]}}, CompressionNone)
+	if err != ErrMessageSizeTooLarge {
+		t.Fatalf("expected %v, got %v", ErrMessageSizeTooLarge, err)
+	}
+}
+
 func TestDecoder(t *testing.T) {
 	d := NewDecoder(bytes.NewBuffer(bint8))
 	if d.DecodeInt8() != int8(keyint) {
@@ -64,6 +87,145 @@ func TestDecoder(t *testing.T) {
 	}
 }
 
+func TestDecoderSkip(t *testing.T) {
+	d := NewDecoder(bytes.NewReader([]byte{0x1, 0x2, 0x3, 0x0, 0x2a}))
+	d.Skip(3)
+	if v := d.DecodeInt16(); v != 42 || d.Err() != nil {
+		t.Fatalf("expected 42, got %d, %v", v, d.Err())
+	}
+	d.Skip(0)
+	if d.Err() != nil {
+		t.Fatalf("unexpected error: %s", d.Err())
+	}
+	d.Skip(1)
+	if d.Err() != io.EOF {
+		t.Fatalf("expected EOF, got %v", d.Err())
+	}
+
+	d = NewDecoder(bytes.NewReader([]byte{0x1, 0x2}))
+	d.Skip(3)
+	if d.Err() != io.ErrUnexpectedEOF {
+		t.Fatalf("expected unexpected EOF, got %v", d.Err())
+	}
+
+	d = NewDecoder(bytes.NewReader([]byte{0x1, 0x2}))
+	d.Skip(-1)
+	if d.Err() == nil {
+		t.Fatal("expected negative skip to fail")
+	}
+	// errors are sticky
+	if d.DecodeInt8(); d.Err() == nil {
+		t.Fatal("expected error to be kept")
+	}
+}
+
+func TestDecodeUvarint(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.EncodeUvarint(300)
+	dec := NewDecoder(&buf)
+	if got := dec.DecodeUvarint(); got != 300 || dec.Err() != nil {
+		t.Fatalf("expected 300, got %d, %v", got, dec.Err())
+	}
+
+	// more than 64 bits
+	overflow := append(bytes.Repeat([]byte{0xff}, 10), 0x01)
+	dec = NewDecoder(bytes.NewReader(overflow))
+	if got := dec.DecodeUvarint(); got != 0 || dec.Err() == nil {
+		t.Fatalf("expected overflow error, got %d, %v", got, dec.Err())
+	}
+
+	dec = NewDecoder(bytes.NewReader([]byte{0x80}))
+	if dec.DecodeUvarint(); dec.Err() != io.ErrUnexpectedEOF {
+		t.Fatalf("expected %v, got %v", io.ErrUnexpectedEOF, dec.Err())
+	}
+}
+
+func TestDecodeStringValidateUTF8(t *testing.T) {
+	invalid := []byte{0x00, 0x03, 0x66, 0xff, 0x6f}
+	invalidVar := []byte{0x06, 0x66, 0xff, 0x6f}
+
+	// not validated by default
+	if s := NewDecoder(bytes.NewReader(invalid)).DecodeString(); s != "f\xffo" {
+		t.Fatalf("unexpected string %q", s)
+	}
+
+	if err := ConfigureParser(ParserConfig{ValidateUTF8: true}); err != nil {
+		t.Fatalf("cannot configure parser: %s", err)
+	}
+	defer ConfigureParser(ParserConfig{})
+
+	d := NewDecoder(bytes.NewReader(invalid))
+	if s := d.DecodeString(); s != "" || d.Err() != ErrInvalidUTF8 {
+		t.Fatalf("expected %s, got %q, %v", ErrInvalidUTF8, s, d.Err())
+	}
+	d = NewDecoder(bytes.NewReader(invalidVar))
+	if s := d.DecodeVarString(); s != "" || d.Err() != ErrInvalidUTF8 {
+		t.Fatalf("expected %s, got %q, %v", ErrInvalidUTF8, s, d.Err())
+	}
+	d = NewDecoder(bytes.NewReader(bstr))
+	if s := d.DecodeString(); s != keystr || d.Err() != nil {
+		t.Fatalf("expected valid string, got %q, %v", s, d.Err())
+	}
+}
+
+// quirkyWriter writes at most limit bytes per call, failing with err once
+// failAfter bytes were written.
+type quirkyWriter struct {
+	buf       bytes.Buffer
+	limit     int
+	failAfter int
+	err       error
+}
+
+func (w *quirkyWriter) Write(b []byte) (int, error) {
+	if w.err != nil && w.buf.Len()+len(b) > w.failAfter {
+		n, _ := w.buf.Write(b[:w.failAfter-w.buf.Len()])
+		return n, w.err
+	}
+	if len(b) > w.limit {
+		b = b[:w.limit]
+	}
+	return w.buf.Write(b)
+}
+
+func TestWriteToShortWrites(t *testing.T) {
+	req := &FetchReq{
+		RequestHeader: RequestHeader{correlationID: 1, ClientID: "test"},
+		ReplicaID:     -1,
+		MinBytes:      1,
+		Topics: []FetchReqTopic{
+			{Name: "foo", Partitions: []FetchReqPartition{{ID: 0, FetchOffset: 2, MaxBytes: 1024}}},
+		},
+	}
+	b, err := req.Bytes()
+	if err != nil {
+		t.Fatalf("cannot serialize request: %s", err)
+	}
+
+	// short writes without error are retried
+	w := &quirkyWriter{limit: 3}
+	if n, err := req.WriteTo(w); err != nil || n != int64(len(b)) {
+		t.Fatalf("expected %d bytes written, got %d, %v", len(b), n, err)
+	}
+	if !bytes.Equal(w.buf.Bytes(), b) {
+		t.Fatalf("expected %#v, got %#v", b, w.buf.Bytes())
+	}
+
+	// partial count is returned together with the error
+	errBroken := errors.New("broken pipe")
+	w = &quirkyWriter{limit: 7, failAfter: 10, err: errBroken}
+	if n, err := req.WriteTo(w); err != errBroken || n != 10 {
+		t.Fatalf("expected 10 bytes written and %v, got %d, %v", errBroken, n, err)
+	}
+
+	// writer making no progress
+	w = &quirkyWriter{limit: 0}
+	if n, err := req.WriteTo(w); err != io.ErrShortWrite || n != 0 {
+		t.Fatalf("expected %v, got %d, %v", io.ErrShortWrite, n, err)
+	}
+}
+
 func BenchmarkReadVarint(b *testing.B) {
 	data := []byte{0x10}
 	r := bytes.NewReader(data)
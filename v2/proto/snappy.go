@@ -3,7 +3,9 @@ package proto
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io/ioutil"
 
 	"github.com/golang/snappy"
 )
@@ -20,9 +22,27 @@ import (
 
 var snappyJavaMagic = []byte("\x82SNAPPY\x00")
 
+// snappyFramedMagic is the stream identifier starting data in the standard
+// snappy framing format, which is not used by Kafka clients, but might be
+// written by other producers. See ParserConfig.SnappyFramedFallback.
+var snappyFramedMagic = []byte("\xff\x06\x00\x00sNaPpY")
+
 func snappyDecode(b []byte) ([]byte, error) {
-	if !bytes.HasPrefix(b, snappyJavaMagic) {
-		return snappy.Decode(nil, b)
+	if bytes.HasPrefix(b, snappyJavaMagic) {
+		return decodeXerialSnappy(b)
+	}
+	if conf.SnappyFramedFallback && bytes.HasPrefix(b, snappyFramedMagic) {
+		return ioutil.ReadAll(snappy.NewReader(bytes.NewReader(b)))
+	}
+	return snappy.Decode(nil, b)
+}
+
+// decodeXerialSnappy decodes data framed by snappy-java: the magic header,
+// followed by two 4 byte versions and a sequence of blocks, each prefixed
+// with its 4 byte length.
+func decodeXerialSnappy(b []byte) ([]byte, error) {
+	if len(b) < 16 || !bytes.HasPrefix(b, snappyJavaMagic) {
+		return nil, errors.New("invalid snappy-java header")
 	}
 
 	// See https://github.com/xerial/snappy-java/blob/develop/src/main/java/org/xerial/snappy/SnappyInputStream.java
@@ -37,8 +57,14 @@ func snappyDecode(b []byte) ([]byte, error) {
 		err     error
 	)
 	for i := 16; i < len(b); {
+		if len(b)-i < 4 {
+			return nil, errors.New("truncated snappy-java block length")
+		}
 		n := int(binary.BigEndian.Uint32(b[i : i+4]))
 		i += 4
+		if n < 0 || n > len(b)-i {
+			return nil, fmt.Errorf("snappy-java block of %d bytes exceeds remaining %d bytes", n, len(b)-i)
+		}
 		chunk, err = snappy.Decode(chunk, b[i:i+n])
 		if err != nil {
 			return nil, err
@@ -3,6 +3,8 @@ package proto
 import (
 	"bytes"
 	"testing"
+
+	"github.com/golang/snappy"
 )
 
 var snappyChunk = []byte("\x03\x08foo") // snappy encoding of "foo"
@@ -35,3 +37,74 @@ func TestSnappyDecodeJava(t *testing.T) {
 		t.Fatalf("got: %v; want: %v", got, want)
 	}
 }
+
+func TestDecodeXerialSnappy(t *testing.T) {
+	header := []byte{
+		0x82, 'S', 'N', 'A', 'P', 'P', 'Y', 0x0, // magic
+		0, 0, 0, 1, // version
+		0, 0, 0, 1, // compatible version
+	}
+	tests := []struct {
+		name    string
+		data    []byte
+		want    []byte
+		wantErr bool
+	}{
+		{name: "no blocks", data: header, want: []byte{}},
+		{name: "single block", data: append(append([]byte{}, header...), 0, 0, 0, 5, 0x3, 0x8, 'f', 'o', 'o'), want: []byte("foo")},
+		{name: "plain snappy", data: snappyChunk, wantErr: true},
+		{name: "short header", data: header[:12], wantErr: true},
+		{name: "bad version", data: []byte{0x82, 'S', 'N', 'A', 'P', 'P', 'Y', 0x0, 0, 0, 0, 2, 0, 0, 0, 1}, wantErr: true},
+		{name: "truncated length", data: append(append([]byte{}, header...), 0, 0), wantErr: true},
+		{name: "truncated block", data: append(append([]byte{}, header...), 0, 0, 0, 5, 0x3, 0x8), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := decodeXerialSnappy(tt.data)
+		if tt.wantErr {
+			if err == nil {
+				t.Fatalf("%s: expected error, got %v", tt.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Fatalf("%s: got: %v; want: %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSnappyDecodeFramed(t *testing.T) {
+	var buf bytes.Buffer
+	w := snappy.NewBufferedWriter(&buf)
+	if _, err := w.Write([]byte("foofoo")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	framed := buf.Bytes()
+
+	if _, err := snappyDecode(framed); err == nil {
+		t.Fatal("expected framed data to be rejected by default")
+	}
+
+	if err := ConfigureParser(ParserConfig{SnappyFramedFallback: true}); err != nil {
+		t.Fatalf("cannot configure parser: %s", err)
+	}
+	defer ConfigureParser(ParserConfig{})
+
+	got, err := snappyDecode(framed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte("foofoo"); !bytes.Equal(got, want) {
+		t.Fatalf("got: %v; want: %v", got, want)
+	}
+	// other framings are still supported
+	if got, err := snappyDecode(snappyChunk); err != nil || !bytes.Equal(got, []byte("foo")) {
+		t.Fatalf("got: %v, %v; want: foo", got, err)
+	}
+}
@@ -0,0 +1,72 @@
+package proto
+
+import (
+	"bufio"
+	"sync/atomic"
+)
+
+// FetchStats accumulates counters of decoded fetch responses, when set as
+// FetchResp.Stats. Counters are updated atomically, so the same stats can
+// be shared by readers running concurrently. They must be read using
+// atomic.LoadInt64, or all at once using Snapshot.
+type FetchStats struct {
+	// Bytes is the size of complete messages and record batches decoded.
+	// Data cut off at the end of a partition is not counted.
+	Bytes int64
+	// Messages is the number of messages, or records of record batches,
+	// decoded.
+	Messages int64
+	// CompressedSets and UncompressedSets count the legacy (MessageV0 and
+	// MessageV1) message sets and record batches decoded, by compression.
+	// A message set is counted as compressed if it starts with a compressed
+	// wrapper message.
+	CompressedSets   int64
+	UncompressedSets int64
+	// CrcFailures is the number of legacy messages and record batches with
+	// invalid checksum.
+	CrcFailures int64
+}
+
+// Snapshot returns a copy of the current counters.
+func (s *FetchStats) Snapshot() FetchStats {
+	return FetchStats{
+		Bytes:            atomic.LoadInt64(&s.Bytes),
+		Messages:         atomic.LoadInt64(&s.Messages),
+		CompressedSets:   atomic.LoadInt64(&s.CompressedSets),
+		UncompressedSets: atomic.LoadInt64(&s.UncompressedSets),
+		CrcFailures:      atomic.LoadInt64(&s.CrcFailures),
+	}
+}
+
+// countPartition counts decoded partition data.
+func (s *FetchStats) countPartition(bytes, messages int) {
+	atomic.AddInt64(&s.Bytes, int64(bytes))
+	atomic.AddInt64(&s.Messages, int64(messages))
+}
+
+// countSet counts message set or record batch with given compression.
+func (s *FetchStats) countSet(compression Compression) {
+	if compression == CompressionNone {
+		atomic.AddInt64(&s.UncompressedSets, 1)
+	} else {
+		atomic.AddInt64(&s.CompressedSets, 1)
+	}
+}
+
+// countMessageSet counts legacy message set about to be read from br, using
+// the attributes of its first message.
+func (s *FetchStats) countMessageSet(br *bufio.Reader) {
+	// offset, size, crc, magic byte and attributes
+	b, err := br.Peek(18)
+	if err != nil {
+		return
+	}
+	s.countSet(compressionFromAttributes(int8(b[17])))
+}
+
+// countCrcFailure counts invalid checksum. It does nothing if s is nil.
+func (s *FetchStats) countCrcFailure() {
+	if s != nil {
+		atomic.AddInt64(&s.CrcFailures, 1)
+	}
+}
@@ -0,0 +1,107 @@
+package proto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFetchStats(t *testing.T) {
+	var set bytes.Buffer
+	_, err := writeMessageSetVersioned(&set, []*Message{
+		{Offset: 0, Value: []byte("a")},
+		{Offset: 1, Value: []byte("b")},
+	}, CompressionNone, MessageV0)
+	if err != nil {
+		t.Fatalf("cannot serialize messages: %s", err)
+	}
+	set.Write(rawRecordBatch(2, CompressionNone, []byte("c"), []byte("d")))
+	set.Write(rawRecordBatch(4, CompressionSnappy, []byte("e")))
+	complete := set.Len()
+	last := rawRecordBatch(5, CompressionNone, []byte("f"))
+	set.Write(last[:len(last)-2])
+
+	var compressed bytes.Buffer
+	_, err = writeMessageSetVersioned(&compressed, []*Message{
+		{Offset: 0, Value: []byte("x")},
+		{Offset: 1, Value: []byte("y")},
+	}, CompressionGzip, MessageV1)
+	if err != nil {
+		t.Fatalf("cannot serialize messages: %s", err)
+	}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	for i, set := range [][]byte{set.Bytes(), compressed.Bytes()} {
+		enc.EncodeInt32(int32(i)) // partition id
+		enc.EncodeInt16(0)        // error
+		enc.EncodeInt64(6)        // high watermark
+		enc.EncodeInt32(int32(len(set)))
+		buf.Write(set)
+	}
+
+	var stats FetchStats
+	dec := NewDecoder(&buf)
+	dec.stats = &stats
+	for i := 0; i < 2; i++ {
+		var part FetchRespPartition
+		if err := readFetchRespPartition(dec, &buf, KafkaV0, "foo", &part); err != nil {
+			t.Fatalf("cannot read partition: %s", err)
+		}
+	}
+	expected := FetchStats{
+		Bytes:            int64(complete + compressed.Len()),
+		Messages:         7,
+		CompressedSets:   2,
+		UncompressedSets: 2,
+	}
+	if got := stats.Snapshot(); got != expected {
+		t.Fatalf("expected %+v, got %+v", expected, got)
+	}
+
+	// corrupt the crc of the second message
+	b := set.Bytes()
+	b[27+12] ^= 0xff
+	if _, _, err := readMessageSetInto(bytes.NewReader(b), int32(len(b)), nil, nil, nil, &stats); err != nil {
+		t.Fatalf("cannot read message set: %s", err)
+	}
+	if n := stats.Snapshot().CrcFailures; n != 1 {
+		t.Fatalf("expected 1 crc failure, got %d", n)
+	}
+}
+
+func TestFetchStatsPerResponse(t *testing.T) {
+	b, err := (&FetchResp{
+		CorrelationID: 1,
+		Topics: []FetchRespTopic{
+			{
+				Name: "foo",
+				Partitions: []FetchRespPartition{
+					{ID: 0, TipOffset: 2, Messages: []*Message{{Offset: 0, Value: []byte("a")}, {Offset: 1, Value: []byte("b")}}},
+				},
+			},
+		},
+	}).Bytes()
+	if err != nil {
+		t.Fatalf("cannot serialize response: %s", err)
+	}
+
+	var stats FetchStats
+	resp := &FetchResp{Stats: &stats}
+	if err := ReadFetchRespInto(bytes.NewReader(b), resp); err != nil {
+		t.Fatalf("cannot read response: %s", err)
+	}
+	if resp.Stats != &stats {
+		t.Fatal("expected stats to be kept")
+	}
+	if n := stats.Snapshot().Messages; n != 2 {
+		t.Fatalf("expected 2 messages, got %d", n)
+	}
+
+	// responses decoded without stats are not counted
+	if _, err := ReadFetchResp(bytes.NewReader(b)); err != nil {
+		t.Fatalf("cannot read response: %s", err)
+	}
+	if n := stats.Snapshot().Messages; n != 2 {
+		t.Fatalf("expected 2 messages, got %d", n)
+	}
+}
@@ -21,3 +21,15 @@ func allocParseBuf(size int) ([]byte, error) {
 
 	return make([]byte, size), nil
 }
+
+// allocValueBuf is used to allocate buffers for message keys and values. They
+// are taken from the arena if it is not nil.
+func allocValueBuf(arena *Arena, size int) ([]byte, error) {
+	if arena == nil {
+		return allocParseBuf(size)
+	}
+	if size < 0 || size > maxParseBufSize {
+		return nil, messageSizeError(size)
+	}
+	return arena.Alloc(size), nil
+}
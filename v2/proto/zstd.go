@@ -0,0 +1,50 @@
+package proto
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ErrZstdMessageSet is returned when MessageSet message is compressed with
+// zstd. Kafka supports zstd only within RecordBatch (MessageV2).
+var ErrZstdMessageSet = errors.New("zstd compression is not supported by MessageSet")
+
+// Encoder and decoder are safe for concurrent use when used with EncodeAll
+// and DecodeAll, so single instances are shared. Encoders are created on
+// first use of their level.
+var (
+	zstdDec, _ = zstd.NewReader(nil)
+
+	zstdEncMu sync.Mutex
+	zstdEncs  = make(map[CompressionLevel]*zstd.Encoder)
+)
+
+func zstdDecode(b []byte) ([]byte, error) {
+	return zstdDec.DecodeAll(b, nil)
+}
+
+func zstdEncode(b []byte, level CompressionLevel) []byte {
+	return zstdEncoder(level).EncodeAll(b, nil)
+}
+
+// zstdEncoder returns the shared encoder for given compression level.
+func zstdEncoder(level CompressionLevel) *zstd.Encoder {
+	zstdEncMu.Lock()
+	defer zstdEncMu.Unlock()
+
+	if enc, ok := zstdEncs[level]; ok {
+		return enc
+	}
+	zlevel := zstd.SpeedDefault
+	switch level {
+	case CompressionLevelFastest:
+		zlevel = zstd.SpeedFastest
+	case CompressionLevelBest:
+		zlevel = zstd.SpeedBestCompression
+	}
+	enc, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zlevel))
+	zstdEncs[level] = enc
+	return enc
+}
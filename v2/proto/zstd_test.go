@@ -0,0 +1,250 @@
+package proto
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+func TestZstdRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("zstd compressed value "), 100)
+	decoded, err := zstdDecode(zstdEncode(data, CompressionLevelDefault))
+	if err != nil {
+		t.Fatalf("cannot decode: %s", err)
+	}
+	if !bytes.Equal(decoded, data) {
+		t.Fatalf("expected %q, got %q", data, decoded)
+	}
+}
+
+// randomWords returns random sequence of words, as repetitive payload
+// compresses equally well on all levels.
+func randomWords() []byte {
+	rnd := rand.New(rand.NewSource(1))
+	words := []string{"kafka", "broker", "topic", "partition", "offset", "message", "consumer", "producer"}
+	var buf bytes.Buffer
+	for buf.Len() < 64*1024 {
+		buf.WriteString(words[rnd.Intn(len(words))])
+		buf.WriteByte(' ')
+	}
+	return buf.Bytes()
+}
+
+func TestZstdCompressionLevels(t *testing.T) {
+	data := randomWords()
+	fastest := zstdEncode(data, CompressionLevelFastest)
+	best := zstdEncode(data, CompressionLevelBest)
+	if len(best) >= len(fastest) {
+		t.Fatalf("expected best level output (%d bytes) to be smaller than fastest (%d bytes)", len(best), len(fastest))
+	}
+	for _, compressed := range [][]byte{fastest, best} {
+		decoded, err := zstdDecode(compressed)
+		if err != nil {
+			t.Fatalf("cannot decode: %s", err)
+		}
+		if !bytes.Equal(decoded, data) {
+			t.Fatal("decoded data differs")
+		}
+	}
+}
+
+func TestZstdMessageSet(t *testing.T) {
+	messages := []*Message{{Value: []byte("foo")}}
+	var buf bytes.Buffer
+	if _, err := writeMessageSetVersioned(&buf, messages, CompressionZstd, MessageV1); err != ErrZstdMessageSet {
+		t.Fatalf("expected %s, got %v", ErrZstdMessageSet, err)
+	}
+
+	// wrapper message claiming zstd compression
+	buf.Reset()
+	wrapper := []*Message{{Value: zstdEncode([]byte("foo"), CompressionLevelDefault)}}
+	if _, err := writeMessageSetVersioned(&buf, wrapper, CompressionNone, MessageV1); err != nil {
+		t.Fatalf("cannot serialize message: %s", err)
+	}
+	b := buf.Bytes()
+	b[17] = byte(CompressionZstd)
+	binary.BigEndian.PutUint32(b[12:16], crc32.ChecksumIEEE(b[16:]))
+
+	if _, _, err := readMessageSet(bytes.NewReader(b), int32(len(b))); err != ErrZstdMessageSet {
+		t.Fatalf("expected %s, got %v", ErrZstdMessageSet, err)
+	}
+}
+
+func TestProduceRequestZstd(t *testing.T) {
+	req := &ProduceReq{
+		RequestHeader: RequestHeader{correlationID: 241, ClientID: "test", version: KafkaV2},
+		Compression:   CompressionZstd,
+		RequiredAcks:  RequiredAcksAll,
+		Timeout:       time.Second,
+		Topics: []ProduceReqTopic{
+			{
+				Name: "foo",
+				Partitions: []ProduceReqPartition{
+					{ID: 0, Messages: []*Message{
+						{Key: []byte("a"), Value: []byte("first"), TimestampMs: 1500000000100},
+						{Value: []byte("second"), TimestampMs: 1500000000050},
+					}},
+				},
+			},
+		},
+	}
+	// message sets cannot be compressed with zstd
+	if _, err := req.Bytes(); err != ErrZstdMessageSet {
+		t.Fatalf("expected %s, got %v", ErrZstdMessageSet, err)
+	}
+
+	SetVersion(&req.RequestHeader, KafkaV3)
+	b, err := req.Bytes()
+	if err != nil {
+		t.Fatalf("cannot serialize request: %s", err)
+	}
+	var streamed bytes.Buffer
+	if _, err := req.WriteTo(&streamed); err != nil {
+		t.Fatalf("cannot write request: %s", err)
+	}
+	if !bytes.Equal(streamed.Bytes(), b) {
+		t.Fatal("written request differs from serialized one")
+	}
+
+	r, err := ReadProduceReq(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("cannot read request: %s", err)
+	}
+	expected := []*Message{
+		{Key: []byte("a"), Value: []byte("first"), Offset: 0, TimestampMs: 1500000000100, MessageVersion: MessageV2},
+		{Key: nil, Value: []byte("second"), Offset: 1, TimestampMs: 1500000000050, MessageVersion: MessageV2},
+	}
+	if got := r.Topics[0].Partitions[0].Messages; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, got)
+	}
+}
+
+func TestProduceRequestZstdLevels(t *testing.T) {
+	payload := randomWords()
+	sizes := make(map[CompressionLevel]int)
+	for _, level := range []CompressionLevel{CompressionLevelFastest, CompressionLevelBest} {
+		req := &ProduceReq{
+			RequestHeader:    RequestHeader{correlationID: 241, ClientID: "test", version: KafkaV3},
+			Compression:      CompressionZstd,
+			CompressionLevel: level,
+			RequiredAcks:     RequiredAcksAll,
+			Timeout:          time.Second,
+			Topics: []ProduceReqTopic{
+				{
+					Name:       "foo",
+					Partitions: []ProduceReqPartition{{ID: 0, Messages: []*Message{{Value: payload}}}},
+				},
+			},
+		}
+		b, err := req.Bytes()
+		if err != nil {
+			t.Fatalf("cannot serialize request: %s", err)
+		}
+		sizes[level] = len(b)
+
+		r, err := ReadProduceReq(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("cannot read request: %s", err)
+		}
+		if messages := r.Topics[0].Partitions[0].Messages; len(messages) != 1 || !bytes.Equal(messages[0].Value, payload) {
+			t.Fatalf("level %d: payload not round tripped", level)
+		}
+	}
+	if sizes[CompressionLevelBest] >= sizes[CompressionLevelFastest] {
+		t.Fatalf("expected best level to produce smaller request than fastest: %v", sizes)
+	}
+}
+
+// benchmarkPayload returns sample of JSON encoded events, that compresses
+// similarly to the usual kafka messages.
+func benchmarkPayload() []byte {
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < 64*1024; i++ {
+		fmt.Fprintf(&buf, `{"id":%d,"type":"page_view","user":"user-%d","path":"/articles/%d","duration_ms":%d}`+"\n", i, i%97, i%13, i*7%1000)
+	}
+	return buf.Bytes()
+}
+
+func BenchmarkCompressGzip(b *testing.B) {
+	payload := benchmarkPayload()
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		_, _ = gz.Write(payload)
+		_ = gz.Close()
+		b.ReportMetric(float64(len(payload))/float64(buf.Len()), "ratio")
+	}
+}
+
+func BenchmarkCompressSnappy(b *testing.B) {
+	payload := benchmarkPayload()
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		compressed := snappy.Encode(nil, payload)
+		b.ReportMetric(float64(len(payload))/float64(len(compressed)), "ratio")
+	}
+}
+
+func BenchmarkCompressZstd(b *testing.B) {
+	payload := benchmarkPayload()
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		compressed := zstdEncode(payload, CompressionLevelDefault)
+		b.ReportMetric(float64(len(payload))/float64(len(compressed)), "ratio")
+	}
+}
+
+func BenchmarkDecompressGzip(b *testing.B) {
+	payload := benchmarkPayload()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, _ = gz.Write(payload)
+	_ = gz.Close()
+	compressed := buf.Bytes()
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		gz, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			b.Fatalf("cannot decompress: %s", err)
+		}
+		if _, err := ioutil.ReadAll(gz); err != nil {
+			b.Fatalf("cannot decompress: %s", err)
+		}
+	}
+}
+
+func BenchmarkDecompressSnappy(b *testing.B) {
+	compressed := snappy.Encode(nil, benchmarkPayload())
+	b.SetBytes(int64(len(benchmarkPayload())))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := snappyDecode(compressed); err != nil {
+			b.Fatalf("cannot decompress: %s", err)
+		}
+	}
+}
+
+func BenchmarkDecompressZstd(b *testing.B) {
+	compressed := zstdEncode(benchmarkPayload(), CompressionLevelDefault)
+	b.SetBytes(int64(len(benchmarkPayload())))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := zstdDecode(compressed); err != nil {
+			b.Fatalf("cannot decompress: %s", err)
+		}
+	}
+}